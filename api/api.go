@@ -0,0 +1,114 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package goofys mounts an S3 bucket from Go, the way the goofys
+// command does:
+//
+//	mfs, err := goofys.Mount(ctx, "bucket", goofys.Config{
+//		MountPoint: "/mnt/bucket",
+//		Flags:      []string{"--stat-cache-ttl=1m"},
+//	})
+//	...
+//	err = mfs.Unmount()
+package goofys
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+
+	"github.com/kahing/goofys/internal"
+)
+
+type Config struct {
+	// Where to mount, it has to exist.
+	MountPoint string
+
+	// Command line flags, like "--read-only" or
+	// "--stat-cache-ttl=1m". Flags that are left out get the same
+	// defaults as on the command line.
+	Flags []string
+
+	// Where to find S3 and the credentials to use. nil means
+	// the same as the command line: us-west-2 and the default
+	// credentials chain. --region and --endpoint still apply on
+	// top of this.
+	AwsConfig *aws.Config
+}
+
+type MountedFS struct {
+	fs  internal.FileSystem
+	mfs *fuse.MountedFileSystem
+}
+
+// Mount bucket at config.MountPoint. bucket can be bucket:prefix to
+// mount only what's under prefix. The file system is served until
+// it's unmounted, with Unmount or from outside.
+func Mount(ctx context.Context, bucket string, config Config) (mounted *MountedFS, err error) {
+	flags, err := internal.ParseFlags(config.Flags)
+	if err != nil {
+		return nil, fmt.Errorf("Mount: %v", err)
+	}
+
+	var awsConfig *aws.Config
+	if config.AwsConfig != nil {
+		// NewGoofys changes it
+		c := *config.AwsConfig
+		awsConfig = &c
+	}
+
+	fs, mfs, err := internal.Mount(ctx, bucket, config.MountPoint, awsConfig, flags)
+	if err != nil {
+		return
+	}
+
+	return &MountedFS{fs, mfs}, nil
+}
+
+// Where the file system is mounted.
+func (m *MountedFS) Dir() string {
+	return m.mfs.Dir()
+}
+
+// The file system being served, to call into it directly.
+func (m *MountedFS) FileSystem() fuseutil.FileSystem {
+	return m.fs
+}
+
+// Wait until the file system is unmounted.
+func (m *MountedFS) Join(ctx context.Context) error {
+	return m.mfs.Join(ctx)
+}
+
+// Save what's been written to files that are still open, unmount,
+// and wait for the file system to stop being served. Fails with the
+// file system still mounted if it's busy.
+func (m *MountedFS) Unmount() (err error) {
+	_, err = m.fs.FlushAll()
+	if err != nil {
+		return
+	}
+
+	err = fuse.Unmount(m.mfs.Dir())
+	if err != nil {
+		return
+	}
+
+	return m.mfs.Join(context.Background())
+}
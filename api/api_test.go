@@ -0,0 +1,100 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goofys
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	. "gopkg.in/check.v1"
+)
+
+type ApiTest struct {
+	awsConfig *aws.Config
+	s3        *s3.S3
+}
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&ApiTest{})
+
+func (s *ApiTest) SetUpSuite(t *C) {
+	// the s3proxy from test/run-tests.sh
+	s.awsConfig = &aws.Config{
+		Credentials:      credentials.NewStaticCredentials("foo", "bar", ""),
+		Region:           aws.String("us-west-2"),
+		Endpoint:         aws.String("127.0.0.1:8080"),
+		DisableSSL:       aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	}
+	s.s3 = s3.New(s.awsConfig)
+}
+
+func (s *ApiTest) TestMountUnmount(t *C) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("no fuse")
+	}
+
+	bucket := fmt.Sprintf("goofys-api-%v", time.Now().UnixNano())
+	_, err := s.s3.CreateBucket(&s3.CreateBucketInput{Bucket: &bucket})
+	t.Assert(err, IsNil)
+
+	mountPoint, err := ioutil.TempDir("", "goofys-api")
+	t.Assert(err, IsNil)
+	defer os.Remove(mountPoint)
+
+	mfs, err := Mount(context.Background(), bucket, Config{
+		MountPoint: mountPoint,
+		Flags:      []string{"--stat-cache-ttl=0", "--type-cache-ttl=0"},
+		AwsConfig:  s.awsConfig,
+	})
+	t.Assert(err, IsNil)
+	t.Assert(mfs.Dir(), Equals, mountPoint)
+	t.Assert(mfs.FileSystem(), NotNil)
+
+	err = ioutil.WriteFile(filepath.Join(mountPoint, "file"), []byte("hello"), 0644)
+	t.Assert(err, IsNil)
+
+	err = mfs.Unmount()
+	t.Assert(err, IsNil)
+
+	resp, err := s.s3.GetObject(&s3.GetObjectInput{Bucket: &bucket, Key: aws.String("file")})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Assert(string(content), Equals, "hello")
+
+	// not a flag
+	_, err = Mount(context.Background(), bucket, Config{
+		MountPoint: mountPoint,
+		Flags:      []string{"--no-such-flag"},
+		AwsConfig:  s.awsConfig,
+	})
+	t.Assert(err, NotNil)
+}
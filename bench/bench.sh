@@ -116,6 +116,11 @@ function write_large_file {
     dd if=/dev/zero of=largefile bs=1MB count=1000 status=none
 }
 
+function write_small_chunks {
+    # like appending to a log a line at a time
+    dd if=/dev/zero of=smallchunks bs=512 count=20000 status=none
+}
+
 function read_large_file {
     dd if=largefile of=/dev/null bs=1MB status=none
 }
@@ -154,3 +159,10 @@ if [ "$t" = "" -o "$t" = "io" ]; then
         rm largefile
     done
 fi
+
+if [ "$t" = "" -o "$t" = "small_writes" ]; then
+    for i in $(seq 1 10); do
+        run_test write_small_chunks
+        rm smallchunks
+    done
+fi
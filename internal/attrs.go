@@ -0,0 +1,377 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --posix-attrs, mode/uid/gid/mtime are stored as decimal
+// strings in the object's user metadata. S3 can't change metadata
+// in place so saving them means copying the object onto itself;
+// changes that come in quick succession (chmod followed by touch)
+// are batched into one copy after ATTR_FLUSH_DELAY, and changes to a
+// file that's being written just ride along with the upload.
+//
+// Listings don't include metadata, so reading a directory doesn't
+// know them. They are read by the HEAD of looking up a file, which
+// with --posix-attrs isn't skipped when a listing has just seen it.
+//
+// Renames and links save the mtime of what they copy the same way,
+// since the copy gets a new LastModified. That mtime is used even
+// without --posix-attrs.
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const ATTR_FLUSH_DELAY = 100 * time.Millisecond
+
+const MODE_META = "mode"
+const UID_META = "uid"
+const GID_META = "gid"
+const MTIME_META = "mtime"
+
+// The SDK canonicalizes the header names so we can't just index the
+// map.
+func metadataValue(metadata map[string]*string, key string) *string {
+	for k, v := range metadata {
+		if strings.ToLower(k) == key {
+			return v
+		}
+	}
+	return nil
+}
+
+func metadataUint(metadata map[string]*string, key string) (v uint64, ok bool) {
+	s := metadataValue(metadata, key)
+	if s == nil {
+		return
+	}
+
+	v, err := strconv.ParseUint(*s, 10, 32)
+	return v, err == nil
+}
+
+// Override attr with whatever is stored in metadata, values that are
+// missing or that we can't parse keep the defaults.
+func (fs *Goofys) applyMetadata(attr *fuseops.InodeAttributes, metadata map[string]*string) {
+	if s := metadataValue(metadata, MTIME_META); s != nil {
+		if mtime, err := strconv.ParseInt(*s, 10, 64); err == nil {
+			attr.Mtime = time.Unix(mtime, 0)
+			attr.Atime = attr.Mtime
+			attr.Ctime = attr.Mtime
+		}
+	}
+
+	if !fs.flags.PosixAttrs {
+		return
+	}
+
+	if mode, ok := metadataUint(metadata, MODE_META); ok {
+		attr.Mode = (attr.Mode &^ os.ModePerm) | (os.FileMode(mode) & os.ModePerm)
+	}
+	if uid, ok := metadataUint(metadata, UID_META); ok {
+		attr.Uid = uint32(uid)
+	}
+	if gid, ok := metadataUint(metadata, GID_META); ok {
+		attr.Gid = uint32(gid)
+	}
+}
+
+func attrsToMetadata(attr *fuseops.InodeAttributes) map[string]*string {
+	return map[string]*string{
+		MODE_META:  aws.String(strconv.FormatUint(uint64(attr.Mode.Perm()), 10)),
+		UID_META:   aws.String(strconv.FormatUint(uint64(attr.Uid), 10)),
+		GID_META:   aws.String(strconv.FormatUint(uint64(attr.Gid), 10)),
+		MTIME_META: aws.String(strconv.FormatInt(attr.Mtime.Unix(), 10)),
+	}
+}
+
+// The metadata to upload along with inode's content, nil if there's
+// nothing to keep. Whoever asks is about to write the attributes out
+// so they are no longer dirty.
+func (fs *Goofys) inodeMetadata(inode *Inode) map[string]*string {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	inode.attrsDirty = false
+	metadata := inode.metadata(fs)
+	if !fs.flags.PosixAttrs && metadata != nil {
+		// a rename may have left the old mtime here, the new
+		// content should get a new one
+		delete(metadata, MTIME_META)
+	}
+	return metadata
+}
+
+// Whatever metadata the object had when we last looked, with the
+// attributes on top. We only keep the old metadata if we care about
+// metadata, otherwise a write replaces it like it does in S3.
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) metadata(fs *Goofys) (metadata map[string]*string) {
+	if (fs.flags.Xattr || fs.flags.PosixAttrs) && len(inode.userMetadata) != 0 {
+		metadata = make(map[string]*string)
+		for k, v := range inode.userMetadata {
+			metadata[k] = v
+		}
+	}
+
+	if fs.flags.PosixAttrs {
+		if metadata == nil {
+			metadata = make(map[string]*string)
+		}
+		for k, v := range attrsToMetadata(inode.Attributes) {
+			metadata[k] = v
+		}
+	}
+
+	return
+}
+
+func (inode *Inode) SetAttributes(fs *Goofys, mode *os.FileMode, uid *uint32, gid *uint32,
+	mtime *time.Time) {
+	inode.logFuse("SetAttributes", mode, uid, gid, mtime)
+
+	if inode.Attributes.Mode&os.ModeDir != 0 {
+		// XXX directories are all sharing fs.rootAttrs and
+		// usually don't have an object to put metadata on
+		return
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	changed := false
+
+	if mode != nil && mode.Perm() != inode.Attributes.Mode.Perm() {
+		inode.Attributes.Mode = (inode.Attributes.Mode &^ os.ModePerm) | mode.Perm()
+		changed = true
+	}
+
+	if uid != nil && *uid != inode.Attributes.Uid {
+		inode.Attributes.Uid = *uid
+		changed = true
+	}
+
+	if gid != nil && *gid != inode.Attributes.Gid {
+		inode.Attributes.Gid = *gid
+		changed = true
+	}
+
+	if mtime != nil && !mtime.Equal(inode.Attributes.Mtime) {
+		inode.Attributes.Mtime = *mtime
+		inode.Attributes.Atime = *mtime
+		inode.Attributes.Ctime = *mtime
+		changed = true
+	}
+
+	if changed {
+		inode.scheduleAttrFlush(fs)
+	}
+}
+
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) scheduleAttrFlush(fs *Goofys) {
+	inode.attrsDirty = true
+	inode.changed = true
+
+	if inode.dirtyHandles != 0 || inode.attrTimer != nil {
+		// the upload or the copy that's already scheduled will
+		// pick up the new attributes
+		return
+	}
+
+	inode.attrTimer = time.AfterFunc(ATTR_FLUSH_DELAY, func() {
+		inode.flushAttributes(fs)
+	})
+}
+
+// Copy the object onto itself to replace its metadata with the
+// current attributes.
+func (inode *Inode) flushAttributes(fs *Goofys) {
+	inode.mu.Lock()
+	inode.attrTimer = nil
+	if !inode.attrsDirty || inode.dirtyHandles != 0 {
+		inode.mu.Unlock()
+		return
+	}
+	inode.mu.Unlock()
+
+	// the metadata we don't know about would be lost otherwise
+	_, err := inode.getUserMetadata(fs)
+	if err != nil {
+		// still dirty, the next upload or flush saves them
+		log.Printf("Unable to save attributes for %v: %v", *inode.FullName, err)
+		return
+	}
+
+	inode.mu.Lock()
+	if !inode.attrsDirty || inode.dirtyHandles != 0 {
+		inode.mu.Unlock()
+		return
+	}
+	inode.attrsDirty = false
+	metadata := inode.metadata(fs)
+	inode.mu.Unlock()
+
+	inode.logFuse("flushAttributes", metadata)
+
+	err = inode.replaceMetadata(fs, metadata)
+	if err != nil {
+		// nobody is waiting for this
+		log.Printf("Unable to save attributes for %v: %v", *inode.FullName, err)
+	}
+}
+
+// Copy the object onto itself with metadata instead of what it has,
+// keeping its headers.
+func (inode *Inode) replaceMetadata(fs *Goofys, metadata map[string]*string) (err error) {
+	// we need to know the headers to keep them
+	_, err = inode.getUserMetadata(fs)
+	if err != nil {
+		return
+	}
+
+	inode.mu.Lock()
+	props := &BlobProperties{
+		Metadata:                metadata,
+		ContentType:             inode.contentType,
+		CacheControl:            inode.cacheControl,
+		ContentDisposition:      inode.contentDisposition,
+		ContentEncoding:         inode.contentEncoding,
+		ContentLanguage:         inode.contentLanguage,
+		WebsiteRedirectLocation: inode.websiteRedirect,
+	}
+	params := &CopyBlobInput{
+		Source:       *inode.FullName,
+		Destination:  *inode.FullName,
+		Properties:   props,
+		StorageClass: fs.storageClass(*inode.FullName),
+	}
+	isSymlink := inode.Attributes.Mode&os.ModeSymlink != 0
+	size := int64(inode.Attributes.Size)
+	inode.mu.Unlock()
+
+	if props.ContentType == nil {
+		// it's not uploaded yet, or S3 has no idea either
+		props.ContentType = fs.contentType(inode, nil)
+	}
+
+	if isSymlink {
+		// REPLACE would drop what makes this a symlink
+		target, err := inode.ReadSymlink(fs)
+		if err != nil {
+			return err
+		}
+
+		if metadata == nil {
+			metadata = make(map[string]*string)
+		}
+		metadata[SYMLINK_META] = &target
+		props.Metadata = metadata
+		props.ContentType = aws.String(SYMLINK_CONTENT_TYPE)
+	}
+
+	var etag *string
+	if size > MAX_COPY_SIZE {
+		etag, err = inode.replaceMetadataMultipart(fs, size, *inode.FullName, props)
+	} else {
+		var resp *CopyBlobOutput
+		err = fs.retry(func() (err error) {
+			resp, err = fs.backend.CopyBlob(context.Background(), params)
+			return
+		})
+		if err == nil {
+			etag = resp.ETag
+		}
+	}
+	if err != nil {
+		return mapAwsError(err)
+	}
+
+	// the content is the same, so if the kernel had the old one
+	// cached it's still good
+	if etag != nil {
+		inode.mu.Lock()
+		old := inode.ETag
+		if inode.cacheEtag != nil && old != nil && *inode.cacheEtag == *old {
+			inode.cacheEtag = etag
+		}
+		inode.ETag = etag
+		inode.mu.Unlock()
+
+		if old != nil {
+			fs.etagReplaced(inode, *old, etag)
+		}
+	}
+	return
+}
+
+// We copied inode onto itself and the ETag went from old to etag.
+// The handles that opened old can keep reading, otherwise they'd
+// think someone else replaced it and return ESTALE.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) etagReplaced(inode *Inode, old string, etag *string) {
+	var handles []*FileHandle
+
+	fs.mu.Lock()
+	for _, fh := range fs.fileHandles {
+		if fh.inode == inode {
+			handles = append(handles, fh)
+		}
+	}
+	fs.mu.Unlock()
+
+	for _, fh := range handles {
+		fh.mu.Lock()
+		if fh.etag != nil && *fh.etag == old {
+			fh.etag = etag
+		}
+		fh.mu.Unlock()
+	}
+}
+
+// replaceMetadata for objects too big for CopyBlob, a multipart copy
+// of the object onto itself. Completing one doesn't say what the ETag
+// is, so we HEAD for it afterwards.
+func (inode *Inode) replaceMetadataMultipart(fs *Goofys, size int64, key string,
+	props *BlobProperties) (etag *string, err error) {
+
+	err = fs.copyObjectMultipart(size, key, key, "", props)
+	if err != nil {
+		return
+	}
+
+	var head *HeadBlobOutput
+	err = fs.retry(func() (err error) {
+		head, err = fs.backend.HeadBlob(context.Background(), &HeadBlobInput{Key: key})
+		return
+	})
+	if err != nil {
+		// the copy is done, we just don't know its ETag
+		log.Printf("Unable to HEAD %v after replacing its metadata: %v", key, err)
+		return nil, nil
+	}
+	return head.ETag, nil
+}
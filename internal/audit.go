@@ -0,0 +1,204 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// --audit-log appends a JSON line for every request that changes the
+// bucket, with the key, the size of what's uploaded and the HTTP
+// status, or the error if there's no response. Retries are logged
+// too, each attempt is a request. With --audit-dry-run those requests
+// are only logged and fail with EROFS instead of being sent, so
+// nothing is changed.
+//
+// Like the metrics, this is done with handlers so every call site is
+// covered, including ones added later.
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var AUDITED_OPERATIONS = map[string]bool{
+	"PutObject":               true,
+	"CopyObject":              true,
+	"DeleteObject":            true,
+	"DeleteObjects":           true,
+	"CreateMultipartUpload":   true,
+	"UploadPart":              true,
+	"UploadPartCopy":          true,
+	"CompleteMultipartUpload": true,
+	"AbortMultipartUpload":    true,
+	"RestoreObject":           true,
+}
+
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"op"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key,omitempty"`
+	// DeleteObjects
+	Keys []string `json:"keys,omitempty"`
+	// CopyObject and UploadPartCopy
+	Source string `json:"source,omitempty"`
+	Size   *int64 `json:"size,omitempty"`
+	DryRun bool   `json:"dry_run,omitempty"`
+	// 0 if there was no response
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type auditLog struct {
+	dryRun bool
+
+	mu sync.Mutex
+	// GUARDED_BY(mu)
+	file *os.File
+}
+
+func openAuditLog(path string, dryRun bool) (a *auditLog, err error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	return &auditLog{dryRun: dryRun, file: file}, nil
+}
+
+// Log the mutating requests made through svc, or with dryRun fail
+// them instead of sending them.
+func (a *auditLog) instrument(svc *s3.S3, bucket string) {
+	if a.dryRun {
+		// an error from Validate stops the request before it's
+		// built, let alone sent
+		svc.Handlers.Validate.PushBack(func(r *request.Request) {
+			if !AUDITED_OPERATIONS[r.Operation.Name] {
+				return
+			}
+			rec := newAuditRecord(r, bucket, false)
+			rec.DryRun = true
+			a.write(rec)
+			r.Error = syscall.EROFS
+		})
+		return
+	}
+
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		if !AUDITED_OPERATIONS[r.Operation.Name] {
+			return
+		}
+		rec := newAuditRecord(r, bucket, true)
+		if r.HTTPResponse != nil {
+			rec.Status = r.HTTPResponse.StatusCode
+		}
+		if r.Error != nil {
+			rec.Error = r.Error.Error()
+		}
+		a.write(rec)
+	})
+}
+
+// The body has been read by the time a request is sent, then its size
+// is what we told S3 it is.
+func newAuditRecord(r *request.Request, bucket string, sent bool) (rec *auditRecord) {
+	rec = &auditRecord{
+		Time:      time.Now(),
+		Operation: r.Operation.Name,
+		Bucket:    bucket,
+	}
+
+	var body io.ReadSeeker
+
+	switch params := r.Params.(type) {
+	case *s3.PutObjectInput:
+		rec.Key = *params.Key
+		body = params.Body
+	case *s3.CopyObjectInput:
+		rec.Key = *params.Key
+		rec.Source = *params.CopySource
+	case *s3.DeleteObjectInput:
+		rec.Key = *params.Key
+	case *s3.DeleteObjectsInput:
+		for _, o := range params.Delete.Objects {
+			rec.Keys = append(rec.Keys, *o.Key)
+		}
+	case *s3.CreateMultipartUploadInput:
+		rec.Key = *params.Key
+	case *s3.UploadPartInput:
+		rec.Key = *params.Key
+		body = params.Body
+	case *s3.UploadPartCopyInput:
+		rec.Key = *params.Key
+		rec.Source = *params.CopySource
+	case *s3.CompleteMultipartUploadInput:
+		rec.Key = *params.Key
+	case *s3.AbortMultipartUploadInput:
+		rec.Key = *params.Key
+	case *s3.RestoreObjectInput:
+		rec.Key = *params.Key
+	}
+
+	if body != nil {
+		if sent {
+			size := r.HTTPRequest.ContentLength
+			rec.Size = &size
+		} else {
+			rec.Size = seekerSize(body)
+		}
+	}
+	return
+}
+
+// How much is left to read from body, nil if we can't tell.
+func seekerSize(body io.ReadSeeker) *int64 {
+	cur, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	end, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil
+	}
+	if _, err = body.Seek(cur, io.SeekStart); err != nil {
+		return nil
+	}
+
+	size := end - cur
+	return &size
+}
+
+// LOCKS_EXCLUDED(a.mu)
+func (a *auditLog) write(rec *auditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Unable to write audit log: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// one write per line so lines from several mounts appending
+	// to the same file don't interleave
+	if _, err = a.file.Write(line); err != nil {
+		log.Printf("Unable to write audit log: %v", err)
+	}
+}
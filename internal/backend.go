@@ -0,0 +1,275 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// Everything the file system does to objects goes through
+// fs.backend, a StorageBackend, in terms of the types below rather
+// than S3's: HEAD, GET of a range, listing, PUT, copy, delete one or
+// many, multipart uploads and restoring archived objects. Each call
+// takes the context of the fuse op it's for, or context.Background()
+// when it isn't for one, and a backend gives up on the request when
+// that's done. The S3 one is s3Backend, in s3backend.go.
+//
+// Retrying is up to the caller, see retry.go. Errors are whatever the
+// store returned: mapAwsError turns S3 ones into errnos and leaves
+// anything else alone, so another store should return errnos or
+// errors that are, and the few places that look for a particular S3
+// error code won't see it from another store.
+//
+// Finding the bucket's region, checking that we can get to it,
+// --probe and the Object Lock check are about S3 itself and use fs.s3,
+// as do the handlers we install on it: metrics, the audit log,
+// signature V2 and Content-MD5. So do the encryption, ACL, Object Lock
+// and tagging flags, which s3Backend adds to everything it writes.
+
+import (
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// What an object is stored with besides its content. Writing an
+// object sets all of these, S3 can't change one of them without
+// sending the others again.
+type BlobProperties struct {
+	Metadata map[string]*string
+
+	ContentType             *string
+	CacheControl            *string
+	ContentDisposition      *string
+	ContentEncoding         *string
+	ContentLanguage         *string
+	WebsiteRedirectLocation *string
+}
+
+// An object as a listing has it
+type BlobItemOutput struct {
+	Key          string
+	ETag         *string
+	LastModified time.Time
+	Size         int64
+	// nil for the default, STANDARD in S3
+	StorageClass *string
+}
+
+type HeadBlobInput struct {
+	Key string
+	// nil for the latest version
+	VersionId *string
+}
+
+type HeadBlobOutput struct {
+	BlobItemOutput
+	BlobProperties
+
+	// the MD5 of the content in hex, if the store knows it
+	ContentMD5 *string
+}
+
+type GetBlobInput struct {
+	Key       string
+	VersionId *string
+
+	// the range to read, Count 0 is to the end. Without either
+	// there's no range and we get the whole object
+	Start int64
+	Count int64
+	// with a range, the ETag it's a range of. If the object
+	// isn't that anymore we get the whole of it instead
+	IfRange *string
+}
+
+type GetBlobOutput struct {
+	// Size is the size of the whole object, even when we asked
+	// for a range of it
+	HeadBlobOutput
+
+	Body io.ReadCloser
+}
+
+type ListBlobsInput struct {
+	Prefix string
+	// with a delimiter, keys that have it after Prefix are
+	// rolled up into Prefixes
+	Delimiter string
+	// nil for as many as the store gives us
+	MaxKeys           *int64
+	ContinuationToken *string
+}
+
+type ListBlobsOutput struct {
+	Prefixes []string
+	Items    []BlobItemOutput
+
+	// NextContinuationToken is set whenever IsTruncated
+	IsTruncated           bool
+	NextContinuationToken *string
+}
+
+type PutBlobInput struct {
+	Key string
+	// nil for an empty object. It's read from the start again if
+	// we retry
+	Body io.ReadSeeker
+	BlobProperties
+	StorageClass *string
+
+	// fail with 412 if the object isn't IfMatch, or with
+	// IfNoneMatch "*" if there is one
+	IfMatch     *string
+	IfNoneMatch *string
+}
+
+type PutBlobOutput struct {
+	ETag *string
+}
+
+type CopyBlobInput struct {
+	Source      string
+	Destination string
+	// nil to keep what Source has
+	Properties   *BlobProperties
+	StorageClass *string
+}
+
+type CopyBlobOutput struct {
+	ETag *string
+}
+
+type DeleteBlobInput struct {
+	Key string
+}
+
+type DeleteBlobsInput struct {
+	// at most DELETE_BATCH_SIZE
+	Keys []string
+}
+
+type DeleteBlobsOutput struct {
+	// the keys that weren't deleted, with the error a delete of
+	// just that key would have had
+	Errors map[string]error
+}
+
+type RestoreBlobInput struct {
+	Key string
+	// how long the restored copy is kept
+	Days int
+}
+
+type MultipartBlobBeginInput struct {
+	Key string
+	BlobProperties
+	StorageClass *string
+}
+
+type MultipartBlobBeginOutput struct {
+	UploadId string
+}
+
+type MultipartBlobAddInput struct {
+	Key        string
+	UploadId   string
+	PartNumber int64
+	// read from the start again if we retry
+	Body io.ReadSeeker
+}
+
+type MultipartBlobAddOutput struct {
+	ETag *string
+}
+
+// A part copied from [Offset, Offset + Size) of Source
+type MultipartBlobCopyInput struct {
+	Key        string
+	UploadId   string
+	PartNumber int64
+	Source     string
+	Offset     int64
+	Size       int64
+}
+
+type MultipartBlobCommitInput struct {
+	Key      string
+	UploadId string
+	// the ETag of each part, part n is ETags[n-1]
+	ETags []*string
+
+	// like PutBlobInput's
+	IfMatch     *string
+	IfNoneMatch *string
+}
+
+type MultipartBlobCommitOutput struct {
+	ETag *string
+}
+
+type MultipartBlobAbortInput struct {
+	Key      string
+	UploadId string
+}
+
+type ListMultipartBlobsInput struct {
+	Prefix string
+}
+
+type MultipartBlob struct {
+	Key       string
+	UploadId  string
+	Initiated time.Time
+}
+
+type ListMultipartBlobsOutput struct {
+	// all of them, by key
+	Uploads []MultipartBlob
+}
+
+type ListMultipartBlobPartsInput struct {
+	Key      string
+	UploadId string
+}
+
+type MultipartBlobPart struct {
+	PartNumber int64
+	ETag       *string
+	Size       int64
+}
+
+type ListMultipartBlobPartsOutput struct {
+	// all of them, in order
+	Parts []MultipartBlobPart
+}
+
+type StorageBackend interface {
+	HeadBlob(ctx context.Context, param *HeadBlobInput) (*HeadBlobOutput, error)
+	GetBlob(ctx context.Context, param *GetBlobInput) (*GetBlobOutput, error)
+	ListBlobs(ctx context.Context, param *ListBlobsInput) (*ListBlobsOutput, error)
+
+	PutBlob(ctx context.Context, param *PutBlobInput) (*PutBlobOutput, error)
+	CopyBlob(ctx context.Context, param *CopyBlobInput) (*CopyBlobOutput, error)
+	DeleteBlob(ctx context.Context, param *DeleteBlobInput) error
+	DeleteBlobs(ctx context.Context, param *DeleteBlobsInput) (*DeleteBlobsOutput, error)
+	// succeeds if it's already being restored
+	RestoreBlob(ctx context.Context, param *RestoreBlobInput) error
+
+	MultipartBlobBegin(ctx context.Context, param *MultipartBlobBeginInput) (*MultipartBlobBeginOutput, error)
+	MultipartBlobAdd(ctx context.Context, param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error)
+	MultipartBlobCopy(ctx context.Context, param *MultipartBlobCopyInput) (*MultipartBlobAddOutput, error)
+	MultipartBlobCommit(ctx context.Context, param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error)
+	MultipartBlobAbort(ctx context.Context, param *MultipartBlobAbortInput) error
+	ListMultipartBlobs(ctx context.Context, param *ListMultipartBlobsInput) (*ListMultipartBlobsOutput, error)
+	ListMultipartBlobParts(ctx context.Context, param *ListMultipartBlobPartsInput) (*ListMultipartBlobPartsOutput, error)
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// --max-read-bps and --max-write-bps limit how fast we talk to S3,
+// over all connections together. We limit the connections rather
+// than the object bodies: the SDK reads an upload once to sign it
+// before sending it, and that shouldn't count. That means we have to
+// make the HTTP client, so the flags can't be used with one that's
+// passed in.
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// A token bucket holding up to a second worth of bytes. Taking more
+// than there is leaves it in debt and the taker waits it out, so a
+// read bigger than the bucket still works.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+
+	// time.Now and time.Sleep, except in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newTokenBucket(bps int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(bps),
+		tokens: float64(bps),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+func (b *tokenBucket) take(n int) {
+	b.mu.Lock()
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if wait > 0 {
+		b.sleep(wait)
+	}
+}
+
+// nil buckets don't limit anything
+type throttledConn struct {
+	net.Conn
+	read  *tokenBucket
+	write *tokenBucket
+}
+
+func (c *throttledConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if c.read != nil && n > 0 {
+		c.read.take(n)
+	}
+	return
+}
+
+func (c *throttledConn) Write(p []byte) (n int, err error) {
+	if c.write != nil {
+		c.write.take(len(p))
+	}
+	return c.Conn.Write(p)
+}
+
+// dial, with the connections it makes limited to flags.MaxReadBps
+// and flags.MaxWriteBps
+func throttleDial(flags *FlagStorage,
+	dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+
+	if flags.MaxReadBps <= 0 && flags.MaxWriteBps <= 0 {
+		return dial
+	}
+
+	var read, write *tokenBucket
+	if flags.MaxReadBps > 0 {
+		read = newTokenBucket(flags.MaxReadBps)
+	}
+	if flags.MaxWriteBps > 0 {
+		write = newTokenBucket(flags.MaxWriteBps)
+	}
+
+	return func(network, addr string) (net.Conn, error) {
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &throttledConn{conn, read, write}, nil
+	}
+}
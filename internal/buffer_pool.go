@@ -80,6 +80,24 @@ func (pool *BufferPool) requestBuffer() (buf []byte) {
 	return
 }
 
+// Like requestBuffer, but nil instead of waiting for one to be freed.
+func (pool *BufferPool) tryRequestBuffer() (buf []byte) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if len(pool.freelist) == 0 {
+		if pool.numBuffers < pool.maxBuffersGlobal {
+			pool.numBuffers++
+			buf = make([]byte, 0, BUF_SIZE)
+		}
+		return
+	}
+
+	buf = pool.freelist[len(pool.freelist)-1]
+	pool.freelist = pool.freelist[0 : len(pool.freelist)-1]
+	return
+}
+
 func (pool *BufferPool) freeBuffer(buf []byte) {
 	pool.mu.Lock()
 	defer pool.mu.Unlock()
@@ -102,6 +120,22 @@ func (h *BufferPoolHandle) Request() []byte {
 	return buf
 }
 
+// Like Request, but nil instead of waiting.
+func (h *BufferPoolHandle) TryRequest() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.inUseBuffers == h.maxBuffers {
+		return nil
+	}
+
+	buf := h.pool.tryRequestBuffer()
+	if buf != nil {
+		h.inUseBuffers++
+	}
+	return buf
+}
+
 func (h *BufferPoolHandle) Free(buf []byte) {
 	buf = buf[:0]
 	h.pool.freeBuffer(buf)
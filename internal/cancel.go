@@ -0,0 +1,137 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// S3 requests made for a fuse op give up when the kernel interrupts
+// the op, and with --request-timeout every request gives up after
+// that long so a connection that hangs can be retried instead of
+// holding things up forever. The SDK we use predates request
+// contexts so we put the context on the http.Request ourselves.
+//
+// Part uploads and read ahead happen in the background for no op in
+// particular, so only the timeout applies to them. Neither does the
+// op apply to flushing a file, interrupting close() would lose it.
+
+import (
+	"io"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// ctx, expiring after flags.RequestTimeout
+func (fs *Goofys) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if fs.flags.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, fs.flags.RequestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Tell apart a request that was interrupted from one that took too
+// long, the latter is worth retrying.
+func contextError(ctx context.Context, reqCtx context.Context, err error) error {
+	if err == nil || reqCtx.Err() == nil {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		return syscall.EINTR
+	}
+	return syscall.ETIMEDOUT
+}
+
+// Send req on behalf of ctx. The response has to be read by the time
+// this returns, so this doesn't work for GetObject.
+func (fs *Goofys) send(ctx context.Context, req *request.Request) (err error) {
+	reqCtx, cancel := fs.requestContext(ctx)
+	defer cancel()
+
+	req.HTTPRequest = req.HTTPRequest.WithContext(reqCtx)
+	return contextError(ctx, reqCtx, req.Send())
+}
+
+// The body of a response we are streaming, closing it lets go of the
+// request.
+type streamBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *streamBody) Close() (err error) {
+	err = b.ReadCloser.Close()
+	b.cancel()
+	return
+}
+
+// Abort whatever read is in progress, the body is no good after this.
+func (b *streamBody) interrupt() {
+	b.cancel()
+}
+
+// a body that can be interrupted like streamBody
+type interruptible interface {
+	interrupt()
+}
+
+// Like send, but ctx and flags.RequestTimeout only apply until the
+// response starts, after that the body is read for as long as it
+// takes. body is where the SDK leaves the response body, it's
+// replaced with a streamBody.
+func (fs *Goofys) sendStream(ctx context.Context, req *request.Request, body *io.ReadCloser) (err error) {
+	streamCtx, cancel := context.WithCancel(context.Background())
+
+	reqCtx, reqCancel := fs.requestContext(ctx)
+	defer reqCancel()
+
+	started := make(chan struct{})
+	go func() {
+		select {
+		case <-reqCtx.Done():
+			cancel()
+		case <-started:
+		}
+	}()
+
+	req.HTTPRequest = req.HTTPRequest.WithContext(streamCtx)
+	err = req.Send()
+	close(started)
+
+	if err != nil {
+		cancel()
+		return contextError(ctx, reqCtx, err)
+	}
+
+	*body = &streamBody{*body, cancel}
+	return
+}
+
+// Call interrupt if ctx is done before the returned function is
+// called.
+func whenDone(ctx context.Context, interrupt func()) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			interrupt()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
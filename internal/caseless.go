@@ -0,0 +1,164 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --case-insensitive, a name that doesn't exist is looked for
+// again ignoring case, by listing what in the directory starts with
+// the part of the name that case doesn't change. What it matched is
+// remembered in fs.caseNames, so the next time we go straight to the
+// real one, which is usually an inode we already have. Creating the
+// name as it is forgets what it matched. If several keys match, like
+// README and readme, the first one in a listing wins, which is the
+// same one every time.
+//
+// XXX only lookups ignore case. Unlink, Rename and creating readme
+// when README exists go by the name they're given
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/fuse"
+)
+
+// The start of name that's the same in any case.
+func caseInvariantPrefix(name string) string {
+	for i, r := range name {
+		if unicode.ToUpper(r) != r || unicode.ToLower(r) != r {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+// name doesn't exist, look up what does when case is ignored. The
+// inode may be one we already have.
+func (parent *Inode) lookUpCaseless(ctx context.Context, fs *Goofys, name string) (inode *Inode, err error) {
+	fullName := parent.getChildName(name)
+
+	fs.mu.Lock()
+	match, ok := fs.caseNames[fullName]
+	fs.mu.Unlock()
+
+	if ok {
+		inode, err = parent.lookUpCaseMatch(ctx, fs, match)
+		if err != fuse.ENOENT {
+			return
+		}
+
+		// gone or renamed since
+		fs.mu.Lock()
+		delete(fs.caseNames, fullName)
+		fs.mu.Unlock()
+	}
+
+	matches, err := parent.listCaseless(ctx, fs, name)
+	if err != nil {
+		return
+	}
+	if len(matches) == 0 {
+		return nil, fuse.ENOENT
+	}
+	if len(matches) > 1 {
+		log.Printf("%v matches %v ignoring case, using %v", fullName, matches, matches[0])
+	}
+	match = matches[0]
+	parent.logFuse("caseless", name, match)
+
+	inode, err = parent.lookUpCaseMatch(ctx, fs, match)
+	if err == nil {
+		fs.mu.Lock()
+		fs.caseNames[fullName] = match
+		fs.mu.Unlock()
+	}
+	return
+}
+
+// Whether we know what name is when case is ignored, so there's no
+// point looking it up as it is first.
+func (parent *Inode) isCaseName(fs *Goofys, name string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, ok := fs.caseNames[parent.getChildName(name)]
+	return ok
+}
+
+// The inode of match, which the kernel may already have under that
+// name. A new one would be a second inode for the same key.
+func (parent *Inode) lookUpCaseMatch(ctx context.Context, fs *Goofys, match string) (inode *Inode, err error) {
+	fullName := parent.getChildName(match)
+
+	fs.mu.Lock()
+	inode = fs.inodesCache[fullName]
+	fs.mu.Unlock()
+	if inode != nil {
+		return
+	}
+
+	return fs.lookUpInodeWithHint(ctx, match, fullName, LOOKUP_UNKNOWN)
+}
+
+// The names in parent that are name ignoring case, sorted.
+func (parent *Inode) listCaseless(ctx context.Context, fs *Goofys, name string) (matches []string, err error) {
+	prefix := *parent.FullName
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+
+	params := &ListBlobsInput{
+		Delimiter: "/",
+		Prefix:    prefix + caseInvariantPrefix(name),
+	}
+
+	seen := make(map[string]bool)
+	found := func(key string) {
+		base := strings.TrimSuffix(key[len(prefix):], "/")
+		if !seen[base] && strings.EqualFold(base, name) {
+			seen[base] = true
+			matches = append(matches, base)
+		}
+	}
+
+	for {
+		var resp *ListBlobsOutput
+		err = fs.retry(func() (err error) {
+			resp, err = fs.backend.ListBlobs(ctx, params)
+			return
+		})
+		if err != nil {
+			return nil, mapAwsError(err)
+		}
+
+		for _, p := range resp.Prefixes {
+			found(p)
+		}
+		for _, obj := range resp.Items {
+			found(obj.Key)
+		}
+
+		if !resp.IsTruncated || resp.NextContinuationToken == nil {
+			break
+		}
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+
+	sort.Strings(matches)
+	return
+}
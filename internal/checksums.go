@@ -0,0 +1,111 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --verify-checksums uploads carry Content-MD5, see contentMD5,
+// and S3 rejects a part or object that doesn't match. For reads, the
+// ETag of an object uploaded in one piece and not encrypted with KMS
+// or a customer key is the MD5 of its content, so a stream that reads
+// such an object from the start checks what it got against it, and
+// the read that hits the end fails with EIO if it's wrong. When a
+// sequential reader gets fast enough for read ahead to take over from
+// the stream, read ahead carries on with the stream's checksum.
+//
+// XXX reads that jump around, and multipart objects whose ETag isn't
+// an MD5 of the content, aren't checked. Neither are the newer
+// x-amz-checksum-* algorithms, which this SDK doesn't know about
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"syscall"
+)
+
+// The MD5 of what's been read of an object so far, in order from the
+// start.
+type runningChecksum struct {
+	h   hash.Hash
+	md5 string
+
+	inode *Inode
+}
+
+// All of the object has been hashed, compare it with its MD5.
+func (c *runningChecksum) verify() error {
+	if sum := hex.EncodeToString(c.h.Sum(nil)); sum != c.md5 {
+		log.Printf("%v: checksum mismatch, got %v expected %v",
+			*c.inode.FullName, sum, c.md5)
+		return syscall.EIO
+	}
+	return nil
+}
+
+// A body that hashes what's read from it and compares it with the
+// object's MD5 at the end.
+type verifiedBody struct {
+	io.ReadCloser
+	runningChecksum
+}
+
+func (b *verifiedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.h.Write(p[:n])
+
+	if err == io.EOF {
+		if verifyErr := b.verify(); verifyErr != nil {
+			err = verifyErr
+		}
+	}
+	return
+}
+
+func (b *verifiedBody) interrupt() {
+	if body, ok := b.ReadCloser.(interruptible); ok {
+		body.interrupt()
+	}
+}
+
+// Check the body of a GET from the start of the object, if the
+// backend knows the MD5 of its content.
+func (fh *FileHandle) verifyBody(resp *GetBlobOutput) {
+	if resp.ContentMD5 == nil {
+		fh.inode.logFuse("can't verify", resp.ETag)
+		return
+	}
+	resp.Body = &verifiedBody{
+		ReadCloser: resp.Body,
+		runningChecksum: runningChecksum{
+			h:     md5.New(),
+			md5:   *resp.ContentMD5,
+			inode: fh.inode,
+		},
+	}
+}
+
+// Read ahead is taking over at offset, from the stream that got
+// there if there is one. Keep its checksum going.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) takeStreamChecksum(offset int64) {
+	fh.readAheadSum = nil
+	for _, s := range fh.streams {
+		if b, ok := s.body.(*verifiedBody); ok && !s.busy && s.offset == offset {
+			fh.readAheadSum = &b.runningChecksum
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// Databases and columnar formats read a file in small pieces all over
+// the place, which neither the streams nor readahead help with, every
+// read is a GET of its own. With --coalesce-window, once a small read
+// lands within the window of the one before it and no stream is close
+// enough to it, we GET a range around it of up to the window, reading
+// at most --coalesce-max-over-read more than asked for, and the reads
+// after it that fall in the range are served from memory.
+//
+// XXX the ranges are per handle, two handles reading the same file
+// each fetch their own
+
+import (
+	"time"
+)
+
+// How many ranges a handle keeps, the least recently used one is
+// dropped to make room
+const COALESCE_MAX_RANGES = 8
+
+type coalescedRange struct {
+	offset   int64
+	buf      []byte
+	lastUsed time.Time
+}
+
+// Whether this range has [offset, offset + size), or the part of it
+// before the end of the file.
+func (r *coalescedRange) covers(offset int64, size int, fileSize int64) bool {
+	end := minInt64(offset+int64(size), fileSize)
+	return offset >= r.offset && end <= r.offset+int64(len(r.buf))
+}
+
+// Serve the read from a range we have, if there's one.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) readCoalesced(offset int64, buf []byte) (bytesRead int, ok bool) {
+	fileSize := int64(fh.inode.Attributes.Size)
+
+	for _, r := range fh.coalesced {
+		if r.covers(offset, len(buf), fileSize) {
+			r.lastUsed = time.Now()
+			bytesRead = copy(buf, r.buf[offset-r.offset:])
+			return bytesRead, true
+		}
+	}
+	return
+}
+
+// Whether a read we don't have should fetch a range around it, which
+// is when it's small and close to the small read before it.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) shouldCoalesce(fs *Goofys, offset int64, size int) bool {
+	window := fs.flags.CoalesceWindow
+	if window <= 0 || int64(size) >= window {
+		return false
+	}
+
+	last := fh.lastSmallRead
+	seen := fh.smallReadSeen
+	fh.lastSmallRead = offset
+	fh.smallReadSeen = true
+
+	if !seen || offset == fh.readBufOffset {
+		// the first one, or sequential which the streams
+		// and readahead are better at
+		return false
+	}
+
+	distance := offset - last
+	if distance < 0 {
+		distance = -distance
+	}
+	return distance < window
+}
+
+// GET a range around [offset, offset + len(buf)), keep it and read
+// from it.
+//
+// LOCKS_EXCLUDED(fh.mu)
+func (fh *FileHandle) readCoalescing(fs *Goofys, offset int64, buf []byte) (bytesRead int, err error) {
+	fileSize := int64(fh.inode.Attributes.Size)
+
+	size := fs.flags.CoalesceWindow
+	if overRead := int64(len(buf)) + fs.flags.CoalesceMaxOverRead; size > overRead {
+		size = overRead
+	}
+
+	// the read is in the middle, we don't know which way the next
+	// one goes
+	start := offset - (size-int64(len(buf)))/2
+	if start < 0 {
+		start = 0
+	}
+	end := minInt64(start+size, fileSize)
+
+	fh.inode.logFuse("coalescing read", offset, len(buf), start, end)
+
+	r := &coalescedRange{offset: start, buf: make([]byte, end-start)}
+	err = fh.readBase(fs, start, r.buf)
+	if err != nil {
+		return
+	}
+	r.lastUsed = time.Now()
+	bytesRead = copy(buf, r.buf[offset-start:])
+
+	fh.mu.Lock()
+	fh.addCoalesced(r)
+	fh.readDone(offset, bytesRead)
+	fh.mu.Unlock()
+	return
+}
+
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) addCoalesced(r *coalescedRange) {
+	if len(fh.coalesced) >= COALESCE_MAX_RANGES {
+		oldest := 0
+		for i, c := range fh.coalesced {
+			if c.lastUsed.Before(fh.coalesced[oldest].lastUsed) {
+				oldest = i
+			}
+		}
+		fh.coalesced = append(fh.coalesced[:oldest], fh.coalesced[oldest+1:]...)
+	}
+	fh.coalesced = append(fh.coalesced, r)
+}
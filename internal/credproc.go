@@ -0,0 +1,174 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// Credentials from an external command, like the AWS CLI's
+// credential_process: it prints a JSON document with the keys and
+// when they expire, and it's run again shortly before that. The
+// command is --credential-process, or else credential_process in the
+// profile's section of ~/.aws/config.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const CREDENTIAL_PROCESS_PROVIDER = "CredentialProcess"
+
+// how long before they expire we ask for new credentials
+const CREDENTIAL_PROCESS_EXPIRY_WINDOW = 5 * time.Minute
+
+type credentialProcessProvider struct {
+	command string
+	// zero if they don't expire
+	expiration time.Time
+}
+
+// what the command prints
+type credentialProcessOutput struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      *time.Time
+}
+
+func (p *credentialProcessProvider) Retrieve() (v credentials.Value, err error) {
+	cmd := exec.Command("/bin/sh", "-c", p.command)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Env = os.Environ()
+
+	out, err := cmd.Output()
+	if err != nil {
+		return v, fmt.Errorf("credential process %q: %v: %v",
+			p.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var creds credentialProcessOutput
+	err = json.Unmarshal(out, &creds)
+	if err != nil {
+		return v, fmt.Errorf("credential process %q: %v", p.command, err)
+	}
+	if creds.Version != 1 {
+		return v, fmt.Errorf("credential process %q: unsupported version %v",
+			p.command, creds.Version)
+	}
+	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" {
+		return v, fmt.Errorf("credential process %q: no AccessKeyId or SecretAccessKey",
+			p.command)
+	}
+
+	if creds.Expiration != nil {
+		p.expiration = *creds.Expiration
+	} else {
+		p.expiration = time.Time{}
+	}
+
+	v = credentials.Value{
+		AccessKeyID:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		ProviderName:    CREDENTIAL_PROCESS_PROVIDER,
+	}
+	return
+}
+
+func (p *credentialProcessProvider) IsExpired() bool {
+	return !p.expiration.IsZero() &&
+		time.Now().Add(CREDENTIAL_PROCESS_EXPIRY_WINDOW).After(p.expiration)
+}
+
+// credential_process of the AWS_PROFILE (or default) profile in the
+// AWS config file, if there's one.
+func profileCredentialProcess() (command string) {
+	path := os.Getenv("AWS_CONFIG_FILE")
+	if path == "" {
+		path = filepath.Join(os.Getenv("HOME"), ".aws", "config")
+	}
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	inProfile := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section := strings.TrimSpace(line[1 : len(line)-1])
+			section = strings.TrimSpace(strings.TrimPrefix(section, "profile "))
+			inProfile = section == profile
+			continue
+		}
+
+		if !inProfile {
+			continue
+		}
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 &&
+			strings.TrimSpace(kv[0]) == "credential_process" {
+			command = strings.TrimSpace(kv[1])
+		}
+	}
+	return
+}
+
+// Use the credentials of flags.CredentialProcess, or of the profile's
+// credential_process if we weren't given any in the environment.
+func useCredentialProcess(awsConfig *aws.Config, flags *FlagStorage) (err error) {
+	command := flags.CredentialProcess
+	if command == "" {
+		if awsConfig.Credentials != nil || os.Getenv("AWS_ACCESS_KEY_ID") != "" ||
+			os.Getenv("AWS_ACCESS_KEY") != "" {
+			return
+		}
+		command = profileCredentialProcess()
+		if command == "" {
+			return
+		}
+	}
+
+	creds := credentials.NewCredentials(&credentialProcessProvider{command: command})
+
+	// fail now rather than on the first request
+	_, err = creds.Get()
+	if err != nil {
+		return
+	}
+
+	awsConfig.Credentials = creds
+	return
+}
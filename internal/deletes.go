@@ -0,0 +1,199 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// Unlinks and rmdirs go out through one queue. A delete that comes in
+// while nothing else is going out is sent right away on its own.
+// Deletes that come in while one is in flight wait for it, then go
+// out together in a single DeleteObjects, so removing a tree with
+// many removes in parallel (a parallel rm, find | xargs -P) takes a
+// handful of requests instead of one per file. Each unlink still only
+// returns once S3 has deleted its key, with the error S3 gave for
+// that key.
+//
+// XXX a plain rm -rf removes one file at a time, and each unlink has
+// to wait for its delete, so it still sends one request per file
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/fuse"
+)
+
+// DeleteObjects takes at most this many keys
+const DELETE_BATCH_SIZE = 1000
+
+type deleteError struct {
+	keys []string
+	errs []string
+	// what each of errs maps to
+	errnos []error
+}
+
+func (e *deleteError) Error() string {
+	msg := fmt.Sprintf("failed to delete %v keys:", len(e.keys))
+	for i := range e.keys {
+		msg += fmt.Sprintf(" %v (%v)", e.keys[i], e.errs[i])
+	}
+	return msg
+}
+
+// One DeleteObjects of at most DELETE_BATCH_SIZE keys. failed has
+// what each key that S3 didn't delete mapped to, err is for the
+// request as a whole. A key that's already gone isn't a failure,
+// deleting just that key wouldn't have minded either.
+func (fs *Goofys) deleteBatch(keys []string) (failed map[string]error, err error) {
+	var resp *DeleteBlobsOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.DeleteBlobs(context.Background(), &DeleteBlobsInput{Keys: keys})
+		return
+	})
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	failed = make(map[string]error)
+	for key, e := range resp.Errors {
+		if errno := mapAwsError(e); errno != fuse.ENOENT {
+			failed[key] = errno
+		}
+	}
+	return
+}
+
+// Delete keys with as few requests as we can. The batches are sent
+// one at a time; keys that S3 refused to delete are all reported in
+// a *deleteError after we've tried every batch.
+func (fs *Goofys) deleteKeys(keys []string) (err error) {
+	failed := &deleteError{}
+
+	for len(keys) != 0 {
+		n := len(keys)
+		if n > DELETE_BATCH_SIZE {
+			n = DELETE_BATCH_SIZE
+		}
+
+		errs, err := fs.deleteBatch(keys[:n])
+		if err != nil {
+			return err
+		}
+		for _, key := range keys[:n] {
+			if errno, ok := errs[key]; ok {
+				failed.keys = append(failed.keys, key)
+				failed.errs = append(failed.errs, errno.Error())
+				failed.errnos = append(failed.errnos, errno)
+			}
+		}
+		keys = keys[n:]
+	}
+
+	if len(failed.keys) != 0 {
+		return failed
+	}
+	return
+}
+
+// What a file system operation that had deleteKeys fail returns: the
+// error of the first key, the rest are logged.
+func deleteErrno(err error) error {
+	if failed, ok := err.(*deleteError); ok {
+		log.Print(failed)
+		return failed.errnos[0]
+	}
+	return err
+}
+
+type pendingDelete struct {
+	key  string
+	err  error
+	done chan struct{}
+}
+
+type deleteQueue struct {
+	mu sync.Mutex
+	// GUARDED_BY(mu)
+	pending []*pendingDelete
+	// GUARDED_BY(mu)
+	sending bool
+}
+
+// Delete key, together with whatever other deletes are waiting.
+//
+// LOCKS_EXCLUDED(fs.deletes.mu)
+func (fs *Goofys) deleteKey(key string) error {
+	d := &pendingDelete{key: key, done: make(chan struct{})}
+
+	q := &fs.deletes
+	q.mu.Lock()
+	q.pending = append(q.pending, d)
+	if !q.sending {
+		q.sending = true
+		go fs.sendDeletes()
+	}
+	q.mu.Unlock()
+
+	<-d.done
+	return d.err
+}
+
+// Send what's queued until nothing is
+func (fs *Goofys) sendDeletes() {
+	q := &fs.deletes
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.sending = false
+			q.mu.Unlock()
+			return
+		}
+		n := len(q.pending)
+		if n > DELETE_BATCH_SIZE {
+			n = DELETE_BATCH_SIZE
+		}
+		batch := q.pending[:n]
+		q.pending = q.pending[n:]
+		q.mu.Unlock()
+
+		if len(batch) == 1 {
+			d := batch[0]
+			d.err = fs.retry(func() error {
+				return fs.backend.DeleteBlob(context.Background(), &DeleteBlobInput{Key: d.key})
+			})
+			if d.err != nil {
+				d.err = mapAwsError(d.err)
+			}
+			close(d.done)
+			continue
+		}
+
+		keys := make([]string, len(batch))
+		for i, d := range batch {
+			keys[i] = d.key
+		}
+		failed, err := fs.deleteBatch(keys)
+		for _, d := range batch {
+			if err != nil {
+				d.err = err
+			} else {
+				d.err = failed[d.key]
+			}
+			close(d.done)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --dir-size-ttl, a directory's size is the total size of what's
+// under it instead of 4096. Stat lists everything under the directory
+// to add it up, unless a listing of it that's not older than the TTL
+// already did: reading a directory whose subdirectories all have a
+// size adds up the files it sees and those. Directories with more
+// than DIR_SIZE_MAX_KEYS under them keep 4096. Writes don't update
+// sizes, they are only seen once the TTL is up.
+//
+// The size is for stat and ls -l, not du. The kernel gets st_blocks
+// from the size, and du adds a directory's blocks to those of
+// everything it finds under it, so each file is counted once for it
+// and once for every directory above it. Use du without the flag.
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const DIR_SIZE_MAX_KEYS = 100000
+
+// we start dropping expired sizes when we have more than this
+const DIR_SIZE_MAX_DIRS = 10000
+
+type dirSize struct {
+	size uint64
+	// false if there's too much to add up
+	known bool
+	time  time.Time
+}
+
+type dirSizes struct {
+	ttl time.Duration
+
+	mu sync.Mutex
+	// directory full name to its size
+	dirs map[string]dirSize
+}
+
+func newDirSizes(ttl time.Duration) *dirSizes {
+	return &dirSizes{ttl: ttl, dirs: make(map[string]dirSize)}
+}
+
+// The size of dir if we added it up less than ttl ago.
+func (d *dirSizes) get(dir string) (size dirSize, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	size, ok = d.dirs[dir]
+	if ok && time.Since(size.time) >= d.ttl {
+		ok = false
+	}
+	return
+}
+
+func (d *dirSizes) set(dir string, size uint64, known bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.dirs) >= DIR_SIZE_MAX_DIRS {
+		for k, v := range d.dirs {
+			if time.Since(v.time) >= d.ttl {
+				delete(d.dirs, k)
+			}
+		}
+	}
+
+	d.dirs[dir] = dirSize{size, known, time.Now()}
+}
+
+// List everything under dir and add it up.
+func (fs *Goofys) scanDirSize(dir string) (size uint64, known bool, err error) {
+	prefix := dir
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+
+	params := &ListBlobsInput{Prefix: prefix}
+
+	keys := 0
+	for {
+		var resp *ListBlobsOutput
+		err = fs.retry(func() (err error) {
+			resp, err = fs.backend.ListBlobs(context.Background(), params)
+			return
+		})
+		if err != nil {
+			return 0, false, mapAwsError(err)
+		}
+
+		for _, obj := range resp.Items {
+			size += uint64(obj.Size)
+		}
+
+		keys += len(resp.Items)
+		if keys > DIR_SIZE_MAX_KEYS {
+			return 0, false, nil
+		}
+
+		if !resp.IsTruncated || resp.NextContinuationToken == nil {
+			return size, true, nil
+		}
+
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+// The directory's attributes with the size of what's under it, if
+// we can tell.
+func (inode *Inode) dirAttributes(fs *Goofys) (*fuseops.InodeAttributes, error) {
+	size, ok := fs.dirSizes.get(*inode.FullName)
+	if !ok {
+		bytes, known, err := fs.scanDirSize(*inode.FullName)
+		if err != nil {
+			return nil, err
+		}
+		fs.dirSizes.set(*inode.FullName, bytes, known)
+		size = dirSize{size: bytes, known: known}
+	}
+
+	if !size.known {
+		return inode.Attributes, nil
+	}
+
+	attr := *inode.Attributes
+	attr.Size = size.size
+	return &attr, nil
+}
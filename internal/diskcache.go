@@ -0,0 +1,258 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --cache-dir, objects that are read from start to end are kept
+// in that directory, and later opens of the same object read them
+// from there instead of from S3. An entry is named after the bucket,
+// key and ETag, so once the object changes (and we notice, see
+// --stat-cache-ttl) it's simply not found anymore and ages out. The
+// least recently used entries are removed to stay under
+// --cache-max-size. Entries survive remounts.
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefix of entries that are still being filled
+const CACHE_TMP_PREFIX = ".tmp-"
+
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mu   sync.Mutex
+	size int64
+	// front is the most recently used
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type diskCacheEntry struct {
+	name string
+	size int64
+}
+
+// Pick up what's in dir from an earlier mount, and throw away what
+// was left half filled.
+func newDiskCache(dir string, maxSize int64) (c *diskCache, err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	c = &diskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	sort.Sort(byModTime(files))
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(f.Name(), CACHE_TMP_PREFIX) {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		c.add(f.Name(), f.Size())
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return
+}
+
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+
+func (c *diskCache) entryName(bucket string, key string, etag string) string {
+	h := sha256.Sum256([]byte(bucket + "/" + key + "\n" + etag))
+	return hex.EncodeToString(h[:])
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *diskCache) add(name string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[name]; ok {
+		c.size -= e.Value.(*diskCacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[name] = c.lru.PushFront(&diskCacheEntry{name, size})
+	c.size += size
+}
+
+// Remove the least recently used entries until we fit.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *diskCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() != 0 {
+		e := c.lru.Back()
+		entry := e.Value.(*diskCacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, entry.name)
+		c.size -= entry.size
+
+		// handles that have it open can keep reading it
+		err := os.Remove(filepath.Join(c.dir, entry.name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to remove cache entry %v: %v", entry.name, err)
+		}
+	}
+}
+
+// The entry called name, or nil if we don't have it.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *diskCache) open(name string) *os.File {
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	path := filepath.Join(c.dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		// evicted since, or removed from under us
+		return nil
+	}
+
+	// so the order is right after a remount
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return f
+}
+
+// Start filling the entry called name with an object of size bytes.
+// nil if it's too big to cache or we can't write to the cache.
+func (c *diskCache) fill(name string, size int64) *cacheFill {
+	if size > c.maxSize {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(c.dir, CACHE_TMP_PREFIX)
+	if err != nil {
+		log.Printf("Unable to create cache entry: %v", err)
+		return nil
+	}
+
+	return &cacheFill{cache: c, name: name, file: f, size: size}
+}
+
+// An entry being filled by what's read, in order, from the start.
+// Reads that skip ahead leave a gap and it's never finished.
+type cacheFill struct {
+	cache *diskCache
+	name  string
+	file  *os.File
+	size  int64
+	// how much from the start we have
+	next int64
+}
+
+// data was read at offset. Returns true once the fill is over, one
+// way or the other, and f shouldn't be used anymore.
+func (f *cacheFill) add(offset int64, data []byte) (over bool) {
+	end := offset + int64(len(data))
+	if offset > f.next || end <= f.next {
+		return false
+	}
+
+	_, err := f.file.WriteAt(data[f.next-offset:], f.next)
+	if err != nil {
+		log.Printf("Unable to write cache entry: %v", err)
+		f.abort()
+		return true
+	}
+	f.next = end
+
+	if f.next < f.size {
+		return false
+	}
+
+	tmp := f.file.Name()
+	err = f.file.Close()
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(f.cache.dir, f.name))
+	}
+	if err != nil {
+		log.Printf("Unable to save cache entry: %v", err)
+		os.Remove(tmp)
+		return true
+	}
+
+	f.cache.add(f.name, f.size)
+	f.cache.mu.Lock()
+	f.cache.evict()
+	f.cache.mu.Unlock()
+	return true
+}
+
+func (f *cacheFill) abort() {
+	f.file.Close()
+	os.Remove(f.file.Name())
+}
+
+// The cache entry to read this handle from, or nil. The first read
+// looks for one, and if there isn't one and it's at the start, it
+// starts filling one.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) cachedFile(fs *Goofys, offset int64) *os.File {
+	if fs.diskCache == nil || fh.cacheChecked {
+		return fh.cacheFile
+	}
+	fh.cacheChecked = true
+
+	if fh.etag == nil || fh.gunzip || fh.dirty {
+		return nil
+	}
+
+	name := fs.diskCache.entryName(fs.bucket, *fh.inode.FullName, *fh.etag)
+	fh.cacheFile = fs.diskCache.open(name)
+	if fh.cacheFile == nil && offset == 0 {
+		fh.cacheFill = fs.diskCache.fill(name, int64(fh.inode.Attributes.Size))
+	}
+	return fh.cacheFile
+}
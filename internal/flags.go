@@ -16,6 +16,8 @@
 package internal
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 	"time"
@@ -29,7 +31,7 @@ func init() {
    {{.Name}} - {{.Usage}}
 
 USAGE:
-   {{.Name}} {{if .Flags}}[global options]{{end}} bucket mountpoint
+   {{.Name}} {{if .Flags}}[global options]{{end}} bucket[:prefix] mountpoint
    {{if .Version}}
 VERSION:
    {{.Version}}
@@ -84,6 +86,20 @@ func NewApp() (app *cli.App) {
 				Usage: "Permission bits for files (default: 0644)",
 			},
 
+			cli.IntFlag{
+				Name:  "umask",
+				Value: 0022,
+				Usage: "Permission bits to clear from the mode asked for when" +
+					" creating files and directories. (default: 0022)",
+			},
+
+			cli.StringFlag{
+				Name:  "exec-suffixes",
+				Value: "",
+				Usage: "Comma separated file name suffixes, e.g. .sh,.py. Files ending in one" +
+					" of them are executable by whoever can read them.",
+			},
+
 			cli.IntFlag{
 				Name:  "uid",
 				Value: -1,
@@ -96,10 +112,65 @@ func NewApp() (app *cli.App) {
 				Usage: "GID owner of all inodes.",
 			},
 
+			cli.BoolFlag{
+				Name:  "read-only",
+				Usage: "Refuse to change anything in the bucket, same as -o ro.",
+			},
+
+			cli.BoolFlag{
+				Name: "xattr",
+				Usage: "Store user.* extended attributes in object metadata." +
+					" Reading them may need a HEAD and changing them copies the object.",
+			},
+
+			cli.BoolFlag{
+				Name: "posix-attrs",
+				Usage: "Save mode, owner and mtime changes in object metadata and use the" +
+					" mode/uid/gid/mtime found there instead of the defaults." +
+					" Listings don't have metadata, so looking up a file always needs a HEAD.",
+			},
+
+			cli.BoolFlag{
+				Name: "list-symlinks",
+				Usage: "HEAD the empty objects in a directory listing to tell symlinks" +
+					" from empty files. Otherwise symlinks are listed as files until" +
+					" they are looked up.",
+			},
+
+			cli.BoolFlag{
+				Name: "gunzip",
+				Usage: "Decompress objects stored with Content-Encoding: gzip when reading them." +
+					" Their size is unknown until they've been read to the end and" +
+					" they can only be read from the start.",
+			},
+
+			cli.IntFlag{
+				Name:  "max-read-size",
+				Value: 0,
+				Usage: "Fail reads of files bigger than this many MB with EFBIG, so nobody" +
+					" runs up a bill by reading a huge object by mistake. (default: off)",
+			},
+
+			cli.IntFlag{
+				Name:  "max-write-size",
+				Value: 0,
+				Usage: "Fail writes that would make a file bigger than this many MB with EFBIG." +
+					" (default: off)",
+			},
+
 			/////////////////////////
 			// S3
 			/////////////////////////
 
+			cli.StringFlag{
+				Name:  "region",
+				Value: "",
+				Usage: "The region the bucket is in. Skips looking it up with" +
+					" GetBucketLocation, which some IAM policies don't allow." +
+					" With --endpoint, the region requests are signed for." +
+					" (default: detected)",
+			},
+
 			cli.StringFlag{
 				Name:  "endpoint",
 				Value: "",
@@ -111,7 +182,172 @@ func NewApp() (app *cli.App) {
 				Name:  "storage-class",
 				Value: "STANDARD",
 				Usage: "The type of storage to use when writing objects." +
-					" Possible values: REDUCED_REDUNDANCY, STANDARD (default), STANDARD_IA.",
+					" Possible values: REDUCED_REDUNDANCY, STANDARD (default), STANDARD_IA," +
+					" GLACIER, DEEP_ARCHIVE.",
+			},
+
+			cli.StringFlag{
+				Name:  "storage-class-rules",
+				Value: "",
+				Usage: "Storage classes for some keys, as a comma separated list of" +
+					" pattern=class, e.g. logs/*=STANDARD_IA,*.tmp=REDUCED_REDUNDANCY." +
+					" Patterns with a / are globs against the full key, --prefix included," +
+					" those without match a name at any depth. One that matches a directory" +
+					" covers what's in it. The first match wins, other keys use --storage-class.",
+			},
+
+			cli.IntFlag{
+				Name:  "restore-days",
+				Value: 0,
+				Usage: "Reading an archived object asks S3 to restore it for this many days," +
+					" reads fail with EAGAIN until it's restored. (default: off)",
+			},
+
+			cli.StringFlag{
+				Name:  "acl",
+				Value: "",
+				Usage: "The canned ACL to apply to new objects, e.g. private, public-read," +
+					" bucket-owner-full-control (default: the bucket's default).",
+			},
+
+			cli.StringFlag{
+				Name:  "tagging",
+				Value: "",
+				Usage: "Tags to put on new objects, URL encoded like" +
+					" project=x&classification=internal.",
+			},
+
+			cli.BoolFlag{
+				Name:  "sse",
+				Usage: "Enable basic server-side encryption at rest (SSE-S3) in S3 for all writes.",
+			},
+
+			cli.BoolFlag{
+				Name:  "sse-kms",
+				Usage: "Enable KMS encryption (SSE-KMS) for all writes.",
+			},
+
+			cli.StringFlag{
+				Name:  "sse-kms-key-id",
+				Value: "",
+				Usage: "The KMS key to use with --sse-kms, defaults to the account's S3 key.",
+			},
+
+			cli.BoolFlag{
+				Name: "multi-bucket",
+				Usage: "Mount a directory for each bucket in a comma separated list," +
+					" or for every bucket in the account if the bucket is *.",
+			},
+
+			cli.StringFlag{
+				Name:  "object-lock-mode",
+				Value: "",
+				Usage: "Lock what we write with S3 Object Lock, GOVERNANCE or COMPLIANCE." +
+					" The bucket needs to have Object Lock enabled.",
+			},
+
+			cli.DurationFlag{
+				Name:  "object-lock-retention",
+				Value: 0,
+				Usage: "How long what we write is locked for with --object-lock-mode.",
+			},
+
+			cli.StringFlag{
+				Name:  "credential-process",
+				Value: "",
+				Usage: "A command that prints credentials as JSON, like the AWS CLI's" +
+					" credential_process. It's run again before they expire." +
+					" (default: the profile's credential_process in ~/.aws/config, if any)",
+			},
+
+			cli.BoolFlag{
+				Name: "anonymous, no-sign-request",
+				Usage: "Don't sign requests, to mount a public bucket without credentials." +
+					" Nothing can be written without them, so this implies --read-only" +
+					" and the mount is read-only even if it isn't given.",
+			},
+
+			cli.StringFlag{
+				Name:  "role-arn",
+				Value: "",
+				Usage: "Assume this IAM role for all requests, using the credentials" +
+					" found in the environment to do so.",
+			},
+
+			cli.StringFlag{
+				Name:  "role-external-id",
+				Value: "",
+				Usage: "The external ID to pass when assuming --role-arn, if the role requires one.",
+			},
+
+			cli.StringFlag{
+				Name:  "role-session-name",
+				Value: "goofys",
+				Usage: "The session name to use when assuming --role-arn.",
+			},
+
+			cli.BoolFlag{
+				Name: "no-content-type",
+				Usage: "Don't set Content-Type on new objects. By default it's guessed" +
+					" from the file extension, or the content if that doesn't help.",
+			},
+
+			cli.StringFlag{
+				Name:  "cache-control",
+				Value: "",
+				Usage: "Cache-Control to set on new objects, e.g. \"max-age=3600\".",
+			},
+
+			cli.StringFlag{
+				Name:  "content-disposition",
+				Value: "",
+				Usage: "Content-Disposition to set on new objects, e.g. \"attachment\".",
+			},
+
+			cli.BoolFlag{
+				Name: "versions",
+				Usage: "Make file@version=<id> the read only version <id> of file," +
+					" in a versioned bucket.",
+			},
+
+			cli.BoolFlag{
+				Name: "metadata-files",
+				Usage: "Make file" + METADATA_SUFFIX + " a read only JSON document with the size," +
+					" ETag, storage class, last modified time and user metadata of file." +
+					" Keys that end with " + METADATA_SUFFIX + " can't be seen.",
+			},
+
+			cli.BoolFlag{
+				Name: "case-insensitive",
+				Usage: "Look up names that don't exist again ignoring case, for programs" +
+					" from case insensitive file systems. This lists the directory, so" +
+					" it's slow in big ones.",
+			},
+
+			cli.BoolFlag{
+				Name: "no-dir-markers",
+				Usage: "Don't create dir/ objects for new directories. A directory" +
+					" then exists only because of what's in it, and an empty one" +
+					" is gone after a remount.",
+			},
+
+			cli.BoolFlag{
+				Name: "head-fallback",
+				Usage: "For policies that allow GetObject but not HEAD or listing:" +
+					" look up files whose HEAD is forbidden with a GET of their first byte," +
+					" and take a forbidden listing to mean there's no such directory.",
+			},
+
+			cli.StringFlag{
+				Name:  "ca-bundle",
+				Value: "",
+				Usage: "PEM file of extra CA certificates to trust, for endpoints" +
+					" with private certificates.",
+			},
+
+			cli.BoolFlag{
+				Name:  "insecure-tls",
+				Usage: "Don't verify the endpoint's certificate. Only for testing.",
 			},
 
 			cli.BoolFlag{
@@ -120,14 +356,238 @@ func NewApp() (app *cli.App) {
 					" Needed for some private object stores.",
 			},
 
+			cli.BoolFlag{
+				Name: "signature-v2",
+				Usage: "Sign requests with the older Signature Version 2 instead of V4." +
+					" Needed for some private object stores.",
+			},
+
+			cli.DurationFlag{
+				Name: "cleanup-uploads",
+				Usage: "Abort multipart uploads under the mount that are older than this," +
+					" left behind by interrupted writes. Done when mounting and on SIGUSR1." +
+					" (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name: "probe",
+				Usage: "Before mounting, check that we can list the bucket and, unless" +
+					" read only, write and delete a " + PROBE_KEY_PREFIX + "* object in it.",
+			},
+
+			cli.BoolFlag{
+				Name: "conditional-writes",
+				Usage: "Fail with ESTALE instead of overwriting a file that was changed" +
+					" by someone else since it was opened, if the store supports If-Match.",
+			},
+
+			cli.BoolFlag{
+				Name: "verify-checksums",
+				Usage: "Send Content-MD5 with uploads so S3 rejects corrupted ones, and" +
+					" fail reads of a whole object with EIO if what we got doesn't match its ETag.",
+			},
+
+			cli.BoolFlag{
+				Name: "use-list-v2",
+				Usage: "List with ListObjectsV2 instead of ListObjects." +
+					" Some object stores only implement v2 well.",
+			},
+
 			/////////////////////////
 			// Tuning
 			/////////////////////////
 
+			cli.IntFlag{
+				Name:  "part-size",
+				Value: 128,
+				Usage: "Size in MB of each part when copying large objects" +
+					" (5-5120, default: 128).",
+			},
+
+			cli.IntFlag{
+				Name:  "single-put-size",
+				Value: 0,
+				Usage: "Upload files of up to about this many MB with one PutObject rather than" +
+					" a multipart upload, keeping them in memory until they're flushed." +
+					" (default: less than 5)",
+			},
+
+			cli.IntFlag{
+				Name:  "max-parallel-copy",
+				Value: 16,
+				Usage: "Number of parts to copy in parallel when copying large objects," +
+					" also limits the HEADs made for a directory listing.",
+			},
+
+			cli.IntFlag{
+				Name:  "memory-limit",
+				Value: 1000,
+				Usage: "Size in MB of all the write and read ahead buffers, a multiple of 5." +
+					" Every file being written holds at least 5MB until it's closed," +
+					" writes block when this runs out. (default: 1000)",
+			},
+
+			cli.IntFlag{
+				Name:  "handle-memory-limit",
+				Value: 200,
+				Usage: "Size in MB of the buffers one open file can use, a multiple of 5." +
+					" Random writes beyond this are staged on disk. (default: 200)",
+			},
+
+			cli.DurationFlag{
+				Name:  "flush-interval",
+				Value: 0,
+				Usage: "Complete the upload of a file that's still open once it hasn't been" +
+					" written to for this long, so slow writers don't lose everything" +
+					" if goofys dies. Each flush makes a new version of the object. (default: off)",
+			},
+
+			cli.BoolFlag{
+				Name: "writeback-cache",
+				Usage: "Let the kernel collect small writes in the page cache and send them" +
+					" to us in larger pieces, instead of one request for each write(2)" +
+					" of programs that write a few bytes at a time. The kernel then keeps" +
+					" its own size and mtime for a file while it has writes cached, so" +
+					" changes made elsewhere show up later. Needs Linux 3.15 or newer.",
+			},
+
+			cli.IntFlag{
+				Name:  "max-idle-conns-per-host",
+				Value: 1000,
+				Usage: "Number of idle connections to S3 to keep open, enough for all" +
+					" the parallel requests so they don't have to reconnect.",
+			},
+
+			cli.DurationFlag{
+				Name:  "dial-timeout",
+				Value: 30 * time.Second,
+				Usage: "How long to wait to connect to S3.",
+			},
+
+			cli.DurationFlag{
+				Name:  "response-header-timeout",
+				Value: time.Minute,
+				Usage: "How long to wait for S3 to respond once a request is sent, 0 for no limit.",
+			},
+
+			cli.BoolFlag{
+				Name:  "disable-http2",
+				Usage: "Only talk HTTP/1.1 to S3.",
+			},
+
+			cli.IntFlag{
+				Name:  "max-read-bps",
+				Usage: "Bytes per second to receive from S3 at most, over all files. (default: off)",
+			},
+
+			cli.IntFlag{
+				Name:  "max-write-bps",
+				Usage: "Bytes per second to send to S3 at most, over all files. (default: off)",
+			},
+
+			cli.IntFlag{
+				Name:  "read-ahead",
+				Value: 20,
+				Usage: "How far ahead in MB to read when a file is read sequentially," +
+					" 0 to disable (default: 20).",
+			},
+
+			cli.IntFlag{
+				Name:  "read-ahead-streams",
+				Value: 4,
+				Usage: "Number of parallel requests used to read ahead.",
+			},
+
+			cli.DurationFlag{
+				Name:  "request-timeout",
+				Value: 0,
+				Usage: "Give up on an S3 request that takes longer than this and retry it." +
+					" Reads only wait this long for the response to start. (default: off)",
+			},
+
+			cli.IntFlag{
+				Name:  "max-retries",
+				Value: 3,
+				Usage: "How many times to retry a failed S3 request that might succeed" +
+					" if tried again (throttling, server errors, timeouts).",
+			},
+
+			cli.IntFlag{
+				Name:  "max-dir-entries",
+				Value: 0,
+				Usage: "Stop listing a directory after this many entries, 0 for no limit.",
+			},
+
+			cli.BoolFlag{
+				Name: "presorted-listings",
+				Usage: "Merge the directories and files S3 lists in order instead of" +
+					" sorting every page of a directory listing.",
+			},
+
+			cli.IntFlag{
+				Name:  "list-page-size",
+				Value: 0,
+				Usage: "How many entries to ask for in the first page of a directory listing." +
+					" The pages after it grow up to 1000, what S3 allows. (default: 1000 for every page)",
+			},
+
+			cli.IntFlag{
+				Name:  "coalesce-window",
+				Value: 0,
+				Usage: "Size in KB of the range to GET when small random reads of a file are" +
+					" close together, so the reads around them are served from memory." +
+					" (default: off)",
+			},
+
+			cli.IntFlag{
+				Name:  "coalesce-max-over-read",
+				Value: 256,
+				Usage: "How much more in KB than a read asked for --coalesce-window may GET.",
+			},
+
+			cli.IntFlag{
+				Name:  "prewarm-depth",
+				Value: 0,
+				Usage: "List this many levels of directories in the background when mounting," +
+					" so listing them is fast until --type-cache-ttl is up. (default: off)",
+			},
+
+			cli.DurationFlag{
+				Name:  "usage-refresh",
+				Value: 0,
+				Usage: "How often to list the whole mount to report real usage in statfs." +
+					" This is expensive for big buckets. (default: off)",
+			},
+
+			cli.DurationFlag{
+				Name:  "dir-size-ttl",
+				Value: 0,
+				Usage: "Report the total size of what's under a directory as its size," +
+					" and keep it this long. Adding it up lists everything under the" +
+					" directory, which is expensive for big ones. This is for stat and" +
+					" ls -l, du adds the files up again and counts them more than once." +
+					" (default: off)",
+			},
+
+			cli.StringFlag{
+				Name:  "cache-dir",
+				Value: "",
+				Usage: "Keep objects that were read from start to end in this directory," +
+					" and read them from there until they change (default: off).",
+			},
+
+			cli.IntFlag{
+				Name:  "cache-max-size",
+				Value: 1024,
+				Usage: "How big --cache-dir can get in MB, the least recently" +
+					" used objects are removed first (default: 1024).",
+			},
+
 			cli.DurationFlag{
 				Name:  "stat-cache-ttl",
 				Value: time.Minute,
-				Usage: "How long to cache StatObject results and inode attributes.",
+				Usage: "How long to cache StatObject results and inode attributes," +
+					" 0 to ask S3 every time.",
 			},
 
 			cli.DurationFlag{
@@ -150,6 +610,25 @@ func NewApp() (app *cli.App) {
 				Name:  "debug_s3",
 				Usage: "Enable S3-related debugging output.",
 			},
+
+			cli.StringFlag{
+				Name:  "audit-log",
+				Value: "",
+				Usage: "Append a JSON line to this file for every request that changes the bucket.",
+			},
+
+			cli.BoolFlag{
+				Name: "audit-dry-run",
+				Usage: "With --audit-log, log requests that would change the bucket" +
+					" instead of sending them. They fail as if it were read-only.",
+			},
+
+			cli.StringFlag{
+				Name:  "metrics-addr",
+				Value: "",
+				Usage: "Serve Prometheus metrics on this address, e.g. :9090, and" +
+					" counts of inodes and handles on /debug/inodes. (default: off)",
+			},
 		},
 	}
 
@@ -161,21 +640,93 @@ type FlagStorage struct {
 	MountOptions map[string]string
 	DirMode      os.FileMode
 	FileMode     os.FileMode
+	Umask        os.FileMode
+	ExecSuffixes []string
 	Uid          uint32
 	Gid          uint32
+	ReadOnly     bool
+	PosixAttrs   bool
+	ListSymlinks bool
+	Xattr        bool
+	Gunzip       bool
+	MaxReadSize  int64
+	MaxWriteSize int64
 
 	// S3
-	Endpoint       string
-	StorageClass   string
-	UsePathRequest bool
+	Prefix             string
+	Region             string
+	Endpoint           string
+	StorageClass       string
+	StorageClassRules  string
+	RestoreDays        int
+	UsePathRequest     bool
+	SignatureV2        bool
+	CABundlePath       string
+	InsecureTLS        bool
+	UseV2List          bool
+	UseSSE             bool
+	UseKMS             bool
+	KMSKeyID           string
+	ACL                string
+	Tagging            string
+	NoContentType      bool
+	CacheControl       string
+	ContentDisposition string
+	NoDirMarkers       bool
+	HeadFallback       bool
+	Versions           bool
+	MetadataFiles      bool
+	CaseInsensitive    bool
+	ConditionalWrites  bool
+	VerifyChecksums    bool
+	Probe              bool
+	MultiBucket        bool
+	ObjectLockMode     string
+	RetentionPeriod    time.Duration
+	CredentialProcess  string
+	Anonymous          bool
+	RoleARN            string
+	RoleExternalID     string
+	RoleSessionName    string
+	CleanupUploads     time.Duration
 
 	// Tuning
-	StatCacheTTL time.Duration
-	TypeCacheTTL time.Duration
+	PartSize              int64
+	SinglePutSize         int64
+	MaxParallelCopy       int
+	MemoryLimit           int64
+	HandleMemoryLimit     int64
+	FlushInterval         time.Duration
+	WritebackCache        bool
+	MaxIdleConnsPerHost   int
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	DisableHTTP2          bool
+	MaxReadBps            int64
+	MaxWriteBps           int64
+	ReadAheadSize         int64
+	ReadAheadStreams      int
+	RequestTimeout        time.Duration
+	MaxRetries            int
+	UsageRefresh          time.Duration
+	DirSizeTTL            time.Duration
+	MaxDirEntries         int
+	ListPageSize          int
+	PresortedListings     bool
+	CoalesceWindow        int64
+	CoalesceMaxOverRead   int64
+	PrewarmDepth          int
+	StatCacheTTL          time.Duration
+	TypeCacheTTL          time.Duration
+	CacheDir              string
+	CacheMaxSize          int64
 
 	// Debugging
-	DebugFuse bool
-	DebugS3   bool
+	DebugFuse   bool
+	DebugS3     bool
+	AuditLog    string
+	AuditDryRun bool
+	MetricsAddr string
 }
 
 func parseOptions(m map[string]string, s string) {
@@ -203,32 +754,141 @@ func parseOptions(m map[string]string, s string) {
 
 // Add the flags accepted by run to the supplied flag set, returning the
 // variables into which the flags will parse.
-func PopulateFlags(c *cli.Context) (flags *FlagStorage) {
+func PopulateFlags(c *cli.Context) (flags *FlagStorage, err error) {
 	flags = &FlagStorage{
 		// File system
 		MountOptions: make(map[string]string),
 		DirMode:      os.FileMode(c.Int("dir-mode")),
 		FileMode:     os.FileMode(c.Int("file-mode")),
+		Umask:        os.FileMode(c.Int("umask")),
 		Uid:          uint32(c.Int("uid")),
 		Gid:          uint32(c.Int("gid")),
+		ReadOnly:     c.Bool("read-only"),
+		PosixAttrs:   c.Bool("posix-attrs"),
+		ListSymlinks: c.Bool("list-symlinks"),
+		Xattr:        c.Bool("xattr"),
+		Gunzip:       c.Bool("gunzip"),
+		MaxReadSize:  int64(c.Int("max-read-size")) * 1024 * 1024,
+		MaxWriteSize: int64(c.Int("max-write-size")) * 1024 * 1024,
 
 		// Tuning,
-		StatCacheTTL: c.Duration("stat-cache-ttl"),
-		TypeCacheTTL: c.Duration("type-cache-ttl"),
+		PartSize:              int64(c.Int("part-size")) * 1024 * 1024,
+		SinglePutSize:         int64(c.Int("single-put-size")) * 1024 * 1024,
+		MaxParallelCopy:       c.Int("max-parallel-copy"),
+		MemoryLimit:           int64(c.Int("memory-limit")) * 1024 * 1024,
+		HandleMemoryLimit:     int64(c.Int("handle-memory-limit")) * 1024 * 1024,
+		FlushInterval:         c.Duration("flush-interval"),
+		WritebackCache:        c.Bool("writeback-cache"),
+		MaxIdleConnsPerHost:   c.Int("max-idle-conns-per-host"),
+		DialTimeout:           c.Duration("dial-timeout"),
+		ResponseHeaderTimeout: c.Duration("response-header-timeout"),
+		DisableHTTP2:          c.Bool("disable-http2"),
+		MaxReadBps:            int64(c.Int("max-read-bps")),
+		MaxWriteBps:           int64(c.Int("max-write-bps")),
+		ReadAheadSize:         int64(c.Int("read-ahead")) * 1024 * 1024,
+		ReadAheadStreams:      c.Int("read-ahead-streams"),
+		RequestTimeout:        c.Duration("request-timeout"),
+		MaxRetries:            c.Int("max-retries"),
+		UsageRefresh:          c.Duration("usage-refresh"),
+		DirSizeTTL:            c.Duration("dir-size-ttl"),
+		MaxDirEntries:         c.Int("max-dir-entries"),
+		ListPageSize:          c.Int("list-page-size"),
+		PresortedListings:     c.Bool("presorted-listings"),
+		CoalesceWindow:        int64(c.Int("coalesce-window")) * 1024,
+		CoalesceMaxOverRead:   int64(c.Int("coalesce-max-over-read")) * 1024,
+		PrewarmDepth:          c.Int("prewarm-depth"),
+		StatCacheTTL:          c.Duration("stat-cache-ttl"),
+		TypeCacheTTL:          c.Duration("type-cache-ttl"),
+		CacheDir:              c.String("cache-dir"),
+		CacheMaxSize:          int64(c.Int("cache-max-size")) * 1024 * 1024,
 
 		// S3
-		Endpoint:       c.String("endpoint"),
-		StorageClass:   c.String("storage-class"),
-		UsePathRequest: c.Bool("use-path-request"),
+		Region:             c.String("region"),
+		Endpoint:           c.String("endpoint"),
+		StorageClass:       c.String("storage-class"),
+		StorageClassRules:  c.String("storage-class-rules"),
+		RestoreDays:        c.Int("restore-days"),
+		UsePathRequest:     c.Bool("use-path-request"),
+		SignatureV2:        c.Bool("signature-v2"),
+		CABundlePath:       c.String("ca-bundle"),
+		InsecureTLS:        c.Bool("insecure-tls"),
+		UseV2List:          c.Bool("use-list-v2"),
+		UseSSE:             c.Bool("sse"),
+		UseKMS:             c.Bool("sse-kms") || c.String("sse-kms-key-id") != "",
+		KMSKeyID:           c.String("sse-kms-key-id"),
+		ACL:                c.String("acl"),
+		Tagging:            c.String("tagging"),
+		NoContentType:      c.Bool("no-content-type"),
+		CacheControl:       c.String("cache-control"),
+		ContentDisposition: c.String("content-disposition"),
+		NoDirMarkers:       c.Bool("no-dir-markers"),
+		HeadFallback:       c.Bool("head-fallback"),
+		Versions:           c.Bool("versions"),
+		MetadataFiles:      c.Bool("metadata-files"),
+		CaseInsensitive:    c.Bool("case-insensitive"),
+		ConditionalWrites:  c.Bool("conditional-writes"),
+		VerifyChecksums:    c.Bool("verify-checksums"),
+		Probe:              c.Bool("probe"),
+		MultiBucket:        c.Bool("multi-bucket"),
+		ObjectLockMode:     c.String("object-lock-mode"),
+		RetentionPeriod:    c.Duration("object-lock-retention"),
+		CredentialProcess:  c.String("credential-process"),
+		Anonymous:          c.Bool("anonymous"),
+		RoleARN:            c.String("role-arn"),
+		RoleExternalID:     c.String("role-external-id"),
+		RoleSessionName:    c.String("role-session-name"),
+		CleanupUploads:     c.Duration("cleanup-uploads"),
 
 		// Debugging,
-		DebugFuse: c.Bool("debug_fuse"),
-		DebugS3:   c.Bool("debug_s3"),
+		DebugFuse:   c.Bool("debug_fuse"),
+		DebugS3:     c.Bool("debug_s3"),
+		AuditLog:    c.String("audit-log"),
+		AuditDryRun: c.Bool("audit-dry-run"),
+		MetricsAddr: c.String("metrics-addr"),
 	}
 
 	// Handle the repeated "-o" flag.
 	for _, o := range c.StringSlice("o") {
 		parseOptions(flags.MountOptions, o)
 	}
+	for _, suffix := range strings.Split(c.String("exec-suffixes"), ",") {
+		if suffix = strings.TrimSpace(suffix); len(suffix) != 0 {
+			flags.ExecSuffixes = append(flags.ExecSuffixes, suffix)
+		}
+	}
+	if _, ok := flags.MountOptions["ro"]; ok {
+		flags.ReadOnly = true
+	}
+
+	// 0 is the default
+	if flags.PartSize != 0 {
+		if err = checkPartSize(flags.PartSize); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Parse command line flags without the bucket and mount point, for
+// mounting from Go. Flags that aren't given get the same defaults as
+// on the command line.
+func ParseFlags(args []string) (flags *FlagStorage, err error) {
+	app := NewApp()
+	app.Writer = ioutil.Discard
+	app.Action = func(c *cli.Context) {
+		if len(c.Args()) != 0 {
+			err = fmt.Errorf("unexpected arguments: %v", c.Args())
+			return
+		}
+		flags, err = PopulateFlags(c)
+	}
+
+	runErr := app.Run(append([]string{app.Name}, args...))
+	if runErr != nil {
+		return nil, runErr
+	}
+	if err == nil && flags == nil {
+		err = fmt.Errorf("unable to parse %v", args)
+	}
 	return
 }
@@ -15,18 +15,32 @@
 package internal
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -48,13 +62,15 @@ type Goofys struct {
 
 	flags *FlagStorage
 
-	umask uint32
-
 	awsConfig *aws.Config
 	s3        *s3.S3
+	// what we read and write objects with, see backend.go
+	backend   StorageBackend
 	rootAttrs fuseops.InodeAttributes
 
 	bufferPool *BufferPool
+	uploads    *uploadLimiter
+	deletes    deleteQueue
 
 	// A lock protecting the state of the file system struct itself (distinct
 	// from per-inode locks). Make sure to see the notes on lock ordering above.
@@ -79,59 +95,270 @@ type Goofys struct {
 	inodes      map[fuseops.InodeID]*Inode
 	inodesCache map[string]*Inode // fullname to inode
 
+	// fullname to when we can stop believing it doesn't exist. This
+	// is independent from inodes so ForgetInode doesn't touch it.
+	//
+	// GUARDED_BY(mu)
+	negativeCache map[string]time.Time
+
+	// fullname to the lookup that's going to S3 for it, lookups of
+	// the same name wait for that one instead of going themselves
+	//
+	// GUARDED_BY(mu)
+	lookups map[string]*lookupCall
+
+	// with flags.CaseInsensitive, fullname to the key it turned out
+	// to be when case is ignored
+	//
+	// GUARDED_BY(mu)
+	caseNames map[string]string
+
+	// nil unless we report real usage in StatFS
+	usage *usageStats
+
+	// nil unless flags.NoDirMarkers
+	localDirs *localDirs
+
+	// nil unless flags.CacheDir
+	diskCache *diskCache
+
+	// nil unless flags.DirSizeTTL
+	dirSizes *dirSizes
+
+	// listings from flags.PrewarmDepth, nil without it
+	prewarmed *prewarmedDirs
+
+	// from flags.StorageClassRules, in order
+	storageClassRules []storageClassRule
+
+	// MAX_PARTS and WRITE_PART_GROWTH, which tests lower so they
+	// can go past MAX_PARTS without writing 50GB
+	maxParts   int
+	partGrowth int
+
 	nextHandleID fuseops.HandleID
 	dirHandles   map[fuseops.HandleID]*DirHandle
 
 	fileHandles map[fuseops.HandleID]*FileHandle
 }
 
+// What the Goofys of every bucket of a MultiBucket share, so that
+// --memory-limit and --cache-max-size are for all of them together.
+type sharedResources struct {
+	bufferPool *BufferPool
+	uploads    *uploadLimiter
+	// nil unless flags.CacheDir
+	diskCache *diskCache
+}
+
+// flags have to have been through checkMemoryLimits.
+func newSharedResources(flags *FlagStorage) (shared *sharedResources, err error) {
+	shared = &sharedResources{
+		bufferPool: NewBufferPool(flags.MemoryLimit, flags.HandleMemoryLimit),
+		uploads:    newUploadLimiter(int(flags.MemoryLimit/BUF_SIZE), flags.DebugS3),
+	}
+
+	if len(flags.CacheDir) != 0 {
+		if flags.CacheMaxSize <= 0 {
+			flags.CacheMaxSize = 1024 * 1024 * 1024
+		}
+		shared.diskCache, err = newDiskCache(flags.CacheDir, flags.CacheMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to use cache dir %v: %v", flags.CacheDir, err)
+		}
+	}
+	return
+}
+
+// Fill in the default memory limits, and check that they make sense.
+func checkMemoryLimits(flags *FlagStorage) error {
+	if flags.MemoryLimit == 0 {
+		flags.MemoryLimit = 1000 * 1024 * 1024
+	}
+	if flags.HandleMemoryLimit == 0 {
+		flags.HandleMemoryLimit = 200 * 1024 * 1024
+	}
+	if flags.MemoryLimit%BUF_SIZE != 0 || flags.HandleMemoryLimit%BUF_SIZE != 0 ||
+		flags.HandleMemoryLimit <= 0 || flags.HandleMemoryLimit > flags.MemoryLimit {
+		return fmt.Errorf("memory limits %v and %v per handle need to be multiples of %v,"+
+			" and per handle can't be more than the total",
+			flags.MemoryLimit, flags.HandleMemoryLimit, BUF_SIZE)
+	}
+	return nil
+}
+
+// NewGoofysWithError, but logs why it failed instead of returning it.
 func NewGoofys(bucket string, awsConfig *aws.Config, flags *FlagStorage) *Goofys {
+	fs, err := NewGoofysWithError(bucket, awsConfig, flags)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	return fs
+}
+
+// Set up a Goofys for bucket. If the bucket is missing or we can't
+// get to it, the error is a *BucketError.
+func NewGoofysWithError(bucket string, awsConfig *aws.Config, flags *FlagStorage) (*Goofys, error) {
+	return newGoofys(bucket, awsConfig, flags, nil, nil)
+}
+
+// NewGoofysWithError, sharing what's in shared instead of making its
+// own if it's not nil. If svc isn't nil it's the client to use, it
+// has to be for the region in flags.
+func newGoofys(bucket string, awsConfig *aws.Config, flags *FlagStorage,
+	shared *sharedResources, svc *s3.S3) (*Goofys, error) {
 	// Set up the basic struct.
 	fs := &Goofys{
 		bucket: bucket,
 		flags:  flags,
-		umask:  0122,
 	}
 
 	if flags.DebugS3 {
 		awsConfig.LogLevel = aws.LogLevel(aws.LogDebug | aws.LogDebugWithRequestErrors)
 	}
 
-	fs.awsConfig = awsConfig
-	fs.s3 = s3.New(awsConfig)
+	if flags.DirMode&^os.ModePerm != 0 || flags.FileMode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("dir mode %o and file mode %o can only have permission bits",
+			uint32(flags.DirMode), uint32(flags.FileMode))
+	}
+	if flags.Umask&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("umask %o can only have permission bits", uint32(flags.Umask))
+	}
 
-	params := &s3.GetBucketLocationInput{Bucket: &bucket}
-	resp, err := fs.s3.GetBucketLocation(params)
-	var fromRegion, toRegion string
-	if err != nil {
-		if mapAwsError(err) == fuse.ENOENT {
-			log.Printf("bucket %v does not exist", bucket)
-			return nil
+	if flags.PartSize == 0 {
+		flags.PartSize = 128 * 1024 * 1024
+	}
+	if err := checkPartSize(flags.PartSize); err != nil {
+		return nil, err
+	}
+
+	if flags.ACL != "" && !CANNED_ACLS[flags.ACL] {
+		return nil, fmt.Errorf("invalid canned ACL: %v", flags.ACL)
+	}
+
+	if flags.Tagging != "" {
+		if err := validateTagging(flags.Tagging); err != nil {
+			return nil, fmt.Errorf("invalid tagging %v: %v", flags.Tagging, err)
 		}
-		fromRegion, toRegion = parseRegionError(err)
-	} else {
-		fs.logS3(resp)
+	}
 
-		if resp.LocationConstraint == nil {
-			toRegion = "us-east-1"
-		} else {
-			toRegion = *resp.LocationConstraint
+	if flags.StorageClassRules != "" {
+		rules, err := parseStorageClassRules(flags.StorageClassRules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage class rules %v: %v", flags.StorageClassRules, err)
 		}
+		fs.storageClassRules = rules
+	}
 
-		fromRegion = *awsConfig.Region
+	if err := checkMemoryLimits(flags); err != nil {
+		return nil, err
 	}
 
-	if len(toRegion) != 0 && fromRegion != toRegion {
-		log.Printf("Switching from region '%v' to '%v'", fromRegion, toRegion)
-		awsConfig.Region = &toRegion
+	if flags.SinglePutSize < 0 || flags.SinglePutSize+BUF_SIZE > flags.HandleMemoryLimit {
+		return nil, fmt.Errorf("single PUT size %v has to fit in the %v a handle may use",
+			flags.SinglePutSize, flags.HandleMemoryLimit)
+	}
+
+	if flags.MaxReadSize < 0 || flags.MaxWriteSize < 0 {
+		return nil, fmt.Errorf("max read size %v and max write size %v can't be negative",
+			flags.MaxReadSize, flags.MaxWriteSize)
+	}
+
+	if flags.ListPageSize > LIST_MAX_KEYS {
+		return nil, fmt.Errorf("list page size %v is more than %v", flags.ListPageSize, LIST_MAX_KEYS)
+	}
+
+	if flags.ObjectLockMode != "" || flags.RetentionPeriod != 0 {
+		flags.ObjectLockMode = strings.ToUpper(flags.ObjectLockMode)
+		if !OBJECT_LOCK_MODES[flags.ObjectLockMode] || flags.RetentionPeriod <= 0 {
+			return nil, fmt.Errorf("object lock needs a mode of GOVERNANCE or COMPLIANCE,"+
+				" and a retention: %v %v", flags.ObjectLockMode, flags.RetentionPeriod)
+		}
+	}
+
+	if flags.CoalesceWindow > 0 && flags.CoalesceMaxOverRead < 0 {
+		return nil, fmt.Errorf("--coalesce-max-over-read can't be negative: %v",
+			flags.CoalesceMaxOverRead/1024)
+	}
+
+	if flags.ReadAheadSize > 0 && flags.ReadAheadStreams <= 0 {
+		flags.ReadAheadStreams = 4
+	}
+
+	if flags.MaxParallelCopy <= 0 {
+		flags.MaxParallelCopy = 16
+	}
+
+	if flags.Anonymous {
+		if len(flags.CredentialProcess) != 0 || len(flags.RoleARN) != 0 {
+			return nil, fmt.Errorf("--anonymous can't be used with --credential-process or --role-arn")
+		}
+		// nobody is allowed to write without credentials
+		if !flags.ReadOnly {
+			log.Printf("--anonymous: mounting %v read-only", bucket)
+			flags.ReadOnly = true
+		}
+	}
+
+	if err := configureAws(awsConfig, flags); err != nil {
+		return nil, err
+	}
+
+	fs.awsConfig = awsConfig
+	if svc != nil {
+		fs.s3 = svc
+	} else {
 		fs.s3 = s3.New(awsConfig)
-		_, err = fs.s3.GetBucketLocation(params)
+		if flags.SignatureV2 {
+			useSignatureV2(fs.s3, bucket)
+		}
+	}
+
+	var err error
+	if len(flags.Endpoint) != 0 {
+		// not AWS, regions don't mean anything and
+		// GetBucketLocation may not even be implemented
+		err = fs.checkBucket()
+	} else if len(flags.Region) != 0 {
+		// trust it, we might not be allowed to
+		// GetBucketLocation
+	} else if flags.SignatureV2 {
+		// V2 signatures don't have a region to get wrong,
+		// and switching regions would lose the signer
+		err = fs.checkBucket()
+	} else if flags.Anonymous {
+		// only the bucket owner can GetBucketLocation
+		err = fs.detectBucketRegionAnonymously()
+	} else {
+		err = fs.detectBucketRegion()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if svc == nil {
+		// one that's passed in already is
+		instrumentS3(fs.s3)
+	}
+	fs.backend = &s3Backend{fs: fs, svc: fs.s3}
+
+	if flags.ObjectLockMode != "" || flags.VerifyChecksums {
+		// Object Lock requires it too
+		fs.s3.Handlers.Build.PushBack(contentMD5)
+	}
+	if flags.ObjectLockMode != "" {
+		fs.useObjectLock()
+	}
+
+	if flags.AuditLog != "" {
+		audit, err := openAuditLog(flags.AuditLog, flags.AuditDryRun)
 		if err != nil {
-			log.Println(err)
-			return nil
+			return nil, fmt.Errorf("Unable to open audit log: %v", err)
 		}
-	} else if len(toRegion) == 0 && *awsConfig.Region != "milkyway" {
-		log.Printf("Unable to detect bucket region, staying at '%v'", *awsConfig.Region)
+		audit.instrument(fs.s3, bucket)
+	} else if flags.AuditDryRun {
+		return nil, fmt.Errorf("--audit-dry-run needs --audit-log")
 	}
 
 	now := time.Now()
@@ -147,23 +374,66 @@ func NewGoofys(bucket string, awsConfig *aws.Config, flags *FlagStorage) *Goofys
 		Gid:    fs.flags.Gid,
 	}
 
-	fs.bufferPool = NewBufferPool(1000*1024*1024, 200*1024*1024)
+	if shared == nil {
+		shared, err = newSharedResources(flags)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fs.bufferPool = shared.bufferPool
+	fs.uploads = shared.uploads
+	fs.diskCache = shared.diskCache
+	fs.maxParts = MAX_PARTS
+	fs.partGrowth = WRITE_PART_GROWTH
 
 	fs.nextInodeID = fuseops.RootInodeID + 1
 	fs.inodes = make(map[fuseops.InodeID]*Inode)
-	root := NewInode(aws.String(""), aws.String(""), flags)
+	// the root's full name is the prefix, so everything below
+	// it gets the prefix too
+	flags.Prefix = strings.Trim(flags.Prefix, "/")
+	root := NewInode(aws.String(""), aws.String(flags.Prefix), flags)
 	root.Id = fuseops.RootInodeID
 	root.Attributes = &fs.rootAttrs
 
 	fs.inodes[fuseops.RootInodeID] = root
 	fs.inodesCache = make(map[string]*Inode)
+	fs.negativeCache = make(map[string]time.Time)
+	fs.lookups = make(map[string]*lookupCall)
+	fs.caseNames = make(map[string]string)
 
 	fs.nextHandleID = 1
 	fs.dirHandles = make(map[fuseops.HandleID]*DirHandle)
 
 	fs.fileHandles = make(map[fuseops.HandleID]*FileHandle)
 
-	return fs
+	if flags.Probe {
+		err = fs.probe()
+		if err != nil {
+			return nil, fmt.Errorf("probe failed: %v", err)
+		}
+	}
+
+	go fs.sweeper()
+
+	if flags.UsageRefresh > 0 {
+		fs.usage = newUsageStats()
+		go fs.refreshUsage()
+	}
+
+	if flags.NoDirMarkers {
+		fs.localDirs = newLocalDirs()
+	}
+
+	if flags.DirSizeTTL > 0 {
+		fs.dirSizes = newDirSizes(flags.DirSizeTTL)
+	}
+
+	if flags.PrewarmDepth > 0 && flags.TypeCacheTTL > 0 {
+		fs.prewarmed = newPrewarmedDirs()
+		go fs.prewarm(flags.PrewarmDepth)
+	}
+
+	return fs, nil
 }
 
 // Find the given inode. Panic if it doesn't exist.
@@ -178,6 +448,36 @@ func (fs *Goofys) getInodeOrDie(id fuseops.InodeID) (inode *Inode) {
 	return
 }
 
+// Find the given file handle. A kernel that asks about a handle we
+// don't have is confused, but that's no reason to take down the
+// whole mount.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) getFileHandle(op string, id fuseops.HandleID) (fh *FileHandle, err error) {
+	fs.mu.Lock()
+	fh = fs.fileHandles[id]
+	fs.mu.Unlock()
+
+	if fh == nil {
+		log.Printf("%v: unknown file handle %v", op, id)
+		err = syscall.EBADF
+	}
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) getDirHandle(op string, id fuseops.HandleID) (dh *DirHandle, err error) {
+	fs.mu.Lock()
+	dh = fs.dirHandles[id]
+	fs.mu.Unlock()
+
+	if dh == nil {
+		log.Printf("%v: unknown dir handle %v", op, id)
+		err = syscall.EBADF
+	}
+	return
+}
+
 func (fs *Goofys) logFuse(op string, args ...interface{}) {
 	if fs.flags.DebugFuse {
 		log.Printf("%v: %v", op, args)
@@ -205,6 +505,21 @@ func (fs *Goofys) StatFS(
 	op.IoSize = 1 * 1024 * 1024 // 1MB
 	op.Inodes = INODES
 	op.InodesFree = INODES
+
+	if fs.usage != nil {
+		bytes, objects := fs.usage.get()
+		used := (bytes + BLOCK_SIZE - 1) / BLOCK_SIZE
+		if used > TOTAL_BLOCKS {
+			used = TOTAL_BLOCKS
+		}
+		if objects > INODES {
+			objects = INODES
+		}
+
+		op.BlocksFree = TOTAL_BLOCKS - used
+		op.BlocksAvailable = op.BlocksFree
+		op.InodesFree = INODES - objects
+	}
 	return
 }
 
@@ -217,9 +532,297 @@ func (fs *Goofys) GetInodeAttributes(
 	fs.mu.Unlock()
 
 	attr, err := inode.GetAttributes(fs)
+	if err != nil {
+		return err
+	}
+
 	op.Attributes = *attr
-	op.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	op.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+
+	return
+}
+
+// The default client only keeps 2 idle connections per host, which
+// means most of our parallel requests have to reconnect.
+func newHTTPClient(flags *FlagStorage) (client *http.Client, err error) {
+	tlsConfig, err := newTLSConfig(flags)
+	if err != nil {
+		return
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           http.ProxyFromEnvironment,
+		Dial: throttleDial(flags, (&net.Dialer{
+			Timeout:   flags.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial),
+		TLSHandshakeTimeout:   10 * time.Second,
+		MaxIdleConnsPerHost:   flags.MaxIdleConnsPerHost,
+		ResponseHeaderTimeout: flags.ResponseHeaderTimeout,
+	}
+
+	if flags.DisableHTTP2 {
+		// a non-nil map is how to turn it off
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	} else {
+		// setting Dial stops net/http from doing this by itself
+		err := http2.ConfigureTransport(transport)
+		if err != nil {
+			log.Printf("Unable to enable HTTP/2: %v", err)
+		}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// nil means the defaults
+func newTLSConfig(flags *FlagStorage) (config *tls.Config, err error) {
+	if flags.InsecureTLS {
+		log.Printf("WARNING: not verifying certificates, anyone in between can" +
+			" read and change what's stored")
+		config = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	if len(flags.CABundlePath) != 0 {
+		pem, err := ioutil.ReadFile(flags.CABundlePath)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			// not available on windows
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %v", flags.CABundlePath)
+		}
+
+		if config == nil {
+			config = &tls.Config{}
+		}
+		config.RootCAs = pool
+	}
+
+	return
+}
+
+// Point awsConfig at the endpoint and credentials that flags ask for.
+func configureAws(awsConfig *aws.Config, flags *FlagStorage) error {
+	if flags.MaxIdleConnsPerHost <= 0 {
+		flags.MaxIdleConnsPerHost = 1000
+	}
+	if flags.DialTimeout <= 0 {
+		flags.DialTimeout = 30 * time.Second
+	}
+	// fs.retry does the retrying, the SDK's would retry each of
+	// its tries again
+	awsConfig.MaxRetries = aws.Int(0)
+
+	if awsConfig.HTTPClient == nil {
+		client, err := newHTTPClient(flags)
+		if err != nil {
+			return fmt.Errorf("Unable to set up HTTP client: %v", err)
+		}
+		awsConfig.HTTPClient = client
+	} else if flags.MaxReadBps > 0 || flags.MaxWriteBps > 0 {
+		return fmt.Errorf("--max-read-bps and --max-write-bps only limit the HTTP client" +
+			" we make, not one that's passed in")
+	}
+
+	if len(flags.Endpoint) != 0 {
+		awsConfig.Endpoint = &flags.Endpoint
+	}
+	if len(flags.Region) != 0 {
+		awsConfig.Region = &flags.Region
+	}
+	if flags.UsePathRequest {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	if flags.Anonymous {
+		// the SDK doesn't sign anything with these
+		awsConfig.Credentials = credentials.AnonymousCredentials
+		return nil
+	}
+
+	if err := useCredentialProcess(awsConfig, flags); err != nil {
+		return fmt.Errorf("Unable to get credentials: %v", err)
+	}
+
+	if len(flags.RoleARN) != 0 {
+		if len(flags.RoleSessionName) == 0 {
+			flags.RoleSessionName = "goofys"
+		}
+		err := assumeRole(awsConfig, flags)
+		if err != nil {
+			return fmt.Errorf("Unable to assume role %v: %v", flags.RoleARN, err)
+		}
+	}
+
+	return nil
+}
+
+// Use temporary credentials of flags.RoleARN, obtained with whatever
+// credentials awsConfig had. The SDK renews them before they expire.
+func assumeRole(awsConfig *aws.Config, flags *FlagStorage) (err error) {
+	// STS is always AWS even if S3 isn't
+	stsConfig := *awsConfig
+	stsConfig.Endpoint = nil
+	stsConfig.S3ForcePathStyle = nil
+	// nothing else retries renewing them
+	stsConfig.MaxRetries = nil
+
+	provider := &stscreds.AssumeRoleProvider{
+		Client:          sts.New(&stsConfig),
+		RoleARN:         flags.RoleARN,
+		RoleSessionName: flags.RoleSessionName,
+	}
+	if len(flags.RoleExternalID) != 0 {
+		provider.ExternalID = &flags.RoleExternalID
+	}
+
+	creds := credentials.NewCredentials(provider)
+
+	// fail now rather than on the first request
+	_, err = creds.Get()
+	if err != nil {
+		return mapAwsError(err)
+	}
+
+	awsConfig.Credentials = creds
+	return
+}
+
+// Why we couldn't mount a bucket.
+type BucketError struct {
+	Bucket string
+	// empty for AWS
+	Endpoint string
+	// fuse.ENOENT if it doesn't exist, syscall.EACCES if we are
+	// not allowed to get to it, or what else went wrong after
+	// retrying
+	Err error
+}
+
+func (e *BucketError) Error() string {
+	where := e.Bucket
+	if e.Endpoint != "" {
+		where += " at " + e.Endpoint
+	}
+
+	switch e.Err {
+	case fuse.ENOENT:
+		return fmt.Sprintf("bucket %v does not exist", where)
+	case syscall.EACCES:
+		return fmt.Sprintf("access denied to bucket %v, check the credentials"+
+			" and the bucket policy", where)
+	default:
+		return fmt.Sprintf("unable to access bucket %v: %v", where, e.Err)
+	}
+}
+
+func (fs *Goofys) bucketError(err error) *BucketError {
+	err = mapAwsError(err)
+	if err == syscall.ENXIO {
+		// NoSuchBucket, which is ENOENT when it's the bucket
+		// we are asking about
+		err = fuse.ENOENT
+	}
+	return &BucketError{Bucket: fs.bucket, Endpoint: fs.flags.Endpoint, Err: err}
+}
+
+// Find out where the bucket is and switch fs.s3 to that region.
+func (fs *Goofys) detectBucketRegion() (err error) {
+	params := &s3.GetBucketLocationInput{Bucket: &fs.bucket}
+	var resp *s3.GetBucketLocationOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.s3.GetBucketLocation(params)
+		return
+	})
+	var fromRegion, toRegion string
+	if err != nil {
+		bucketErr := fs.bucketError(err)
+		switch bucketErr.Err {
+		case fuse.ENOENT:
+			return bucketErr
+		case syscall.EACCES:
+			// only the bucket owner can GetBucketLocation,
+			// that doesn't mean we can't use it
+			log.Printf("Not allowed to get the region of bucket %v, staying at '%v'",
+				fs.bucket, *fs.awsConfig.Region)
+			return fs.checkBucket()
+		}
+		fromRegion, toRegion = parseRegionError(err)
+		err = nil
+	} else {
+		fs.logS3(resp)
+
+		toRegion = locationRegion(resp.LocationConstraint)
 
+		fromRegion = *fs.awsConfig.Region
+	}
+
+	if len(toRegion) != 0 && fromRegion != toRegion {
+		log.Printf("Switching from region '%v' to '%v'", fromRegion, toRegion)
+		fs.awsConfig.Region = &toRegion
+		fs.s3 = s3.New(fs.awsConfig)
+		err = fs.retry(func() (err error) {
+			_, err = fs.s3.GetBucketLocation(params)
+			return
+		})
+		if err != nil {
+			return fs.bucketError(err)
+		}
+	} else if len(toRegion) == 0 && *fs.awsConfig.Region != "milkyway" {
+		log.Printf("Unable to detect bucket region, staying at '%v'", *fs.awsConfig.Region)
+	}
+
+	return
+}
+
+// S3 says where a bucket is in the response to a HEAD, even to
+// someone who's not allowed to HEAD it.
+func (fs *Goofys) detectBucketRegionAnonymously() (err error) {
+	var region string
+	err = fs.retry(func() (err error) {
+		req, _ := fs.s3.HeadBucketRequest(&s3.HeadBucketInput{Bucket: &fs.bucket})
+		err = req.Send()
+		if req.HTTPResponse != nil {
+			region = req.HTTPResponse.Header.Get("X-Amz-Bucket-Region")
+		}
+		return
+	})
+	if len(region) == 0 || region == *fs.awsConfig.Region {
+		if err != nil {
+			return fs.bucketError(err)
+		}
+		return
+	}
+
+	log.Printf("Switching from region '%v' to '%v'", *fs.awsConfig.Region, region)
+	fs.awsConfig.Region = &region
+	fs.s3 = s3.New(fs.awsConfig)
+	return fs.checkBucket()
+}
+
+// Make sure the bucket exists and we can get to it, for endpoints
+// that are not AWS and when we can't ask AWS where it is.
+func (fs *Goofys) checkBucket() (err error) {
+	err = fs.retry(func() (err error) {
+		_, err = fs.s3.HeadBucket(&s3.HeadBucketInput{Bucket: &fs.bucket})
+		return
+	})
+	if err != nil {
+		bucketErr := fs.bucketError(err)
+		if bucketErr.Err == syscall.EACCES && fs.flags.HeadFallback {
+			// we may still be allowed to GET what's in it
+			log.Printf("Not allowed to HEAD bucket %v, trying anyway", fs.bucket)
+			return nil
+		}
+		return bucketErr
+	}
 	return
 }
 
@@ -250,13 +853,44 @@ func parseRegionError(err error) (fromRegion, toRegion string) {
 
 func mapAwsError(err error) error {
 	if awsErr, ok := err.(awserr.Error); ok {
+		if isArchived(err) {
+			// see restore.go
+			return syscall.ENODATA
+		}
 		if reqErr, ok := err.(awserr.RequestFailure); ok {
 			// A service error occurred
+			switch reqErr.Code() {
+			case "NoSuchBucket":
+				// the bucket is gone from under us
+				return syscall.ENXIO
+			case "RequestTimeout":
+				// we were too slow sending the body
+				return syscall.ETIMEDOUT
+			case "SlowDown":
+				return syscall.EAGAIN
+			}
+
 			switch reqErr.StatusCode() {
+			case 400:
+				log.Printf("code=%v msg=%v request=%v\n", reqErr.Code(), reqErr.Message(), reqErr.RequestID())
+				return syscall.EINVAL
+			case 403:
+				return syscall.EACCES
 			case 404:
 				return fuse.ENOENT
 			case 405:
 				return syscall.ENOTSUP
+			case 409:
+				// something else is happening to it, like
+				// OperationAborted
+				log.Printf("code=%v msg=%v request=%v\n", reqErr.Code(), reqErr.Message(), reqErr.RequestID())
+				return syscall.EBUSY
+			case 412:
+				// someone else changed it under us
+				return syscall.ESTALE
+			case 503:
+				// still throttled after retrying
+				return syscall.EAGAIN
 			default:
 				log.Printf("code=%v msg=%v request=%v\n", reqErr.Message(), reqErr.StatusCode(), reqErr.RequestID())
 				return reqErr
@@ -271,143 +905,275 @@ func mapAwsError(err error) error {
 	}
 }
 
-func (fs *Goofys) LookUpInodeNotDir(name string, c chan s3.HeadObjectOutput, errc chan error) {
-	params := &s3.HeadObjectInput{Bucket: &fs.bucket, Key: &name}
-	resp, err := fs.s3.HeadObject(params)
+func (fs *Goofys) LookUpInodeNotDir(ctx context.Context, name string, c chan HeadBlobOutput, errc chan error) {
+	var resp *HeadBlobOutput
+	err := fs.retry(func() (err error) {
+		resp, err = fs.backend.HeadBlob(ctx, &HeadBlobInput{Key: name})
+		return
+	})
+	err = mapAwsError(err)
+	if err == syscall.EACCES && fs.flags.HeadFallback {
+		resp, err = fs.headByGet(ctx, name)
+	}
 	if err != nil {
-		errc <- mapAwsError(err)
+		errc <- err
 		return
 	}
 
-	fs.logS3(resp)
 	c <- *resp
 }
 
-func (fs *Goofys) LookUpInodeDir(name string, c chan s3.ListObjectsOutput, errc chan error) {
-	params := &s3.ListObjectsInput{
-		Bucket:    &fs.bucket,
-		Delimiter: aws.String("/"),
+func (fs *Goofys) LookUpInodeDir(ctx context.Context, name string, c chan ListBlobsOutput, errc chan error) {
+	params := &ListBlobsInput{
+		Delimiter: "/",
 		MaxKeys:   aws.Int64(1),
-		Prefix:    aws.String(name + "/"),
+		Prefix:    name + "/",
 	}
 
-	resp, err := fs.s3.ListObjects(params)
+	var resp *ListBlobsOutput
+	err := fs.retry(func() (err error) {
+		resp, err = fs.backend.ListBlobs(ctx, params)
+		return
+	})
 	if err != nil {
 		errc <- mapAwsError(err)
 		return
 	}
 
-	fs.logS3(resp)
 	c <- *resp
 }
 
-func (fs *Goofys) mpuCopyPart(from string, to string, mpuId string, bytes string, part int64, wg *sync.WaitGroup,
-	etag **string, errout *error) {
-
-	defer func() {
-		wg.Done()
-	}()
+func (fs *Goofys) mpuCopyPart(from string, to string, mpuId string, offset int64, size int64,
+	part int64) (etag *string, err error) {
 
-	// XXX use CopySourceIfUnmodifiedSince to ensure that
-	// we are copying from the same object
-	params := &s3.UploadPartCopyInput{
-		Bucket:          &fs.bucket,
-		Key:             &to,
-		CopySource:      &from,
-		UploadId:        &mpuId,
-		CopySourceRange: &bytes,
-		PartNumber:      &part,
+	params := &MultipartBlobCopyInput{
+		Key:        to,
+		UploadId:   mpuId,
+		PartNumber: part,
+		Source:     from,
+		Offset:     offset,
+		Size:       size,
 	}
 
-	fs.logS3(params)
-
-	resp, err := fs.s3.UploadPartCopy(params)
-	if err != nil {
-		*errout = mapAwsError(err)
+	var resp *MultipartBlobAddOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.MultipartBlobCopy(context.Background(), params)
 		return
+	})
+	if err != nil {
+		return nil, mapAwsError(err)
 	}
 
-	*etag = resp.CopyPartResult.ETag
-	return
+	return resp.ETag, nil
+}
+
+const MIN_PART_SIZE = 5 * 1024 * 1024
+const MAX_PART_SIZE = 5 * 1024 * 1024 * 1024
+const MAX_PARTS = 10000
+
+// The most CopyObject copies, bigger objects are copied part by part.
+// This has nothing to do with flags.PartSize, which is only the size
+// of the parts when we do.
+const MAX_COPY_SIZE = 5 * 1024 * 1024 * 1024
+
+func checkPartSize(partSize int64) error {
+	if partSize < MIN_PART_SIZE || partSize > MAX_PART_SIZE {
+		return fmt.Errorf("part size %v is not between %v and %v",
+			partSize, MIN_PART_SIZE, MAX_PART_SIZE)
+	}
+	return nil
 }
 
-func sizeToParts(size int64) int {
-	const PART_SIZE = 5 * 1024 * 1024 * 1024
+// Pick the part size to copy an object of this size, growing
+// flags.PartSize if we would otherwise need more than MAX_PARTS
+func (fs *Goofys) copyPartSize(size int64) int64 {
+	partSize := fs.flags.PartSize
+	for size > partSize*MAX_PARTS && partSize < MAX_PART_SIZE {
+		partSize *= 2
+	}
+
+	if partSize > MAX_PART_SIZE {
+		partSize = MAX_PART_SIZE
+	}
+	return partSize
+}
 
-	nParts := int(size / PART_SIZE)
-	if size%PART_SIZE != 0 {
+func sizeToParts(size int64, partSize int64) int {
+	nParts := int(size / partSize)
+	if size%partSize != 0 {
 		nParts++
 	}
 	return nParts
 }
 
-func (fs *Goofys) mpuCopyParts(size int64, from string, to string, mpuId string,
-	wg *sync.WaitGroup, etags []*string, err *error) {
+// Copy all the parts with at most flags.MaxParallelCopy in flight,
+// skipping the ones that already have an etag. Each part is retried
+// on its own, the first error that's left stops any parts that
+// haven't started yet.
+func (fs *Goofys) mpuCopyParts(size int64, partSize int64, from string, to string, mpuId string,
+	etags []*string) (err error) {
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	parts := make(chan int64)
+
+	for i := 0; i < fs.flags.MaxParallelCopy; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for part := range parts {
+				mu.Lock()
+				failed := err != nil
+				mu.Unlock()
+
+				if failed {
+					continue
+				}
 
-	const PART_SIZE = 5 * 1024 * 1024 * 1024
+				rangeFrom := (part - 1) * partSize
+				rangeTo := rangeFrom + partSize
+				if rangeTo > size {
+					rangeTo = size
+				}
+				etag, partErr := fs.mpuCopyPart(from, to, mpuId, rangeFrom,
+					rangeTo-rangeFrom, part)
+
+				mu.Lock()
+				if partErr != nil {
+					if err == nil {
+						err = partErr
+					}
+				} else {
+					etags[part-1] = etag
+				}
+				mu.Unlock()
+			}
+		}()
+	}
 
-	rangeFrom := int64(0)
-	rangeTo := int64(0)
+	for i := int64(1); i <= int64(len(etags)); i++ {
+		mu.Lock()
+		failed := err != nil
+		done := etags[i-1] != nil
+		mu.Unlock()
 
-	for i := int64(1); rangeTo < size; i++ {
-		rangeFrom = rangeTo
-		rangeTo = i * PART_SIZE
-		if rangeTo > size {
-			rangeTo = size
+		if failed {
+			break
+		}
+		if done {
+			continue
 		}
-		bytes := fmt.Sprintf("bytes=%v-%v", rangeFrom, rangeTo-1)
 
-		wg.Add(1)
-		go fs.mpuCopyPart(from, to, mpuId, bytes, i, wg, &etags[i-1], err)
+		parts <- i
 	}
+
+	close(parts)
+	wg.Wait()
+
+	return
 }
 
-func (fs *Goofys) copyObjectMultipart(size int64, from string, to string, mpuId string) (err error) {
-	var wg sync.WaitGroup
-	nParts := sizeToParts(size)
+// Fill in the etags of the parts of upload mpuId that are already
+// there, so copying them again can be skipped. A part that's not the
+// size we would have copied is left to be copied again.
+func (fs *Goofys) copiedParts(to string, mpuId string, size int64, partSize int64,
+	etags []*string) (err error) {
+
+	var resp *ListMultipartBlobPartsOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.ListMultipartBlobParts(context.Background(),
+			&ListMultipartBlobPartsInput{Key: to, UploadId: mpuId})
+		return
+	})
+	if err != nil {
+		return mapAwsError(err)
+	}
+
+	for _, part := range resp.Parts {
+		i := part.PartNumber - 1
+		if i < 0 || i >= int64(len(etags)) {
+			continue
+		}
+
+		expected := partSize
+		if i == int64(len(etags))-1 {
+			expected = size - i*partSize
+		}
+		if part.Size == expected {
+			etags[i] = part.ETag
+		}
+	}
+	return
+}
+
+// Copy from to to part by part. Without an mpuId we start a new
+// upload, which is aborted if the copy fails so its parts don't
+// linger, and which gets props: the metadata and headers copyHead
+// returned for from, or nil to have us call it. With an mpuId we
+// continue that upload, which already has them, so props is not
+// used, and parts that were copied before are not copied again.
+func (fs *Goofys) copyObjectMultipart(size int64, from string, to string, mpuId string,
+	props *BlobProperties) (err error) {
+	if props == nil && mpuId == "" {
+		head, err := fs.copyHead(from)
+		if err != nil {
+			return err
+		}
+		props = &head.BlobProperties
+	}
+
+	partSize := fs.copyPartSize(size)
+	nParts := sizeToParts(size, partSize)
 	etags := make([]*string, nParts)
 
-	if mpuId == "" {
-		params := &s3.CreateMultipartUploadInput{
-			Bucket:       &fs.bucket,
-			Key:          &to,
-			StorageClass: &fs.flags.StorageClass,
+	if mpuId != "" {
+		err = fs.copiedParts(to, mpuId, size, partSize, etags)
+		if err != nil {
+			return
+		}
+	} else {
+		// unlike CopyBlob, the tags are not copied but are
+		// the ones we give everything we write
+		params := &MultipartBlobBeginInput{
+			Key:            to,
+			BlobProperties: *props,
+			StorageClass:   fs.storageClass(to),
 		}
 
-		resp, err := fs.s3.CreateMultipartUpload(params)
+		var resp *MultipartBlobBeginOutput
+		err = fs.retry(func() (err error) {
+			resp, err = fs.backend.MultipartBlobBegin(context.Background(), params)
+			return
+		})
 		if err != nil {
 			return mapAwsError(err)
 		}
 
-		mpuId = *resp.UploadId
+		mpuId = resp.UploadId
+		defer func() {
+			if err != nil {
+				fs.abortMultipart(to, mpuId)
+			}
+		}()
 	}
 
-	fs.mpuCopyParts(size, from, to, mpuId, &wg, etags, &err)
-	wg.Wait()
+	err = fs.mpuCopyParts(size, partSize, from, to, mpuId, etags)
 
 	if err != nil {
 		return
 	} else {
-		parts := make([]*s3.CompletedPart, nParts)
-		for i := 0; i < nParts; i++ {
-			parts[i] = &s3.CompletedPart{
-				ETag:       etags[i],
-				PartNumber: aws.Int64(int64(i + 1)),
-			}
+		params := &MultipartBlobCommitInput{
+			Key:      to,
+			UploadId: mpuId,
+			ETags:    etags,
 		}
 
-		params := &s3.CompleteMultipartUploadInput{
-			Bucket:   &fs.bucket,
-			Key:      &to,
-			UploadId: &mpuId,
-			MultipartUpload: &s3.CompletedMultipartUpload{
-				Parts: parts,
-			},
-		}
-
-		fs.logS3(params)
-
-		_, err = fs.s3.CompleteMultipartUpload(params)
+		err = fs.retry(func() (err error) {
+			_, err = fs.backend.MultipartBlobCommit(context.Background(), params)
+			return
+		})
 		if err != nil {
 			return mapAwsError(err)
 		}
@@ -416,31 +1182,73 @@ func (fs *Goofys) copyObjectMultipart(size int64, from string, to string, mpuId
 	return
 }
 
-func (fs *Goofys) copyObjectMaybeMultipart(size int64, from string, to string) (err error) {
-	if size == -1 {
-		params := &s3.HeadObjectInput{Bucket: &fs.bucket, Key: &from}
-		resp, err := fs.s3.HeadObject(params)
-		if err != nil {
-			return mapAwsError(err)
-		}
+// Abort the multipart upload or copy mpuId to to. There's nobody to
+// tell if that fails, so it's logged and left for --cleanup-uploads.
+func (fs *Goofys) abortMultipart(to string, mpuId string) {
+	err := fs.retry(func() (err error) {
+		return fs.backend.MultipartBlobAbort(context.Background(),
+			&MultipartBlobAbortInput{Key: to, UploadId: mpuId})
+	})
+	if err != nil {
+		log.Printf("Unable to abort the upload to %v, upload %v: %v", to, mpuId, mapAwsError(err))
+	}
+}
+
+// The HEAD of from with what a copy of it needs to keep: all of its
+// metadata, and its mtime. A copy gets a new LastModified so we save
+// the old one as MTIME_META if it's not there already.
+func (fs *Goofys) copyHead(from string) (head *HeadBlobOutput, err error) {
+	err = fs.retry(func() (err error) {
+		head, err = fs.backend.HeadBlob(context.Background(), &HeadBlobInput{Key: from})
+		return
+	})
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
 
-		size = *resp.ContentLength
+	metadata := make(map[string]*string)
+	for k, v := range head.Metadata {
+		metadata[strings.ToLower(k)] = v
+	}
+	if metadata[MTIME_META] == nil && !head.LastModified.IsZero() {
+		metadata[MTIME_META] = aws.String(strconv.FormatInt(head.LastModified.Unix(), 10))
 	}
 
-	from = fs.bucket + "/" + from
+	head.Metadata = metadata
+	return
+}
 
-	if size > 5*1024*1024*1024 {
-		return fs.copyObjectMultipart(size, from, to, "")
+// Copy from to to, keeping the metadata and the mtime of from. We
+// replace the metadata with what we read rather than let S3 copy it
+// so a copy always has MTIME_META, and the multipart copy, which
+// can't copy metadata, ends up with the same as a plain one.
+func (fs *Goofys) copyObjectMaybeMultipart(from string, to string) (err error) {
+	head, err := fs.copyHead(from)
+	if err != nil {
+		return
+	}
+
+	return fs.copyObjectWithHead(from, to, head)
+}
+
+// copyObjectMaybeMultipart with what copyHead returned for from.
+func (fs *Goofys) copyObjectWithHead(from string, to string, head *HeadBlobOutput) (err error) {
+	size := head.Size
+	if size > MAX_COPY_SIZE {
+		return fs.copyObjectMultipart(size, from, to, "", &head.BlobProperties)
 	}
 
-	params := &s3.CopyObjectInput{
-		Bucket:       &fs.bucket,
-		CopySource:   &from,
-		Key:          &to,
-		StorageClass: &fs.flags.StorageClass,
+	params := &CopyBlobInput{
+		Source:       from,
+		Destination:  to,
+		Properties:   &head.BlobProperties,
+		StorageClass: fs.storageClass(to),
 	}
 
-	_, err = fs.s3.CopyObject(params)
+	err = fs.retry(func() (err error) {
+		_, err = fs.backend.CopyBlob(context.Background(), params)
+		return
+	})
 	if err != nil {
 		err = mapAwsError(err)
 	}
@@ -448,106 +1256,460 @@ func (fs *Goofys) copyObjectMaybeMultipart(size int64, from string, to string) (
 	return
 }
 
+// Make sure what copyObjectWithHead copied to to is there and is
+// what from was, before we delete from. The ETag is only compared
+// when a plain copy would keep it: when it's the MD5 of the content,
+// which multipart and KMS ETags are not.
+func (fs *Goofys) verifyCopy(from *HeadBlobOutput, to string) (err error) {
+	var head *HeadBlobOutput
+	err = fs.retry(func() (err error) {
+		head, err = fs.backend.HeadBlob(context.Background(), &HeadBlobInput{Key: to})
+		return
+	})
+	if err != nil {
+		return mapAwsError(err)
+	}
+
+	if head.Size != from.Size {
+		log.Printf("copy to %v has %v bytes instead of %v", to, head.Size, from.Size)
+		return syscall.EIO
+	}
+
+	compareETag := from.Size <= MAX_COPY_SIZE && !fs.flags.UseKMS &&
+		from.ContentMD5 != nil && head.ETag != nil
+	if compareETag && *head.ETag != *from.ETag {
+		log.Printf("copy to %v has ETag %v instead of %v", to, *head.ETag, *from.ETag)
+		return syscall.EIO
+	}
+	return
+}
+
+// Guess the content type of inode from its extension, or from the
+// first part of its content if the extension doesn't tell us. nil
+// if we are not supposed to set it.
+func (fs *Goofys) contentType(inode *Inode, firstPart []byte) *string {
+	if fs.flags.NoContentType {
+		return nil
+	}
+
+	if t := mime.TypeByExtension(path.Ext(*inode.Name)); t != "" {
+		return &t
+	}
+
+	if len(firstPart) != 0 {
+		return aws.String(http.DetectContentType(firstPart))
+	}
+
+	return nil
+}
+
+// The encryption to ask for on every object we create, nil for none
+func (fs *Goofys) sseType() *string {
+	if fs.flags.UseKMS {
+		return aws.String("aws:kms")
+	} else if fs.flags.UseSSE {
+		return aws.String("AES256")
+	}
+	return nil
+}
+
+// nil means the account's default KMS key
+func (fs *Goofys) sseKMSKeyId() *string {
+	if fs.flags.UseKMS && fs.flags.KMSKeyID != "" {
+		return &fs.flags.KMSKeyID
+	}
+	return nil
+}
+
+var CANNED_ACLS = map[string]bool{
+	"private":                   true,
+	"public-read":               true,
+	"public-read-write":         true,
+	"authenticated-read":        true,
+	"aws-exec-read":             true,
+	"bucket-owner-read":         true,
+	"bucket-owner-full-control": true,
+}
+
+// nil means the bucket default
+func (fs *Goofys) acl() *string {
+	if fs.flags.ACL != "" {
+		return &fs.flags.ACL
+	}
+	return nil
+}
+
+// S3's limits on tags
+const MAX_TAGS = 10
+const MAX_TAG_KEY = 128
+const MAX_TAG_VALUE = 256
+
+// tagging is a URL encoded tag set, like project=x&classification=internal
+func validateTagging(tagging string) (err error) {
+	tags, err := url.ParseQuery(tagging)
+	if err != nil {
+		return
+	}
+
+	if len(tags) > MAX_TAGS {
+		return fmt.Errorf("more than %v tags", MAX_TAGS)
+	}
+
+	for k, v := range tags {
+		if len(k) == 0 || len(k) > MAX_TAG_KEY {
+			return fmt.Errorf("tag key %q is not 1-%v characters", k, MAX_TAG_KEY)
+		}
+		if len(v) != 1 {
+			return fmt.Errorf("tag %q is given %v times", k, len(v))
+		}
+		if len(v[0]) > MAX_TAG_VALUE {
+			return fmt.Errorf("tag value %q is longer than %v characters", v[0], MAX_TAG_VALUE)
+		}
+	}
+	return
+}
+
+// nil means no tags
+func (fs *Goofys) tagging() *string {
+	if fs.flags.Tagging != "" {
+		return &fs.flags.Tagging
+	}
+	return nil
+}
+
+func (fs *Goofys) cacheControl() *string {
+	if fs.flags.CacheControl != "" {
+		return &fs.flags.CacheControl
+	}
+	return nil
+}
+
+func (fs *Goofys) contentDisposition() *string {
+	if fs.flags.ContentDisposition != "" {
+		return &fs.flags.ContentDisposition
+	}
+	return nil
+}
+
 func (fs *Goofys) allocateInodeId() (id fuseops.InodeID) {
 	id = fs.nextInodeID
 	fs.nextInodeID++
 	return
 }
 
-// returned inode has nil Id
-func (fs *Goofys) LookUpInodeMaybeDir(name string, fullName string) (inode *Inode, err error) {
+// What we already know about a name we are about to look up.
+type lookupHint int
+
+const (
+	LOOKUP_UNKNOWN lookupHint = iota
+	LOOKUP_FILE
+	LOOKUP_DIR
+)
+
+// Look for both name and name/ unless hint says which one it is. If
+// both exist, name is a directory.
+func (fs *Goofys) lookUpInodeWithHint(ctx context.Context, name string, fullName string, hint lookupHint) (inode *Inode, err error) {
 	errObjectChan := make(chan error, 1)
-	objectChan := make(chan s3.HeadObjectOutput, 1)
+	objectChan := make(chan HeadBlobOutput, 1)
 	errDirChan := make(chan error, 1)
-	dirChan := make(chan s3.ListObjectsOutput, 1)
+	dirChan := make(chan ListBlobsOutput, 1)
 
-	go fs.LookUpInodeNotDir(fullName, objectChan, errObjectChan)
-	go fs.LookUpInodeDir(fullName, dirChan, errDirChan)
+	pending := 0
+	if hint != LOOKUP_DIR {
+		go fs.LookUpInodeNotDir(ctx, fullName, objectChan, errObjectChan)
+		pending++
+	}
+	dirPending := hint != LOOKUP_FILE
+	if dirPending {
+		go fs.LookUpInodeDir(ctx, fullName, dirChan, errDirChan)
+		pending++
+	}
 
-	notFound := false
+	var object *HeadBlobOutput
 
-	for {
+	for pending != 0 {
 		select {
 		case resp := <-objectChan:
-			// XXX/TODO if both object and object/ exists, return dir
-			inode = NewInode(&name, &fullName, fs.flags)
-			inode.Attributes = &fuseops.InodeAttributes{
-				Size:   uint64(*resp.ContentLength),
-				Nlink:  1,
-				Mode:   fs.flags.FileMode,
-				Atime:  *resp.LastModified,
-				Mtime:  *resp.LastModified,
-				Ctime:  *resp.LastModified,
-				Crtime: *resp.LastModified,
-				Uid:    fs.flags.Uid,
-				Gid:    fs.flags.Gid,
-			}
-			return
+			pending--
+			object = &resp
 		case err = <-errObjectChan:
-			if err == fuse.ENOENT {
-				if notFound {
-					return nil, err
-				} else {
-					notFound = true
-					err = nil
-				}
-			} else {
-				// XXX retry
+			pending--
+			if err != fuse.ENOENT {
+				// already retried
+				return nil, err
 			}
+			err = nil
 		case resp := <-dirChan:
-			if len(resp.CommonPrefixes) != 0 || len(resp.Contents) != 0 {
+			pending--
+			dirPending = false
+			if len(resp.Prefixes) != 0 || len(resp.Items) != 0 {
 				inode = NewInode(&name, &fullName, fs.flags)
 				inode.Attributes = &fs.rootAttrs
 				return
-			} else {
-				// 404
-				if notFound {
-					return nil, fuse.ENOENT
-				} else {
-					notFound = true
-				}
 			}
 		case err = <-errDirChan:
-			// XXX retry
+			if err == syscall.EACCES && fs.flags.HeadFallback {
+				// not allowed to list, so no directories
+				pending--
+				dirPending = false
+				err = nil
+				break
+			}
+			// already retried
+			return nil, err
 		}
+
+		if object != nil && !dirPending {
+			break
+		}
+	}
+
+	if object != nil {
+		inode = NewInode(&name, &fullName, fs.flags)
+		inode.fillAttributes(fs, object)
+		return
+	}
+
+	if hint != LOOKUP_UNKNOWN {
+		// what we knew is out of date
+		return fs.lookUpInodeWithHint(ctx, name, fullName, LOOKUP_UNKNOWN)
 	}
+
+	if fs.localDirs != nil && fs.localDirs.has(fullName) {
+		inode = NewInode(&name, &fullName, fs.flags)
+		inode.Attributes = &fs.rootAttrs
+		return
+	}
+
+	return nil, fuse.ENOENT
 }
 
 func (fs *Goofys) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) (err error) {
 
+	name, err := checkName(op.Name)
+	if err != nil {
+		return
+	}
+
 	fs.mu.Lock()
 
 	parent := fs.getInodeOrDie(op.Parent)
-	inode, ok := fs.inodesCache[parent.getChildName(op.Name)]
-	if ok {
-		defer inode.Ref()
-	} else {
+	if name == "." || name == ".." {
+		defer fs.mu.Unlock()
+		return fs.lookUpDots(parent, name, op)
+	}
+
+	fullName := parent.getChildName(name)
+	inode, ok := fs.inodesCache[fullName]
+	for ok && fs.flags.StatCacheTTL == 0 && !inode.isDir() {
+		// nothing is cached and someone else may have changed
+		// it, but the kernel may know this inode already so
+		// refresh it rather than making a new one. One we are
+		// writing is not in S3 yet and doesn't get refreshed
 		fs.mu.Unlock()
+		_, err = inode.GetAttributes(fs)
+		fs.mu.Lock()
 
-		inode, err = parent.LookUp(fs, op.Name)
-		if err != nil {
-			return err
+		if err == fuse.ENOENT {
+			if fs.inodesCache[fullName] == inode {
+				delete(fs.inodesCache, fullName)
+			}
+			ok = false
+			err = nil
+		} else if err != nil {
+			fs.mu.Unlock()
+			return
+		} else if fs.inodes[inode.Id] != inode {
+			// forgotten while we were refreshing it, taking a
+			// reference now would bring it back unregistered
+			inode, ok = fs.inodesCache[fullName]
+			continue
+		}
+		break
+	}
+	if ok {
+		inodeCacheLookups.WithLabelValues("hit").Inc()
+		// under fs.mu, so ForgetInode sees it
+		inode.Ref()
+	} else {
+		if fs.isNegativeCached(fullName) {
+			fs.mu.Unlock()
+			inodeCacheLookups.WithLabelValues("negative_hit").Inc()
+			return fuse.ENOENT
 		}
+		if call, ok := fs.lookups[fullName]; ok {
+			fs.mu.Unlock()
+			inodeCacheLookups.WithLabelValues("coalesced").Inc()
+
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return syscall.EINTR
+			}
+			if call.err == syscall.EINTR && ctx.Err() == nil {
+				// it was the other lookup that got interrupted
+				return fs.LookUpInode(ctx, op)
+			}
+			if call.err != nil {
+				return call.err
+			}
 
-		fs.mu.Lock()
-		inode.Id = fs.allocateInodeId()
-		fs.inodesCache[*inode.FullName] = inode
+			inode = call.inode
+			fs.mu.Lock()
+			inode.Ref()
+		} else {
+			call := &lookupCall{done: make(chan struct{})}
+			fs.lookups[fullName] = call
+			gen := parent.negativeGen
+			fs.mu.Unlock()
+			inodeCacheLookups.WithLabelValues("miss").Inc()
+
+			inode, err = parent.LookUp(ctx, fs, name)
+
+			fs.mu.Lock()
+			delete(fs.lookups, fullName)
+			call.inode, call.err = inode, err
+			if err == nil && inode.Id != 0 {
+				// one we have under another name, see
+				// lookUpCaseless
+				inode.Ref()
+			} else if err == nil {
+				inode.Id = fs.allocateInodeId()
+				if inode.VersionId == nil && inode.metadataFile == nil {
+					// versions share FullName with the latest
+					// one, and metadata is looked up each time
+					fs.inodesCache[*inode.FullName] = inode
+				}
+				// before the waiters can use it
+				fs.inodes[inode.Id] = inode
+			} else if err == fuse.ENOENT && parent.negativeGen == gen {
+				// nothing was created here while we looked
+				fs.addNegativeCache(fullName)
+			}
+			close(call.done)
+
+			if err != nil {
+				fs.mu.Unlock()
+				return err
+			}
+		}
 	}
 
 	fs.inodes[inode.Id] = inode
+	fs.fillLookUpEntry(inode, op)
+	fs.mu.Unlock()
+
+	inode.logFuse("<-- LookUpInode")
+
+	return
+}
+
+// LOCKS_REQUIRED(fs.mu)
+// LOCKS_EXCLUDED(inode.mu)
+func (fs *Goofys) fillLookUpEntry(inode *Inode, op *fuseops.LookUpInodeOp) {
 	op.Entry.Child = inode.Id
+	inode.mu.Lock()
 	op.Entry.Attributes = *inode.Attributes
+	inode.mu.Unlock()
 	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	if fs.dirSizes != nil && op.Entry.Attributes.Mode&os.ModeDir != 0 {
+		// adding up the size takes a while, leave it to
+		// GetInodeAttributes rather than doing it under fs.mu
+		op.Entry.AttributesExpiration = time.Time{}
+	}
 	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
-	fs.mu.Unlock()
+}
 
-	inode.logFuse("<-- LookUpInode")
+// The kernel resolves . and .. itself, but an NFS export of the
+// mount asks us.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *Goofys) lookUpDots(parent *Inode, name string, op *fuseops.LookUpInodeOp) (err error) {
+	inode := parent
+	if name == ".." {
+		inode = fs.parentOf(parent)
+		if inode == nil {
+			return fuse.ENOENT
+		}
+	}
 
+	inode.Ref()
+	fs.fillLookUpEntry(inode, op)
 	return
 }
 
+// Check a name we are given to look up or create. The kernel gives
+// us one path component at a time, but some callers add a / to a
+// directory's name, which we drop so we don't end up with dir//.
+// Anything else is not a name we'd find in a listing.
+func checkName(name string) (string, error) {
+	name = strings.TrimRight(name, "/")
+	if len(name) == 0 || strings.Contains(name, "/") {
+		return "", fuse.EINVAL
+	}
+	return name, nil
+}
+
+// A LookUp going to S3, see fs.lookups
+type lookupCall struct {
+	done  chan struct{}
+	inode *Inode
+	err   error
+}
+
+const NEGATIVE_CACHE_MAX = 10000
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *Goofys) isNegativeCached(fullName string) bool {
+	expires, ok := fs.negativeCache[fullName]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(expires) {
+		delete(fs.negativeCache, fullName)
+		return false
+	}
+	return true
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *Goofys) addNegativeCache(fullName string) {
+	if fs.flags.TypeCacheTTL == 0 {
+		return
+	}
+
+	now := time.Now()
+	if len(fs.negativeCache) >= NEGATIVE_CACHE_MAX {
+		for k, expires := range fs.negativeCache {
+			if now.After(expires) {
+				delete(fs.negativeCache, k)
+			}
+		}
+	}
+	// still full, make room with whatever the map gives us first
+	for k := range fs.negativeCache {
+		if len(fs.negativeCache) < NEGATIVE_CACHE_MAX {
+			break
+		}
+		delete(fs.negativeCache, k)
+	}
+
+	fs.negativeCache[fullName] = now.Add(fs.flags.TypeCacheTTL)
+}
+
+// Something was just created at fullName in parent
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *Goofys) invalidateNegativeCache(parent *Inode, fullName string) {
+	parent.negativeGen++
+	delete(fs.negativeCache, fullName)
+	// it's no longer another name for something else
+	delete(fs.caseNames, fullName)
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *Goofys) ForgetInode(
 	ctx context.Context,
@@ -561,10 +1723,153 @@ func (fs *Goofys) ForgetInode(
 
 	if stale {
 		fs.mu.Lock()
-		defer fs.mu.Unlock()
+		inode.mu.Lock()
+		stale = inode.refcnt == 0
+		inode.mu.Unlock()
+		if !stale {
+			// looked up again before we got fs.mu
+			fs.mu.Unlock()
+			return
+		}
 
 		delete(fs.inodes, op.Inode)
-		delete(fs.inodesCache, *inode.FullName)
+		// a rename or a new lookup may have put a different inode
+		// under the same name
+		if fs.inodesCache[*inode.FullName] == inode {
+			delete(fs.inodesCache, *inode.FullName)
+		}
+		dirs, files := fs.forgetHandles(inode)
+		fs.mu.Unlock()
+
+		// releasing waits for what the handles are doing
+		for _, dh := range dirs {
+			dh.CloseDir()
+		}
+		for _, fh := range files {
+			fh.Release()
+		}
+
+		if inode.forget() {
+			// lookups could otherwise find what the parent's
+			// listing said about it before we changed it
+			fs.mu.Lock()
+			parent := fs.parentOf(inode)
+			fs.mu.Unlock()
+			if parent != nil {
+				parent.mu.Lock()
+				parent.invalidateDir(fs)
+				parent.mu.Unlock()
+			}
+		}
+	}
+
+	return
+}
+
+// The directory inode is in, nil if the kernel has forgotten it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *Goofys) parentOf(inode *Inode) *Inode {
+	root := fs.inodes[fuseops.RootInodeID]
+	dir := path.Dir(*inode.FullName)
+	if dir == "." || dir == *root.FullName {
+		return root
+	}
+	return fs.inodesCache[dir]
+}
+
+// The kernel releases all the handles of an inode before forgetting
+// it, if it didn't we would keep the handles and the inode around
+// forever. Returns the handles that are left for the caller to
+// release once it lets go of fs.mu.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *Goofys) forgetHandles(inode *Inode) (dirs []*DirHandle, files []*FileHandle) {
+	for id, dh := range fs.dirHandles {
+		if dh.inode == inode {
+			log.Printf("Releasing dir handle %v of forgotten inode %v", id, inode.Id)
+			dirs = append(dirs, dh)
+			delete(fs.dirHandles, id)
+		}
+	}
+
+	for id, fh := range fs.fileHandles {
+		if fh.inode == inode {
+			log.Printf("Releasing file handle %v of forgotten inode %v", id, inode.Id)
+			files = append(files, fh)
+			delete(fs.fileHandles, id)
+		}
+	}
+	return
+}
+
+const SWEEP_INTERVAL = time.Minute
+
+// Drop the caches that have expired but that nobody has looked at
+// since, so they don't pile up on a mount that sees a lot of names.
+func (fs *Goofys) sweep() {
+	fs.mu.Lock()
+	now := time.Now()
+	for k, expires := range fs.negativeCache {
+		if now.After(expires) {
+			delete(fs.negativeCache, k)
+		}
+	}
+
+	inodes := make([]*Inode, 0, len(fs.inodes))
+	for _, inode := range fs.inodes {
+		inodes = append(inodes, inode)
+	}
+	fs.mu.Unlock()
+
+	for _, inode := range inodes {
+		inode.expireListing(fs)
+	}
+}
+
+func (fs *Goofys) sweeper() {
+	for {
+		time.Sleep(SWEEP_INTERVAL)
+		fs.sweep()
+	}
+}
+
+// Check that the inode and handle tables agree with each other,
+// this is for tests and InodeStats.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) checkInvariants() (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for id, inode := range fs.inodes {
+		if inode.Id != id {
+			return fmt.Errorf("inode %v is under %v", inode.Id, id)
+		}
+		inode.mu.Lock()
+		refcnt := inode.refcnt
+		inode.mu.Unlock()
+		if refcnt == 0 {
+			return fmt.Errorf("inode %v is forgotten", id)
+		}
+	}
+
+	for name, inode := range fs.inodesCache {
+		if fs.inodes[inode.Id] != inode {
+			return fmt.Errorf("cached inode %v for %v is forgotten", inode.Id, name)
+		}
+	}
+
+	for id, dh := range fs.dirHandles {
+		if fs.inodes[dh.inode.Id] != dh.inode {
+			return fmt.Errorf("dir handle %v is of forgotten inode %v", id, dh.inode.Id)
+		}
+	}
+
+	for id, fh := range fs.fileHandles {
+		if fs.inodes[fh.inode.Id] != fh.inode {
+			return fmt.Errorf("file handle %v is of forgotten inode %v", id, fh.inode.Id)
+		}
 	}
 
 	return
@@ -574,19 +1879,22 @@ func (fs *Goofys) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) (err error) {
 	fs.mu.Lock()
-
-	handleID := fs.nextHandleID
-	fs.nextHandleID++
-
 	in := fs.getInodeOrDie(op.Inode)
 	fs.mu.Unlock()
 
-	// XXX/is this a dir?
+	if in.Attributes.Mode&os.ModeDir == 0 {
+		in.logFuse("OpenDir", "not a directory")
+		return syscall.ENOTDIR
+	}
+
 	dh := in.OpenDir()
 
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	handleID := fs.nextHandleID
+	fs.nextHandleID++
+
 	fs.dirHandles[handleID] = dh
 	op.Handle = handleID
 
@@ -598,20 +1906,18 @@ func (fs *Goofys) ReadDir(
 	ctx context.Context,
 	op *fuseops.ReadDirOp) (err error) {
 
-	// Find the handle.
-	fs.mu.Lock()
-	dh := fs.dirHandles[op.Handle]
-	//inode := fs.inodes[op.Inode]
-	fs.mu.Unlock()
-
-	if dh == nil {
-		panic(fmt.Sprintf("can't find dh=%v", op.Handle))
+	dh, err := fs.getDirHandle("ReadDir", op.Handle)
+	if err != nil {
+		return
 	}
 
 	dh.inode.logFuse("ReadDir", op.Offset)
 
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
 	for i := op.Offset; ; i++ {
-		e, err := dh.ReadDir(fs, i)
+		e, err := dh.ReadDir(ctx, fs, i)
 		if err != nil {
 			return err
 		}
@@ -640,6 +1946,10 @@ func (fs *Goofys) ReleaseDirHandle(
 	defer fs.mu.Unlock()
 
 	dh := fs.dirHandles[op.Handle]
+	if dh == nil {
+		log.Printf("ReleaseDirHandle: unknown dir handle %v", op.Handle)
+		return syscall.EBADF
+	}
 	dh.CloseDir()
 	fs.logFuse("ReleaseDirHandle", *dh.inode.FullName)
 
@@ -655,6 +1965,13 @@ func (fs *Goofys) OpenFile(
 	in := fs.getInodeOrDie(op.Inode)
 	fs.mu.Unlock()
 
+	if in.Attributes.Mode&os.ModeDir != 0 {
+		in.logFuse("OpenFile", "is a directory")
+		return syscall.EISDIR
+	}
+
+	// this refreshes the ETag the handle expects to replace
+	keepPageCache := in.keepPageCache(fs)
 	fh := in.OpenFile(fs)
 
 	fs.mu.Lock()
@@ -666,7 +1983,7 @@ func (fs *Goofys) OpenFile(
 	fs.fileHandles[handleID] = fh
 
 	op.Handle = handleID
-	op.KeepPageCache = true
+	op.KeepPageCache = keepPageCache
 
 	return
 }
@@ -675,11 +1992,12 @@ func (fs *Goofys) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) (err error) {
 
-	fs.mu.Lock()
-	fh := fs.fileHandles[op.Handle]
-	fs.mu.Unlock()
+	fh, err := fs.getFileHandle("ReadFile", op.Handle)
+	if err != nil {
+		return
+	}
 
-	op.BytesRead, err = fh.ReadFile(fs, op.Offset, op.Dst)
+	op.BytesRead, err = fh.ReadFile(ctx, fs, op.Offset, op.Dst)
 
 	return
 }
@@ -688,9 +2006,10 @@ func (fs *Goofys) SyncFile(
 	ctx context.Context,
 	op *fuseops.SyncFileOp) (err error) {
 
-	fs.mu.Lock()
-	fh := fs.fileHandles[op.Handle]
-	fs.mu.Unlock()
+	fh, err := fs.getFileHandle("SyncFile", op.Handle)
+	if err != nil {
+		return
+	}
 
 	err = fh.FlushFile(fs)
 	return
@@ -700,9 +2019,10 @@ func (fs *Goofys) FlushFile(
 	ctx context.Context,
 	op *fuseops.FlushFileOp) (err error) {
 
-	fs.mu.Lock()
-	fh := fs.fileHandles[op.Handle]
-	fs.mu.Unlock()
+	fh, err := fs.getFileHandle("FlushFile", op.Handle)
+	if err != nil {
+		return
+	}
 
 	err = fh.FlushFile(fs)
 
@@ -713,9 +2033,15 @@ func (fs *Goofys) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) (err error) {
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
+	fh := fs.fileHandles[op.Handle]
 	delete(fs.fileHandles, op.Handle)
+	fs.mu.Unlock()
+
+	// this waits for what the handle is doing, which shouldn't
+	// hold up everyone else
+	if fh != nil {
+		fh.Release()
+	}
 	return
 }
 
@@ -723,15 +2049,31 @@ func (fs *Goofys) CreateFile(
 	ctx context.Context,
 	op *fuseops.CreateFileOp) (err error) {
 
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if op.Name, err = checkName(op.Name); err != nil {
+		return
+	}
+	if _, ok := fs.metadataOf(op.Name); ok {
+		// that's where the metadata of something would be
+		return syscall.EROFS
+	}
+
 	fs.mu.Lock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.Unlock()
 
 	inode, fh := parent.Create(fs, op.Name)
+	// nobody else has the inode yet
+	inode.Attributes.Mode = fs.createMode(op.Mode)
 
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	fs.invalidateNegativeCache(parent, parent.getChildName(op.Name))
+
 	nextInode := fs.nextInodeID
 	fs.nextInodeID++
 
@@ -762,19 +2104,38 @@ func (fs *Goofys) MkDir(
 	ctx context.Context,
 	op *fuseops.MkDirOp) (err error) {
 
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if op.Name, err = checkName(op.Name); err != nil {
+		return
+	}
+	if _, ok := fs.metadataOf(op.Name); ok {
+		// that's where the metadata of something would be
+		return syscall.EROFS
+	}
+
 	fs.mu.Lock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.Unlock()
 
-	// ignore op.Mode for now
 	inode, err := parent.MkDir(fs, op.Name)
 	if err != nil {
 		return err
 	}
 
+	// XXX the mode isn't kept anywhere, once the inode is
+	// forgotten the directory has flags.DirMode like the others
+	attrs := fs.rootAttrs
+	attrs.Mode = fs.createMode(op.Mode) | os.ModeDir
+	inode.Attributes = &attrs
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	fs.invalidateNegativeCache(parent, parent.getChildName(op.Name))
+
 	nextInode := fs.nextInodeID
 	fs.nextInodeID++
 
@@ -789,10 +2150,117 @@ func (fs *Goofys) MkDir(
 	return
 }
 
+func (fs *Goofys) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if op.Name, err = checkName(op.Name); err != nil {
+		return
+	}
+	if _, ok := fs.metadataOf(op.Name); ok {
+		// that's where the metadata of something would be
+		return syscall.EROFS
+	}
+
+	fs.mu.Lock()
+	parent := fs.getInodeOrDie(op.Parent)
+	fs.mu.Unlock()
+
+	inode, err := parent.CreateSymlink(fs, op.Name, op.Target)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.invalidateNegativeCache(parent, *inode.FullName)
+
+	inode.Id = fs.allocateInodeId()
+	fs.inodes[inode.Id] = inode
+	fs.inodesCache[*inode.FullName] = inode
+
+	op.Entry.Child = inode.Id
+	op.Entry.Attributes = *inode.Attributes
+	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
+
+	return
+}
+
+// S3 can't have two keys share an object, so this makes a copy
+// under the new name. The two are independent afterwards.
+func (fs *Goofys) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if op.Name, err = checkName(op.Name); err != nil {
+		return
+	}
+	if _, ok := fs.metadataOf(op.Name); ok {
+		// that's where the metadata of something would be
+		return syscall.EROFS
+	}
+
+	fs.mu.Lock()
+	parent := fs.getInodeOrDie(op.Parent)
+	target := fs.getInodeOrDie(op.Target)
+	fs.mu.Unlock()
+
+	inode, err := parent.Link(fs, op.Name, target)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.invalidateNegativeCache(parent, *inode.FullName)
+
+	inode.Id = fs.allocateInodeId()
+	fs.inodes[inode.Id] = inode
+	fs.inodesCache[*inode.FullName] = inode
+
+	op.Entry.Child = inode.Id
+	op.Entry.Attributes = *inode.Attributes
+	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
+
+	return
+}
+
+func (fs *Goofys) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+
+	fs.mu.Lock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.Unlock()
+
+	op.Target, err = inode.ReadSymlink(fs)
+	return
+}
+
 func (fs *Goofys) RmDir(
 	ctx context.Context,
 	op *fuseops.RmDirOp) (err error) {
 
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if op.Name, err = checkName(op.Name); err != nil {
+		return
+	}
+
 	fs.mu.Lock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.Unlock()
@@ -804,22 +2272,217 @@ func (fs *Goofys) RmDir(
 func (fs *Goofys) SetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.SetInodeAttributesOp) (err error) {
-	// do nothing, we don't support any of the changes
+
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	fs.mu.Lock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.Unlock()
+
+	if inode.VersionId != nil || inode.metadataFile != nil {
+		return syscall.EROFS
+	}
+
+	if op.Size != nil {
+		err = fs.truncate(inode, int64(*op.Size))
+		if err != nil {
+			return
+		}
+	}
+
+	// other than with --posix-attrs, we don't support any of the
+	// other changes
+	if fs.flags.PosixAttrs {
+		inode.SetAttributes(fs, op.Mode, op.Uid, op.Gid, op.Mtime)
+	}
+
+	inode.mu.Lock()
+	op.Attributes = *inode.Attributes
+	inode.mu.Unlock()
+	op.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+
 	return
 }
 
-func (fs *Goofys) WriteFile(
+func (fs *Goofys) GetXattr(
 	ctx context.Context,
-	op *fuseops.WriteFileOp) (err error) {
+	op *fuseops.GetXattrOp) (err error) {
+
+	if !fs.flags.Xattr {
+		return syscall.ENOTSUP
+	}
 
 	fs.mu.Lock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.Unlock()
 
-	fh, ok := fs.fileHandles[op.Handle]
-	if !ok {
-		panic(fmt.Sprintf("WriteFile: can't find handle %v", op.Handle))
+	value, err := inode.GetXattr(fs, op.Name)
+	if err != nil {
+		return
+	}
+
+	op.BytesRead = len(value)
+	// an empty buffer is asking how big it is
+	if len(op.Dst) != 0 {
+		if len(op.Dst) < len(value) {
+			return syscall.ERANGE
+		}
+		copy(op.Dst, value)
+	}
+
+	return
+}
+
+func (fs *Goofys) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+
+	if !fs.flags.Xattr {
+		return syscall.ENOTSUP
+	}
+
+	fs.mu.Lock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.Unlock()
+
+	names, err := inode.ListXattr(fs)
+	if err != nil {
+		return
+	}
+
+	// each name is followed by a NUL
+	for _, name := range names {
+		op.BytesRead += len(name) + 1
+	}
+
+	if len(op.Dst) != 0 {
+		if len(op.Dst) < op.BytesRead {
+			return syscall.ERANGE
+		}
+
+		dst := op.Dst
+		for _, name := range names {
+			n := copy(dst, name)
+			dst[n] = 0
+			dst = dst[n+1:]
+		}
+	}
+
+	return
+}
+
+func (fs *Goofys) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if !fs.flags.Xattr {
+		return syscall.ENOTSUP
+	}
+
+	fs.mu.Lock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.Unlock()
+
+	return inode.SetXattr(fs, op.Name, op.Value, op.Flags)
+}
+
+func (fs *Goofys) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if !fs.flags.Xattr {
+		return syscall.ENOTSUP
+	}
+
+	fs.mu.Lock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.Unlock()
+
+	return inode.RemoveXattr(fs, op.Name)
+}
+
+// If the file is open, the new size is uploaded when that handle is
+// flushed so we don't race with its writes; otherwise we do it now.
+func (fs *Goofys) truncate(inode *Inode, size int64) (err error) {
+	if inode.Attributes.Mode&os.ModeDir != 0 {
+		return syscall.EISDIR
+	}
+
+	// stage the truncate into a handle that's going to upload
+	// anyway. OpenFileOp doesn't tell us which handles were opened
+	// for writing (see ReadOnly), so one that hasn't written yet
+	// may never upload and the truncate goes out now instead
+	var handles []*FileHandle
+
+	fs.mu.Lock()
+	for _, h := range fs.fileHandles {
+		if h.inode == inode {
+			handles = append(handles, h)
+		}
 	}
 	fs.mu.Unlock()
 
+	for _, h := range handles {
+		h.mu.Lock()
+		dirty := h.dirty
+		h.mu.Unlock()
+
+		if dirty {
+			return h.Truncate(fs, size)
+		}
+	}
+
+	inode.mu.Lock()
+	old := inode.ETag
+	inode.mu.Unlock()
+
+	fh := inode.OpenFile(fs)
+	defer fh.Release()
+
+	err = fh.Truncate(fs, size)
+	if err != nil {
+		return
+	}
+
+	err = fh.FlushFile(fs)
+	if err != nil {
+		return
+	}
+
+	// the handles that are open replace what we uploaded now,
+	// not what they opened
+	inode.mu.Lock()
+	etag := inode.ETag
+	inode.mu.Unlock()
+	if old != nil {
+		fs.etagReplaced(inode, *old, etag)
+	}
+	return
+}
+
+func (fs *Goofys) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	fh, err := fs.getFileHandle("WriteFile", op.Handle)
+	if err != nil {
+		return
+	}
+
 	err = fh.WriteFile(fs, op.Offset, op.Data)
 
 	return
@@ -829,6 +2492,14 @@ func (fs *Goofys) Unlink(
 	ctx context.Context,
 	op *fuseops.UnlinkOp) (err error) {
 
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if op.Name, err = checkName(op.Name); err != nil {
+		return
+	}
+
 	fs.mu.Lock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.Unlock()
@@ -841,10 +2512,36 @@ func (fs *Goofys) Rename(
 	ctx context.Context,
 	op *fuseops.RenameOp) (err error) {
 
+	if fs.flags.ReadOnly {
+		return syscall.EROFS
+	}
+
+	if op.OldName, err = checkName(op.OldName); err != nil {
+		return
+	}
+	if op.NewName, err = checkName(op.NewName); err != nil {
+		return
+	}
+	if _, ok := fs.metadataOf(op.OldName); ok {
+		return syscall.EROFS
+	}
+	if _, ok := fs.metadataOf(op.NewName); ok {
+		return syscall.EROFS
+	}
+
 	fs.mu.Lock()
 	parent := fs.getInodeOrDie(op.OldParent)
 	newParent := fs.getInodeOrDie(op.NewParent)
 	fs.mu.Unlock()
 
-	return parent.Rename(fs, op.OldName, newParent, op.NewName)
+	err = parent.Rename(fs, op.OldName, newParent, op.NewName)
+	if err != nil {
+		return
+	}
+
+	fs.mu.Lock()
+	fs.invalidateNegativeCache(newParent, newParent.getChildName(op.NewName))
+	fs.mu.Unlock()
+
+	return
 }
@@ -17,14 +17,23 @@ package internal
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -32,13 +41,18 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -268,13 +282,13 @@ func (s *GoofysTest) LookUpInode(t *C, name string) (in *Inode, err error) {
 		dirName := name[0:idx]
 		name = name[idx+1:]
 
-		parent, err = parent.LookUp(s.fs, dirName)
+		parent, err = parent.LookUp(s.ctx, s.fs, dirName)
 		if err != nil {
 			return
 		}
 	}
 
-	in, err = parent.LookUp(s.fs, name)
+	in, err = parent.LookUp(s.ctx, s.fs, name)
 	return
 }
 
@@ -296,7 +310,7 @@ func (s *GoofysTest) TestLookUpInode(t *C) {
 }
 
 func (s *GoofysTest) TestGetInodeAttributes(t *C) {
-	inode, err := s.getRoot(t).LookUp(s.fs, "file1")
+	inode, err := s.getRoot(t).LookUp(s.ctx, s.fs, "file1")
 	t.Assert(err, IsNil)
 
 	attr, err := inode.GetAttributes(s.fs)
@@ -305,16 +319,16 @@ func (s *GoofysTest) TestGetInodeAttributes(t *C) {
 }
 
 func (s *GoofysTest) readDirFully(t *C, dh *DirHandle) (entries []fuseutil.Dirent) {
-	en, err := dh.ReadDir(s.fs, fuseops.DirOffset(0))
+	en, err := dh.ReadDir(s.ctx, s.fs, fuseops.DirOffset(0))
 	t.Assert(err, IsNil)
 	t.Assert(en.Name, Equals, ".")
 
-	en, err = dh.ReadDir(s.fs, fuseops.DirOffset(1))
+	en, err = dh.ReadDir(s.ctx, s.fs, fuseops.DirOffset(1))
 	t.Assert(err, IsNil)
 	t.Assert(en.Name, Equals, "..")
 
 	for i := fuseops.DirOffset(2); ; i++ {
-		en, err = dh.ReadDir(s.fs, i)
+		en, err = dh.ReadDir(s.ctx, s.fs, i)
 		t.Assert(err, IsNil)
 
 		if en == nil {
@@ -357,7 +371,7 @@ func (s *GoofysTest) TestReadDir(t *C) {
 	s.assertEntries(t, in, []string{"dir3"})
 
 	// test listing dir2/dir3/
-	in, err = in.LookUp(s.fs, "dir3")
+	in, err = in.LookUp(s.ctx, s.fs, "dir3")
 	t.Assert(err, IsNil)
 	s.assertEntries(t, in, []string{"file4"})
 }
@@ -368,7 +382,7 @@ func (s *GoofysTest) TestReadFiles(t *C) {
 	defer dh.CloseDir()
 
 	for i := fuseops.DirOffset(0); ; i++ {
-		en, err := dh.ReadDir(s.fs, i)
+		en, err := dh.ReadDir(s.ctx, s.fs, i)
 		t.Assert(err, IsNil)
 
 		if en == nil {
@@ -376,13 +390,13 @@ func (s *GoofysTest) TestReadFiles(t *C) {
 		}
 
 		if en.Type == fuseutil.DT_File {
-			in, err := parent.LookUp(s.fs, en.Name)
+			in, err := parent.LookUp(s.ctx, s.fs, en.Name)
 			t.Assert(err, IsNil)
 
 			fh := in.OpenFile(s.fs)
 			buf := make([]byte, 4096)
 
-			nread, err := fh.ReadFile(s.fs, 0, buf)
+			nread, err := fh.ReadFile(s.ctx, s.fs, 0, buf)
 			if en.Name == "zero" {
 				t.Assert(nread, Equals, 0)
 			} else {
@@ -400,14 +414,14 @@ func (s *GoofysTest) TestReadOffset(t *C) {
 	root := s.getRoot(t)
 	f := "file1"
 
-	in, err := root.LookUp(s.fs, f)
+	in, err := root.LookUp(s.ctx, s.fs, f)
 	t.Assert(err, IsNil)
 
 	fh := in.OpenFile(s.fs)
 
 	buf := make([]byte, 4096)
 
-	nread, err := fh.ReadFile(s.fs, 1, buf)
+	nread, err := fh.ReadFile(s.ctx, s.fs, 1, buf)
 	t.Assert(err, IsNil)
 	t.Assert(nread, Equals, len(f)-1)
 	t.Assert(string(buf[0:nread]), DeepEquals, f[1:])
@@ -426,13 +440,13 @@ func (s *GoofysTest) TestCreateFiles(t *C) {
 	t.Assert(*resp.ContentLength, DeepEquals, int64(0))
 	defer resp.Body.Close()
 
-	_, err = s.getRoot(t).LookUp(s.fs, fileName)
+	_, err = s.getRoot(t).LookUp(s.ctx, s.fs, fileName)
 	t.Assert(err, IsNil)
 
 	fileName = "testCreateFile2"
 	s.testWriteFile(t, fileName, 1, 128*1024)
 
-	inode, err := s.getRoot(t).LookUp(s.fs, fileName)
+	inode, err := s.getRoot(t).LookUp(s.ctx, s.fs, fileName)
 	t.Assert(err, IsNil)
 
 	fh = inode.OpenFile(s.fs)
@@ -485,7 +499,7 @@ func (s *GoofysTest) testWriteFile(t *C, fileName string, size int64, write_size
 
 	for {
 		var nread int
-		nread, err = fh.ReadFile(s.fs, offset, rbuf[:])
+		nread, err = fh.ReadFile(s.ctx, s.fs, offset, rbuf[:])
 		offset += int64(nread)
 		if err != nil || nread == 0 {
 			break
@@ -498,6 +512,169 @@ func (s *GoofysTest) testWriteFile(t *C, fileName string, size int64, write_size
 	t.Assert(offset, Equals, size)
 }
 
+func (s *GoofysTest) readObject(t *C, key string) string {
+	resp, err := s.s3.GetObject(&s3.GetObjectInput{Bucket: &s.fs.bucket, Key: &key})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	return string(buf)
+}
+
+func (s *GoofysTest) TestWriteRandom(t *C) {
+	fileName := "testWriteRandom"
+	_, fh := s.getRoot(t).Create(s.fs, fileName)
+
+	err := fh.WriteFile(s.fs, 0, []byte("hello world"))
+	t.Assert(err, IsNil)
+
+	err = fh.WriteFile(s.fs, 0, []byte("J"))
+	t.Assert(err, IsNil)
+
+	// leaves a hole
+	err = fh.WriteFile(s.fs, 13, []byte("!"))
+	t.Assert(err, IsNil)
+
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, fileName), Equals, "Jello world\x00\x00!")
+
+	// patch the middle of an existing object
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, fileName)
+	t.Assert(err, IsNil)
+
+	fh = in.OpenFile(s.fs)
+	err = fh.WriteFile(s.fs, 6, []byte("W"))
+	t.Assert(err, IsNil)
+
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, fileName), Equals, "Jello World\x00\x00!")
+}
+
+func (s *GoofysTest) TestTruncateOverwrite(t *C) {
+	s.fs.flags.PartSize = MIN_PART_SIZE
+
+	var mu sync.Mutex
+	ops := make(map[string]int)
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		mu.Lock()
+		ops[r.Operation.Name]++
+		mu.Unlock()
+	})
+
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+
+	// open(O_TRUNC) and write it all again
+	fh := in.OpenFile(s.fs)
+	err = fh.Truncate(s.fs, 0)
+	t.Assert(err, IsNil)
+
+	size := 2*MIN_PART_SIZE + 1
+	chunk := make([]byte, 128*1024)
+	for off := 0; off < size; off += len(chunk) {
+		n := len(chunk)
+		if off+n > size {
+			n = size - off
+		}
+		err = fh.WriteFile(s.fs, int64(off), chunk[:n])
+		t.Assert(err, IsNil)
+	}
+
+	// streamed out in parts rather than staged
+	t.Assert(fh.overlay, IsNil)
+	mu.Lock()
+	t.Assert(ops["UploadPart"] > 0, Equals, true)
+	mu.Unlock()
+
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	fh.Release()
+	t.Assert(ops["CreateMultipartUpload"], Equals, 1)
+	t.Assert(ops["PutObject"], Equals, 0)
+	t.Assert(len(s.readObject(t, "file1")), Equals, size)
+}
+
+func (s *GoofysTest) TestWriteStartOfExisting(t *C) {
+	fileName := "testWriteStartOfExisting"
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    &fileName,
+		Body:   bytes.NewReader([]byte("0123456789")),
+	})
+	t.Assert(err, IsNil)
+
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, fileName)
+	t.Assert(err, IsNil)
+
+	// not truncated, so the rest of it stays
+	fh := in.OpenFile(s.fs)
+	err = fh.WriteFile(s.fs, 0, []byte("ab"))
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(s.fs, 5, []byte("XY"))
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(10))
+
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	fh.Release()
+	t.Assert(s.readObject(t, fileName), Equals, "ab234XY789")
+	t.Assert(in.Attributes.Size, Equals, uint64(10))
+}
+
+func (s *GoofysTest) TestWriteRandomSpill(t *C) {
+	// two buffers for a handle
+	s.fs.bufferPool = NewBufferPool(100*BUF_SIZE, 2*BUF_SIZE)
+
+	fileName := "testWriteRandomSpill"
+	_, fh := s.getRoot(t).Create(s.fs, fileName)
+
+	// the writes are kept in buffers of the pool
+	err := fh.WriteFile(s.fs, BUF_SIZE, []byte("b"))
+	t.Assert(err, IsNil)
+	t.Assert(fh.poolHandle.inUseBuffers, Equals, int64(1))
+	err = fh.WriteFile(s.fs, 0, []byte("a"))
+	t.Assert(err, IsNil)
+	t.Assert(fh.poolHandle.inUseBuffers, Equals, int64(2))
+
+	// until there's no more, then they all go to disk
+	err = fh.WriteFile(s.fs, 2*BUF_SIZE, []byte("c"))
+	t.Assert(err, IsNil)
+	t.Assert(fh.poolHandle.inUseBuffers, Equals, int64(0))
+	t.Assert(fh.overlay.spill, NotNil)
+
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+
+	content := s.readObject(t, fileName)
+	t.Assert(len(content), Equals, 2*BUF_SIZE+1)
+	t.Assert(content[0], Equals, byte('a'))
+	t.Assert(content[BUF_SIZE], Equals, byte('b'))
+	t.Assert(content[2*BUF_SIZE], Equals, byte('c'))
+}
+
+func (s *GoofysTest) TestWriteRandomLarge(t *C) {
+	fileName := "testWriteRandomLarge"
+	s.testWriteFile(t, fileName, 11*1024*1024, 128*1024)
+
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, fileName)
+	t.Assert(err, IsNil)
+
+	// this spans the boundary between the first two parts
+	fh := in.OpenFile(s.fs)
+	err = fh.WriteFile(s.fs, BUF_SIZE-1, []byte("ab"))
+	t.Assert(err, IsNil)
+
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+
+	content := s.readObject(t, fileName)
+	t.Assert(len(content), Equals, 11*1024*1024)
+	t.Assert(content[BUF_SIZE-2:BUF_SIZE+2], Equals, "\x00ab\x00")
+}
+
 func (s *GoofysTest) TestWriteLargeFile(t *C) {
 	s.testWriteFile(t, "testLargeFile", 21*1024*1024, 128*1024)
 	s.testWriteFile(t, "testLargeFile2", 20*1024*1024, 128*1024)
@@ -508,7 +685,7 @@ func (s *GoofysTest) TestReadLargeFile(t *C) {
 
 	root := s.getRoot(t)
 
-	in, err := root.LookUp(s.fs, "testLargeFile")
+	in, err := root.LookUp(s.ctx, s.fs, "testLargeFile")
 	t.Assert(err, IsNil)
 
 	fh := in.OpenFile(s.fs)
@@ -516,13 +693,13 @@ func (s *GoofysTest) TestReadLargeFile(t *C) {
 	buf := [128 * 1024]byte{}
 
 	totalRead := int64(0)
-	nread, err := fh.ReadFile(s.fs, 0, buf[:32*1024])
+	nread, err := fh.ReadFile(s.ctx, s.fs, 0, buf[:32*1024])
 	t.Assert(err, IsNil)
 	t.Assert(nread, Equals, 32*1024)
 	totalRead += int64(nread)
 
 	for {
-		nread, err := fh.ReadFile(s.fs, totalRead, buf[:])
+		nread, err := fh.ReadFile(s.ctx, s.fs, totalRead, buf[:])
 		t.Assert(err, IsNil)
 		totalRead += int64(nread)
 
@@ -534,6 +711,148 @@ func (s *GoofysTest) TestReadLargeFile(t *C) {
 	}
 }
 
+func (s *GoofysTest) TestReadAheadLargeFile(t *C) {
+	s.fs.flags.ReadAheadSize = 20 * 1024 * 1024
+	s.fs.flags.ReadAheadStreams = 4
+	s.TestReadLargeFile(t)
+}
+
+func (s *GoofysTest) TestReadAheadUnlocked(t *C) {
+	s.fs.flags.ReadAheadSize = 4 * 1024 * 1024
+	s.fs.flags.ReadAheadStreams = 4
+
+	content := make([]byte, 2*1024*1024)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	key := "slow_readahead"
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(content),
+	})
+	t.Assert(err, IsNil)
+
+	var blocking int32
+	unblock := make(chan struct{})
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "GetObject" && atomic.LoadInt32(&blocking) != 0 {
+			<-unblock
+		}
+	})
+
+	in, err := s.LookUpInode(t, key)
+	t.Assert(err, IsNil)
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+
+	buf := make([]byte, 4096)
+	_, err = fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, IsNil)
+
+	// the next read is sequential and waits for readahead
+	atomic.StoreInt32(&blocking, 1)
+	done := make(chan error)
+	go func() {
+		_, err := fh.ReadFile(s.ctx, s.fs, 4096, buf)
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		fh.mu.Lock()
+		fh.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("fh.mu is held while waiting for a GET")
+	}
+
+	close(unblock)
+	t.Assert(<-done, IsNil)
+	t.Assert(bytes.Equal(buf, content[4096:8192]), Equals, true)
+}
+
+func (s *GoofysTest) TestReadReorder(t *C) {
+	content := make([]byte, 1024*1024)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	key := "reorder"
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(content),
+	})
+	t.Assert(err, IsNil)
+
+	var gets int
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "GetObject" {
+			gets++
+		}
+	})
+
+	in, err := s.LookUpInode(t, key)
+	t.Assert(err, IsNil)
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+
+	read := func(offset int64, size int) {
+		buf := make([]byte, size)
+		nread, err := fh.ReadFile(s.ctx, s.fs, offset, buf)
+		t.Assert(err, IsNil)
+		t.Assert(nread, Equals, size)
+		t.Assert(bytes.Equal(buf, content[offset:offset+int64(size)]), Equals, true)
+	}
+
+	read(0, 4096)
+	read(8192, 4096)
+	// back a bit, and straddling what's been read
+	read(4096, 4096)
+	read(10000, 8192)
+	t.Assert(gets, Equals, 1)
+
+	// too far ahead
+	read(512*1024, 4096)
+	t.Assert(gets, Equals, 2)
+}
+
+func (s *GoofysTest) TestUploadThrottling(t *C) {
+	l := newUploadLimiter(8, false)
+
+	l.acquire()
+	l.release(true)
+	t.Assert(l.limit, Equals, 4)
+
+	for i := 0; i < 4; i++ {
+		l.acquire()
+		l.release(false)
+	}
+	t.Assert(l.limit, Equals, 5)
+
+	slowDown := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "")
+	t.Assert(isThrottled(slowDown), Equals, true)
+
+	// more throttling than flags.MaxRetries would allow
+	s.fs.flags.MaxRetries = 1
+	attempts := 0
+	err := s.fs.retryUpload(func() error {
+		attempts++
+		if attempts <= 3 {
+			return slowDown
+		}
+		return nil
+	})
+	t.Assert(err, IsNil)
+	t.Assert(attempts, Equals, 4)
+	t.Assert(s.fs.uploads.inFlight, Equals, 0)
+}
+
 func (s *GoofysTest) TestWriteManyFilesFile(t *C) {
 	var files sync.WaitGroup
 
@@ -593,15 +912,24 @@ func (s *GoofysTest) TestRename(t *C) {
 
 	from, to := "dir1", "new_dir"
 	err := root.Rename(s.fs, from, root, to)
-	t.Assert(err, Equals, fuse.ENOTEMPTY)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, "new_dir/file3"), Equals, "dir1/file3")
+
+	_, err = s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: aws.String("dir1/file3")})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
 
-	dir2, err := root.LookUp(s.fs, "dir2")
+	dir2, err := root.LookUp(s.ctx, s.fs, "dir2")
 	t.Assert(err, IsNil)
 
+	// can't replace a directory that's not empty
 	from, to = "dir3", "new_dir"
 	err = dir2.Rename(s.fs, from, root, to)
 	t.Assert(err, Equals, fuse.ENOTEMPTY)
 
+	from, to = "new_dir", "dir1"
+	err = root.Rename(s.fs, from, root, to)
+	t.Assert(err, IsNil)
+
 	from, to = "empty_dir", "dir1"
 	err = root.Rename(s.fs, from, root, to)
 	t.Assert(err, Equals, fuse.ENOTEMPTY)
@@ -640,7 +968,3814 @@ func (s *GoofysTest) TestRename(t *C) {
 	t.Assert(err, Equals, fuse.ENOENT)
 
 	// not really rename but can be used by rename
-	from, to = s.fs.bucket+"/file2", "new_file"
-	err = s.fs.copyObjectMultipart(int64(len(from)), from, to, "")
+	from, to = "file2", "new_file"
+	err = s.fs.copyObjectMultipart(int64(len(from)), from, to, "", nil)
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestCopyPartSize(t *C) {
+	s.fs.flags.PartSize = MIN_PART_SIZE
+	t.Assert(s.fs.copyPartSize(1024), Equals, int64(MIN_PART_SIZE))
+
+	// would need 30000 parts at the configured size
+	size := int64(MIN_PART_SIZE) * MAX_PARTS * 3
+	partSize := s.fs.copyPartSize(size)
+	t.Assert(partSize > MIN_PART_SIZE, Equals, true)
+	t.Assert(sizeToParts(size, partSize) <= MAX_PARTS, Equals, true)
+
+	// a bad size is caught before we get this far
+	_, err := ParseFlags([]string{"--part-size", "1"})
+	t.Assert(err, NotNil)
+	flags, err := ParseFlags([]string{"--part-size", "5"})
+	t.Assert(err, IsNil)
+	t.Assert(flags.PartSize, Equals, int64(MIN_PART_SIZE))
+
+	// the part size doesn't decide when to copy part by part
+	s.testWriteFile(t, "testCopyPartSize", 2*MIN_PART_SIZE, 128*1024)
+	var copies, partCopies int32
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "CopyObject":
+			atomic.AddInt32(&copies, 1)
+		case "UploadPartCopy":
+			atomic.AddInt32(&partCopies, 1)
+		}
+	})
+	err = s.fs.copyObjectMaybeMultipart("testCopyPartSize", "testCopyPartSize2")
+	t.Assert(err, IsNil)
+	t.Assert(atomic.LoadInt32(&copies), Equals, int32(1))
+	t.Assert(atomic.LoadInt32(&partCopies), Equals, int32(0))
+}
+
+func (s *GoofysTest) TestCopyPartsBounded(t *C) {
+	fileName := "testCopyParts"
+	size := int64(6 * MIN_PART_SIZE)
+	s.testWriteFile(t, fileName, size, 128*1024)
+
+	s.fs.flags.PartSize = MIN_PART_SIZE
+	s.fs.flags.MaxParallelCopy = 2
+
+	var mu sync.Mutex
+	inflight, maxInflight := 0, 0
+
+	s.fs.s3.Handlers.Send.PushFront(func(r *request.Request) {
+		if r.Operation.Name == "UploadPartCopy" {
+			mu.Lock()
+			inflight++
+			if inflight > maxInflight {
+				maxInflight = inflight
+			}
+			mu.Unlock()
+		}
+	})
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "UploadPartCopy" {
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+		}
+	})
+
+	err := s.fs.copyObjectMultipart(size, fileName, "testCopyParts2", "", nil)
+	t.Assert(err, IsNil)
+	t.Assert(maxInflight > 0, Equals, true)
+	t.Assert(maxInflight <= 2, Equals, true)
+}
+
+func (s *GoofysTest) TestNegativeCache(t *C) {
+	s.fs.flags.TypeCacheTTL = time.Minute
+
+	lookup := func(name string) error {
+		return s.fs.LookUpInode(s.ctx, &fuseops.LookUpInodeOp{
+			Parent: fuseops.RootInodeID,
+			Name:   name,
+		})
+	}
+
+	err := lookup("new_dir")
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	// created behind our back, we still believe it's not there
+	key := "new_dir/"
+	_, err = s.s3.PutObject(&s3.PutObjectInput{Bucket: &s.fs.bucket, Key: &key})
+	t.Assert(err, IsNil)
+
+	err = lookup("new_dir")
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	// but creating it through us is noticed right away
+	err = s.fs.MkDir(s.ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "new_dir"})
+	t.Assert(err, IsNil)
+
+	err = lookup("new_dir")
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestNegativeCacheRace(t *C) {
+	s.fs.flags.TypeCacheTTL = time.Minute
+
+	// created through us while the lookup is waiting for S3
+	var created int32
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "HeadObject" && atomic.CompareAndSwapInt32(&created, 0, 1) {
+			err := s.fs.CreateFile(s.ctx, &fuseops.CreateFileOp{
+				Parent: fuseops.RootInodeID,
+				Name:   "raced",
+			})
+			t.Check(err, IsNil)
+		}
+	})
+
+	s.fs.LookUpInode(s.ctx, &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "raced"})
+	t.Assert(atomic.LoadInt32(&created), Equals, int32(1))
+
+	s.fs.mu.Lock()
+	cached := s.fs.isNegativeCached("raced")
+	s.fs.mu.Unlock()
+	t.Assert(cached, Equals, false)
+
+	// and the cache doesn't grow past its limit when nothing has
+	// expired
+	s.fs.mu.Lock()
+	for i := 0; i < NEGATIVE_CACHE_MAX+10; i++ {
+		s.fs.addNegativeCache(fmt.Sprintf("missing%v", i))
+	}
+	t.Assert(len(s.fs.negativeCache) <= NEGATIVE_CACHE_MAX, Equals, true)
+	s.fs.mu.Unlock()
+}
+
+func (s *GoofysTest) TestSymlink(t *C) {
+	root := s.getRoot(t)
+
+	_, err := root.CreateSymlink(s.fs, "link", "file1")
+	t.Assert(err, IsNil)
+
+	in, err := s.LookUpInode(t, "link")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode&os.ModeSymlink, Equals, os.ModeSymlink)
+
+	// forget what we learned from the lookup
+	in.SymlinkTarget = nil
+	target, err := in.ReadSymlink(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(target, Equals, "file1")
+
+	dh := root.OpenDir()
+	defer dh.CloseDir()
+
+	// without --list-symlinks the listing doesn't HEAD anything
+	for _, en := range s.readDirFully(t, dh) {
+		if en.Name == "link" {
+			t.Assert(en.Type, Equals, fuseutil.DT_File)
+		}
+	}
+
+	s.fs.flags.ListSymlinks = true
+	s.fs.flags.MaxParallelCopy = 1
+
+	// and don't reuse that listing
+	root.mu.Lock()
+	root.invalidateDir(s.fs)
+	root.mu.Unlock()
+
+	dh = root.OpenDir()
+	defer dh.CloseDir()
+
+	for _, en := range s.readDirFully(t, dh) {
+		if en.Name == "link" {
+			t.Assert(en.Type, Equals, fuseutil.DT_Link)
+		} else if en.Name == "zero" {
+			t.Assert(en.Type, Equals, fuseutil.DT_File)
+		}
+	}
+
+	// a regular file is not a symlink
+	in, err = s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	_, err = in.ReadSymlink(s.fs)
+	t.Assert(err, Equals, fuse.EINVAL)
+}
+
+func (s *GoofysTest) TestPosixAttrs(t *C) {
+	s.fs.flags.PosixAttrs = true
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	mode := os.FileMode(0600)
+	mtime := time.Unix(1234567890, 0)
+	uid := uint32(1001)
+	gid := uint32(1002)
+	in.SetAttributes(s.fs, &mode, nil, nil, nil)
+	in.SetAttributes(s.fs, nil, &uid, &gid, &mtime)
+
+	// both changes went out in one copy
+	in.mu.Lock()
+	t.Assert(in.attrTimer, NotNil)
+	in.attrTimer.Stop()
+	in.mu.Unlock()
+	in.flushAttributes(s.fs)
+
+	t.Assert(s.readObject(t, "file1"), Equals, "file1")
+
+	in, err = s.fs.lookUpInodeWithHint(s.ctx, "file1", "file1", LOOKUP_UNKNOWN)
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode, Equals, mode)
+	t.Assert(in.Attributes.Uid, Equals, uid)
+	t.Assert(in.Attributes.Gid, Equals, gid)
+	t.Assert(in.Attributes.Mtime.Equal(mtime), Equals, true)
+
+	heads := 0
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "HeadObject" {
+			heads++
+		}
+	})
+
+	// listing doesn't HEAD anything
+	s.fs.flags.StatCacheTTL = time.Minute
+	root := s.getRoot(t)
+	dh := root.OpenDir()
+	defer dh.CloseDir()
+	s.readDirFully(t, dh)
+	t.Assert(heads, Equals, 0)
+
+	// looking one up does, even though it was just listed
+	in, err = root.LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode, Equals, mode)
+	t.Assert(in.Attributes.Uid, Equals, uid)
+	t.Assert(heads, Equals, 1)
+
+	in, err = root.LookUp(s.ctx, s.fs, "file2")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode, Equals, s.fs.flags.FileMode)
+}
+
+func (s *GoofysTest) TestPosixAttrsRefresh(t *C) {
+	s.fs.flags.PosixAttrs = true
+	s.fs.flags.StatCacheTTL = 0
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	mode := os.FileMode(0600)
+	mtime := time.Unix(1234567890, 0)
+	uid := uint32(1001)
+	in.SetAttributes(s.fs, &mode, &uid, nil, &mtime)
+	in.mu.Lock()
+	in.attrTimer.Stop()
+	in.mu.Unlock()
+
+	// a stat before they are saved doesn't bring back the old ones
+	attr, err := in.GetAttributes(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(attr.Mode, Equals, mode)
+	t.Assert(attr.Uid, Equals, uid)
+	t.Assert(attr.Mtime.Equal(mtime), Equals, true)
+
+	in.flushAttributes(s.fs)
+
+	in, err = s.fs.lookUpInodeWithHint(s.ctx, "file1", "file1", LOOKUP_UNKNOWN)
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode, Equals, mode)
+	t.Assert(in.Attributes.Uid, Equals, uid)
+	t.Assert(in.Attributes.Mtime.Equal(mtime), Equals, true)
+}
+
+func (s *GoofysTest) TestPrefix(t *C) {
+	s.fs = NewGoofys(s.fs.bucket, s.awsConfig, &FlagStorage{
+		StorageClass: "STANDARD",
+		Prefix:       "/dir2/",
+	})
+
+	root := s.getRoot(t)
+	s.assertEntries(t, root, []string{"dir3"})
+
+	in, err := s.LookUpInode(t, "dir3/file4")
+	t.Assert(err, IsNil)
+	t.Assert(*in.FullName, Equals, "dir2/dir3/file4")
+
+	_, fh := root.Create(s.fs, "newfile")
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+
+	t.Assert(s.readObject(t, "dir2/newfile"), Equals, "")
+}
+
+func (s *GoofysTest) TestMetrics(t *C) {
+	count := func(c prometheus.Counter) float64 {
+		var m dto.Metric
+		c.Write(&m)
+		return m.GetCounter().GetValue()
+	}
+
+	lists := count(s3Requests.WithLabelValues("ListObjects"))
+	misses := count(inodeCacheLookups.WithLabelValues("miss"))
+	hits := count(inodeCacheLookups.WithLabelValues("hit"))
+
+	op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "dir1"}
+	err := s.fs.LookUpInode(s.ctx, op)
+	t.Assert(err, IsNil)
+	err = s.fs.LookUpInode(s.ctx, op)
+	t.Assert(err, IsNil)
+
+	t.Assert(count(s3Requests.WithLabelValues("ListObjects")) > lists, Equals, true)
+	t.Assert(count(inodeCacheLookups.WithLabelValues("miss")), Equals, misses+1)
+	t.Assert(count(inodeCacheLookups.WithLabelValues("hit")), Equals, hits+1)
+}
+
+func (s *GoofysTest) TestGetInodeAttributesRefresh(t *C) {
+	s.fs.flags.StatCacheTTL = time.Minute
+
+	inode, err := s.getRoot(t).LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+
+	// grown by someone else
+	key := "file1"
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    &key,
+		Body:   bytes.NewReader([]byte("file1file1")),
+	})
+	t.Assert(err, IsNil)
+
+	attr, err := inode.GetAttributes(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(attr.Size, Equals, uint64(len("file1")))
+
+	s.fs.flags.StatCacheTTL = 0
+
+	attr, err = inode.GetAttributes(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(attr.Size, Equals, uint64(len("file1file1")))
+}
+
+func (s *GoofysTest) TestLookUpForgetRace(t *C) {
+	s.fs.flags.StatCacheTTL = 0
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "file1"}
+	t.Assert(s.fs.LookUpInode(s.ctx, lookup), IsNil)
+	old := lookup.Entry.Child
+
+	// the kernel forgets it while the next lookup refreshes it
+	var forgot int32
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "HeadObject" && atomic.CompareAndSwapInt32(&forgot, 0, 1) {
+			s.fs.ForgetInode(s.ctx, &fuseops.ForgetInodeOp{Inode: old, N: 1})
+		}
+	})
+
+	lookup = &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "file1"}
+	t.Assert(s.fs.LookUpInode(s.ctx, lookup), IsNil)
+	t.Assert(atomic.LoadInt32(&forgot), Equals, int32(1))
+	t.Assert(lookup.Entry.Child, Not(Equals), old)
+
+	in := s.fs.getInodeOrDie(lookup.Entry.Child)
+	in.mu.Lock()
+	t.Assert(in.refcnt, Equals, uint64(1))
+	in.mu.Unlock()
+}
+
+func (s *GoofysTest) TestKeepPageCache(t *C) {
+	s.fs.flags.StatCacheTTL = time.Minute
+
+	inode, err := s.getRoot(t).LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+
+	// nothing was cached from this object yet
+	t.Assert(inode.keepPageCache(s.fs), Equals, false)
+	t.Assert(inode.keepPageCache(s.fs), Equals, true)
+
+	// replaced by someone else
+	key := "file1"
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    &key,
+		Body:   bytes.NewReader([]byte("file2")),
+	})
+	t.Assert(err, IsNil)
+
+	s.fs.flags.StatCacheTTL = 0
+	t.Assert(inode.keepPageCache(s.fs), Equals, false)
+	t.Assert(inode.keepPageCache(s.fs), Equals, true)
+
+	// our own writes are what the kernel has
+	fh := inode.OpenFile(s.fs)
+	err = fh.WriteFile(s.fs, 0, []byte("file3"))
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	t.Assert(inode.keepPageCache(s.fs), Equals, true)
+}
+
+func (s *GoofysTest) TestUnlinkBatched(t *C) {
+	const n = 20
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("batch/file%v", i)
+		_, err := s.s3.PutObject(&s3.PutObjectInput{
+			Bucket: &s.fs.bucket,
+			Key:    &key,
+			Body:   bytes.NewReader([]byte(key)),
+		})
+		t.Assert(err, IsNil)
+	}
+
+	// the first delete is slow, everyone else queues up behind it
+	var singles, batches int32
+	unblock := make(chan struct{})
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "DeleteObject":
+			if atomic.AddInt32(&singles, 1) == 1 {
+				<-unblock
+			}
+		case "DeleteObjects":
+			atomic.AddInt32(&batches, 1)
+		}
+	})
+
+	dir, err := s.LookUpInode(t, "batch")
+	t.Assert(err, IsNil)
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- dir.Unlink(s.fs, fmt.Sprintf("file%v", i))
+		}(i)
+	}
+
+	for {
+		s.fs.deletes.mu.Lock()
+		queued := len(s.fs.deletes.pending)
+		s.fs.deletes.mu.Unlock()
+		if queued == n-1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(unblock)
+
+	for i := 0; i < n; i++ {
+		t.Assert(<-errs, IsNil)
+	}
+	t.Assert(atomic.LoadInt32(&singles), Equals, int32(1))
+	t.Assert(atomic.LoadInt32(&batches), Equals, int32(1))
+
+	err = s.getRoot(t).RmDir(s.fs, "batch")
+	t.Assert(err, IsNil)
+	_, err = s.LookUpInode(t, "batch")
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) TestStatFSUsage(t *C) {
+	var op fuseops.StatFSOp
+	err := s.fs.StatFS(s.ctx, &op)
+	t.Assert(err, IsNil)
+	t.Assert(op.BlocksFree, Equals, op.Blocks)
+
+	s.fs.usage = newUsageStats()
+
+	// what ReadDir sees counts before any scan
+	dh := s.getRoot(t).OpenDir()
+	s.readDirFully(t, dh)
+	dh.CloseDir()
+
+	bytes, objects := s.fs.usage.get()
+	t.Assert(bytes, Equals, uint64(len("file1")+len("file2")))
+	t.Assert(objects, Equals, uint64(3))
+
+	err = s.fs.scanUsage()
+	t.Assert(err, IsNil)
+
+	bytes, objects = s.fs.usage.get()
+	t.Assert(objects, Equals, uint64(len(s.env)))
+
+	var total uint64
+	for key, r := range s.env {
+		if r == nil {
+			total += uint64(len(key))
+		}
+	}
+	t.Assert(bytes, Equals, total)
+
+	err = s.getRoot(t).Unlink(s.fs, "file1")
+	t.Assert(err, IsNil)
+
+	err = s.fs.StatFS(s.ctx, &op)
+	t.Assert(err, IsNil)
+	t.Assert(op.Blocks-op.BlocksFree, Equals, (total-uint64(len("file1"))+4095)/4096)
+	t.Assert(op.Inodes-op.InodesFree, Equals, uint64(len(s.env)-1))
+}
+
+func (s *GoofysTest) TestEndpoint(t *C) {
+	flags := &FlagStorage{
+		StorageClass:   "STANDARD",
+		Endpoint:       *s.awsConfig.Endpoint,
+		UsePathRequest: true,
+	}
+
+	awsConfig := *s.awsConfig
+	awsConfig.Endpoint = nil
+	fs := NewGoofys(s.fs.bucket, &awsConfig, flags)
+	t.Assert(fs, NotNil)
+	t.Assert(*fs.awsConfig.Endpoint, Equals, flags.Endpoint)
+
+	awsConfig = *s.awsConfig
+	fs = NewGoofys("no_such_bucket", &awsConfig, flags)
+	t.Assert(fs, IsNil)
+}
+
+func (s *GoofysTest) TestRegion(t *C) {
+	flags := &FlagStorage{
+		StorageClass: "STANDARD",
+		Region:       "eu-west-1",
+	}
+
+	// the bucket is not looked up at all
+	awsConfig := *s.awsConfig
+	fs := NewGoofys("no_such_bucket", &awsConfig, flags)
+	t.Assert(fs, NotNil)
+	t.Assert(*fs.awsConfig.Region, Equals, "eu-west-1")
+
+	flags.Region = ""
+	awsConfig = *s.awsConfig
+	fs = NewGoofys("no_such_bucket", &awsConfig, flags)
+	t.Assert(fs, IsNil)
+}
+
+func (s *GoofysTest) TestMemoryLimit(t *C) {
+	flags := &FlagStorage{
+		StorageClass:      "STANDARD",
+		MemoryLimit:       2 * BUF_SIZE,
+		HandleMemoryLimit: 3 * BUF_SIZE,
+	}
+	t.Assert(NewGoofys(s.fs.bucket, s.awsConfig, flags), IsNil)
+
+	flags.MemoryLimit = 2*BUF_SIZE + 1
+	flags.HandleMemoryLimit = BUF_SIZE
+	t.Assert(NewGoofys(s.fs.bucket, s.awsConfig, flags), IsNil)
+
+	flags.MemoryLimit = 2 * BUF_SIZE
+	fs := NewGoofys(s.fs.bucket, s.awsConfig, flags)
+	t.Assert(fs, NotNil)
+
+	// the third writer waits for one of the first two
+	h1 := fs.bufferPool.NewPoolHandle()
+	h2 := fs.bufferPool.NewPoolHandle()
+	h3 := fs.bufferPool.NewPoolHandle()
+
+	buf := h1.Request()
+	h2.Request()
+
+	got := make(chan bool)
+	go func() {
+		h3.Request()
+		got <- true
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("got a buffer over the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	h1.Free(buf)
+	<-got
+}
+
+func (s *GoofysTest) TestCleanupUploads(t *C) {
+	key := "interrupted"
+	mpu, err := s.s3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: &s.fs.bucket,
+		Key:    &key,
+	})
+	t.Assert(err, IsNil)
+
+	_, err = s.s3.UploadPart(&s3.UploadPartInput{
+		Bucket:     &s.fs.bucket,
+		Key:        &key,
+		PartNumber: aws.Int64(1),
+		UploadId:   mpu.UploadId,
+		Body:       bytes.NewReader(make([]byte, 1000)),
+	})
+	t.Assert(err, IsNil)
+
+	// too young
+	aborted, size, err := s.fs.CleanupUploads(time.Hour)
+	t.Assert(err, IsNil)
+	t.Assert(aborted, Equals, 0)
+
+	aborted, size, err = s.fs.CleanupUploads(0)
+	t.Assert(err, IsNil)
+	t.Assert(aborted, Equals, 1)
+	t.Assert(size, Equals, int64(1000))
+
+	resp, err := s.s3.ListMultipartUploads(&s3.ListMultipartUploadsInput{Bucket: &s.fs.bucket})
+	t.Assert(err, IsNil)
+	t.Assert(len(resp.Uploads), Equals, 0)
+}
+
+func (s *GoofysTest) TestContentType(t *C) {
+	contentType := func(key string) string {
+		resp, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: &key})
+		t.Assert(err, IsNil)
+		return *resp.ContentType
+	}
+
+	root := s.getRoot(t)
+	write := func(name string, data string) {
+		_, fh := root.Create(s.fs, name)
+		err := fh.WriteFile(s.fs, 0, []byte(data))
+		t.Assert(err, IsNil)
+		err = fh.FlushFile(s.fs)
+		t.Assert(err, IsNil)
+	}
+
+	write("index.html", "hello")
+	t.Assert(strings.HasPrefix(contentType("index.html"), "text/html"), Equals, true)
+
+	// no extension, sniffed
+	write("page", "<html><body>hello</body></html>")
+	t.Assert(contentType("page"), Equals, "text/html; charset=utf-8")
+
+	s.fs.flags.NoContentType = true
+	write("style.css", "body {}")
+	t.Assert(strings.HasPrefix(contentType("style.css"), "text/css"), Equals, false)
+}
+
+func (s *GoofysTest) TestReadDirCache(t *C) {
+	s.fs.flags.TypeCacheTTL = time.Minute
+
+	var lists int
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "ListObjects" {
+			lists++
+		}
+	})
+
+	root := s.getRoot(t)
+	s.assertEntries(t, root, []string{"dir1", "dir2", "empty_dir", "file1", "file2", "zero"})
+	t.Assert(lists, Equals, 1)
+
+	// a new handle is served from the cache
+	s.assertEntries(t, root, []string{"dir1", "dir2", "empty_dir", "file1", "file2", "zero"})
+	t.Assert(lists, Equals, 1)
+
+	err := root.Unlink(s.fs, "file1")
+	t.Assert(err, IsNil)
+
+	s.assertEntries(t, root, []string{"dir1", "dir2", "empty_dir", "file2", "zero"})
+	t.Assert(lists, Equals, 2)
+}
+
+func (s *GoofysTest) TestLookUpHint(t *C) {
+	s.fs.flags.TypeCacheTTL = time.Minute
+
+	var heads, lists int
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "HeadObject":
+			heads++
+		case "ListObjects":
+			lists++
+		}
+	})
+
+	root := s.getRoot(t)
+	s.assertEntries(t, root, []string{"dir1", "dir2", "empty_dir", "file1", "file2", "zero"})
+	heads, lists = 0, 0
+
+	// the listing says what they are
+	in, err := root.LookUp(s.ctx, s.fs, "dir1")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode&os.ModeDir, Not(Equals), os.FileMode(0))
+	t.Assert(heads, Equals, 0)
+	t.Assert(lists, Equals, 1)
+
+	in, err = root.LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode&os.ModeDir, Equals, os.FileMode(0))
+	t.Assert(heads, Equals, 1)
+	t.Assert(lists, Equals, 1)
+
+	heads, lists = 0, 0
+	in, err = s.fs.lookUpInodeWithHint(s.ctx, "dir2", "dir2", LOOKUP_DIR)
+	t.Assert(err, IsNil)
+	t.Assert(*in.FullName, Equals, "dir2")
+	t.Assert(heads, Equals, 0)
+	t.Assert(lists, Equals, 1)
+
+	// both file1 and file1/ exist
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("file1/file3"),
+		Body:   bytes.NewReader([]byte("file3")),
+	})
+	t.Assert(err, IsNil)
+
+	for i := 0; i < 5; i++ {
+		in, err = s.fs.lookUpInodeWithHint(s.ctx, "file1", "file1", LOOKUP_UNKNOWN)
+		t.Assert(err, IsNil)
+		t.Assert(in.Attributes.Mode&os.ModeDir, Not(Equals), os.FileMode(0))
+	}
+}
+
+func (s *GoofysTest) TestReadOnly(t *C) {
+	s.fs.flags.ReadOnly = true
+
+	var writes int
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "HeadObject", "ListObjects", "GetObject":
+		default:
+			writes++
+		}
+	})
+
+	root := fuseops.RootInodeID
+
+	err := s.fs.CreateFile(s.ctx, &fuseops.CreateFileOp{Parent: root, Name: "new_file"})
+	t.Assert(err, Equals, syscall.EROFS)
+	err = s.fs.MkDir(s.ctx, &fuseops.MkDirOp{Parent: root, Name: "new_dir"})
+	t.Assert(err, Equals, syscall.EROFS)
+	err = s.fs.RmDir(s.ctx, &fuseops.RmDirOp{Parent: root, Name: "empty_dir"})
+	t.Assert(err, Equals, syscall.EROFS)
+	err = s.fs.Unlink(s.ctx, &fuseops.UnlinkOp{Parent: root, Name: "file1"})
+	t.Assert(err, Equals, syscall.EROFS)
+	err = s.fs.Rename(s.ctx, &fuseops.RenameOp{
+		OldParent: root, OldName: "file1",
+		NewParent: root, NewName: "file3",
+	})
+	t.Assert(err, Equals, syscall.EROFS)
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	size := uint64(0)
+	err = s.fs.SetInodeAttributes(s.ctx, &fuseops.SetInodeAttributesOp{Inode: in.Id, Size: &size})
+	t.Assert(err, Equals, syscall.EROFS)
+	err = s.fs.WriteFile(s.ctx, &fuseops.WriteFileOp{Inode: in.Id, Data: []byte("x")})
+	t.Assert(err, Equals, syscall.EROFS)
+
+	t.Assert(writes, Equals, 0)
+
+	// reading still works
+	s.assertEntries(t, s.getRoot(t), []string{"dir1", "dir2", "empty_dir", "file1", "file2", "zero"})
+}
+
+func (s *GoofysTest) TestReadDirLarge(t *C) {
+	// more than one ListObjects page
+	const N = 1100
+
+	var wg sync.WaitGroup
+	sem := make(chan bool, 20)
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		sem <- true
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+
+			key := fmt.Sprintf("large_dir/%04v", i)
+			_, err := s.s3.PutObject(&s3.PutObjectInput{
+				Bucket: &s.fs.bucket,
+				Key:    &key,
+				Body:   bytes.NewReader([]byte(key)),
+			})
+			t.Assert(err, IsNil)
+		}(i)
+	}
+	wg.Wait()
+
+	dir, err := s.LookUpInode(t, "large_dir")
+	t.Assert(err, IsNil)
+
+	dh := dir.OpenDir()
+	entries := s.readDirFully(t, dh)
+	dh.CloseDir()
+	t.Assert(len(entries), Equals, N)
+	for i, en := range entries {
+		t.Assert(en.Name, Equals, fmt.Sprintf("%04v", i))
+	}
+
+	s.fs.flags.MaxDirEntries = 10
+	dh = dir.OpenDir()
+	entries = s.readDirFully(t, dh)
+	dh.CloseDir()
+	t.Assert(len(entries), Equals, 10)
+}
+
+func (s *GoofysTest) TestListV2(t *C) {
+	s.fs.flags.UseV2List = true
+
+	var v1, v2 int
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "ListObjects":
+			v1++
+		case "ListObjectsV2":
+			v2++
+		}
+	})
+
+	s.assertEntries(t, s.getRoot(t), []string{"dir1", "dir2", "empty_dir", "file1", "file2", "zero"})
+
+	in, err := s.LookUpInode(t, "dir2/dir3")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode&os.ModeDir, Not(Equals), os.FileMode(0))
+
+	// continuation tokens work the same as markers
+	s.TestReadDirLarge(t)
+
+	t.Assert(v1, Equals, 0)
+	t.Assert(v2 > 2, Equals, true)
+}
+
+func (s *GoofysTest) TestLink(t *C) {
+	root := s.getRoot(t)
+
+	file1, err := root.LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+
+	in, err := root.Link(s.fs, "file1_link", file1)
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(len("file1")))
+	t.Assert(in.Attributes.Nlink, Equals, uint32(1))
+	t.Assert(s.readObject(t, "file1_link"), Equals, "file1")
+
+	// they are separate objects
+	fh := in.OpenFile(s.fs)
+	err = fh.Truncate(s.fs, 0)
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	fh.Release()
+	t.Assert(s.readObject(t, "file1_link"), Equals, "")
+	t.Assert(s.readObject(t, "file1"), Equals, "file1")
+
+	dir1, err := root.LookUp(s.ctx, s.fs, "dir1")
+	t.Assert(err, IsNil)
+	_, err = root.Link(s.fs, "dir1_link", dir1)
+	t.Assert(err, Equals, syscall.EPERM)
+}
+
+func (s *GoofysTest) TestTruncate(t *C) {
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	// nobody has it open
+	err = s.fs.truncate(in, 2)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, "file1"), Equals, "fi")
+
+	err = s.fs.truncate(in, 4)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, "file1"), Equals, "fi\x00\x00")
+
+	err = s.fs.truncate(in, 0)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, "file1"), Equals, "")
+
+	// a handle that hasn't written anything may never upload, so
+	// it's truncated right away
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "file2"}
+	t.Assert(s.fs.LookUpInode(s.ctx, lookup), IsNil)
+	in = s.fs.getInodeOrDie(lookup.Entry.Child)
+	open := &fuseops.OpenFileOp{Inode: in.Id}
+	t.Assert(s.fs.OpenFile(s.ctx, open), IsNil)
+	err = s.fs.truncate(in, 1)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, "file2"), Equals, "f")
+	fh := s.fs.fileHandles[open.Handle]
+	t.Assert(fh.dirty, Equals, false)
+
+	// and what that handle writes next replaces the truncated
+	// object, not the one it opened
+	s.fs.flags.ConditionalWrites = true
+	err = fh.WriteFile(s.fs, 1, []byte("!"))
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, "file2"), Equals, "f!")
+	err = s.fs.ReleaseFileHandle(s.ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle})
+	t.Assert(err, IsNil)
+
+	// truncating in the middle of writing
+	_, fh = s.getRoot(t).Create(s.fs, "new_file")
+	err = fh.WriteFile(s.fs, 0, []byte("hello world"))
+	t.Assert(err, IsNil)
+	err = fh.Truncate(s.fs, 5)
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(s.fs, 5, []byte("!"))
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, "new_file"), Equals, "hello!")
+}
+
+func (s *GoofysTest) TestAppend(t *C) {
+	var copies, gets int
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "UploadPartCopy":
+			copies++
+		case "GetObject":
+			gets++
+		}
+	})
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	fh := in.OpenFile(s.fs)
+	err = fh.WriteFile(s.fs, int64(len("file1")), []byte("+log"))
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(s.fs, int64(len("file1+log")), []byte("+log"))
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	t.Assert(s.readObject(t, "file1"), Equals, "file1+log+log")
+	t.Assert(copies, Equals, 0)
+
+	// the whole part is copied and only the tail is read back
+	key := "big_log"
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(make([]byte, BUF_SIZE+3)),
+	})
+	t.Assert(err, IsNil)
+
+	in, err = s.LookUpInode(t, key)
+	t.Assert(err, IsNil)
+
+	copies, gets = 0, 0
+	fh = in.OpenFile(s.fs)
+	err = fh.WriteFile(s.fs, BUF_SIZE+3, []byte("tail"))
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	t.Assert(copies, Equals, 1)
+	t.Assert(gets, Equals, 1)
+
+	content := s.readObject(t, key)
+	t.Assert(len(content), Equals, BUF_SIZE+3+len("tail"))
+	t.Assert(strings.HasSuffix(content, "\x00\x00\x00tail"), Equals, true)
+}
+
+func (s *GoofysTest) TestFlushInterval(t *C) {
+	s.fs.flags.FlushInterval = 100 * time.Millisecond
+
+	in, fh := s.getRoot(t).Create(s.fs, "slow_log")
+
+	part := make([]byte, BUF_SIZE)
+	err := fh.WriteFile(s.fs, 0, part)
+	t.Assert(err, IsNil)
+	err = fh.WriteFile(s.fs, BUF_SIZE, []byte("line1\n"))
+	t.Assert(err, IsNil)
+
+	time.Sleep(time.Second)
+	content := s.readObject(t, "slow_log")
+	t.Assert(len(content), Equals, BUF_SIZE+len("line1\n"))
+
+	err = fh.WriteFile(s.fs, int64(in.Attributes.Size), []byte("line2\n"))
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	content = s.readObject(t, "slow_log")
+	t.Assert(content[BUF_SIZE:], Equals, "line1\nline2\n")
+}
+
+func (s *GoofysTest) TestFlushIntervalRelease(t *C) {
+	s.fs.flags.FlushInterval = time.Hour
+
+	_, fh := s.getRoot(t).Create(s.fs, "released_log")
+	err := fh.WriteFile(s.fs, 0, make([]byte, BUF_SIZE+1))
+	t.Assert(err, IsNil)
+
+	// the timer fired just as the handle was released
+	fh.Release()
+	fh.lastWrite = time.Time{}
+	fh.idleFlush(s.fs)
+
+	_, err = s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("released_log"),
+	})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) TestConditionalWrites(t *C) {
+	s.fs.flags.ConditionalWrites = true
+
+	var ifMatch, ifNoneMatch string
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "PutObject" {
+			ifMatch = r.HTTPRequest.Header.Get("If-Match")
+			ifNoneMatch = r.HTTPRequest.Header.Get("If-None-Match")
+		}
+	})
+
+	root := s.getRoot(t)
+	_, fh := root.Create(s.fs, "new_file")
+	err := fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(ifNoneMatch, Equals, "*")
+	t.Assert(ifMatch, Equals, "")
+
+	in, err := root.LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	etag := *in.ETag
+
+	fh = in.OpenFile(s.fs)
+	err = fh.Truncate(s.fs, 1)
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(ifMatch, Equals, etag)
+	t.Assert(ifNoneMatch, Equals, "")
+
+	// the next flush expects what we just uploaded
+	etag = *fh.etag
+	err = fh.Truncate(s.fs, 0)
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(ifMatch, Equals, etag)
+	fh.Release()
+
+	precondition := awserr.NewRequestFailure(awserr.New("PreconditionFailed", "", nil), 412, "")
+	t.Assert(mapAwsError(precondition), Equals, syscall.ESTALE)
+}
+
+func (s *GoofysTest) TestXattr(t *C) {
+	s.fs.flags.Xattr = true
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	_, err = in.GetXattr(s.fs, "user.foo")
+	t.Assert(err, Equals, fuse.ENOATTR)
+
+	err = in.SetXattr(s.fs, "user.foo", []byte("bar"), 0)
+	t.Assert(err, IsNil)
+	err = in.SetXattr(s.fs, "user.bin", []byte{0, 1, 2}, XATTR_CREATE)
+	t.Assert(err, IsNil)
+	err = in.SetXattr(s.fs, "user.bin", []byte{3}, XATTR_CREATE)
+	t.Assert(err, Equals, syscall.EEXIST)
+	err = in.SetXattr(s.fs, "user.nope", []byte{3}, XATTR_REPLACE)
+	t.Assert(err, Equals, fuse.ENOATTR)
+	err = in.SetXattr(s.fs, "security.selinux", []byte("x"), 0)
+	t.Assert(err, Equals, syscall.ENOTSUP)
+	err = in.SetXattr(s.fs, "user.big", make([]byte, METADATA_MAX_SIZE), 0)
+	t.Assert(err, Equals, syscall.E2BIG)
+
+	// make sure it's in S3 and not just cached
+	in, err = s.fs.lookUpInodeWithHint(s.ctx, "file1", "file1", LOOKUP_UNKNOWN)
+	t.Assert(err, IsNil)
+
+	value, err := in.GetXattr(s.fs, "user.foo")
+	t.Assert(err, IsNil)
+	t.Assert(string(value), Equals, "bar")
+
+	value, err = in.GetXattr(s.fs, "user.bin")
+	t.Assert(err, IsNil)
+	t.Assert(value, DeepEquals, []byte{0, 1, 2})
+
+	names, err := in.ListXattr(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(names, DeepEquals, []string{"user.bin", "user.foo"})
+
+	err = in.RemoveXattr(s.fs, "user.foo")
+	t.Assert(err, IsNil)
+	err = in.RemoveXattr(s.fs, "user.foo")
+	t.Assert(err, Equals, fuse.ENOATTR)
+
+	t.Assert(s.readObject(t, "file1"), Equals, "file1")
+}
+
+func (s *GoofysTest) TestTagging(t *C) {
+	flags := &FlagStorage{
+		StorageClass: "STANDARD",
+		Tagging:      "a=1&a=2",
+	}
+	t.Assert(NewGoofys(s.fs.bucket, s.awsConfig, flags), IsNil)
+
+	flags.Tagging = "=1"
+	t.Assert(NewGoofys(s.fs.bucket, s.awsConfig, flags), IsNil)
+
+	flags.Tagging = "%zz"
+	t.Assert(NewGoofys(s.fs.bucket, s.awsConfig, flags), IsNil)
+
+	s.fs.flags.Tagging = "project=x&classification=internal"
+
+	fileName := "testTagging"
+	s.testWriteFile(t, fileName, 1, 128*1024)
+
+	resp, err := s.s3.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: &s.fs.bucket,
+		Key:    &fileName,
+	})
+	t.Assert(err, IsNil)
+
+	tags := make(map[string]string)
+	for _, tag := range resp.TagSet {
+		tags[*tag.Key] = *tag.Value
+	}
+	t.Assert(tags, DeepEquals, map[string]string{
+		"project":        "x",
+		"classification": "internal",
+	})
+}
+
+func (s *GoofysTest) TestForgetInodeReleasesState(t *C) {
+	op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "file1"}
+	err := s.fs.LookUpInode(s.ctx, op)
+	t.Assert(err, IsNil)
+	id := op.Entry.Child
+
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	err = s.fs.OpenFile(s.ctx, openOp)
+	t.Assert(err, IsNil)
+	t.Assert(s.fs.checkInvariants(), IsNil)
+
+	// the kernel is supposed to release the handle first
+	s.ForgetInode(t, id)
+	t.Assert(s.fs.checkInvariants(), IsNil)
+
+	s.fs.mu.Lock()
+	_, ok := s.fs.inodes[id]
+	t.Assert(ok, Equals, false)
+	_, ok = s.fs.inodesCache["file1"]
+	t.Assert(ok, Equals, false)
+	_, ok = s.fs.fileHandles[openOp.Handle]
+	t.Assert(ok, Equals, false)
+	s.fs.mu.Unlock()
+
+	// a newer inode with the same name is not forgotten along
+	// with the old one
+	err = s.fs.LookUpInode(s.ctx, op)
+	t.Assert(err, IsNil)
+	old := op.Entry.Child
+
+	createOp := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "file1"}
+	err = s.fs.CreateFile(s.ctx, createOp)
+	t.Assert(err, IsNil)
+	t.Assert(createOp.Entry.Child, Not(Equals), old)
+
+	s.ForgetInode(t, old)
+	s.fs.mu.Lock()
+	t.Assert(s.fs.inodesCache["file1"].Id, Equals, createOp.Entry.Child)
+	s.fs.mu.Unlock()
+	t.Assert(s.fs.checkInvariants(), IsNil)
+
+	// expired listings are dropped by the sweeper
+	root := s.getRoot(t)
+	s.fs.flags.TypeCacheTTL = time.Hour
+	root.cacheListing(s.fs, root.dirGen, []dirPage{dirPage{}})
+	t.Assert(root.dirPages, NotNil)
+	s.fs.flags.TypeCacheTTL = 0
+	s.fs.sweep()
+	t.Assert(root.dirPages, IsNil)
+}
+
+func (s *GoofysTest) TestHTTPClient(t *C) {
+	flags := &FlagStorage{
+		StorageClass:          "STANDARD",
+		ResponseHeaderTimeout: time.Minute,
+		DisableHTTP2:          true,
+	}
+
+	awsConfig := *s.awsConfig
+	awsConfig.HTTPClient = nil
+	fs := NewGoofys(s.fs.bucket, &awsConfig, flags)
+	t.Assert(fs, NotNil)
+
+	transport := fs.awsConfig.HTTPClient.Transport.(*http.Transport)
+	t.Assert(transport.MaxIdleConnsPerHost, Equals, 1000)
+	t.Assert(transport.ResponseHeaderTimeout, Equals, time.Minute)
+	t.Assert(transport.TLSNextProto, NotNil)
+	t.Assert(transport.TLSNextProto, HasLen, 0)
+
+	// and it works
+	_, err := fs.lookUpInodeWithHint(s.ctx, "file1", "file1", LOOKUP_UNKNOWN)
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestTLSConfig(t *C) {
+	flags := &FlagStorage{}
+	config, err := newTLSConfig(flags)
+	t.Assert(err, IsNil)
+	t.Assert(config, IsNil)
+
+	flags.InsecureTLS = true
+	config, err = newTLSConfig(flags)
+	t.Assert(err, IsNil)
+	t.Assert(config.InsecureSkipVerify, Equals, true)
+
+	f, err := ioutil.TempFile("", "goofys")
+	t.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	flags.CABundlePath = f.Name()
+	_, err = newTLSConfig(flags)
+	t.Assert(err, NotNil)
+
+	flags.CABundlePath = f.Name() + ".missing"
+	_, err = newTLSConfig(flags)
+	t.Assert(err, NotNil)
+
+	awsConfig := *s.awsConfig
+	awsConfig.HTTPClient = nil
+	flags.StorageClass = "STANDARD"
+	t.Assert(NewGoofys(s.fs.bucket, &awsConfig, flags), IsNil)
+}
+
+func (s *GoofysTest) TestRequestContext(t *C) {
+	root := s.getRoot(t)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	cancel()
+
+	_, err := root.LookUp(ctx, s.fs, "file1")
+	t.Assert(err, Equals, syscall.EINTR)
+
+	in, err := root.LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+
+	buf := make([]byte, 5)
+	_, err = fh.ReadFile(ctx, s.fs, 0, buf)
+	t.Assert(err, Equals, syscall.EINTR)
+
+	// the read after that isn't affected
+	n, err := fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:n]), Equals, "file1")
+
+	// requests that take too long are retried
+	attempts := 0
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "HeadObject" {
+			attempts++
+		}
+	})
+	s.fs.flags.RequestTimeout = time.Nanosecond
+	s.fs.flags.MaxRetries = 2
+
+	errc := make(chan error, 1)
+	s.fs.LookUpInodeNotDir(s.ctx, "file2", make(chan HeadBlobOutput, 1), errc)
+	t.Assert(<-errc, Equals, syscall.ETIMEDOUT)
+	t.Assert(attempts, Equals, 3)
+}
+
+func (s *GoofysTest) TestRetryable(t *C) {
+	failure := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, code, nil), status, "")
+	}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{failure("InternalError", 500), true},
+		{failure("ServiceUnavailable", 503), true},
+		{failure("SlowDown", 503), true},
+		{awserr.New("RequestError", "send request failed", reset), true},
+		{reset, true},
+		{failure("AccessDenied", 403), false},
+		{failure("NoSuchKey", 404), false},
+	} {
+		t.Assert(isRetryable(test.err), Equals, test.retryable)
+
+		attempts := 0
+		err := retryWithFlags(&FlagStorage{MaxRetries: 2}, func() error {
+			attempts++
+			return test.err
+		})
+		t.Assert(err, Equals, test.err)
+		if test.retryable {
+			t.Assert(attempts, Equals, 3)
+		} else {
+			t.Assert(attempts, Equals, 1)
+		}
+	}
+
+	// --max-retries 0 is one try, the SDK doesn't retry either
+	attempts := 0
+	err := retryWithFlags(&FlagStorage{}, func() error {
+		attempts++
+		return failure("SlowDown", 503)
+	})
+	t.Assert(err, NotNil)
+	t.Assert(attempts, Equals, 1)
+	t.Assert(*s.fs.awsConfig.MaxRetries, Equals, 0)
+}
+
+func (s *GoofysTest) TestETag(t *C) {
+	head, err := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("file1"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(head.ETag, NotNil)
+
+	root := s.getRoot(t)
+
+	in, err := root.LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(*in.ETag, Equals, *head.ETag)
+
+	// from the listing
+	dh := root.OpenDir()
+	s.readDirFully(t, dh)
+	t.Assert(*dh.NameToETag["file1"], Equals, *head.ETag)
+
+	in, err = root.LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(*in.ETag, Equals, *head.ETag)
+	dh.CloseDir()
+
+	fh := in.OpenFile(s.fs)
+	t.Assert(*fh.etag, Equals, *head.ETag)
+
+	err = fh.WriteFile(s.fs, 0, []byte("new content"))
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	head, err = s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("file1"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(*in.ETag, Equals, *head.ETag)
+
+	// someone else changes it
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("file1"),
+		Body:   bytes.NewReader([]byte("changed")),
+	})
+	t.Assert(err, IsNil)
+
+	in.mu.Lock()
+	in.attrTime = time.Time{}
+	in.mu.Unlock()
+	_, err = in.GetAttributes(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(*in.ETag, Not(Equals), *head.ETag)
+}
+
+func (s *GoofysTest) TestReadReplaced(t *C) {
+	s.fs.flags.ReadAheadSize = 0
+
+	data := make([]byte, 1024*1024)
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("replaced"),
+		Body:   bytes.NewReader(data),
+	})
+	t.Assert(err, IsNil)
+
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, "replaced")
+	t.Assert(err, IsNil)
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+
+	buf := make([]byte, 4096)
+	_, err = fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, IsNil)
+
+	data[0] = 1
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("replaced"),
+		Body:   bytes.NewReader(data),
+	})
+	t.Assert(err, IsNil)
+
+	// too far ahead to read through, this reopens the stream
+	_, err = fh.ReadFile(s.ctx, s.fs, 512*1024, buf)
+	t.Assert(err, Equals, syscall.ESTALE)
+
+	// a new open sees the new object
+	in, err = s.getRoot(t).LookUp(s.ctx, s.fs, "replaced")
+	t.Assert(err, IsNil)
+	fh2 := in.OpenFile(s.fs)
+	defer fh2.Release()
+
+	n, err := fh2.ReadFile(s.ctx, s.fs, 0, buf[:1])
+	t.Assert(err, IsNil)
+	t.Assert(n, Equals, 1)
+	t.Assert(buf[0], Equals, byte(1))
+}
+
+func (s *GoofysTest) TestNoStatCache(t *C) {
+	s.fs.flags.StatCacheTTL = 0
+
+	op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "file1"}
+	err := s.fs.LookUpInode(s.ctx, op)
+	t.Assert(err, IsNil)
+	t.Assert(op.Entry.Attributes.Size, Equals, uint64(len("file1")))
+	t.Assert(op.Entry.AttributesExpiration.After(time.Now()), Equals, false)
+
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("file1"),
+		Body:   bytes.NewReader([]byte("changed by someone else")),
+	})
+	t.Assert(err, IsNil)
+
+	attrOp := &fuseops.GetInodeAttributesOp{Inode: op.Entry.Child}
+	err = s.fs.GetInodeAttributes(s.ctx, attrOp)
+	t.Assert(err, IsNil)
+	t.Assert(attrOp.Attributes.Size, Equals, uint64(len("changed by someone else")))
+	t.Assert(attrOp.AttributesExpiration.After(time.Now()), Equals, false)
+
+	// the same inode the kernel already has, with what S3 says now
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("file1"),
+		Body:   bytes.NewReader([]byte("changed again")),
+	})
+	t.Assert(err, IsNil)
+	id := op.Entry.Child
+	err = s.fs.LookUpInode(s.ctx, op)
+	t.Assert(err, IsNil)
+	t.Assert(op.Entry.Child, Equals, id)
+	t.Assert(op.Entry.Attributes.Size, Equals, uint64(len("changed again")))
+
+	// one we are writing isn't in S3 yet
+	createOp := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "unflushed"}
+	err = s.fs.CreateFile(s.ctx, createOp)
+	t.Assert(err, IsNil)
+	err = s.fs.WriteFile(s.ctx, &fuseops.WriteFileOp{
+		Inode:  createOp.Entry.Child,
+		Handle: createOp.Handle,
+		Data:   []byte("hello"),
+	})
+	t.Assert(err, IsNil)
+	unflushed := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "unflushed"}
+	err = s.fs.LookUpInode(s.ctx, unflushed)
+	t.Assert(err, IsNil)
+	t.Assert(unflushed.Entry.Child, Equals, createOp.Entry.Child)
+	t.Assert(unflushed.Entry.Attributes.Size, Equals, uint64(5))
+
+	// lookups don't trust the inode we already have either
+	_, err = s.s3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("file1"),
+	})
+	t.Assert(err, IsNil)
+
+	err = s.fs.LookUpInode(s.ctx, op)
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) TestReadArchived(t *C) {
+	restores := 0
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "GetObject":
+			r.Error = awserr.NewRequestFailure(awserr.New("InvalidObjectState",
+				"The operation is not valid for the object's storage class", nil), 403, "")
+		case "RestoreObject":
+			restores++
+			// as good as success
+			r.Error = awserr.NewRequestFailure(awserr.New("RestoreAlreadyInProgress",
+				"Object restore is already in progress", nil), 409, "")
+		}
+	})
+
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+
+	buf := make([]byte, 5)
+	_, err = fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, Equals, syscall.ENODATA)
+	t.Assert(restores, Equals, 0)
+
+	s.fs.flags.RestoreDays = 1
+	_, err = fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, Equals, syscall.EAGAIN)
+	t.Assert(restores, Equals, 1)
+
+	// only asked once
+	_, err = fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, Equals, syscall.EAGAIN)
+	t.Assert(restores, Equals, 1)
+}
+
+func (s *GoofysTest) TestDirMarkers(t *C) {
+	root := s.getRoot(t)
+
+	// marker only
+	in, err := root.LookUp(s.ctx, s.fs, "empty_dir")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode&os.ModeDir, Not(Equals), os.FileMode(0))
+	s.assertEntries(t, in, nil)
+	err = root.RmDir(s.fs, "empty_dir")
+	t.Assert(err, IsNil)
+	_, err = root.LookUp(s.ctx, s.fs, "empty_dir")
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	// no marker, the directory goes away with its last file
+	dir1, err := root.LookUp(s.ctx, s.fs, "dir1")
+	t.Assert(err, IsNil)
+	err = root.RmDir(s.fs, "dir1")
+	t.Assert(err, Equals, fuse.ENOTEMPTY)
+	err = dir1.Unlink(s.fs, "file3")
+	t.Assert(err, IsNil)
+	s.assertEntries(t, dir1, nil)
+	err = root.RmDir(s.fs, "dir1")
+	t.Assert(err, IsNil)
+
+	// marker and content
+	dir2, err := root.LookUp(s.ctx, s.fs, "dir2")
+	t.Assert(err, IsNil)
+	dir3, err := dir2.LookUp(s.ctx, s.fs, "dir3")
+	t.Assert(err, IsNil)
+	s.assertEntries(t, dir3, []string{"file4"})
+	err = dir2.RmDir(s.fs, "dir3")
+	t.Assert(err, Equals, fuse.ENOTEMPTY)
+	err = dir3.Unlink(s.fs, "file4")
+	t.Assert(err, IsNil)
+	s.assertEntries(t, dir3, nil)
+	err = dir2.RmDir(s.fs, "dir3")
+	t.Assert(err, IsNil)
+	_, err = s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: aws.String("dir2/dir3/")})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+
+	// what MkDir makes is the same as a marker made by someone else
+	newDir, err := root.MkDir(s.fs, "new_dir")
+	t.Assert(err, IsNil)
+	t.Assert(*newDir.FullName, Equals, "new_dir")
+	s.assertEntries(t, newDir, nil)
+	err = root.RmDir(s.fs, "new_dir")
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestRenamePreservesMtime(t *C) {
+	root := s.getRoot(t)
+
+	resp, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: aws.String("file1")})
+	t.Assert(err, IsNil)
+	mtime := resp.LastModified.Unix()
+
+	// so that the copy would get a different LastModified
+	time.Sleep(time.Second)
+
+	err = root.Rename(s.fs, "file1", root, "new_file")
+	t.Assert(err, IsNil)
+
+	resp, err = s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: aws.String("new_file")})
+	t.Assert(err, IsNil)
+	t.Assert(*metadataValue(resp.Metadata, MTIME_META), Equals, strconv.FormatInt(mtime, 10))
+
+	in, err := root.LookUp(s.ctx, s.fs, "new_file")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mtime.Unix(), Equals, mtime)
+}
+
+func (s *GoofysTest) TestLookUpFromListing(t *C) {
+	s.fs.flags.TypeCacheTTL = time.Minute
+	s.fs.flags.StatCacheTTL = time.Minute
+
+	var requests int
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		requests++
+	})
+
+	root := s.getRoot(t)
+	s.assertEntries(t, root, []string{"dir1", "dir2", "empty_dir", "file1", "file2", "zero"})
+	requests = 0
+
+	// the handle is closed but the listing is still good
+	in, err := root.LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(len("file1")))
+	t.Assert(in.ETag, NotNil)
+
+	in, err = root.LookUp(s.ctx, s.fs, "dir1")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode&os.ModeDir, Not(Equals), os.FileMode(0))
+	t.Assert(requests, Equals, 0)
+
+	// not once it's older than the stat cache
+	s.fs.flags.StatCacheTTL = time.Nanosecond
+	_, err = root.LookUp(s.ctx, s.fs, "file2")
+	t.Assert(err, IsNil)
+	t.Assert(requests, Not(Equals), 0)
+}
+
+func (s *GoofysTest) TestSignatureV2(t *C) {
+	// the example from the S3 docs
+	req, err := http.NewRequest("GET", "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg?acl&foo=bar", nil)
+	t.Assert(err, IsNil)
+	req.Header.Set("Date", "Tue, 27 Mar 2007 19:36:42 +0000")
+	req.Header.Set("X-Amz-Meta-B", "2")
+	req.Header.Set("X-Amz-Meta-A", "1")
+	t.Assert(stringToSignV2(req, "johnsmith"), Equals,
+		"GET\n\n\nTue, 27 Mar 2007 19:36:42 +0000\n"+
+			"x-amz-meta-a:1\nx-amz-meta-b:2\n"+
+			"/johnsmith/photos/puppy.jpg?acl")
+
+	awsConfig := *s.awsConfig
+	fs := NewGoofys(s.fs.bucket, &awsConfig, &FlagStorage{
+		StorageClass: "STANDARD",
+		SignatureV2:  true,
+	})
+	t.Assert(fs, NotNil)
+	s.fs = fs
+
+	s.assertEntries(t, s.getRoot(t), []string{"dir1", "dir2", "empty_dir", "file1", "file2", "zero"})
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(len("file1")))
+}
+
+func (s *GoofysTest) TestWriteWhileFlushing(t *C) {
+	fileName := "testWriteWhileFlushing"
+	size := 2*BUF_SIZE + 128*1024
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	_, fh := s.getRoot(t).Create(s.fs, fileName)
+
+	done := make(chan struct{})
+	flushed := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-done:
+				flushed <- nil
+				return
+			default:
+			}
+
+			err := fh.FlushFile(s.fs)
+			if err != nil {
+				flushed <- err
+				return
+			}
+		}
+	}()
+
+	for off := 0; off < size; off += 128 * 1024 {
+		err := fh.WriteFile(s.fs, int64(off), data[off:off+128*1024])
+		t.Assert(err, IsNil)
+	}
+	close(done)
+	t.Assert(<-flushed, IsNil)
+
+	err := fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	fh.Release()
+
+	resp, err := s.s3.GetObject(&s3.GetObjectInput{Bucket: &s.fs.bucket, Key: &fileName})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Equal(content, data), Equals, true)
+}
+
+func (s *GoofysTest) TestNoDirMarkers(t *C) {
+	s.fs.flags.NoDirMarkers = true
+	s.fs.localDirs = newLocalDirs()
+
+	root := s.getRoot(t)
+	dir, err := root.MkDir(s.fs, "new_dir")
+	t.Assert(err, IsNil)
+
+	_, err = s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: aws.String("new_dir/")})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+
+	// it's still there as far as we are concerned
+	in, err := root.LookUp(s.ctx, s.fs, "new_dir")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode&os.ModeDir, Not(Equals), os.FileMode(0))
+	s.assertEntries(t, root, []string{"dir1", "dir2", "empty_dir", "file1", "file2", "new_dir", "zero"})
+	s.assertEntries(t, dir, nil)
+
+	err = root.Rename(s.fs, "new_dir", root, "new_dir2")
+	t.Assert(err, IsNil)
+	_, err = root.LookUp(s.ctx, s.fs, "new_dir")
+	t.Assert(err, Equals, fuse.ENOENT)
+	dir, err = root.LookUp(s.ctx, s.fs, "new_dir2")
+	t.Assert(err, IsNil)
+
+	// once something is in it S3 knows about it
+	_, fh := dir.Create(s.fs, "file")
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+	s.assertEntries(t, root, []string{"dir1", "dir2", "empty_dir", "file1", "file2", "new_dir2", "zero"})
+	t.Assert(s.fs.localDirs.has("new_dir2"), Equals, false)
+
+	err = root.RmDir(s.fs, "new_dir2")
+	t.Assert(err, Equals, fuse.ENOTEMPTY)
+	err = dir.Unlink(s.fs, "file")
+	t.Assert(err, IsNil)
+	err = root.RmDir(s.fs, "new_dir2")
+	t.Assert(err, IsNil)
+
+	root.MkDir(s.fs, "empty")
+	err = root.RmDir(s.fs, "empty")
+	t.Assert(err, IsNil)
+	_, err = root.LookUp(s.ctx, s.fs, "empty")
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	// mkdir -p a/b, neither of which S3 knows about
+	dir, err = root.MkDir(s.fs, "a")
+	t.Assert(err, IsNil)
+	_, err = dir.MkDir(s.fs, "b")
+	t.Assert(err, IsNil)
+	err = root.RmDir(s.fs, "a")
+	t.Assert(err, Equals, fuse.ENOTEMPTY)
+	t.Assert(s.fs.localDirs.has("a/b"), Equals, true)
+
+	// a is listed where it sorts, not after everything on the
+	// last page
+	s.fs.flags.ListPageSize = 2
+	dh := root.OpenDir()
+	defer dh.CloseDir()
+	entries := s.readDirFully(t, dh)
+	t.Assert(entries[0].Name, Equals, "a")
+	seen := 0
+	for _, en := range entries {
+		if en.Name == "a" {
+			seen++
+		}
+	}
+	t.Assert(seen, Equals, 1)
+}
+
+func (s *GoofysTest) TestUnknownHandle(t *C) {
+	bogus := fuseops.HandleID(12345)
+
+	err := s.fs.ReadDir(s.ctx, &fuseops.ReadDirOp{Handle: bogus})
+	t.Assert(err, Equals, syscall.EBADF)
+
+	err = s.fs.ReleaseDirHandle(s.ctx, &fuseops.ReleaseDirHandleOp{Handle: bogus})
+	t.Assert(err, Equals, syscall.EBADF)
+
+	err = s.fs.ReadFile(s.ctx, &fuseops.ReadFileOp{Handle: bogus})
+	t.Assert(err, Equals, syscall.EBADF)
+
+	err = s.fs.WriteFile(s.ctx, &fuseops.WriteFileOp{Handle: bogus, Data: []byte("x")})
+	t.Assert(err, Equals, syscall.EBADF)
+
+	err = s.fs.FlushFile(s.ctx, &fuseops.FlushFileOp{Handle: bogus})
+	t.Assert(err, Equals, syscall.EBADF)
+
+	err = s.fs.SyncFile(s.ctx, &fuseops.SyncFileOp{Handle: bogus})
+	t.Assert(err, Equals, syscall.EBADF)
+}
+
+func (s *GoofysTest) TestFlushAll(t *C) {
+	root := s.getRoot(t)
+
+	names := []string{"flushAll1", "flushAll2", "flushAll3"}
+	for i, name := range names {
+		_, fh := root.Create(s.fs, name)
+		err := fh.WriteFile(s.fs, 0, []byte(name))
+		t.Assert(err, IsNil)
+		s.fs.fileHandles[fuseops.HandleID(1000+i)] = fh
+	}
+	// nothing to do for a handle that's only read
+	in, err := root.LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	s.fs.fileHandles[fuseops.HandleID(2000)] = in.OpenFile(s.fs)
+
+	flushed, err := s.fs.FlushAll()
+	t.Assert(err, IsNil)
+	t.Assert(flushed, Equals, len(names))
+
+	for _, name := range names {
+		t.Assert(s.readObject(t, name), Equals, name)
+	}
+
+	flushed, err = s.fs.FlushAll()
+	t.Assert(err, IsNil)
+	t.Assert(flushed, Equals, 0)
+}
+
+func (s *GoofysTest) TestTokenBucket(t *C) {
+	b := newTokenBucket(1024 * 1024)
+
+	now := b.last
+	var slept time.Duration
+	b.now = func() time.Time { return now }
+	b.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	// a second worth is there to begin with
+	b.take(1024 * 1024)
+	t.Assert(slept, Equals, time.Duration(0))
+
+	b.take(512 * 1024)
+	t.Assert(slept, Equals, 500*time.Millisecond)
+
+	// what came in while we were idle can be used right away
+	now = now.Add(250 * time.Millisecond)
+	slept = 0
+	b.take(256 * 1024)
+	t.Assert(slept, Equals, time.Duration(0))
+
+	// but no more than a second worth
+	now = now.Add(time.Hour)
+	b.take(2 * 1024 * 1024)
+	t.Assert(slept, Equals, time.Second)
+
+	// the limit only applies to a client we make
+	flags := &FlagStorage{StorageClass: "STANDARD", MaxReadBps: 1024 * 1024}
+	awsConfig := *s.awsConfig
+	awsConfig.HTTPClient = &http.Client{}
+	_, err := NewGoofysWithError(s.fs.bucket, &awsConfig, flags)
+	t.Assert(err, NotNil)
+}
+
+func (s *GoofysTest) TestVersionNames(t *C) {
+	base, version := splitVersion("file1@version=abc")
+	t.Assert(base, Equals, "file1")
+	t.Assert(version, Equals, "abc")
+
+	base, version = splitVersion("file1")
+	t.Assert(base, Equals, "file1")
+	t.Assert(version, Equals, "")
+
+	base, version = splitVersion("@version=abc")
+	t.Assert(base, Equals, "@version=abc")
+	t.Assert(version, Equals, "")
+
+	root := s.getRoot(t)
+
+	// just a name without --versions
+	_, err := root.LookUp(s.ctx, s.fs, "file1@version=abc")
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	s.fs.flags.Versions = true
+	err = root.Unlink(s.fs, "file1@version=abc")
+	t.Assert(err, Equals, syscall.EROFS)
+}
+
+func (s *GoofysTest) TestRenameSpecialChars(t *C) {
+	root := s.getRoot(t)
+	from, to := "a b+c%d", "e f+g%h"
+
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    &from,
+		Body:   bytes.NewReader([]byte(from)),
+	})
+	t.Assert(err, IsNil)
+
+	err = root.Rename(s.fs, from, root, to)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, to), Equals, from)
+
+	_, err = s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: &from})
+	t.Assert(mapAwsError(err), Equals, fuse.ENOENT)
+
+	target, err := root.LookUp(s.ctx, s.fs, to)
+	t.Assert(err, IsNil)
+	_, err = root.Link(s.fs, "i j+k", target)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, "i j+k"), Equals, from)
+
+	// and part by part
+	err = s.fs.copyObjectMultipart(int64(len(from)), to, "l m+n", "", nil)
+	t.Assert(err, IsNil)
+	t.Assert(s.readObject(t, "l m+n"), Equals, from)
+}
+
+func (s *GoofysTest) TestExecSuffixes(t *C) {
+	s.fs.flags.FileMode = 0644
+	s.fs.flags.ExecSuffixes = []string{".sh", ".py"}
+
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("run.sh"),
+		Body:   bytes.NewReader([]byte("#!/bin/sh")),
+	})
+	t.Assert(err, IsNil)
+
+	in, err := s.LookUpInode(t, "run.sh")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode, Equals, os.FileMode(0755))
+
+	in, err = s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Mode, Equals, os.FileMode(0644))
+
+	dh := s.getRoot(t).OpenDir()
+	defer dh.CloseDir()
+	s.readDirFully(t, dh)
+	t.Assert(dh.NameToEntry["run.sh"].Mode, Equals, os.FileMode(0755))
+	t.Assert(dh.NameToEntry["file1"].Mode, Equals, os.FileMode(0644))
+
+	fs := NewGoofys(s.fs.bucket, s.awsConfig, &FlagStorage{
+		StorageClass: "STANDARD",
+		FileMode:     os.ModeDir | 0644,
+	})
+	t.Assert(fs, IsNil)
+}
+
+func (s *GoofysTest) TestGunzip(t *C) {
+	s.fs.flags.Gunzip = true
+	content := strings.Repeat("hello gzip ", 1000)
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, err := w.Write([]byte(content))
+	t.Assert(err, IsNil)
+	t.Assert(w.Close(), IsNil)
+
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket:          &s.fs.bucket,
+		Key:             aws.String("file.gz"),
+		Body:            bytes.NewReader(compressed.Bytes()),
+		ContentEncoding: aws.String("gzip"),
+	})
+	t.Assert(err, IsNil)
+
+	in, err := s.LookUpInode(t, "file.gz")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(GUNZIP_UNKNOWN_SIZE))
+
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+
+	// from the middle, then back to the start
+	buf := make([]byte, 5)
+	nread, err := fh.ReadFile(s.ctx, s.fs, 6, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:nread]), Equals, "gzip ")
+
+	buf = make([]byte, len(content)+100)
+	nread, err = fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:nread]), Equals, content)
+	t.Assert(in.Attributes.Size, Equals, uint64(len(content)))
+
+	// not gzipped without --gunzip
+	s.fs.flags.Gunzip = false
+	in, err = s.LookUpInode(t, "file.gz")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(compressed.Len()))
+}
+
+func (s *GoofysTest) TestCopyMultipartResume(t *C) {
+	fileName := "testCopyResume"
+	size := int64(3 * MIN_PART_SIZE)
+	s.testWriteFile(t, fileName, size, 128*1024)
+	s.fs.flags.PartSize = MIN_PART_SIZE
+
+	to := "testCopyResume2"
+	resp, err := s.s3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: &s.fs.bucket,
+		Key:    &to,
+	})
+	t.Assert(err, IsNil)
+
+	// a copy that stopped after the first part
+	_, err = s.fs.mpuCopyPart(fileName, to, *resp.UploadId, 0, MIN_PART_SIZE, 1)
+	t.Assert(err, IsNil)
+
+	var mu sync.Mutex
+	copied := 0
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "UploadPartCopy" {
+			mu.Lock()
+			copied++
+			mu.Unlock()
+		}
+	})
+
+	err = s.fs.copyObjectMultipart(size, fileName, to, *resp.UploadId, nil)
+	t.Assert(err, IsNil)
+	t.Assert(copied, Equals, 2)
+
+	head, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: &to})
+	t.Assert(err, IsNil)
+	t.Assert(*head.ContentLength, Equals, size)
+
+	// a failed copy doesn't leave its upload behind
+	err = s.fs.copyObjectMultipart(size, "no_such_file", "testCopyResume3", "", nil)
+	t.Assert(err, NotNil)
+
+	uploads, err := s.s3.ListMultipartUploads(&s3.ListMultipartUploadsInput{
+		Bucket: &s.fs.bucket,
+		Prefix: aws.String("testCopyResume3"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(len(uploads.Uploads), Equals, 0)
+}
+
+func (s *GoofysTest) TestProbe(t *C) {
+	fs := NewGoofys(s.fs.bucket, s.awsConfig, &FlagStorage{
+		StorageClass: "STANDARD",
+		Probe:        true,
+	})
+	t.Assert(fs, NotNil)
+
+	// cleaned up after itself
+	resp, err := s.s3.ListObjects(&s3.ListObjectsInput{
+		Bucket: &s.fs.bucket,
+		Prefix: aws.String(PROBE_KEY_PREFIX),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(len(resp.Contents), Equals, 0)
+
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "PutObject" {
+			r.Error = awserr.NewRequestFailure(awserr.New("AccessDenied",
+				"Access Denied", nil), 403, "")
+		}
+	})
+	err = s.fs.probe()
+	t.Assert(err, NotNil)
+	t.Assert(strings.Contains(err.Error(), "unable to write"), Equals, true)
+
+	s.fs.flags.ReadOnly = true
+	err = s.fs.probe()
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestReadStreams(t *C) {
+	const size = 4 * 1024 * 1024
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("streams"),
+		Body:   bytes.NewReader(content),
+	})
+	t.Assert(err, IsNil)
+
+	var mu sync.Mutex
+	gets := 0
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "GetObject" {
+			mu.Lock()
+			gets++
+			mu.Unlock()
+		}
+	})
+
+	in, err := s.LookUpInode(t, "streams")
+	t.Assert(err, IsNil)
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+
+	// two readers taking turns, each should keep its own stream
+	const chunk = 128 * 1024
+	offsets := []int64{0, size / 2}
+	buf := make([]byte, chunk)
+	for i := 0; i < 8; i++ {
+		for r := range offsets {
+			nread, err := fh.ReadFile(s.ctx, s.fs, offsets[r], buf)
+			t.Assert(err, IsNil)
+			t.Assert(nread, Equals, chunk)
+			t.Assert(bytes.Equal(buf, content[offsets[r]:offsets[r]+chunk]), Equals, true)
+			offsets[r] += chunk
+		}
+	}
+	t.Assert(gets, Equals, 2)
+
+	// and at the same time
+	var wg sync.WaitGroup
+	for r := 0; r < 3; r++ {
+		wg.Add(1)
+		go func(offset int64) {
+			defer wg.Done()
+			buf := make([]byte, chunk)
+			for i := 0; i < 4; i++ {
+				nread, err := fh.ReadFile(s.ctx, s.fs, offset, buf)
+				t.Check(err, IsNil)
+				t.Check(bytes.Equal(buf[:nread], content[offset:offset+chunk]), Equals, true)
+				offset += chunk
+			}
+		}(int64(r) * size / 4)
+	}
+	wg.Wait()
+}
+
+func (s *GoofysTest) TestCacheControl(t *C) {
+	s.fs.flags.CacheControl = "max-age=3600"
+	s.fs.flags.ContentDisposition = "attachment"
+
+	root := s.getRoot(t)
+	_, fh := root.Create(s.fs, "published")
+	err := fh.WriteFile(s.fs, 0, []byte("hello"))
+	t.Assert(err, IsNil)
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+
+	check := func(key string) {
+		resp, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: &key})
+		t.Assert(err, IsNil)
+		t.Assert(resp.CacheControl, NotNil)
+		t.Assert(*resp.CacheControl, Equals, "max-age=3600")
+		t.Assert(resp.ContentDisposition, NotNil)
+		t.Assert(*resp.ContentDisposition, Equals, "attachment")
+	}
+	check("published")
+
+	// copies keep what the object had, not what the flags say now
+	s.fs.flags.CacheControl = ""
+	s.fs.flags.ContentDisposition = ""
+	err = root.Rename(s.fs, "published", root, "published2")
+	t.Assert(err, IsNil)
+	check("published2")
+}
+
+func (s *GoofysTest) TestLookUpCoalesced(t *C) {
+	var mu sync.Mutex
+	heads := 0
+	s.fs.s3.Handlers.Send.PushFront(func(r *request.Request) {
+		if r.Operation.Name == "HeadObject" {
+			mu.Lock()
+			heads++
+			mu.Unlock()
+			// so the other lookups come while this one is out
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+
+	const N = 10
+	ids := make(chan fuseops.InodeID, N)
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "file1"}
+			err := s.fs.LookUpInode(s.ctx, op)
+			t.Check(err, IsNil)
+			ids <- op.Entry.Child
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	id := <-ids
+	for other := range ids {
+		t.Assert(other, Equals, id)
+	}
+	t.Assert(heads, Equals, 1)
+
+	inode := s.fs.inodes[id]
+	t.Assert(inode.refcnt, Equals, uint64(N))
+}
+
+func (s *GoofysTest) TestDiskCache(t *C) {
+	dir, err := ioutil.TempDir("", "goofys-cache")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	s.fs.diskCache, err = newDiskCache(dir, 1024*1024)
+	t.Assert(err, IsNil)
+
+	content := bytes.Repeat([]byte("cached "), 100000)
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("cached"),
+		Body:   bytes.NewReader(content),
+	})
+	t.Assert(err, IsNil)
+
+	var mu sync.Mutex
+	gets := 0
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "GetObject" {
+			mu.Lock()
+			gets++
+			mu.Unlock()
+		}
+	})
+
+	in, err := s.LookUpInode(t, "cached")
+	t.Assert(err, IsNil)
+
+	readAll := func() []byte {
+		fh := in.OpenFile(s.fs)
+		defer fh.Release()
+
+		var data []byte
+		buf := make([]byte, 128*1024)
+		for {
+			nread, err := fh.ReadFile(s.ctx, s.fs, int64(len(data)), buf)
+			t.Assert(err, IsNil)
+			if nread == 0 {
+				return data
+			}
+			data = append(data, buf[:nread]...)
+		}
+	}
+
+	t.Assert(bytes.Equal(readAll(), content), Equals, true)
+	t.Assert(gets, Equals, 1)
+
+	t.Assert(bytes.Equal(readAll(), content), Equals, true)
+	t.Assert(gets, Equals, 1)
+
+	// a new mount finds it too
+	cache, err := newDiskCache(dir, 1024*1024)
+	t.Assert(err, IsNil)
+	t.Assert(cache.size, Equals, int64(len(content)))
+
+	// and drops it when it doesn't fit anymore
+	cache, err = newDiskCache(dir, 1024)
+	t.Assert(err, IsNil)
+	t.Assert(cache.size, Equals, int64(0))
+}
+
+func (s *GoofysTest) TestStorageClassRules(t *C) {
+	_, err := parseStorageClassRules("logs/*=COLD")
+	t.Assert(err, NotNil)
+	_, err = parseStorageClassRules("logs")
+	t.Assert(err, NotNil)
+	_, err = parseStorageClassRules("[=STANDARD")
+	t.Assert(err, NotNil)
+
+	s.fs.storageClassRules, err = parseStorageClassRules(
+		"logs/*=standard_ia, *.tmp=REDUCED_REDUNDANCY")
+	t.Assert(err, IsNil)
+
+	var mu sync.Mutex
+	classes := make(map[string]string)
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		var key, class *string
+		switch params := r.Params.(type) {
+		case *s3.PutObjectInput:
+			key, class = params.Key, params.StorageClass
+		case *s3.CopyObjectInput:
+			key, class = params.Key, params.StorageClass
+		default:
+			return
+		}
+		mu.Lock()
+		classes[*key] = *class
+		mu.Unlock()
+	})
+
+	root := s.getRoot(t)
+	logs, err := root.MkDir(s.fs, "logs")
+	t.Assert(err, IsNil)
+	_, err = logs.MkDir(s.fs, "2018")
+	t.Assert(err, IsNil)
+
+	write := func(dir *Inode, name string) {
+		_, fh := dir.Create(s.fs, name)
+		err := fh.WriteFile(s.fs, 0, []byte("hello"))
+		t.Assert(err, IsNil)
+		err = fh.FlushFile(s.fs)
+		t.Assert(err, IsNil)
+	}
+	write(logs, "today")
+	write(root, "scratch.tmp")
+	write(root, "kept")
+	deep, err := root.MkDir(s.fs, "deep")
+	t.Assert(err, IsNil)
+	write(deep, "scratch.tmp")
+
+	err = root.Rename(s.fs, "kept", logs, "kept")
+	t.Assert(err, IsNil)
+
+	t.Assert(classes["logs/"], Equals, "STANDARD")
+	t.Assert(classes["logs/2018/"], Equals, "STANDARD_IA")
+	t.Assert(classes["logs/today"], Equals, "STANDARD_IA")
+	t.Assert(classes["scratch.tmp"], Equals, "REDUCED_REDUNDANCY")
+	t.Assert(classes["deep/"], Equals, "STANDARD")
+	t.Assert(classes["deep/scratch.tmp"], Equals, "REDUCED_REDUNDANCY")
+	t.Assert(classes["kept"], Equals, "STANDARD")
+	t.Assert(classes["logs/kept"], Equals, "STANDARD_IA")
+}
+
+func (s *GoofysTest) TestHeadFallback(t *C) {
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		switch r.Operation.Name {
+		case "HeadObject", "ListObjects", "ListObjectsV2":
+			r.Error = awserr.NewRequestFailure(awserr.New("AccessDenied",
+				"Access Denied", nil), 403, "")
+		}
+	})
+
+	_, err := s.LookUpInode(t, "file1")
+	t.Assert(err, Equals, syscall.EACCES)
+
+	s.fs.flags.HeadFallback = true
+
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(len("file1")))
+
+	in, err = s.LookUpInode(t, "zero")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(0))
+
+	_, err = s.LookUpInode(t, "not_there")
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) TestMapAwsError(t *C) {
+	reqErr := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, "", nil), status, "")
+	}
+
+	t.Assert(mapAwsError(reqErr("InvalidArgument", 400)), Equals, syscall.EINVAL)
+	t.Assert(mapAwsError(reqErr("RequestTimeout", 400)), Equals, syscall.ETIMEDOUT)
+	t.Assert(mapAwsError(reqErr("AccessDenied", 403)), Equals, syscall.EACCES)
+	t.Assert(mapAwsError(reqErr("NoSuchKey", 404)), Equals, fuse.ENOENT)
+	t.Assert(mapAwsError(reqErr("NoSuchBucket", 404)), Equals, syscall.ENXIO)
+	t.Assert(mapAwsError(reqErr("OperationAborted", 409)), Equals, syscall.EBUSY)
+	t.Assert(mapAwsError(reqErr("PreconditionFailed", 412)), Equals, syscall.ESTALE)
+	t.Assert(mapAwsError(reqErr("SlowDown", 503)), Equals, syscall.EAGAIN)
+	t.Assert(mapAwsError(reqErr("ServiceUnavailable", 503)), Equals, syscall.EAGAIN)
+
+	// these stay as they are
+	err := reqErr("InternalError", 500)
+	t.Assert(mapAwsError(err), Equals, err)
+	t.Assert(mapAwsError(syscall.EIO), Equals, syscall.EIO)
+
+	s.fs.bucket = "goofys-test-" + RandStringBytesMaskImprSrc(16)
+	_, err = s.LookUpInode(t, "file1")
+	t.Assert(err, Equals, syscall.ENXIO)
+}
+
+func (s *GoofysTest) TestCredentialProcess(t *C) {
+	dir, err := ioutil.TempDir("", "goofys-creds")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	counter := filepath.Join(dir, "runs")
+	command := func(expiration time.Time) string {
+		return fmt.Sprintf(`echo >> %v; echo '{"Version": 1, "AccessKeyId": "AKID",`+
+			` "SecretAccessKey": "SECRET", "SessionToken": "TOKEN", "Expiration": "%v"}'`,
+			counter, expiration.Format(time.RFC3339))
+	}
+	runs := func() int {
+		out, _ := ioutil.ReadFile(counter)
+		os.Remove(counter)
+		return len(out)
+	}
+
+	config := &aws.Config{}
+	flags := &FlagStorage{CredentialProcess: command(time.Now().Add(time.Hour))}
+	err = useCredentialProcess(config, flags)
+	t.Assert(err, IsNil)
+	v, err := config.Credentials.Get()
+	t.Assert(err, IsNil)
+	t.Assert(v.AccessKeyID, Equals, "AKID")
+	t.Assert(v.SecretAccessKey, Equals, "SECRET")
+	t.Assert(v.SessionToken, Equals, "TOKEN")
+	t.Assert(runs(), Equals, 1)
+
+	// about to expire, so every use runs it again
+	flags.CredentialProcess = command(time.Now().Add(time.Minute))
+	err = useCredentialProcess(config, flags)
+	t.Assert(err, IsNil)
+	_, err = config.Credentials.Get()
+	t.Assert(err, IsNil)
+	t.Assert(runs(), Equals, 2)
+
+	flags.CredentialProcess = "echo '{}'"
+	err = useCredentialProcess(&aws.Config{}, flags)
+	t.Assert(err, NotNil)
+	flags.CredentialProcess = "exit 1"
+	err = useCredentialProcess(&aws.Config{}, flags)
+	t.Assert(err, NotNil)
+
+	// from the profile
+	configFile := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(configFile, []byte("[default]\nregion = us-east-1\n\n"+
+		"[profile sso]\ncredential_process = "+command(time.Now().Add(time.Hour))+"\n"), 0600)
+	t.Assert(err, IsNil)
+	os.Setenv("AWS_CONFIG_FILE", configFile)
+	defer os.Unsetenv("AWS_CONFIG_FILE")
+	os.Setenv("AWS_PROFILE", "sso")
+	defer os.Unsetenv("AWS_PROFILE")
+	// keys in the environment come first
+	for _, k := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY"} {
+		if v := os.Getenv(k); v != "" {
+			os.Unsetenv(k)
+			defer os.Setenv(k, v)
+		}
+	}
+
+	config = &aws.Config{}
+	flags.CredentialProcess = ""
+	err = useCredentialProcess(config, flags)
+	t.Assert(err, IsNil)
+	t.Assert(config.Credentials, NotNil)
+	t.Assert(runs(), Equals, 1)
+}
+
+func (s *GoofysTest) TestDirSize(t *C) {
+	s.fs.dirSizes = newDirSizes(time.Hour)
+
+	var mu sync.Mutex
+	scans := 0
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if params, ok := r.Params.(*s3.ListObjectsInput); ok && params.Delimiter == nil {
+			mu.Lock()
+			scans++
+			mu.Unlock()
+		}
+	})
+
+	dir1, err := s.LookUpInode(t, "dir1")
+	t.Assert(err, IsNil)
+	attr, err := dir1.GetAttributes(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(attr.Size, Equals, uint64(len("dir1/file3")))
+	t.Assert(scans, Equals, 1)
+
+	// listing dir3 and then dir2 adds them up without a scan
+	dir3, err := s.LookUpInode(t, "dir2/dir3")
+	t.Assert(err, IsNil)
+	s.assertEntries(t, dir3, []string{"file4"})
+	dir2, err := s.LookUpInode(t, "dir2")
+	t.Assert(err, IsNil)
+	s.assertEntries(t, dir2, []string{"dir3"})
+
+	attr, err = dir2.GetAttributes(s.fs)
+	t.Assert(err, IsNil)
+	t.Assert(attr.Size, Equals, uint64(len("dir2/dir3/")+len("dir2/dir3/file4")))
+	t.Assert(scans, Equals, 1)
+
+	size, known, err := s.fs.scanDirSize("dir2")
+	t.Assert(err, IsNil)
+	t.Assert(known, Equals, true)
+	t.Assert(size, Equals, attr.Size)
+
+	// directories still share their other attributes
+	t.Assert(s.fs.rootAttrs.Size, Equals, uint64(4096))
+}
+
+func (s *GoofysTest) TestWritePartGrowth(t *C) {
+	maxBuffers := s.fs.bufferPool.maxBuffersPerHandle
+	t.Assert(writePartBuffers(1, WRITE_PART_GROWTH, maxBuffers), Equals, 1)
+	t.Assert(writePartBuffers(WRITE_PART_GROWTH, WRITE_PART_GROWTH, maxBuffers), Equals, 1)
+	t.Assert(writePartBuffers(WRITE_PART_GROWTH+1, WRITE_PART_GROWTH, maxBuffers), Equals, 2)
+	t.Assert(writePartBuffers(WRITE_PART_GROWTH+1, WRITE_PART_GROWTH, 1), Equals, 1)
+
+	buffers := 0
+	for part := 1; part <= MAX_PARTS; part++ {
+		n := writePartBuffers(part, WRITE_PART_GROWTH, maxBuffers)
+		t.Assert(int64(n) <= maxBuffers/2, Equals, true)
+		buffers += n
+	}
+	// what used to be the limit is well within reach now
+	t.Assert(buffers > 4*MAX_PARTS, Equals, true)
+
+	// a part made of several buffers
+	content := make([]byte, 2*BUF_SIZE+100)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	root := s.getRoot(t)
+	_, fh := root.Create(s.fs, "parts")
+	fh.poolHandle = s.fs.bufferPool.NewPoolHandle()
+	fh.initWrite(s.fs, nil)
+	fh.mpuWG.Wait()
+	t.Assert(fh.mpuId, NotNil)
+
+	var bufs partBuffers
+	for offset := 0; offset < len(content); offset += BUF_SIZE {
+		end := int(minInt64(int64(offset+BUF_SIZE), int64(len(content))))
+		buf := fh.poolHandle.Request()[:end-offset]
+		copy(buf, content[offset:end])
+		bufs = append(bufs, buf)
+	}
+
+	etag, err := fh.mpuPartNoSpawn(s.fs, bufs[:2], 1)
+	t.Assert(err, IsNil)
+	fh.mu.Lock()
+	fh.setEtag(1, etag)
+	fh.mu.Unlock()
+
+	etag, err = fh.mpuPartNoSpawn(s.fs, bufs[2:], 2)
+	t.Assert(err, IsNil)
+	fh.mu.Lock()
+	fh.setEtag(2, etag)
+	fh.lastPartId = 2
+	fh.markDirty()
+	fh.mu.Unlock()
+
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, IsNil)
+
+	resp, err := s.s3.GetObject(&s3.GetObjectInput{Bucket: &s.fs.bucket, Key: aws.String("parts")})
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Equal(data, content), Equals, true)
+
+	_, err = fh.mpuPartNoSpawn(s.fs, nil, MAX_PARTS+1)
+	t.Assert(err, Equals, syscall.EFBIG)
+}
+
+func (s *GoofysTest) TestMultiBucket(t *C) {
+	awsConfig := *s.awsConfig
+	// so it's limited by MaxReadBps
+	awsConfig.HTTPClient = nil
+	flags := &FlagStorage{
+		StorageClass: "STANDARD",
+		MultiBucket:  true,
+		// the buckets share the limited client
+		MaxReadBps: 100 * 1024 * 1024,
+	}
+	m := NewMultiBucket("nosuchbucket,"+s.fs.bucket, &awsConfig, flags)
+	t.Assert(m, NotNil)
+
+	// the buckets are listed at the top level
+	openDir := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	err := m.OpenDir(s.ctx, openDir)
+	t.Assert(err, IsNil)
+	readDir := &fuseops.ReadDirOp{Handle: openDir.Handle, Dst: make([]byte, 4096)}
+	err = m.ReadDir(s.ctx, readDir)
+	t.Assert(err, IsNil)
+	t.Assert(bytes.Contains(readDir.Dst[:readDir.BytesRead], []byte(s.fs.bucket)), Equals, true)
+	t.Assert(bytes.Contains(readDir.Dst[:readDir.BytesRead], []byte("nosuchbucket")), Equals, true)
+	err = m.ReleaseDirHandle(s.ctx, &fuseops.ReleaseDirHandleOp{Handle: openDir.Handle})
+	t.Assert(err, IsNil)
+
+	err = m.LookUpInode(s.ctx, &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "other"})
+	t.Assert(err, Equals, fuse.ENOENT)
+	err = m.MkDir(s.ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "new"})
+	t.Assert(err, Equals, syscall.EPERM)
+
+	lookUp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: s.fs.bucket}
+	err = m.LookUpInode(s.ctx, lookUp)
+	t.Assert(err, IsNil)
+	bucket := lookUp.Entry.Child
+	t.Assert(bucket, Equals, fuseops.InodeID(1<<MULTI_BUCKET_ID_SHIFT|fuseops.RootInodeID))
+	// with the buffers all the buckets have
+	t.Assert(m.mountedBuckets()[0].bufferPool, Equals, m.shared.bufferPool)
+	if m.regions != nil {
+		// and the client of its region, with handlers of its own
+		fs := m.mountedBuckets()[0]
+		region := m.regions.client(*fs.awsConfig.Region)
+		t.Assert(fs.s3.Config.HTTPClient, Equals, region.Config.HTTPClient)
+		t.Assert(fs.s3 != region, Equals, true)
+	}
+
+	// and what's in them through the bucket's IDs
+	lookUp = &fuseops.LookUpInodeOp{Parent: bucket, Name: "file1"}
+	err = m.LookUpInode(s.ctx, lookUp)
+	t.Assert(err, IsNil)
+	t.Assert(uint64(lookUp.Entry.Child)>>MULTI_BUCKET_ID_SHIFT, Equals, uint64(1))
+	t.Assert(lookUp.Entry.Attributes.Size, Equals, uint64(len("file1")))
+
+	openFile := &fuseops.OpenFileOp{Inode: lookUp.Entry.Child}
+	err = m.OpenFile(s.ctx, openFile)
+	t.Assert(err, IsNil)
+	readFile := &fuseops.ReadFileOp{
+		Inode:  lookUp.Entry.Child,
+		Handle: openFile.Handle,
+		Dst:    make([]byte, 10),
+	}
+	err = m.ReadFile(s.ctx, readFile)
+	t.Assert(err, IsNil)
+	t.Assert(string(readFile.Dst[:readFile.BytesRead]), Equals, "file1")
+	err = m.ReleaseFileHandle(s.ctx, &fuseops.ReleaseFileHandleOp{Handle: openFile.Handle})
+	t.Assert(err, IsNil)
+
+	err = m.ForgetInode(s.ctx, &fuseops.ForgetInodeOp{Inode: lookUp.Entry.Child})
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestAuditLog(t *C) {
+	dir, err := ioutil.TempDir("", "goofys-audit")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	records := func() (recs []auditRecord) {
+		data, err := ioutil.ReadFile(path)
+		t.Assert(err, IsNil)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var rec auditRecord
+			t.Assert(json.Unmarshal([]byte(line), &rec), IsNil)
+			recs = append(recs, rec)
+		}
+		os.Remove(path)
+		return
+	}
+
+	audit, err := openAuditLog(path, false)
+	t.Assert(err, IsNil)
+	audit.instrument(s.fs.s3, s.fs.bucket)
+
+	// reads are not logged
+	_, err = s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	_, err = s.fs.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("audited"),
+		Body:   bytes.NewReader([]byte("hello")),
+	})
+	t.Assert(err, IsNil)
+	err = s.getRoot(t).Unlink(s.fs, "file1")
+	t.Assert(err, IsNil)
+
+	recs := records()
+	t.Assert(len(recs), Equals, 2)
+	t.Assert(recs[0].Operation, Equals, "PutObject")
+	t.Assert(recs[0].Bucket, Equals, s.fs.bucket)
+	t.Assert(recs[0].Key, Equals, "audited")
+	t.Assert(*recs[0].Size, Equals, int64(5))
+	t.Assert(recs[0].Status, Equals, 200)
+	t.Assert(recs[1].Operation, Equals, "DeleteObject")
+	t.Assert(recs[1].Key, Equals, "file1")
+	t.Assert(recs[1].DryRun, Equals, false)
+
+	// a dry run leaves the bucket alone
+	dryRun, err := openAuditLog(path, true)
+	t.Assert(err, IsNil)
+	dryRun.instrument(s.fs.s3, s.fs.bucket)
+
+	_, err = s.fs.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("dry"),
+		Body:   bytes.NewReader([]byte("hello")),
+	})
+	t.Assert(err, Equals, syscall.EROFS)
+	err = s.getRoot(t).Unlink(s.fs, "file2")
+	t.Assert(err, Equals, syscall.EROFS)
+
+	recs = records()
+	t.Assert(len(recs), Equals, 2)
+	t.Assert(recs[0].Key, Equals, "dry")
+	t.Assert(*recs[0].Size, Equals, int64(5))
+	t.Assert(recs[0].DryRun, Equals, true)
+	t.Assert(recs[1].Key, Equals, "file2")
+
+	_, err = s.LookUpInode(t, "file2")
+	t.Assert(err, IsNil)
+	_, err = s.LookUpInode(t, "dry")
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) TestBucketError(t *C) {
+	awsConfig := *s.awsConfig
+	flags := &FlagStorage{StorageClass: "STANDARD"}
+	fs, err := NewGoofysWithError("goofys-test-no-such-bucket", &awsConfig, flags)
+	t.Assert(fs, IsNil)
+	bucketErr, ok := err.(*BucketError)
+	t.Assert(ok, Equals, true)
+	t.Assert(bucketErr.Err, Equals, fuse.ENOENT)
+	t.Assert(strings.Contains(err.Error(), "does not exist"), Equals, true)
+
+	s.fs.s3.Handlers.Validate.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "HeadBucket" {
+			r.Error = awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
+		}
+	})
+
+	err = s.fs.checkBucket()
+	bucketErr, ok = err.(*BucketError)
+	t.Assert(ok, Equals, true)
+	t.Assert(bucketErr.Err, Equals, syscall.EACCES)
+	t.Assert(strings.Contains(err.Error(), "access denied"), Equals, true)
+
+	// what's in it may still be readable
+	s.fs.flags.HeadFallback = true
+	t.Assert(s.fs.checkBucket(), IsNil)
+}
+
+func (s *GoofysTest) TestPrewarm(t *C) {
+	s.fs.flags.TypeCacheTTL = time.Hour
+	s.fs.prewarmed = newPrewarmedDirs()
+	s.fs.prewarm(2)
+
+	t.Assert(s.fs.prewarmed.get("", time.Hour), NotNil)
+	t.Assert(s.fs.prewarmed.get("dir1", time.Hour), NotNil)
+	t.Assert(s.fs.prewarmed.get("dir2", time.Hour), NotNil)
+	// too deep
+	t.Assert(s.fs.prewarmed.get("dir2/dir3", time.Hour), IsNil)
+
+	dir1, err := s.LookUpInode(t, "dir1")
+	t.Assert(err, IsNil)
+	dir2, err := s.LookUpInode(t, "dir2")
+	t.Assert(err, IsNil)
+
+	var lists int
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "ListObjects" || r.Operation.Name == "ListObjectsV2" {
+			lists++
+		}
+	})
+
+	s.assertEntries(t, s.getRoot(t), []string{"dir1", "dir2", "empty_dir", "file1", "file2", "zero"})
+	s.assertEntries(t, dir1, []string{"file3"})
+	s.assertEntries(t, dir2, []string{"dir3"})
+	t.Assert(lists, Equals, 0)
+
+	// changing a directory drops its listing
+	err = dir1.Unlink(s.fs, "file3")
+	t.Assert(err, IsNil)
+	t.Assert(s.fs.prewarmed.get("dir1", time.Hour), IsNil)
+	s.assertEntries(t, dir1, nil)
+	t.Assert(lists, Equals, 1)
+
+	// and they expire like the directories' own
+	t.Assert(s.fs.prewarmed.get("dir2", 0), IsNil)
+}
+
+func (s *GoofysTest) TestRenamePreservesMetadata(t *C) {
+	root := s.getRoot(t)
+
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("meta"),
+		Body:   bytes.NewReader([]byte("meta")),
+		Metadata: map[string]*string{
+			"Color":   aws.String("blue"),
+			"Owner":   aws.String("alice"),
+			"Project": aws.String("goofys"),
+		},
+		ContentType:     aws.String("text/x-meta"),
+		ContentLanguage: aws.String("en"),
+		CacheControl:    aws.String("max-age=60"),
+	})
+	t.Assert(err, IsNil)
+
+	check := func(key string) {
+		head, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: &key})
+		t.Assert(err, IsNil)
+		t.Assert(*metadataValue(head.Metadata, "color"), Equals, "blue")
+		t.Assert(*metadataValue(head.Metadata, "owner"), Equals, "alice")
+		t.Assert(*metadataValue(head.Metadata, "project"), Equals, "goofys")
+		t.Assert(metadataValue(head.Metadata, MTIME_META), NotNil)
+		t.Assert(*head.ContentType, Equals, "text/x-meta")
+		t.Assert(*head.ContentLanguage, Equals, "en")
+		t.Assert(*head.CacheControl, Equals, "max-age=60")
+	}
+
+	err = root.Rename(s.fs, "meta", root, "meta2")
+	t.Assert(err, IsNil)
+	check("meta2")
+
+	// what's too big to copy in one go gets the same
+	err = s.fs.copyObjectMultipart(int64(len("meta")), "meta2", "meta3", "", nil)
+	t.Assert(err, IsNil)
+	check("meta3")
+}
+
+func (s *GoofysTest) TestListPageSize(t *C) {
+	s.fs.flags.ListPageSize = 1
+
+	var mu sync.Mutex
+	var pages []int64
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// the root's listing, not lookups
+		if params, ok := r.Params.(*s3.ListObjectsInput); ok && *params.Prefix == "" {
+			pages = append(pages, *params.MaxKeys)
+		}
+	})
+
+	s.assertEntries(t, s.getRoot(t), []string{"dir1", "dir2", "empty_dir", "file1", "file2", "zero"})
+	t.Assert(pages, DeepEquals, []int64{1, 1, 2, 4})
+
+	t.Assert(s.fs.listPageSize(0), DeepEquals, aws.Int64(1))
+	t.Assert(s.fs.listPageSize(5000), DeepEquals, aws.Int64(LIST_MAX_KEYS))
+	s.fs.flags.ListPageSize = 0
+	t.Assert(s.fs.listPageSize(5000), IsNil)
+}
+
+func (s *GoofysTest) TestRenamePartialFailure(t *C) {
+	root := s.getRoot(t)
+
+	// to itself is nothing to do
+	err := root.Rename(s.fs, "file1", root, "file1")
+	t.Assert(err, IsNil)
+	_, err = s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: aws.String("file1")})
+	t.Assert(err, IsNil)
+
+	// a copy that doesn't look like the original
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if params, ok := r.Params.(*s3.HeadObjectInput); ok && *params.Key == "bad_copy" &&
+			r.HTTPResponse != nil {
+			r.HTTPResponse.Header.Set("Content-Length", "1")
+		}
+	})
+	err = root.Rename(s.fs, "file1", root, "bad_copy")
+	t.Assert(err, Equals, syscall.EIO)
+	_, err = s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: aws.String("file1")})
+	t.Assert(err, IsNil)
+
+	// a delete that fails leaves both
+	s.fs.s3.Handlers.Validate.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "DeleteObject" {
+			r.Error = awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "")
+		}
+	})
+	err = root.Rename(s.fs, "file2", root, "new_file")
+	t.Assert(err, Equals, syscall.EACCES)
+	_, err = s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: aws.String("file2")})
+	t.Assert(err, IsNil)
+	_, err = s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.fs.bucket, Key: aws.String("new_file")})
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestObjectLock(t *C) {
+	flags := &FlagStorage{StorageClass: "STANDARD", ObjectLockMode: "worm", RetentionPeriod: time.Hour}
+	t.Assert(NewGoofys(s.fs.bucket, s.awsConfig, flags), IsNil)
+	flags = &FlagStorage{StorageClass: "STANDARD", ObjectLockMode: "governance"}
+	t.Assert(NewGoofys(s.fs.bucket, s.awsConfig, flags), IsNil)
+
+	t.Assert(s.fs.objectLockMode(), IsNil)
+	t.Assert(s.fs.objectLockRetainUntil(), IsNil)
+
+	s.fs.flags.ObjectLockMode = "COMPLIANCE"
+	s.fs.flags.RetentionPeriod = time.Hour
+	t.Assert(*s.fs.objectLockMode(), Equals, "COMPLIANCE")
+	until := s.fs.objectLockRetainUntil()
+	t.Assert(until.After(time.Now().Add(59*time.Minute)), Equals, true)
+
+	// S3 checks the MD5 we send
+	var sent string
+	s.fs.s3.Handlers.Build.PushBack(contentMD5)
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "PutObject" {
+			sent = r.HTTPRequest.Header.Get("Content-MD5")
+		}
+	})
+
+	_, err := s.fs.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("locked"),
+		Body:   bytes.NewReader([]byte("locked")),
+	})
+	t.Assert(err, IsNil)
+	// md5 of "locked"
+	t.Assert(sent, Equals, "TO8vMKx9M0GdAMHZOgkAlQ==")
+}
+
+func (s *GoofysTest) TestInodeStats(t *C) {
+	stats := s.fs.InodeStats()
+	t.Assert(stats.Inodes, Equals, 1)
+	t.Assert(stats.InvariantError, Equals, "")
+
+	op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "file1"}
+	err := s.fs.LookUpInode(s.ctx, op)
+	t.Assert(err, IsNil)
+	err = s.fs.LookUpInode(s.ctx, op)
+	t.Assert(err, IsNil)
+	openOp := &fuseops.OpenFileOp{Inode: op.Entry.Child}
+	err = s.fs.OpenFile(s.ctx, openOp)
+	t.Assert(err, IsNil)
+
+	stats = s.fs.InodeStats()
+	t.Assert(stats.Inodes, Equals, 2)
+	t.Assert(stats.CachedNames, Equals, 1)
+	t.Assert(stats.FileHandles, Equals, 1)
+	t.Assert(stats.Refs, Equals, uint64(3))
+	t.Assert(stats.MostReferenced[0].Name, Equals, "file1")
+	t.Assert(stats.MostReferenced[0].Refs, Equals, uint64(2))
+
+	// the same as JSON
+	w := httptest.NewRecorder()
+	serveInodeStats(s.fs)(w, nil)
+	var served InodeStats
+	err = json.Unmarshal(w.Body.Bytes(), &served)
+	t.Assert(err, IsNil)
+	t.Assert(served, DeepEquals, stats)
+}
+
+func (s *GoofysTest) TestCoalesceReads(t *C) {
+	s.fs.flags.ReadAheadSize = 0
+	s.fs.flags.CoalesceWindow = 256 * 1024
+	s.fs.flags.CoalesceMaxOverRead = 64 * 1024
+
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("random"),
+		Body:   bytes.NewReader(data),
+	})
+	t.Assert(err, IsNil)
+
+	gets := 0
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "GetObject" {
+			gets++
+		}
+	})
+
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, "random")
+	t.Assert(err, IsNil)
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+
+	buf := make([]byte, 4096)
+	// the second is too far back for the stream the first opened
+	for _, offset := range []int64{500000, 300000, 310000, 290000} {
+		nread, err := fh.ReadFile(s.ctx, s.fs, offset, buf)
+		t.Assert(err, IsNil)
+		t.Assert(nread, Equals, len(buf))
+		t.Assert(buf, DeepEquals, data[offset:offset+int64(len(buf))])
+	}
+
+	// one for the first read, one for the range around the second
+	t.Assert(gets, Equals, 2)
+	t.Assert(len(fh.coalesced), Equals, 1)
+}
+
+func (s *GoofysTest) TestOpenWrongType(t *C) {
+	lookUp := func(name string) fuseops.InodeID {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: name}
+		err := s.fs.LookUpInode(s.ctx, op)
+		t.Assert(err, IsNil)
+		return op.Entry.Child
+	}
+
+	err := s.fs.OpenDir(s.ctx, &fuseops.OpenDirOp{Inode: lookUp("file1")})
+	t.Assert(err, Equals, syscall.ENOTDIR)
+	t.Assert(s.fs.dirHandles, HasLen, 0)
+
+	err = s.fs.OpenFile(s.ctx, &fuseops.OpenFileOp{Inode: lookUp("dir1")})
+	t.Assert(err, Equals, syscall.EISDIR)
+	t.Assert(s.fs.fileHandles, HasLen, 0)
+}
+
+func (s *GoofysTest) TestCreateMode(t *C) {
+	s.fs.flags.Umask = 0027
+
+	createOp := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "new_file",
+		Mode:   0666,
+	}
+	err := s.fs.CreateFile(s.ctx, createOp)
+	t.Assert(err, IsNil)
+	t.Assert(createOp.Entry.Attributes.Mode, Equals, os.FileMode(0640))
+
+	mkDirOp := &fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "new_dir",
+		Mode:   0777,
+	}
+	err = s.fs.MkDir(s.ctx, mkDirOp)
+	t.Assert(err, IsNil)
+	t.Assert(mkDirOp.Entry.Attributes.Mode, Equals, os.ModeDir|0750)
+
+	// the other directories are left alone
+	t.Assert(s.fs.rootAttrs.Mode, Equals, os.ModeDir|s.fs.flags.DirMode)
+}
+
+func (s *GoofysTest) TestPresortedListings(t *C) {
+	dirs := []fuseutil.Dirent{
+		makeDirEntry("b", fuseutil.DT_Directory),
+		makeDirEntry("d", fuseutil.DT_Directory),
+	}
+	files := []fuseutil.Dirent{
+		makeDirEntry("a", fuseutil.DT_File),
+		makeDirEntry("c", fuseutil.DT_File),
+		makeDirEntry("e", fuseutil.DT_File),
+	}
+	t.Assert(namesOf(sortDirents(dirs, files, true)), DeepEquals,
+		[]string{"a", "b", "c", "d", "e"})
+
+	// in the order S3 lists a-b/ and a/
+	dirs = []fuseutil.Dirent{
+		makeDirEntry("a-b", fuseutil.DT_Directory),
+		makeDirEntry("a", fuseutil.DT_Directory),
+	}
+	t.Assert(namesOf(sortDirents(dirs, files[1:], true)), DeepEquals,
+		[]string{"a", "a-b", "c", "e"})
+
+	s.fs.flags.PresortedListings = true
+	s.assertEntries(t, s.getRoot(t), []string{"dir1", "dir2", "empty_dir", "file1", "file2", "zero"})
+}
+
+func (s *GoofysTest) TestAnonymous(t *C) {
+	awsConfig := *s.awsConfig
+	flags := &FlagStorage{
+		StorageClass: "STANDARD",
+		Anonymous:    true,
+		RoleARN:      "arn:aws:iam::123456789012:role/goofys",
+	}
+	_, err := NewGoofysWithError(s.fs.bucket, &awsConfig, flags)
+	t.Assert(err, NotNil)
+
+	flags = &FlagStorage{StorageClass: "STANDARD", Anonymous: true}
+	fs, err := NewGoofysWithError(s.fs.bucket, &awsConfig, flags)
+	t.Assert(err, IsNil)
+	t.Assert(awsConfig.Credentials, Equals, credentials.AnonymousCredentials)
+	t.Assert(flags.ReadOnly, Equals, true)
+
+	op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "file1"}
+	err = fs.LookUpInode(s.ctx, op)
+	t.Assert(err, IsNil)
+
+	err = fs.MkDir(s.ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "new_dir"})
+	t.Assert(err, Equals, syscall.EROFS)
+}
+
+func (s *GoofysTest) TestGetAttributesCoalesced(t *C) {
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	var mu sync.Mutex
+	heads := 0
+	s.fs.s3.Handlers.Send.PushFront(func(r *request.Request) {
+		if r.Operation.Name == "HeadObject" {
+			mu.Lock()
+			heads++
+			mu.Unlock()
+			// so the other stats come while this one is out
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+
+	s.fs.flags.StatCacheTTL = time.Hour
+	in.mu.Lock()
+	in.attrTime = time.Time{}
+	in.mu.Unlock()
+
+	const N = 10
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attr, err := in.GetAttributes(s.fs)
+			t.Check(err, IsNil)
+			t.Check(attr.Size, Equals, uint64(len("file1")))
+		}()
+	}
+	wg.Wait()
+
+	t.Assert(heads, Equals, 1)
+}
+
+func (s *GoofysTest) TestLookUpOddNames(t *C) {
+	s.fs.flags.StatCacheTTL = time.Hour
+
+	lookUp := func(parent fuseops.InodeID, name string) (fuseops.InodeID, error) {
+		op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+		err := s.fs.LookUpInode(s.ctx, op)
+		return op.Entry.Child, err
+	}
+
+	dir2, err := lookUp(fuseops.RootInodeID, "dir2")
+	t.Assert(err, IsNil)
+	dir3, err := lookUp(dir2, "dir3")
+	t.Assert(err, IsNil)
+
+	id, err := lookUp(dir3, ".")
+	t.Assert(err, IsNil)
+	t.Assert(id, Equals, dir3)
+	id, err = lookUp(dir3, "..")
+	t.Assert(err, IsNil)
+	t.Assert(id, Equals, dir2)
+	id, err = lookUp(dir2, "..")
+	t.Assert(err, IsNil)
+	t.Assert(id, Equals, fuseops.InodeID(fuseops.RootInodeID))
+
+	// a trailing slash is dropped rather than making dir2//
+	id, err = lookUp(fuseops.RootInodeID, "dir2/")
+	t.Assert(err, IsNil)
+	t.Assert(id, Equals, dir2)
+
+	for _, name := range []string{"", "/", "dir2/dir3"} {
+		_, err = lookUp(fuseops.RootInodeID, name)
+		t.Assert(err, Equals, fuse.EINVAL)
+	}
+	err = s.fs.MkDir(s.ctx, &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "a/b"})
+	t.Assert(err, Equals, fuse.EINVAL)
+
+	// keys under dir1// don't show up as a directory with no name
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("dir1//file"),
+		Body:   bytes.NewReader([]byte{}),
+	})
+	t.Assert(err, IsNil)
+	dir1, err := s.LookUpInode(t, "dir1")
+	t.Assert(err, IsNil)
+	s.assertEntries(t, dir1, []string{"file3"})
+}
+
+func (s *GoofysTest) TestRegionClients(t *C) {
+	r := newRegionClients(s.awsConfig, s.fs.flags)
+	svc := r.client(*s.awsConfig.Region)
+	t.Assert(r.client(*s.awsConfig.Region), Equals, svc)
+	t.Assert(r.client("eu-west-1"), Not(Equals), svc)
+
+	// the first one is throttled and retried
+	asked := 0
+	svc.Handlers.Send.PushBack(func(req *request.Request) {
+		if req.Operation.Name == "GetBucketLocation" {
+			asked++
+			if asked == 1 {
+				req.Error = awserr.NewRequestFailure(
+					awserr.New("SlowDown", "slow down", nil), 503, "")
+			}
+		}
+	})
+
+	region, err := r.bucketRegion(s.fs.bucket)
+	t.Assert(err, IsNil)
+	t.Assert(region, Not(Equals), "")
+	again, err := r.bucketRegion(s.fs.bucket)
+	t.Assert(err, IsNil)
+	t.Assert(again, Equals, region)
+	t.Assert(asked, Equals, 2)
+
+	t.Assert(locationRegion(nil), Equals, "us-east-1")
+	t.Assert(locationRegion(aws.String("EU")), Equals, "eu-west-1")
+	t.Assert(locationRegion(aws.String("ap-south-1")), Equals, "ap-south-1")
+
+	_, err = r.bucketRegion("goofys-test-no-such-bucket")
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *GoofysTest) TestSinglePutSize(t *C) {
+	s.fs.flags.SinglePutSize = 12 * 1024 * 1024
+
+	var mu sync.Mutex
+	ops := make(map[string]int)
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		mu.Lock()
+		ops[r.Operation.Name]++
+		mu.Unlock()
+	})
+
+	s.testWriteFile(t, "testSinglePut", 11*1024*1024, 128*1024)
+	t.Assert(ops["CreateMultipartUpload"], Equals, 0)
+	t.Assert(ops["PutObject"], Equals, 1)
+
+	// what we held on to goes out in several parts
+	s.testWriteFile(t, "testMultiPart", 21*1024*1024, 128*1024)
+	t.Assert(ops["CreateMultipartUpload"], Equals, 1)
+	t.Assert(ops["UploadPart"], Equals, 5)
+}
+
+func (s *GoofysTest) TestVerifyChecksums(t *C) {
+	// read ahead takes over after the first read
+	s.fs.flags.VerifyChecksums = true
+
+	data := make([]byte, 300*1024)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("checked"),
+		Body:   bytes.NewReader(data),
+	})
+	t.Assert(err, IsNil)
+
+	readAll := func() (err error) {
+		in, err := s.getRoot(t).LookUp(s.ctx, s.fs, "checked")
+		t.Assert(err, IsNil)
+		fh := in.OpenFile(s.fs)
+		defer fh.Release()
+
+		buf := make([]byte, 64*1024)
+		for offset := int64(0); offset < int64(len(data)); {
+			var nread int
+			nread, err = fh.ReadFile(s.ctx, s.fs, offset, buf)
+			if err != nil {
+				return
+			}
+			offset += int64(nread)
+		}
+		return
+	}
+
+	t.Assert(readAll(), IsNil)
+
+	// flip a byte on the way
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name == "GetObject" && r.Error == nil {
+			body, err := ioutil.ReadAll(r.HTTPResponse.Body)
+			t.Assert(err, IsNil)
+			r.HTTPResponse.Body.Close()
+			body[len(body)/2] ^= 0xff
+			r.HTTPResponse.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+	})
+
+	t.Assert(readAll(), Equals, syscall.EIO)
+}
+
+func (s *GoofysTest) TestWriteSmallChunks(t *C) {
+	// what the kernel sends without --writeback-cache for a
+	// program writing a little at a time, across a part
+	s.testWriteFile(t, "testSmallChunks", 6*1024*1024, 512)
+}
+
+func (s *GoofysTest) TestMetadataFiles(t *C) {
+	s.fs.flags.MetadataFiles = true
+
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket:   &s.fs.bucket,
+		Key:      aws.String("dir2/described"),
+		Body:     bytes.NewReader([]byte("hello")),
+		Metadata: map[string]*string{"color": aws.String("blue")},
+	})
+	t.Assert(err, IsNil)
+	// hidden by the metadata of dir2/real
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("dir2/real" + METADATA_SUFFIX),
+		Body:   bytes.NewReader([]byte("")),
+	})
+	t.Assert(err, IsNil)
+
+	dir2, err := s.getRoot(t).LookUp(s.ctx, s.fs, "dir2")
+	t.Assert(err, IsNil)
+	in, err := dir2.LookUp(s.ctx, s.fs, "described"+METADATA_SUFFIX)
+	t.Assert(err, IsNil)
+
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+	buf := make([]byte, in.Attributes.Size)
+	nread, err := fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(nread, Equals, len(buf))
+
+	var meta objectMetadata
+	t.Assert(json.Unmarshal(buf, &meta), IsNil)
+	t.Assert(meta.Size, Equals, int64(5))
+	t.Assert(meta.StorageClass, Equals, "STANDARD")
+	t.Assert(meta.Metadata["color"], Equals, "blue")
+	t.Assert(meta.ETag, Not(Equals), "")
+
+	t.Assert(fh.WriteFile(s.fs, 0, []byte("x")), Equals, syscall.EROFS)
+	t.Assert(dir2.Unlink(s.fs, "described"+METADATA_SUFFIX), Equals, syscall.EROFS)
+
+	// nothing can be made where the metadata of something would be
+	root := fuseops.InodeID(fuseops.RootInodeID)
+	name := "file1" + METADATA_SUFFIX
+	err = s.fs.CreateFile(s.ctx, &fuseops.CreateFileOp{Parent: root, Name: name})
+	t.Assert(err, Equals, syscall.EROFS)
+	err = s.fs.MkDir(s.ctx, &fuseops.MkDirOp{Parent: root, Name: name})
+	t.Assert(err, Equals, syscall.EROFS)
+	err = s.fs.CreateSymlink(s.ctx, &fuseops.CreateSymlinkOp{Parent: root, Name: name, Target: "file1"})
+	t.Assert(err, Equals, syscall.EROFS)
+	err = s.fs.Rename(s.ctx, &fuseops.RenameOp{
+		OldParent: root, OldName: "file1", NewParent: root, NewName: name})
+	t.Assert(err, Equals, syscall.EROFS)
+	err = s.fs.Rename(s.ctx, &fuseops.RenameOp{
+		OldParent: root, OldName: name, NewParent: root, NewName: "file3"})
+	t.Assert(err, Equals, syscall.EROFS)
+	t.Assert(s.readObject(t, "file1"), Equals, "file1")
+
+	_, err = dir2.LookUp(s.ctx, s.fs, "missing"+METADATA_SUFFIX)
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	dh := dir2.OpenDir()
+	defer dh.CloseDir()
+	for _, name := range namesOf(s.readDirFully(t, dh)) {
+		t.Assert(strings.HasSuffix(name, METADATA_SUFFIX), Equals, false)
+	}
+}
+
+func (s *GoofysTest) TestMaxReadWriteSize(t *C) {
+	s.fs.flags.MaxReadSize = 3
+	s.fs.flags.MaxWriteSize = 3
+
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+
+	buf := make([]byte, 4096)
+	_, err = fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, Equals, syscall.EFBIG)
+
+	_, fh = s.getRoot(t).Create(s.fs, "small")
+	t.Assert(fh.WriteFile(s.fs, 0, []byte("abc")), IsNil)
+	t.Assert(fh.WriteFile(s.fs, 3, []byte("d")), Equals, syscall.EFBIG)
+	t.Assert(fh.Truncate(s.fs, 4), Equals, syscall.EFBIG)
+	t.Assert(fh.FlushFile(s.fs), IsNil)
+
+	nread, err := fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:nread]), Equals, "abc")
+}
+
+func (s *GoofysTest) TestUploadAbortedUnderUs(t *C) {
+	_, fh := s.getRoot(t).Create(s.fs, "aborted")
+
+	buf := make([]byte, 1024*1024)
+	for i := int64(0); i < 7; i++ {
+		err := fh.WriteFile(s.fs, i*int64(len(buf)), buf)
+		t.Assert(err, IsNil)
+	}
+
+	// like a cleanup from another mount
+	fh.mpuWG.Wait()
+	t.Assert(fh.mpuId, NotNil)
+	_, err := s.s3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &s.fs.bucket,
+		Key:      fh.inode.FullName,
+		UploadId: fh.mpuId,
+	})
+	t.Assert(err, IsNil)
+
+	err = fh.FlushFile(s.fs)
+	t.Assert(err, Equals, syscall.ECANCELED)
+}
+
+func (s *GoofysTest) TestCaseInsensitive(t *C) {
+	s.fs.flags.CaseInsensitive = true
+
+	for _, key := range []string{"dir2/ReadMe.txt", "dir2/Dup", "dir2/DUP"} {
+		_, err := s.s3.PutObject(&s3.PutObjectInput{
+			Bucket: &s.fs.bucket,
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte(key)),
+		})
+		t.Assert(err, IsNil)
+	}
+
+	dir2, err := s.getRoot(t).LookUp(s.ctx, s.fs, "DIR2")
+	t.Assert(err, IsNil)
+	t.Assert(*dir2.FullName, Equals, "dir2")
+	t.Assert(dir2.Attributes.Mode&os.ModeDir, Not(Equals), os.FileMode(0))
+
+	in, err := dir2.LookUp(s.ctx, s.fs, "README.TXT")
+	t.Assert(err, IsNil)
+	t.Assert(*in.FullName, Equals, "dir2/ReadMe.txt")
+	t.Assert(s.fs.caseNames["dir2/README.TXT"], Equals, "ReadMe.txt")
+
+	// the first one listed
+	in, err = dir2.LookUp(s.ctx, s.fs, "dup")
+	t.Assert(err, IsNil)
+	t.Assert(*in.FullName, Equals, "dir2/DUP")
+
+	_, err = dir2.LookUp(s.ctx, s.fs, "nothing")
+	t.Assert(err, Equals, fuse.ENOENT)
+
+	// the kernel's inode for the real name is the one we use
+	dirOp := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "dir2"}
+	t.Assert(s.fs.LookUpInode(s.ctx, dirOp), IsNil)
+	realOp := &fuseops.LookUpInodeOp{Parent: dirOp.Entry.Child, Name: "ReadMe.txt"}
+	t.Assert(s.fs.LookUpInode(s.ctx, realOp), IsNil)
+
+	var mu sync.Mutex
+	requests := 0
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+	})
+
+	for i := 0; i < 2; i++ {
+		op := &fuseops.LookUpInodeOp{Parent: dirOp.Entry.Child, Name: "README.TXT"}
+		t.Assert(s.fs.LookUpInode(s.ctx, op), IsNil)
+		t.Assert(op.Entry.Child, Equals, realOp.Entry.Child)
+	}
+	// we knew what it was from before
+	t.Assert(requests, Equals, 0)
+	s.fs.mu.Lock()
+	t.Assert(s.fs.inodesCache["dir2/ReadMe.txt"].Id, Equals, realOp.Entry.Child)
+	s.fs.mu.Unlock()
+}
+
+func (s *GoofysTest) TestSizeFromGet(t *C) {
+	put := func(content string) {
+		_, err := s.s3.PutObject(&s3.PutObjectInput{
+			Bucket: &s.fs.bucket,
+			Key:    aws.String("grown"),
+			Body:   bytes.NewReader([]byte(content)),
+		})
+		t.Assert(err, IsNil)
+	}
+
+	put("01234")
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, "grown")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(5))
+
+	// appended to after we looked it up
+	put("0123456789")
+
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+	buf := make([]byte, 4096)
+	nread, err := fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:nread]), Equals, "0123456789")
+	t.Assert(in.Attributes.Size, Equals, uint64(10))
+
+	// now that we've read some, another one would be mixed up
+	// with what we've read
+	put("0123456789abcdef")
+	fh.mu.Lock()
+	fh.closeStreams()
+	fh.mu.Unlock()
+	_, err = fh.ReadFile(s.ctx, s.fs, 2, buf)
+	t.Assert(err, Equals, syscall.ESTALE)
+}
+
+func (s *GoofysTest) TestRenameDirBatched(t *C) {
+	s.fs.flags.MaxParallelCopy = 4
+
+	const n = 30
+	for i := 0; i < n; i++ {
+		_, err := s.s3.PutObject(&s3.PutObjectInput{
+			Bucket: &s.fs.bucket,
+			Key:    aws.String(fmt.Sprintf("many/%v", i)),
+			Body:   bytes.NewReader([]byte("x")),
+		})
+		t.Assert(err, IsNil)
+	}
+
+	var mu sync.Mutex
+	ops := make(map[string]int)
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		mu.Lock()
+		ops[r.Operation.Name]++
+		mu.Unlock()
+	})
+
+	err := s.fs.renameDir("many/", "moved/")
+	t.Assert(err, IsNil)
+	t.Assert(ops["CopyObject"], Equals, n)
+	// the listing said how big they are, and S3 copies the metadata
+	t.Assert(ops["HeadObject"], Equals, 0)
+	t.Assert(ops["DeleteObjects"], Equals, 1)
+	t.Assert(ops["DeleteObject"], Equals, 0)
+
+	_, err = s.LookUpInode(t, "many")
+	t.Assert(err, Equals, fuse.ENOENT)
+	_, err = s.LookUpInode(t, fmt.Sprintf("moved/%v", n-1))
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestRenameDirUnlocked(t *C) {
+	root := s.getRoot(t)
+	dir2, err := s.LookUpInode(t, "dir2")
+	t.Assert(err, IsNil)
+
+	// the copies don't hold either directory, or looking
+	// something up in them would wait for the whole rename
+	var once sync.Once
+	locked := make(chan bool, 1)
+	s.fs.s3.Handlers.Send.PushBack(func(r *request.Request) {
+		if r.Operation.Name != "CopyObject" {
+			return
+		}
+		once.Do(func() {
+			for _, dir := range []*Inode{root, dir2} {
+				done := make(chan bool)
+				go func() {
+					dir.mu.Lock()
+					dir.mu.Unlock()
+					close(done)
+				}()
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					locked <- true
+					return
+				}
+			}
+			locked <- false
+		})
+	})
+
+	err = root.Rename(s.fs, "dir1", dir2, "moved")
+	t.Assert(err, IsNil)
+	t.Assert(<-locked, Equals, false)
+
+	_, err = s.LookUpInode(t, "dir2/moved/file3")
+	t.Assert(err, IsNil)
+}
+
+// a backend that refuses to delete anything
+type noDeleteBackend struct {
+	StorageBackend
+}
+
+func (b noDeleteBackend) DeleteBlob(context.Context, *DeleteBlobInput) error {
+	return awserr.NewRequestFailure(awserr.New("AccessDenied", "no", nil), 403, "")
+}
+
+func (b noDeleteBackend) DeleteBlobs(ctx context.Context, param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	out := &DeleteBlobsOutput{Errors: make(map[string]error)}
+	for _, key := range param.Keys {
+		out.Errors[key] = b.DeleteBlob(ctx, &DeleteBlobInput{Key: key})
+	}
+	return out, nil
+}
+
+func (s *GoofysTest) TestStorageBackend(t *C) {
+	s.fs.backend = noDeleteBackend{s.fs.backend}
+
+	err := s.getRoot(t).Unlink(s.fs, "file1")
+	t.Assert(err, Equals, syscall.EACCES)
+
+	// everything else still goes to S3
+	_, err = s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+}
+
+func (s *GoofysTest) TestFlushInterrupted(t *C) {
+	createOp := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "interrupted"}
+	err := s.fs.CreateFile(s.ctx, createOp)
+	t.Assert(err, IsNil)
+	err = s.fs.WriteFile(s.ctx, &fuseops.WriteFileOp{
+		Inode:  createOp.Entry.Child,
+		Handle: createOp.Handle,
+		Data:   []byte("hello"),
+	})
+	t.Assert(err, IsNil)
+
+	// close() was interrupted before it started
+	ctx, cancel := context.WithCancel(s.ctx)
+	cancel()
+	err = s.fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: createOp.Entry.Child, Handle: createOp.Handle})
+	t.Assert(err, IsNil)
+	err = s.fs.ReleaseFileHandle(s.ctx, &fuseops.ReleaseFileHandleOp{Handle: createOp.Handle})
+	t.Assert(err, IsNil)
+
+	t.Assert(s.readObject(t, "interrupted"), Equals, "hello")
+}
+
+func (s *GoofysTest) TestSinglePutOutOfMemory(t *C) {
+	s.fs.flags.SinglePutSize = 15 * 1024 * 1024
+	// room for two handles holding two buffers each
+	s.fs.bufferPool = NewBufferPool(4*BUF_SIZE, 4*BUF_SIZE)
+
+	root := s.getRoot(t)
+	_, fh1 := root.Create(s.fs, "held1")
+	_, fh2 := root.Create(s.fs, "held2")
+
+	chunk := make([]byte, 1024*1024)
+	for off := int64(0); off < 15*1024*1024; off += int64(len(chunk)) {
+		// neither would get a third buffer if they both
+		// waited for the other to be closed
+		t.Assert(fh1.WriteFile(s.fs, off, chunk), IsNil)
+		t.Assert(fh2.WriteFile(s.fs, off, chunk), IsNil)
+	}
+
+	for _, fh := range []*FileHandle{fh1, fh2} {
+		t.Assert(fh.FlushFile(s.fs), IsNil)
+		fh.Release()
+		t.Assert(fh.inode.Attributes.Size, Equals, uint64(15*1024*1024))
+	}
+}
+
+func (s *GoofysTest) TestForgetWithAttrFlushPending(t *C) {
+	s.fs.flags.PosixAttrs = true
+
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket:      &s.fs.bucket,
+		Key:         aws.String("pending"),
+		Body:        bytes.NewReader([]byte("x")),
+		ContentType: aws.String("text/x-pending"),
+		Metadata:    map[string]*string{"owner": aws.String("me")},
+	})
+	t.Assert(err, IsNil)
+
+	op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "pending"}
+	t.Assert(s.fs.LookUpInode(s.ctx, op), IsNil)
+	in := s.fs.getInodeOrDie(op.Entry.Child)
+
+	mode := os.FileMode(0600)
+	in.SetAttributes(s.fs, &mode, nil, nil, nil)
+	err = s.fs.ForgetInode(s.ctx, &fuseops.ForgetInodeOp{Inode: op.Entry.Child, N: 1})
+	t.Assert(err, IsNil)
+	t.Assert(in.userMetadata, NotNil)
+
+	time.Sleep(3 * ATTR_FLUSH_DELAY)
+
+	resp, err := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("pending"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(*resp.ContentType, Equals, "text/x-pending")
+	t.Assert(resp.Metadata["Owner"], NotNil)
+	t.Assert(*resp.Metadata["Owner"], Equals, "me")
+	t.Assert(*resp.Metadata[strings.Title(MODE_META)], Equals, "384")
+}
+
+func (s *GoofysTest) TestReplaceMetadataKeepsHeaders(t *C) {
+	s.fs.flags.PosixAttrs = true
+	s.fs.flags.CacheControl = "no-cache"
+
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket:          &s.fs.bucket,
+		Key:             aws.String("headers"),
+		Body:            bytes.NewReader([]byte("x")),
+		CacheControl:    aws.String("max-age=60"),
+		ContentEncoding: aws.String("gzip"),
+		ContentLanguage: aws.String("fr"),
+	})
+	t.Assert(err, IsNil)
+
+	// from a listing, so nothing has HEADed it
+	in := NewInode(aws.String("headers"), aws.String("headers"), s.fs.flags)
+	in.Attributes = &fuseops.InodeAttributes{Mode: 0644}
+
+	in.mu.Lock()
+	in.Attributes.Mode = 0600
+	in.attrsDirty = true
+	in.mu.Unlock()
+	in.flushAttributes(s.fs)
+
+	resp, err := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s.fs.bucket,
+		Key:    aws.String("headers"),
+	})
+	t.Assert(err, IsNil)
+	t.Assert(*resp.Metadata[strings.Title(MODE_META)], Equals, "384")
+	t.Assert(*resp.CacheControl, Equals, "max-age=60")
+	t.Assert(*resp.ContentEncoding, Equals, "gzip")
+	t.Assert(*resp.ContentLanguage, Equals, "fr")
+}
+
+func (s *GoofysTest) TestReleaseFileHandleUnlocked(t *C) {
+	in, err := s.LookUpInode(t, "file1")
+	t.Assert(err, IsNil)
+
+	openOp := &fuseops.OpenFileOp{Inode: in.Id}
+	t.Assert(s.fs.OpenFile(s.ctx, openOp), IsNil)
+
+	s.fs.mu.Lock()
+	fh := s.fs.fileHandles[openOp.Handle]
+	s.fs.mu.Unlock()
+
+	// as if it's busy reading
+	fh.mu.Lock()
+	released := make(chan error)
+	go func() {
+		released <- s.fs.ReleaseFileHandle(s.ctx,
+			&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+	}()
+
+	// everyone else can go on meanwhile
+	time.Sleep(100 * time.Millisecond)
+	_, err = s.fs.FlushAll()
+	t.Assert(err, IsNil)
+	s.fs.mu.Lock()
+	_, ok := s.fs.fileHandles[openOp.Handle]
+	s.fs.mu.Unlock()
+	t.Assert(ok, Equals, false)
+
+	fh.mu.Unlock()
+	t.Assert(<-released, IsNil)
+}
+
+func (s *GoofysTest) TestReplaceMetadataOpenHandle(t *C) {
+	s.fs.flags.PosixAttrs = true
+
+	lookup := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "file1"}
+	t.Assert(s.fs.LookUpInode(s.ctx, lookup), IsNil)
+	in := s.fs.getInodeOrDie(lookup.Entry.Child)
+
+	open := &fuseops.OpenFileOp{Inode: in.Id}
+	t.Assert(s.fs.OpenFile(s.ctx, open), IsNil)
+	fh := s.fs.fileHandles[open.Handle]
+
+	buf := make([]byte, 2)
+	n, err := fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:n]), Equals, "fi")
+
+	// chmod copies the object onto itself, which changes its ETag
+	mode := os.FileMode(0600)
+	in.SetAttributes(s.fs, &mode, nil, nil, nil)
+	in.mu.Lock()
+	in.attrTimer.Stop()
+	in.mu.Unlock()
+	in.flushAttributes(s.fs)
+
+	// the next read has to GET again
+	fh.mu.Lock()
+	fh.dropReadAhead()
+	fh.closeStreams()
+	fh.mu.Unlock()
+
+	buf = make([]byte, 3)
+	n, err = fh.ReadFile(s.ctx, s.fs, 2, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:n]), Equals, "le1")
+
+	err = s.fs.ReleaseFileHandle(s.ctx, &fuseops.ReleaseFileHandleOp{Handle: open.Handle})
+	t.Assert(err, IsNil)
+}
+
+// what the kernel does with --writeback-cache: pages are written back
+// in whatever order, and the rest of a page is read before part of
+// it is written
+func (s *GoofysTest) TestReadBuffered(t *C) {
+	_, fh := s.getRoot(t).Create(s.fs, "buffered")
+	defer fh.Release()
+	t.Assert(fh.WriteFile(s.fs, 0, []byte("hello")), IsNil)
+
+	// from memory, nothing is uploaded for it
+	buf := make([]byte, 10)
+	nread, err := fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:nread]), Equals, "hello")
+	t.Assert(fh.overlay, IsNil)
+	t.Assert(fh.mpuId, IsNil)
+
+	// a part that went out can't be read back, what's after it can
+	t.Assert(fh.WriteFile(s.fs, 5, bytes.Repeat([]byte("x"), BUF_SIZE)), IsNil)
+	_, err = fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, Equals, syscall.EIO)
+	nread, err = fh.ReadFile(s.ctx, s.fs, BUF_SIZE, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:nread]), Equals, "xxxxx")
+	t.Assert(fh.overlay, IsNil)
+
+	t.Assert(fh.FlushFile(s.fs), IsNil)
+	t.Assert(len(s.readObject(t, "buffered")), Equals, BUF_SIZE+5)
+}
+
+func (s *GoofysTest) TestWritebackOrder(t *C) {
+	page := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, 4096)
+	}
+
+	_, fh := s.getRoot(t).Create(s.fs, "writeback")
+	t.Assert(fh.WriteFile(s.fs, 4096, page('b')), IsNil)
+	t.Assert(fh.WriteFile(s.fs, 0, page('a')), IsNil)
+	t.Assert(fh.WriteFile(s.fs, 3*4096, page('d')), IsNil)
+	t.Assert(fh.WriteFile(s.fs, 2*4096, page('c')), IsNil)
+
+	// and it sees what it wrote
+	buf := make([]byte, 2*4096)
+	nread, err := fh.ReadFile(s.ctx, s.fs, 4096, buf)
+	t.Assert(err, IsNil)
+	t.Assert(nread, Equals, len(buf))
+	t.Assert(string(buf), Equals, string(page('b'))+string(page('c')))
+
+	t.Assert(fh.FlushFile(s.fs), IsNil)
+	fh.Release()
+	t.Assert(s.readObject(t, "writeback"), Equals,
+		string(page('a'))+string(page('b'))+string(page('c'))+string(page('d')))
+
+	// a page that's written back again, after parts went out
+	_, fh = s.getRoot(t).Create(s.fs, "writeback2")
+	const size = BUF_SIZE + 3*4096
+	for off := int64(0); off < size; off += 4096 {
+		t.Assert(fh.WriteFile(s.fs, off, page('x')), IsNil)
+	}
+	t.Assert(fh.WriteFile(s.fs, 0, page('y')), IsNil)
+	t.Assert(fh.FlushFile(s.fs), IsNil)
+	fh.Release()
+	content := s.readObject(t, "writeback2")
+	t.Assert(len(content), Equals, size)
+	t.Assert(content[:4096], Equals, string(page('y')))
+	t.Assert(content[size-4096:], Equals, string(page('x')))
+
+	// partial writes into an object we haven't read
+	in, err := s.getRoot(t).LookUp(s.ctx, s.fs, "file1")
+	t.Assert(err, IsNil)
+	fh = in.OpenFile(s.fs)
+	defer fh.Release()
+	t.Assert(fh.WriteFile(s.fs, 2, []byte("XY")), IsNil)
+	buf = make([]byte, 4096)
+	nread, err = fh.ReadFile(s.ctx, s.fs, 0, buf)
 	t.Assert(err, IsNil)
+	t.Assert(string(buf[:nread]), Equals, "fiXY1")
+	t.Assert(fh.WriteFile(s.fs, 0, buf[:nread]), IsNil)
+	t.Assert(fh.FlushFile(s.fs), IsNil)
+	t.Assert(s.readObject(t, "file1"), Equals, "fiXY1")
 }
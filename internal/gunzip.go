@@ -0,0 +1,129 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --gunzip, objects stored with Content-Encoding: gzip read back
+// decompressed. There's no range of the decompressed content we can
+// ask S3 for, so every read that isn't where the last one left off
+// decompresses from the start again. We don't know the size until a
+// read hits the end, until then it's GUNZIP_UNKNOWN_SIZE so the
+// kernel keeps asking.
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
+// the most S3 lets you store
+const GUNZIP_UNKNOWN_SIZE = 5 * 1024 * 1024 * 1024 * 1024
+
+func isGzip(contentEncoding *string) bool {
+	return contentEncoding != nil &&
+		strings.EqualFold(strings.TrimSpace(*contentEncoding), "gzip")
+}
+
+type gunzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+
+	inode *Inode
+	etag  *string
+	// how much we've decompressed
+	n int64
+}
+
+func (b *gunzipBody) Read(p []byte) (n int, err error) {
+	n, err = b.Reader.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.inode.gunzipped(b.etag, b.n)
+	}
+	return
+}
+
+func (b *gunzipBody) Close() (err error) {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+func (b *gunzipBody) interrupt() {
+	if body, ok := b.body.(interruptible); ok {
+		body.interrupt()
+	}
+}
+
+// Now we know how big the decompressed object is.
+//
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) gunzipped(etag *string, size int64) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if !inode.gzipped || etag == nil || inode.ETag == nil || *etag != *inode.ETag {
+		// not what we have anymore
+		return
+	}
+	inode.gunzipEtag = etag
+	inode.gunzipSize = uint64(size)
+	if inode.dirtyHandles == 0 {
+		inode.Attributes.Size = inode.gunzipSize
+	}
+}
+
+// GET the whole object and decompress it up to offset, or as far as
+// it goes if that's past the end.
+func (fh *FileHandle) openGunzip(ctx context.Context, fs *Goofys, offset int64) (reader *gunzipBody, err error) {
+	resp, err := fh.getObject(ctx, fs, 0, 0)
+	if err != nil {
+		return
+	}
+	body := resp.Body
+
+	if !isGzip(resp.ContentEncoding) {
+		// replaced with something that's not gzip since we
+		// looked it up
+		body.Close()
+		return nil, syscall.ESTALE
+	}
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		fh.inode.logFuse("gzip.NewReader", err)
+		body.Close()
+		return nil, syscall.EIO
+	}
+
+	reader = &gunzipBody{Reader: gz, body: body, inode: fh.inode, etag: resp.ETag}
+	stop := whenDone(ctx, reader.interrupt)
+	_, err = io.CopyN(ioutil.Discard, reader, offset)
+	stop()
+	if err == io.EOF {
+		err = nil
+	} else if err != nil {
+		reader.Close()
+		if ctx.Err() != nil {
+			return nil, syscall.EINTR
+		}
+		fh.inode.logFuse("gunzip", err)
+		return nil, syscall.EIO
+	}
+
+	return
+}
@@ -15,17 +15,20 @@
 package internal
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -39,9 +42,79 @@ type Inode struct {
 	flags      *FlagStorage
 	Attributes *fuseops.InodeAttributes
 
+	// nil if we don't know yet, or if this is not a symlink
+	SymlinkTarget *string
+
+	// with flags.Versions, the version of FullName this is. nil
+	// for the latest version
+	VersionId *string
+
+	// with flags.MetadataFiles, the content of file.s3meta
+	metadataFile []byte
+
+	// bumped whenever a name is created in this directory, so a
+	// lookup that started before doesn't remember that the name
+	// isn't there. GUARDED_BY(fs.mu)
+	negativeGen uint64
+
+	// held while any handle of this inode writes, truncates or
+	// flushes, so a flush never sees a write half done and the
+	// part numbering of an upload can't get mixed up. Taken before
+	// fh.mu and mu
+	writeMu sync.Mutex
+
 	mu      sync.Mutex          // everything below is protected by mu
 	handles map[*DirHandle]bool // value is ignored
 	refcnt  uint64
+
+	// the ETag S3 last told us about, nil for directories and
+	// files that haven't been uploaded
+	ETag *string
+
+	// attributes that haven't been saved to metadata yet
+	attrsDirty bool
+	attrTimer  *time.Timer
+	// file handles with writes that are not flushed
+	dirtyHandles int
+	// we changed the object, so a listing of the directory may
+	// have the old size and mtime
+	changed bool
+
+	// when Attributes were last fetched from S3, and the HEAD
+	// that's fetching them again if there's one
+	attrTime       time.Time
+	attrRefresh    chan struct{}
+	attrRefreshErr error
+
+	// from the last HEAD, keys are lower case. nil if we
+	// haven't done one
+	userMetadata       map[string]*string
+	contentType        *string
+	cacheControl       *string
+	contentDisposition *string
+	contentEncoding    *string
+	contentLanguage    *string
+	websiteRedirect    *string
+
+	// the ETag the kernel's page cache was filled from
+	cacheEtag *string
+
+	// we asked S3 to restore this from an archive
+	restoring bool
+
+	// with flags.Gunzip, this is stored gzipped and we decompress
+	// it on read. Once a read got to the end of the object with
+	// gunzipEtag we know its size is gunzipSize
+	gzipped    bool
+	gunzipEtag *string
+	gunzipSize uint64
+
+	// the last complete listing of this directory, and a counter
+	// that's bumped whenever we change the directory so a listing
+	// that raced with the change is not cached
+	dirPages []dirPage
+	dirTime  time.Time
+	dirGen   uint64
 }
 
 func NewInode(name *string, fullName *string, flags *FlagStorage) (inode *Inode) {
@@ -57,19 +130,45 @@ func (inode *Inode) Ref() {
 	inode.refcnt++
 }
 
+// Directories bigger than this many pages are listed every time
+const DIR_CACHE_MAX_PAGES = 10
+
+// One ListObjects worth of a directory
+type dirPage struct {
+	entries []fuseutil.Dirent
+	attrs   map[string]fuseops.InodeAttributes
+	etags   map[string]*string
+	marker  *string
+}
+
 type DirHandle struct {
 	inode *Inode
 
 	mu          sync.Mutex // everything below is protected by mu
 	Entries     []fuseutil.Dirent
 	NameToEntry map[string]fuseops.InodeAttributes // XXX use a smaller struct
-	Marker      *string
+	NameToETag  map[string]*string
+	Marker      *string // the continuation token with flags.UseV2List
 	BaseOffset  int
+
+	// the pages we listed since offset 0, or the cached pages we
+	// are going through instead of listing
+	pages  []dirPage
+	cached []dirPage
+	page   int
+	gen    uint64
+
+	// what we've listed from S3 since offset 0 adds up to, for
+	// fs.dirSizes. sizeUnknown once a subdirectory's size isn't
+	// known
+	sizeTotal   uint64
+	sizeUnknown bool
 }
 
 func NewDirHandle(inode *Inode) (dh *DirHandle) {
 	dh = &DirHandle{inode: inode}
 	dh.NameToEntry = make(map[string]fuseops.InodeAttributes)
+	dh.NameToETag = make(map[string]*string)
 	return
 }
 
@@ -88,12 +187,54 @@ type FileHandle struct {
 
 	poolHandle *BufferPoolHandle
 	buf        []byte
+	// full buffers waiting for the rest of their part, see
+	// writePartBuffers
+	partBufs [][]byte
 
 	lastWriteError error
 
-	// read
-	reader        io.ReadCloser
+	// non-sequential writes are staged here until flush
+	overlay *writeOverlay
+
+	// with flags.FlushInterval, when we were last written to and
+	// the timer that completes the upload if that was long ago
+	lastWrite  time.Time
+	flushTimer *time.Timer
+	// set by Release, so a timer that already fired doesn't flush
+	// after it
+	released bool
+
+	// what we expect to replace with flags.ConditionalWrites: the
+	// ETag of the object when we opened it, or nothing at all if
+	// we created it
+	etag    *string
+	created bool
+
+	// reads are decompressed, see gunzip.go
+	gunzip bool
+
+	// read, see streams.go. readBufOffset is where the last read
+	// ended, readAny is whether we've returned anything
+	streams       []*readStream
 	readBufOffset int64
+	readAny       bool
+
+	// with flags.CacheDir, the cache entry we read from, or the
+	// one we are filling. See diskcache.go
+	cacheChecked bool
+	cacheFile    *os.File
+	cacheFill    *cacheFill
+
+	readAheadBufs   []*readAheadBuffer
+	readAheadWindow int64
+	// with flags.VerifyChecksums, what read ahead has read of the
+	// object so far, see checksums.go
+	readAheadSum *runningChecksum
+
+	// with flags.CoalesceWindow, see coalesce.go
+	coalesced     []*coalescedRange
+	lastSmallRead int64
+	smallReadSeen bool
 }
 
 func NewFileHandle(in *Inode) *FileHandle {
@@ -107,39 +248,96 @@ func (inode *Inode) logFuse(op string, args ...interface{}) {
 	}
 }
 
-// LOCKS_REQUIRED(parent.mu)
-func (parent *Inode) lookupFromDirHandles(name string) (inode *Inode) {
-	parent.mu.Lock()
-	defer parent.mu.Unlock()
-
+// What an open handle or a recent listing of parent says name is, so
+// that the lookups that follow a ReadDir (ls -l) don't each go to S3.
+// The listing is used for as long as flags.StatCacheTTL after it was
+// made, even if the handle that made it is closed.
+func (parent *Inode) lookupFromDirHandles(fs *Goofys, name string) (inode *Inode) {
 	defer func() {
 		if inode != nil {
 			inode.Ref()
 		}
 	}()
 
+	found := func(attr fuseops.InodeAttributes, etag *string) bool {
+		if fs.flags.Gunzip && attr.Mode&os.ModeDir == 0 {
+			// listings don't say what's gzipped, we need a HEAD
+			return false
+		}
+		if fs.flags.PosixAttrs && attr.Mode&(os.ModeDir|os.ModeSymlink) == 0 {
+			// nor what the mode, uid and gid are. Symlinks
+			// were HEADed by the listing already
+			return false
+		}
+		fullName := parent.getChildName(name)
+		inode = NewInode(&name, &fullName, parent.flags)
+		inode.Attributes = &attr
+		inode.ETag = etag
+		return true
+	}
+
+	parent.mu.Lock()
+	handles := make([]*DirHandle, 0, len(parent.handles))
 	for dh := range parent.handles {
+		handles = append(handles, dh)
+	}
+	parent.mu.Unlock()
+
+	// ReadDir takes parent.mu with dh.mu held, so we can't hold
+	// parent.mu here
+	for _, dh := range handles {
+		dh.mu.Lock()
 		attr, ok := dh.NameToEntry[name]
-		if ok {
-			fullName := parent.getChildName(name)
-			inode = NewInode(&name, &fullName, parent.flags)
-			inode.Attributes = &attr
+		etag := dh.NameToETag[name]
+		dh.mu.Unlock()
+
+		if ok && found(attr, etag) {
 			return
 		}
 	}
 
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if parent.dirPages != nil && time.Since(parent.dirTime) < fs.flags.StatCacheTTL &&
+		time.Since(parent.dirTime) < fs.flags.TypeCacheTTL {
+		for _, p := range parent.dirPages {
+			if attr, ok := p.attrs[name]; ok && found(attr, p.etags[name]) {
+				return
+			}
+		}
+	}
+
 	return
 }
 
-func (parent *Inode) LookUp(fs *Goofys, name string) (inode *Inode, err error) {
+func (parent *Inode) LookUp(ctx context.Context, fs *Goofys, name string) (inode *Inode, err error) {
 	parent.logFuse("Inode.LookUp", name)
 
-	inode = parent.lookupFromDirHandles(name)
-	if inode != nil {
-		return
+	if fs.flags.Versions {
+		if base, version := splitVersion(name); len(version) != 0 {
+			return parent.lookUpVersion(ctx, fs, name, base, version)
+		}
+	}
+	if base, ok := fs.metadataOf(name); ok {
+		return parent.lookUpMetadata(ctx, fs, name, base)
+	}
+
+	if fs.flags.StatCacheTTL != 0 {
+		inode = parent.lookupFromDirHandles(fs, name)
+		if inode != nil {
+			return
+		}
+	}
+
+	if fs.flags.CaseInsensitive && parent.isCaseName(fs, name) {
+		return parent.lookUpCaseless(ctx, fs, name)
 	}
 
-	inode, err = fs.LookUpInodeMaybeDir(name, parent.getChildName(name))
+	inode, err = fs.lookUpInodeWithHint(ctx, name, parent.getChildName(name), parent.childHint(fs, name))
+	if err == fuse.ENOENT && fs.flags.CaseInsensitive {
+		inode, err = parent.lookUpCaseless(ctx, fs, name)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -147,8 +345,25 @@ func (parent *Inode) LookUp(fs *Goofys, name string) (inode *Inode, err error) {
 	return
 }
 
+// What a recent listing of parent says name is, so we only need to
+// ask S3 about one of name and name/.
+func (parent *Inode) childHint(fs *Goofys, name string) lookupHint {
+	pages, _ := parent.cachedListing(fs)
+	for _, p := range pages {
+		if attr, ok := p.attrs[name]; ok {
+			if attr.Mode&os.ModeDir != 0 {
+				return LOOKUP_DIR
+			}
+			return LOOKUP_FILE
+		}
+	}
+	return LOOKUP_UNKNOWN
+}
+
+// The S3 key of name in parent, which already includes the prefix
+// we are mounted at.
 func (parent *Inode) getChildName(name string) string {
-	if parent.Id == fuseops.RootInodeID {
+	if len(*parent.FullName) == 0 {
 		return name
 	} else {
 		return fmt.Sprintf("%v/%v", *parent.FullName, name)
@@ -170,22 +385,56 @@ func (inode *Inode) DeRef(n uint64) (stale bool) {
 	return inode.refcnt == 0
 }
 
+// The kernel is done with this inode, drop what we cached for it. An
+// attribute flush that's scheduled still goes ahead, and needs the
+// object's metadata and headers to write them back. Returns whether
+// we changed the object while the kernel knew about it.
+func (inode *Inode) forget() (changed bool) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	changed = inode.changed
+	inode.dirPages = nil
+	inode.SymlinkTarget = nil
+	if inode.attrsDirty || inode.attrTimer != nil || inode.dirtyHandles != 0 {
+		return
+	}
+	inode.userMetadata = nil
+	inode.contentType = nil
+	inode.cacheControl = nil
+	inode.contentDisposition = nil
+	inode.contentEncoding = nil
+	inode.contentLanguage = nil
+	inode.websiteRedirect = nil
+	return
+}
+
 func (parent *Inode) Unlink(fs *Goofys, name string) (err error) {
 	parent.logFuse("Unlink", name)
 
-	fullName := parent.getChildName(name)
-
-	params := &s3.DeleteObjectInput{
-		Bucket: &fs.bucket,
-		Key:    &fullName,
+	if fs.flags.Versions {
+		if _, version := splitVersion(name); len(version) != 0 {
+			return syscall.EROFS
+		}
 	}
+	if _, ok := fs.metadataOf(name); ok {
+		return syscall.EROFS
+	}
+
+	fullName := parent.getChildName(name)
 
-	resp, err := fs.s3.DeleteObject(params)
+	err = fs.deleteKey(fullName)
 	if err != nil {
-		return mapAwsError(err)
+		return
 	}
 
-	fs.logS3(resp)
+	parent.mu.Lock()
+	parent.invalidateDir(fs)
+	parent.mu.Unlock()
+
+	if fs.usage != nil {
+		fs.usage.forget(fullName)
+	}
 
 	return
 }
@@ -200,12 +449,14 @@ func (parent *Inode) Create(
 	parent.mu.Lock()
 	defer parent.mu.Unlock()
 
+	parent.invalidateDir(fs)
+
 	now := time.Now()
 	inode = NewInode(&name, &fullName, parent.flags)
 	inode.Attributes = &fuseops.InodeAttributes{
 		Size:   0,
 		Nlink:  1,
-		Mode:   fs.flags.FileMode,
+		Mode:   fs.fileMode(name),
 		Atime:  now,
 		Mtime:  now,
 		Ctime:  now,
@@ -214,9 +465,12 @@ func (parent *Inode) Create(
 		Gid:    fs.flags.Gid,
 	}
 
+	inode.attrTime = now
+
 	fh = NewFileHandle(inode)
+	fh.created = true
 	fh.poolHandle = fs.bufferPool.NewPoolHandle()
-	fh.dirty = true
+	fh.markDirty()
 
 	return
 }
@@ -227,53 +481,65 @@ func (parent *Inode) MkDir(
 
 	parent.logFuse("MkDir", name)
 
-	fullName := parent.getChildName(name) + "/"
+	fullName := parent.getChildName(name)
 
-	params := &s3.PutObjectInput{
-		Bucket: &fs.bucket,
-		Key:    &fullName,
-		Body:   nil,
-	}
-	_, err = fs.s3.PutObject(params)
-	if err != nil {
-		err = mapAwsError(err)
-		return
+	if fs.localDirs != nil {
+		fs.localDirs.add(fullName)
+	} else {
+		marker := fullName + "/"
+
+		params := &PutBlobInput{
+			Key:          marker,
+			StorageClass: fs.storageClass(marker),
+		}
+		_, err = fs.backend.PutBlob(context.Background(), params)
+		if err != nil {
+			err = mapAwsError(err)
+			return
+		}
 	}
 
 	parent.mu.Lock()
 	defer parent.mu.Unlock()
 
+	parent.invalidateDir(fs)
+
 	inode = NewInode(&name, &fullName, parent.flags)
 	inode.Attributes = &fs.rootAttrs
 
 	return
 }
 
+// A directory exists if there's a dir/ marker or anything else under
+// dir/, and it's empty if the marker is all there is.
 func isEmptyDir(fs *Goofys, fullName string) (isDir bool, err error) {
 	fullName += "/"
 
-	params := &s3.ListObjectsInput{
-		Bucket:    &fs.bucket,
-		Delimiter: aws.String("/"),
+	params := &ListBlobsInput{
+		Delimiter: "/",
 		MaxKeys:   aws.Int64(2),
-		Prefix:    &fullName,
+		Prefix:    fullName,
 	}
 
-	resp, err := fs.s3.ListObjects(params)
+	var resp *ListBlobsOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.ListBlobs(context.Background(), params)
+		return
+	})
 	if err != nil {
 		return false, mapAwsError(err)
 	}
 
-	if len(resp.CommonPrefixes) > 0 || len(resp.Contents) > 1 {
+	if len(resp.Prefixes) > 0 || len(resp.Items) > 1 {
 		err = fuse.ENOTEMPTY
 		isDir = true
 		return
 	}
 
-	if len(resp.Contents) == 1 {
+	if len(resp.Items) == 1 {
 		isDir = true
 
-		if *resp.Contents[0].Key != fullName {
+		if resp.Items[0].Key != fullName {
 			err = fuse.ENOTEMPTY
 		}
 	}
@@ -289,110 +555,377 @@ func (parent *Inode) RmDir(
 
 	fullName := parent.getChildName(name)
 
+	if fs.localDirs != nil && len(fs.localDirs.children(fullName+"/")) != 0 {
+		// S3 doesn't know about what's in it either
+		return fuse.ENOTEMPTY
+	}
+
 	isDir, err := isEmptyDir(fs, fullName)
 	if err != nil {
 		return
 	}
-	if !isDir {
-		return fuse.ENOENT
+	if fs.localDirs != nil {
+		fs.localDirs.remove(fullName)
 	}
-
-	fullName += "/"
-
-	params := &s3.DeleteObjectInput{
-		Bucket: &fs.bucket,
-		Key:    &fullName,
+	if !isDir {
+		// a directory that only existed because of what was in
+		// it, or only in our memory, nothing to remove
+		parent.mu.Lock()
+		parent.invalidateDir(fs)
+		parent.mu.Unlock()
+		return
 	}
 
-	_, err = fs.s3.DeleteObject(params)
+	err = fs.deleteKey(fullName + "/")
 	if err != nil {
-		return mapAwsError(err)
+		return
 	}
 
+	parent.mu.Lock()
+	parent.invalidateDir(fs)
+	parent.mu.Unlock()
+
 	return
 }
 
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) isDir() bool {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	return inode.Attributes.Mode&os.ModeDir != 0
+}
+
 func (inode *Inode) GetAttributes(fs *Goofys) (*fuseops.InodeAttributes, error) {
-	// XXX refresh attributes
 	inode.logFuse("GetAttributes")
+
+	if inode.Attributes.Mode&os.ModeDir != 0 && fs.dirSizes != nil {
+		return inode.dirAttributes(fs)
+	}
+
+	if inode.Attributes.Mode&os.ModeDir != 0 || inode.VersionId != nil || inode.metadataFile != nil {
+		// nothing to refresh for directories, versions don't
+		// change, and metadata is as of the lookup
+		return inode.Attributes, nil
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	// what we have locally is newer than S3 if we are writing
+	if inode.dirtyHandles == 0 && time.Since(inode.attrTime) >= fs.flags.StatCacheTTL {
+		err := inode.refreshAttributes(fs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return inode.Attributes, nil
 }
 
-func (inode *Inode) OpenFile(fs *Goofys) *FileHandle {
+// Fill in the attributes from a HEAD response, updating them in
+// place if we already have some.
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) fillAttributes(fs *Goofys, resp *HeadBlobOutput) {
+	attr := fuseops.InodeAttributes{
+		Size:   uint64(resp.Size),
+		Nlink:  1,
+		Mode:   fs.fileMode(*inode.Name),
+		Atime:  resp.LastModified,
+		Mtime:  resp.LastModified,
+		Ctime:  resp.LastModified,
+		Crtime: resp.LastModified,
+		Uid:    fs.flags.Uid,
+		Gid:    fs.flags.Gid,
+	}
+	if target := symlinkTarget(resp.Metadata); target != nil {
+		attr.Mode = SYMLINK_MODE
+		attr.Size = uint64(len(*target))
+		inode.SymlinkTarget = target
+	}
+	fs.applyMetadata(&attr, resp.Metadata)
+
+	inode.gzipped = fs.flags.Gunzip && isGzip(resp.ContentEncoding) &&
+		inode.SymlinkTarget == nil
+	if inode.gzipped {
+		if inode.gunzipEtag != nil && resp.ETag != nil && *inode.gunzipEtag == *resp.ETag {
+			attr.Size = inode.gunzipSize
+		} else {
+			attr.Size = GUNZIP_UNKNOWN_SIZE
+		}
+	}
+
+	inode.userMetadata = make(map[string]*string)
+	for k, v := range resp.Metadata {
+		inode.userMetadata[strings.ToLower(k)] = v
+	}
+	inode.fillHeaders(&resp.BlobProperties)
+	inode.ETag = resp.ETag
+
+	if old := inode.Attributes; old != nil && inode.attrsDirty {
+		// what we haven't saved yet is newer than S3
+		attr.Mode = (attr.Mode &^ os.ModePerm) | old.Mode.Perm()
+		attr.Uid = old.Uid
+		attr.Gid = old.Gid
+		attr.Atime = old.Atime
+		attr.Mtime = old.Mtime
+		attr.Ctime = old.Ctime
+	}
+
+	if inode.Attributes == nil {
+		inode.Attributes = &attr
+	} else {
+		*inode.Attributes = attr
+	}
+	inode.attrTime = time.Now()
+}
+
+// The headers of the object, which copying it onto itself has to
+// send back because REPLACE replaces them too.
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) fillHeaders(props *BlobProperties) {
+	inode.contentType = props.ContentType
+	inode.cacheControl = props.CacheControl
+	inode.contentDisposition = props.ContentDisposition
+	inode.contentEncoding = props.ContentEncoding
+	inode.contentLanguage = props.ContentLanguage
+	inode.websiteRedirect = props.WebsiteRedirectLocation
+}
+
+// HEAD the object again. Only one of these is in flight per inode,
+// everyone else waits for its result.
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) refreshAttributes(fs *Goofys) (err error) {
+	if inode.attrRefresh != nil {
+		done := inode.attrRefresh
+		inode.mu.Unlock()
+		<-done
+		inode.mu.Lock()
+		return inode.attrRefreshErr
+	}
+
+	done := make(chan struct{})
+	inode.attrRefresh = done
+	inode.mu.Unlock()
+
+	var resp *HeadBlobOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.HeadBlob(context.Background(), &HeadBlobInput{Key: *inode.FullName})
+		return
+	})
+	if err != nil {
+		err = mapAwsError(err)
+	}
+
+	inode.mu.Lock()
+	inode.attrRefresh = nil
+	inode.attrRefreshErr = err
+	close(done)
+
+	// someone might have started writing while we were waiting
+	if err == nil && inode.dirtyHandles == 0 {
+		inode.fillAttributes(fs, resp)
+	}
+
+	return
+}
+
+func (inode *Inode) OpenFile(fs *Goofys) (fh *FileHandle) {
 	inode.logFuse("OpenFile")
-	return NewFileHandle(inode)
+
+	fh = NewFileHandle(inode)
+	inode.mu.Lock()
+	fh.etag = inode.ETag
+	fh.gunzip = inode.gzipped
+	inode.mu.Unlock()
+
+	return
+}
+
+// Whether the pages the kernel cached during an earlier open are
+// still what's in S3. Whatever it caches from now on will be from
+// the object we know about.
+func (inode *Inode) keepPageCache(fs *Goofys) bool {
+	// refresh the ETag if it's old
+	_, err := inode.GetAttributes(fs)
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	keep := err == nil && inode.ETag != nil && inode.cacheEtag != nil &&
+		*inode.ETag == *inode.cacheEtag
+	inode.cacheEtag = inode.ETag
+	return keep
+}
+
+// Call send with the preconditions for replacing what this handle
+// opened, so that a concurrent overwrite fails with ESTALE instead of
+// being lost. Stores that don't implement preconditions get called
+// again without them.
+func (fh *FileHandle) sendConditional(fs *Goofys,
+	send func(ifMatch *string, ifNoneMatch *string) error) (err error) {
+
+	if !fs.flags.ConditionalWrites || (fh.etag == nil && !fh.created) {
+		return send(nil, nil)
+	}
+
+	if fh.etag != nil {
+		err = send(fh.etag, nil)
+	} else {
+		err = send(nil, aws.String("*"))
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 501 {
+		fh.inode.logFuse("preconditions not implemented", reqErr.Message())
+		return send(nil, nil)
+	}
+	return
+}
+
+// We just uploaded what the kernel has cached.
+func (inode *Inode) uploaded(etag *string) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	inode.ETag = etag
+	inode.cacheEtag = etag
+	inode.changed = true
 }
 
-func (fh *FileHandle) initWrite(fs *Goofys) {
+func (fh *FileHandle) initWrite(fs *Goofys, contentType *string) {
 	fh.writeInit.Do(func() {
 		fh.mpuWG.Add(1)
-		go fh.initMPU(fs)
+		go fh.initMPU(fs, contentType)
 	})
 }
 
-func (fh *FileHandle) initMPU(fs *Goofys) {
+func (fh *FileHandle) initMPU(fs *Goofys, contentType *string) {
 	defer func() {
 		fh.mpuWG.Done()
 	}()
 
-	params := &s3.CreateMultipartUploadInput{
-		Bucket:       &fs.bucket,
-		Key:          fh.inode.FullName,
-		StorageClass: &fs.flags.StorageClass,
+	params := &MultipartBlobBeginInput{
+		Key: *fh.inode.FullName,
+		BlobProperties: BlobProperties{
+			Metadata:           fs.inodeMetadata(fh.inode),
+			ContentType:        contentType,
+			CacheControl:       fs.cacheControl(),
+			ContentDisposition: fs.contentDisposition(),
+		},
+		StorageClass: fs.storageClass(*fh.inode.FullName),
 	}
 
-	resp, err := fs.s3.CreateMultipartUpload(params)
+	resp, err := fs.backend.MultipartBlobBegin(context.Background(), params)
 
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 
 	if err != nil {
 		fh.lastWriteError = mapAwsError(err)
+		fh.mpuId = nil
+	} else {
+		fh.mpuId = &resp.UploadId
 	}
+	fh.etags = nil
+
+	return
+}
+
+// Parts start out as one buffer each. Every WRITE_PART_GROWTH parts
+// they double, so a file can be bigger than MAX_PARTS buffers
+const WRITE_PART_GROWTH = 1000
 
-	fs.logS3(resp)
+// How many buffers go into part, doubling every growth parts. A part
+// is at most half of what a handle may have, so the next one can
+// fill while it uploads.
+func writePartBuffers(part int, growth int, maxBuffers int64) int {
+	n := int64(1) << uint((part-1)/growth)
+	if limit := maxBuffers / 2; n > limit {
+		n = limit
+	}
+	if n < 1 {
+		n = 1
+	}
+	return int(n)
+}
 
-	fh.mpuId = resp.UploadId
-	fh.etags = make([]*string, 10000) // at most 10K parts
+// The buffers of a part, one after the other
+type partBuffers [][]byte
 
+func (p partBuffers) size() (n int64) {
+	for _, buf := range p {
+		n += int64(len(buf))
+	}
 	return
 }
 
-func (fh *FileHandle) mpuPartNoSpawn(fs *Goofys, buf []byte, part int) (err error) {
-	fh.inode.logFuse("mpuPartNoSpawn", cap(buf), part)
-	if cap(buf) != 0 {
-		defer fh.poolHandle.Free(buf)
+func (p partBuffers) ReadAt(b []byte, off int64) (n int, err error) {
+	for _, buf := range p {
+		if off >= int64(len(buf)) {
+			off -= int64(len(buf))
+			continue
+		}
+
+		n += copy(b[n:], buf[off:])
+		off = 0
+		if n == len(b) {
+			return
+		}
 	}
+	return n, io.EOF
+}
+
+func (fh *FileHandle) mpuPartNoSpawn(fs *Goofys, bufs partBuffers, part int) (etag *string, err error) {
+	fh.inode.logFuse("mpuPartNoSpawn", bufs.size(), part)
+	defer func() {
+		for _, buf := range bufs {
+			if cap(buf) != 0 {
+				fh.poolHandle.Free(buf)
+			}
+		}
+	}()
 
-	if part == 0 || part > 10000 {
+	if part == 0 {
 		panic(fmt.Sprintf("invalid part number: %v", part))
+	} else if part > fs.maxParts {
+		return nil, syscall.EFBIG
 	}
 
-	params := &s3.UploadPartInput{
-		Bucket:     &fs.bucket,
-		Key:        fh.inode.FullName,
-		PartNumber: aws.Int64(int64(part)),
-		UploadId:   fh.mpuId,
-		Body:       bytes.NewReader(buf),
+	params := &MultipartBlobAddInput{
+		Key:        *fh.inode.FullName,
+		UploadId:   *fh.mpuId,
+		PartNumber: int64(part),
+		Body:       io.NewSectionReader(bufs, 0, bufs.size()),
 	}
 
-	fs.logS3(params)
-
-	resp, err := fs.s3.UploadPart(params)
+	var resp *MultipartBlobAddOutput
+	err = fs.retryUpload(func() (err error) {
+		resp, err = fs.backend.MultipartBlobAdd(context.Background(), params)
+		return
+	})
 	if err != nil {
-		return mapAwsError(err)
+		return nil, mapUploadError(err)
 	}
 
-	en := &fh.etags[part-1]
+	return resp.ETag, nil
+}
+
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) setEtag(part int, etag *string) {
+	for len(fh.etags) < part {
+		fh.etags = append(fh.etags, nil)
+	}
 
+	en := &fh.etags[part-1]
 	if *en != nil {
 		panic(fmt.Sprintf("etags for part %v already set: %v", part, **en))
 	}
-	*en = resp.ETag
-	return
+	*en = etag
 }
 
-func (fh *FileHandle) mpuPart(fs *Goofys, buf []byte, part int) {
+func (fh *FileHandle) mpuPart(fs *Goofys, bufs partBuffers, part int) {
 	defer func() {
 		fh.mpuWG.Done()
 	}()
@@ -406,21 +939,81 @@ func (fh *FileHandle) mpuPart(fs *Goofys, buf []byte, part int) {
 		}
 	}
 
-	err := fh.mpuPartNoSpawn(fs, buf, part)
-	if err != nil {
-		fh.mu.Lock()
-		defer fh.mu.Unlock()
+	etag, err := fh.mpuPartNoSpawn(fs, bufs, part)
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
 
+	if err != nil {
 		if fh.lastWriteError == nil {
-			fh.lastWriteError = mapAwsError(err)
+			fh.lastWriteError = err
+		}
+		return
+	}
+	fh.setEtag(part, etag)
+}
+
+// buf is full. Upload it, along with the full buffers before it if
+// the next part takes more than one.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) partFull(fs *Goofys, buf []byte) (err error) {
+	fh.partBufs = append(fh.partBufs, buf)
+
+	if fh.lastPartId == 0 && partBuffers(fh.partBufs).size() <= fs.flags.SinglePutSize {
+		// this may still go in one PutObject, see flushSmallFile
+		return
+	}
+
+	return fh.uploadPartBufs(fs)
+}
+
+// Upload the full buffers we have, there can be several parts' worth
+// if we held on to them.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) uploadPartBufs(fs *Goofys) (err error) {
+	for {
+		part := fh.lastPartId + 1
+		n := writePartBuffers(part, fs.partGrowth, fs.bufferPool.maxBuffersPerHandle)
+		if len(fh.partBufs) < n {
+			return
 		}
+		if part > fs.maxParts {
+			return syscall.EFBIG
+		}
+
+		err = fh.waitForCreateMPU(fs, fh.partBufs[0])
+		if err != nil {
+			return
+		}
+
+		fh.lastPartId = part
+		bufs := fh.partBufs[:n:n]
+		fh.partBufs = fh.partBufs[n:]
+		fh.mpuWG.Add(1)
+
+		go fh.mpuPart(fs, bufs, part)
 	}
 }
 
-func (fh *FileHandle) waitForCreateMPU(fs *Goofys) (err error) {
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) freePartBufs() {
+	for _, buf := range fh.partBufs {
+		fh.poolHandle.Free(buf)
+	}
+	fh.partBufs = nil
+}
+
+// firstPart is only used to guess the content type, it has to be
+// set when the upload is created.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) waitForCreateMPU(fs *Goofys, firstPart []byte) (err error) {
 	if fh.mpuId == nil {
+		contentType := fs.contentType(fh.inode, firstPart)
 		fh.mu.Unlock()
-		fh.initWrite(fs)
+		fh.initWrite(fs, contentType)
 		fh.mpuWG.Wait() // wait for initMPU
 		fh.mu.Lock()
 
@@ -432,9 +1025,30 @@ func (fh *FileHandle) waitForCreateMPU(fs *Goofys) (err error) {
 	return
 }
 
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) markDirty() {
+	if !fh.dirty {
+		fh.dirty = true
+
+		fh.inode.mu.Lock()
+		fh.inode.dirtyHandles++
+		fh.inode.mu.Unlock()
+	}
+}
+
 func (fh *FileHandle) WriteFile(fs *Goofys, offset int64, data []byte) (err error) {
 	fh.inode.logFuse("WriteFile", offset, len(data))
 
+	if fh.inode.VersionId != nil || fh.inode.metadataFile != nil {
+		return syscall.EROFS
+	}
+	if max := fs.flags.MaxWriteSize; max != 0 && offset+int64(len(data)) > max {
+		return syscall.EFBIG
+	}
+
+	fh.inode.writeMu.Lock()
+	defer fh.inode.writeMu.Unlock()
+
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 
@@ -442,39 +1056,94 @@ func (fh *FileHandle) WriteFile(fs *Goofys, offset int64, data []byte) (err erro
 		return fh.lastWriteError
 	}
 
-	if offset != fh.nextWriteOffset {
-		fh.inode.logFuse("WriteFile: only sequential writes supported", fh.nextWriteOffset, offset)
-		fh.lastWriteError = fuse.EINVAL
-		return fh.lastWriteError
+	if fs.flags.PosixAttrs {
+		// this gets saved with the upload
+		fh.inode.mu.Lock()
+		fh.inode.Attributes.Mtime = time.Now()
+		fh.inode.mu.Unlock()
 	}
 
-	if offset == 0 {
-		fh.poolHandle = fs.bufferPool.NewPoolHandle()
-		fh.dirty = true
+	if fh.overlay == nil && !fh.dirty && offset != 0 &&
+		offset == int64(fh.inode.Attributes.Size) {
+		// O_APPEND, or a write just past the end
+		err = fh.startAppend(fs, offset)
+		if err != nil {
+			fh.lastWriteError = err
+			return
+		}
 	}
 
-	for {
-		if cap(fh.buf) == 0 {
-			fh.buf = fh.poolHandle.Request()
+	if fh.overlay == nil && !fh.dirty && offset == 0 && fh.inode.Attributes.Size != 0 {
+		// overwriting the start of what's there, without
+		// O_TRUNC the rest of it stays (dd conv=notrunc,
+		// rsync --inplace)
+		fh.inode.logFuse("WriteFile: writing over the start", fh.inode.Attributes.Size)
+		err = fh.startOverlay(fs)
+		if err != nil {
+			fh.lastWriteError = err
+			return
 		}
+	}
 
-		nCopied := fh.poolHandle.Copy(&fh.buf, data)
-		fh.nextWriteOffset += int64(nCopied)
+	if fh.overlay == nil && offset != fh.nextWriteOffset {
+		fh.inode.logFuse("WriteFile: switching to random writes", fh.nextWriteOffset, offset)
+		err = fh.startOverlay(fs)
+		if err != nil {
+			fh.lastWriteError = err
+			return
+		}
+	}
 
-		if len(fh.buf) == cap(fh.buf) {
-			// we filled this buffer, upload this part
-			err = fh.waitForCreateMPU(fs)
+	if fh.overlay != nil {
+		err = fh.overlay.Write(offset, data)
+		if err != nil {
+			fh.lastWriteError = err
+			return
+		}
+
+		fh.markDirty()
+		fh.inode.Attributes.Size = uint64(fh.overlay.size)
+		return
+	}
+
+	if offset == 0 {
+		fh.poolHandle = fs.bufferPool.NewPoolHandle()
+		fh.markDirty()
+	}
+
+	end := offset + int64(len(data))
+
+	for {
+		if cap(fh.buf) == 0 {
+			fh.buf = fh.poolHandle.TryRequest()
+		}
+		if cap(fh.buf) == 0 && fh.lastPartId == 0 && len(fh.partBufs) != 0 {
+			// we're out of memory, and what others are
+			// holding for their own single PUT may only
+			// be freed when they are closed. Upload ours
+			// rather than wait for it
+			fh.inode.logFuse("WriteFile: out of buffers, starting multipart upload")
+			err = fh.uploadPartBufs(fs)
 			if err != nil {
 				return
 			}
+		}
+		if cap(fh.buf) == 0 {
+			fh.buf = fh.poolHandle.Request()
+		}
+
+		nCopied := fh.poolHandle.Copy(&fh.buf, data)
+		fh.nextWriteOffset += int64(nCopied)
 
-			fh.lastPartId++
-			part := fh.lastPartId
+		if len(fh.buf) == cap(fh.buf) {
+			// we filled this buffer, it's part of the next
+			// part
 			buf := fh.buf
 			fh.buf = nil
-			fh.mpuWG.Add(1)
-
-			go fh.mpuPart(fs, buf, part)
+			err = fh.partFull(fs, buf)
+			if err != nil {
+				return
+			}
 		}
 
 		if nCopied == len(data) {
@@ -484,8 +1153,451 @@ func (fh *FileHandle) WriteFile(fs *Goofys, offset int64, data []byte) (err erro
 		data = data[nCopied:]
 	}
 
-	fh.inode.Attributes.Size = uint64(offset + int64(len(data)))
+	fh.inode.Attributes.Size = uint64(end)
+
+	if fs.flags.FlushInterval > 0 {
+		fh.lastWrite = time.Now()
+		if fh.flushTimer == nil {
+			fh.flushTimer = time.AfterFunc(fs.flags.FlushInterval, func() {
+				fh.idleFlush(fs)
+			})
+		}
+	}
+
+	return
+}
+
+// Complete the upload of a file that's still open but hasn't been
+// written to for flags.FlushInterval, so what's written so far isn't
+// lost if we crash. The next write starts a new upload from the end
+// of this one, see startAppend.
+//
+// LOCKS_EXCLUDED(fh.inode.writeMu, fh.mu)
+func (fh *FileHandle) idleFlush(fs *Goofys) {
+	// held until we are done so Release waits for us
+	fh.inode.writeMu.Lock()
+	defer fh.inode.writeMu.Unlock()
+
+	fh.mu.Lock()
+	if fh.released {
+		fh.mu.Unlock()
+		return
+	}
+	fh.flushTimer = nil
+
+	if !fh.dirty || fh.overlay != nil || fh.lastPartId == 0 {
+		// small files and random writes are not worth it
+		fh.mu.Unlock()
+		return
+	}
+
+	if idle := time.Since(fh.lastWrite); idle < fs.flags.FlushInterval {
+		fh.flushTimer = time.AfterFunc(fs.flags.FlushInterval-idle, func() {
+			fh.idleFlush(fs)
+		})
+		fh.mu.Unlock()
+		return
+	}
+	fh.mu.Unlock()
+
+	fh.inode.logFuse("idleFlush")
+
+	err := fh.flush(fs)
+	if err != nil {
+		log.Printf("Unable to flush %v: %v", *fh.inode.FullName, err)
+	}
+}
+
+// Like any other write, the new size only goes to S3 when the handle
+// is flushed.
+func (fh *FileHandle) Truncate(fs *Goofys, size int64) (err error) {
+	fh.inode.logFuse("Truncate", size)
+
+	if fh.inode.VersionId != nil || fh.inode.metadataFile != nil {
+		return syscall.EROFS
+	}
+	if max := fs.flags.MaxWriteSize; max != 0 && size > max {
+		return syscall.EFBIG
+	}
+
+	fh.inode.writeMu.Lock()
+	defer fh.inode.writeMu.Unlock()
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if fh.lastWriteError != nil {
+		return fh.lastWriteError
+	}
+
+	if size == 0 && fh.overlay == nil && fh.nextWriteOffset == 0 && fh.lastPartId == 0 {
+		// open(O_TRUNC) before writing it all again, which
+		// can stream out like a new file
+		fh.poolHandle = fs.bufferPool.NewPoolHandle()
+		fh.markDirty()
+		fh.inode.Attributes.Size = 0
+		return
+	}
+
+	if fh.overlay == nil {
+		err = fh.startOverlay(fs)
+		if err != nil {
+			fh.lastWriteError = err
+			return
+		}
+	}
+
+	fh.overlay.Truncate(size)
+	fh.markDirty()
+	fh.inode.Attributes.Size = uint64(size)
+
+	return
+}
+
+// Continue writing sequentially from the end of what's in S3. The
+// whole parts of the object are copied server side to start a new
+// upload, and only the tail that doesn't fill a part is read back
+// into the buffer. If the object isn't size anymore we leave things
+// alone and the write goes through the overlay instead.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) startAppend(fs *Goofys, size int64) (err error) {
+	fh.inode.logFuse("startAppend", size)
+
+	if fh.gunzip {
+		return syscall.ENOTSUP
+	}
+
+	var resp *HeadBlobOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.HeadBlob(context.Background(), &HeadBlobInput{Key: *fh.inode.FullName})
+		return
+	})
+	if err != nil {
+		err = mapAwsError(err)
+		if err == fuse.ENOENT {
+			// not uploaded yet
+			err = nil
+		}
+		return
+	}
+
+	if resp.Size != size {
+		return
+	}
+
+	tail := size % BUF_SIZE
+	head := size - tail
+
+	fh.poolHandle = fs.bufferPool.NewPoolHandle()
+
+	if tail != 0 {
+		fh.buf = fh.poolHandle.Request()
+		fh.buf = fh.buf[:tail]
+		err = fh.readBase(fs, head, fh.buf)
+		if err != nil {
+			return
+		}
+	}
+
+	if head != 0 {
+		// keep the content type it already has
+		fh.mu.Unlock()
+		fh.initWrite(fs, resp.ContentType)
+		fh.mpuWG.Wait()
+		fh.mu.Lock()
+
+		if fh.lastWriteError != nil {
+			return fh.lastWriteError
+		}
+
+		// every part but the last has to be at least
+		// MIN_PART_SIZE, so copy in multiples of BUF_SIZE and
+		// leave most of the parts for what's appended
+		half := int64(fs.maxParts / 2)
+		partSize := int64(BUF_SIZE) * ((head/BUF_SIZE + half - 1) / half)
+		if partSize > MAX_PART_SIZE {
+			partSize = MAX_PART_SIZE
+		}
+		nParts := sizeToParts(head, partSize)
+		fh.etags = make([]*string, nParts)
+
+		// XXX use CopySourceIfMatch in case someone else
+		// changed it since our HEAD
+		err = fs.mpuCopyParts(head, partSize, *fh.inode.FullName,
+			*fh.inode.FullName, *fh.mpuId, fh.etags)
+		if err != nil {
+			return
+		}
+		fh.lastPartId = nParts
+	}
+
+	fh.nextWriteOffset = size
+	fh.markDirty()
+
+	return
+}
+
+// Move whatever we've written sequentially into an overlay so that
+// writes can land anywhere in the file.
+//
+// LOCKS_REQUIRED(fh.inode.writeMu, fh.mu)
+func (fh *FileHandle) startOverlay(fs *Goofys) (err error) {
+	if fh.poolHandle == nil {
+		fh.poolHandle = fs.bufferPool.NewPoolHandle()
+	}
+
+	if fh.nextWriteOffset == 0 && fh.lastPartId == 0 {
+		// nothing written yet, writes go on top of what's in S3
+		fh.overlay = newWriteOverlay(int64(fh.inode.Attributes.Size), fh.poolHandle)
+	} else if fh.lastPartId == 0 {
+		// everything we wrote is still in memory
+		fh.overlay = newWriteOverlay(0, fh.poolHandle)
+		offset := int64(0)
+		for _, buf := range append(fh.partBufs, fh.buf) {
+			if err == nil {
+				err = fh.overlay.Write(offset, buf)
+			}
+			offset += int64(len(buf))
+			// so the overlay can have it
+			if cap(buf) != 0 {
+				fh.poolHandle.Free(buf)
+			}
+		}
+		fh.partBufs = nil
+		fh.buf = nil
+		fh.nextWriteOffset = 0
+	} else {
+		// some parts are already uploaded and we can't read them
+		// back, so finish the upload and use that as the base
+		size := fh.nextWriteOffset
+
+		fh.mu.Unlock()
+		err = fh.flush(fs)
+		fh.mu.Lock()
+
+		if err != nil {
+			return
+		}
+
+		fh.overlay = newWriteOverlay(size, fh.poolHandle)
+	}
+
+	return
+}
 
+// GET [start, start + count) of what this handle opened, count 0 is
+// to the end. If the object has been replaced since, reading a range
+// of the new one would mix old and new content, so that's ESTALE.
+// IfRange means we get the whole new object rather than a range of
+// it, which is how we tell.
+func (fh *FileHandle) getObject(ctx context.Context, fs *Goofys,
+	start int64, count int64) (resp *GetBlobOutput, err error) {
+
+	params := &GetBlobInput{
+		Key:       *fh.inode.FullName,
+		VersionId: fh.inode.VersionId,
+		Start:     start,
+		Count:     count,
+		IfRange:   fh.etag,
+	}
+
+	etag := fh.etag
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.GetBlob(ctx, params)
+		return
+	})
+	if isArchived(err) {
+		return nil, fh.inode.archived(fs)
+	} else if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	if etag != nil && resp.ETag != nil && *resp.ETag != *etag {
+		fh.inode.logFuse("replaced since open", *etag, *resp.ETag)
+		resp.Body.Close()
+		return nil, syscall.ESTALE
+	}
+
+	if !fh.gunzip {
+		fh.inode.sizeFromGet(uint64(resp.Size))
+	}
+	return
+}
+
+// A GET says the object is size big. If we aren't writing it that's
+// newer than what we had, which may be from a listing or a HEAD from
+// before someone else wrote it.
+//
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) sizeFromGet(size uint64) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.dirtyHandles != 0 || inode.Attributes.Size == size {
+		return
+	}
+	inode.logFuse("size from GET", inode.Attributes.Size, size)
+	inode.Attributes.Size = size
+}
+
+// Read [offset, offset + len(buf)) of the original object into buf
+func (fh *FileHandle) readBase(fs *Goofys, offset int64, buf []byte) (err error) {
+	if fh.gunzip {
+		// XXX we could decompress it, but we'd be uploading
+		// something else than what's there now anyway
+		return syscall.ENOTSUP
+	}
+
+	resp, err := fh.getObject(context.Background(), fs, offset, int64(len(buf)))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	_, err = io.ReadFull(resp.Body, buf)
+	return
+}
+
+// Reconstruct the file from the original object and the overlay, and
+// feed it into the multipart machinery. The last part is left in
+// fh.buf for FlushFile to upload.
+func (fh *FileHandle) replayOverlay(fs *Goofys) (err error) {
+	o := fh.overlay
+	fh.overlay = nil
+	defer o.Close()
+
+	fh.buf = nil
+
+	for offset := int64(0); offset < o.size; offset += BUF_SIZE {
+		end := minInt64(offset+BUF_SIZE, o.size)
+
+		buf := fh.poolHandle.TryRequest()
+		if buf == nil && o.spill == nil {
+			// the overlay may have what we are waiting for
+			err = o.spillToDisk()
+			if err != nil {
+				return
+			}
+		}
+		if buf == nil {
+			buf = fh.poolHandle.Request()
+		}
+		buf = buf[:end-offset]
+
+		if offset < o.baseSize && !o.covers(offset, end) {
+			baseEnd := minInt64(end, o.baseSize)
+			err = fh.readBase(fs, offset, buf[:baseEnd-offset])
+			if err != nil {
+				fh.poolHandle.Free(buf)
+				return
+			}
+			// the rest is a hole
+			for i := baseEnd - offset; i < int64(len(buf)); i++ {
+				buf[i] = 0
+			}
+		} else {
+			for i := range buf {
+				buf[i] = 0
+			}
+		}
+
+		err = o.apply(offset, buf)
+		if err != nil {
+			fh.poolHandle.Free(buf)
+			return
+		}
+
+		if end == o.size {
+			fh.buf = buf
+			break
+		}
+
+		fh.mu.Lock()
+		err = fh.partFull(fs, buf)
+		fh.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+
+	fh.nextWriteOffset = o.size
+	return
+}
+
+// Read from a handle with writes we haven't uploaded, which has to
+// see them. With --writeback-cache the kernel reads the rest of a
+// page before it writes part of it, and later writes back what it
+// read, so reading what's in S3 would undo our own writes. Random
+// writes are in an overlay, which knows what was written where.
+// Sequential ones are read from the buffers they're still in.
+//
+// LOCKS_EXCLUDED(fh.inode.writeMu, fh.mu)
+func (fh *FileHandle) readDirty(fs *Goofys, offset int64, buf []byte) (bytesRead int, err error) {
+	fh.inode.writeMu.Lock()
+	defer fh.inode.writeMu.Unlock()
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if fh.lastWriteError != nil {
+		return 0, fh.lastWriteError
+	}
+
+	if fh.overlay == nil {
+		return fh.readBuffered(offset, buf)
+	}
+
+	o := fh.overlay
+	if offset >= o.size {
+		return 0, io.EOF
+	}
+	end := minInt64(offset+int64(len(buf)), o.size)
+	buf = buf[:end-offset]
+
+	baseEnd := offset
+	if offset < o.baseSize && !o.covers(offset, end) {
+		baseEnd = minInt64(end, o.baseSize)
+		err = fh.readBase(fs, offset, buf[:baseEnd-offset])
+		if err != nil {
+			return
+		}
+	}
+	// the rest is a hole
+	for i := baseEnd - offset; i < int64(len(buf)); i++ {
+		buf[i] = 0
+	}
+
+	err = o.apply(offset, buf)
+	if err != nil {
+		return
+	}
+
+	bytesRead = len(buf)
+	fh.readDone(offset, bytesRead)
+	return
+}
+
+// Read what a sequential write still has in memory. The parts that
+// have gone out can't be read back until the upload is completed,
+// and completing it early for a read would upload the file twice, so
+// reading those is EIO.
+//
+// LOCKS_REQUIRED(fh.inode.writeMu, fh.mu)
+func (fh *FileHandle) readBuffered(offset int64, buf []byte) (bytesRead int, err error) {
+	if offset >= fh.nextWriteOffset {
+		return 0, io.EOF
+	}
+
+	bufs := append(partBuffers(fh.partBufs), fh.buf)
+	start := fh.nextWriteOffset - bufs.size()
+	if offset < start {
+		fh.inode.logFuse("read of uploaded parts", offset, start)
+		return 0, syscall.EIO
+	}
+
+	bytesRead, err = bufs.ReadAt(buf, offset-start)
+	fh.readDone(offset, bytesRead)
 	return
 }
 
@@ -506,43 +1618,64 @@ func tryReadAll(r io.ReadCloser, buf []byte) (bytesRead int, err error) {
 	return
 }
 
-func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, err error) {
+func (fh *FileHandle) ReadFile(ctx context.Context, fs *Goofys, offset int64, buf []byte) (bytesRead int, err error) {
+	bytesRead, err = fh.readFile(ctx, fs, offset, buf)
+	if err == syscall.ESTALE && fh.takeReplacement(fs) {
+		bytesRead, err = fh.readFile(ctx, fs, offset, buf)
+	}
+	return
+}
+
+// The object was replaced since the handle was opened, maybe
+// appended to. If we haven't read or written any of the old one
+// there's nothing to mix up, so we can read the new one instead, and
+// its size. Returns whether we do.
+//
+// LOCKS_EXCLUDED(fh.mu)
+func (fh *FileHandle) takeReplacement(fs *Goofys) bool {
 	fh.mu.Lock()
-	defer fh.mu.Unlock()
-	if fh.inode.flags.DebugFuse {
-		defer func() {
-			fh.inode.logFuse("< readFromStream", bytesRead)
-		}()
+	pristine := !fh.readAny && !fh.dirty && !fh.gunzip
+	fh.mu.Unlock()
+	if !pristine {
+		return false
 	}
 
-	if fh.reader != nil {
-		// try to service read from existing stream
-		if offset == fh.readBufOffset {
-			bytesRead, err = tryReadAll(fh.reader, buf)
-			if err == io.EOF {
-				fh.reader.Close()
-				fh.reader = nil
-			}
-			fh.readBufOffset += int64(bytesRead)
-			return
-		} else {
-			// XXX out of order read, maybe disable prefetching
-			fh.inode.logFuse("out of order read", offset, fh.readBufOffset)
-			fh.readBufOffset = offset
-			if fh.reader != nil {
-				fh.reader.Close()
-				fh.reader = nil
-			}
-		}
+	fh.inode.mu.Lock()
+	err := fh.inode.refreshAttributes(fs)
+	etag := fh.inode.ETag
+	fh.inode.mu.Unlock()
+	if err != nil || etag == nil {
+		return false
 	}
 
-	return
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if fh.readAny || fh.dirty {
+		return false
+	}
+	fh.inode.logFuse("reading the replacement", etag)
+	fh.etag = etag
+	fh.dropReadAhead()
+	fh.closeStreams()
+	fh.coalesced = nil
+	return true
 }
 
-func (fh *FileHandle) ReadFile(fs *Goofys, offset int64, buf []byte) (bytesRead int, err error) {
+// A read of bytesRead at offset is done.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) readDone(offset int64, bytesRead int) {
+	fh.readBufOffset = offset + int64(bytesRead)
+	if bytesRead != 0 {
+		fh.readAny = true
+	}
+}
+
+func (fh *FileHandle) readFile(ctx context.Context, fs *Goofys, offset int64, buf []byte) (bytesRead int, err error) {
 	fh.inode.logFuse("ReadFile", offset, len(buf), fh.readBufOffset)
 	defer func() {
-		if bytesRead != 0 && err != nil {
+		if bytesRead != 0 && err != nil || err == io.EOF {
 			err = nil
 		}
 
@@ -555,102 +1688,246 @@ func (fh *FileHandle) ReadFile(fs *Goofys, offset int64, buf []byte) (bytesRead
 		// nothing to read
 		return
 	}
+	if fh.inode.metadataFile != nil {
+		bytesRead = copy(buf, fh.inode.metadataFile[offset:])
+		return
+	}
+	if max := fs.flags.MaxReadSize; max != 0 && fh.inode.Attributes.Size > uint64(max) &&
+		fh.inode.Attributes.Size != GUNZIP_UNKNOWN_SIZE {
+		// we don't know how big a gzipped one is until it's
+		// been read
+		return 0, syscall.EFBIG
+	}
 
-	bytesRead, err = fh.readFromStream(offset, buf)
-	if err != nil {
+	fh.mu.Lock()
+	if fh.dirty {
+		// what we wrote isn't in S3 yet
+		fh.mu.Unlock()
+		return fh.readDirty(fs, offset, buf)
+	}
+	if f := fh.cachedFile(fs, offset); f != nil {
+		fh.readAny = true
+		fh.mu.Unlock()
+		bytesRead, err = f.ReadAt(buf, offset)
 		return
 	}
+	if fh.cacheFill != nil {
+		defer func() {
+			fh.mu.Lock()
+			if fh.cacheFill != nil && fh.cacheFill.add(offset, buf[:bytesRead]) {
+				fh.cacheFill = nil
+			}
+			fh.mu.Unlock()
+		}()
+	}
 
-	if bytesRead == len(buf) || uint64(offset) == fh.inode.Attributes.Size {
-		// nothing more to read
+	if !fh.gunzip && fh.useReadAhead(fs, offset) {
+		bytesRead, err = fh.readFromReadAhead(fs, offset, buf)
+		fh.mu.Unlock()
 		return
 	}
+	if !fh.gunzip && fs.flags.CoalesceWindow > 0 {
+		var ok bool
+		if bytesRead, ok = fh.readCoalesced(offset, buf); ok {
+			fh.readDone(offset, bytesRead)
+			fh.mu.Unlock()
+			return
+		}
+	}
+	s := fh.findStream(offset)
+	if !fh.gunzip && fh.shouldCoalesce(fs, offset, len(buf)) && s == nil {
+		// a stream that's close enough is cheaper than a GET
+		fh.mu.Unlock()
+		bytesRead, err = fh.readCoalescing(fs, offset, buf)
+		return
+	}
+	fh.mu.Unlock()
 
-	offset += int64(bytesRead)
-	buf = buf[bytesRead:]
+	defer func() {
+		fh.mu.Lock()
+		fh.readDone(offset, bytesRead)
+		fh.mu.Unlock()
+	}()
 
-	params := &s3.GetObjectInput{
-		Bucket: &fs.bucket,
-		Key:    fh.inode.FullName,
-	}
+	if s != nil {
+		bytesRead, err = s.read(ctx, offset, buf)
+		fh.doneWithStream(s, false)
+		if err != nil && err != io.EOF {
+			return
+		}
 
-	if offset != 0 {
-		bytes := fmt.Sprintf("bytes=%v-", offset)
-		params.Range = &bytes
+		end := offset + int64(bytesRead)
+		if bytesRead == len(buf) || uint64(end) >= fh.inode.Attributes.Size {
+			// nothing more to read
+			return
+		}
 	}
 
-	resp, err := fs.s3.GetObject(params)
+	// the stream ended early or there wasn't one, the rest comes
+	// from a new one
+	s, err = fh.openStream(ctx, fs, offset+int64(bytesRead))
 	if err != nil {
-		return bytesRead, mapAwsError(err)
+		return
 	}
 
-	fh.reader = resp.Body
-
-	nread, err := tryReadAll(resp.Body, buf)
-	if err == io.EOF {
-		fh.reader.Close()
-		fh.reader = nil
+	if s.offset != offset+int64(bytesRead) {
+		// a gzipped object that ends before this
+		s.close()
+	} else {
+		var nread int
+		nread, err = s.read(ctx, s.offset, buf[bytesRead:])
+		bytesRead += nread
 	}
-	fh.readBufOffset += int64(nread)
-	bytesRead += nread
+	fh.doneWithStream(s, true)
 
 	return
 }
 
+// Let go of everything we hold for reading
+//
+// LOCKS_EXCLUDED(fh.inode.writeMu, fh.mu)
+func (fh *FileHandle) Release() {
+	// an idle flush that's running finishes first
+	fh.inode.writeMu.Lock()
+	defer fh.inode.writeMu.Unlock()
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	fh.released = true
+	if fh.flushTimer != nil {
+		fh.flushTimer.Stop()
+		fh.flushTimer = nil
+	}
+
+	fh.dropReadAhead()
+	fh.closeStreams()
+	fh.coalesced = nil
+
+	if fh.cacheFile != nil {
+		fh.cacheFile.Close()
+		fh.cacheFile = nil
+	}
+	if fh.cacheFill != nil {
+		fh.cacheFill.abort()
+		fh.cacheFill = nil
+	}
+
+	// left over if the last flush failed
+	if cap(fh.buf) != 0 {
+		fh.poolHandle.Free(fh.buf)
+		fh.buf = nil
+	}
+	fh.freePartBufs()
+	if fh.overlay != nil {
+		fh.overlay.Close()
+		fh.overlay = nil
+	}
+}
+
 func (fh *FileHandle) flushSmallFile(fs *Goofys) (err error) {
-	buf := fh.buf
+	// with flags.SinglePutSize there can be full buffers before
+	// fh.buf, see partFull
+	bufs := append(partBuffers(fh.partBufs), fh.buf)
+	fh.partBufs = nil
 	fh.buf = nil
 
-	if cap(buf) != 0 {
-		defer fh.poolHandle.Free(buf)
-	}
+	defer func() {
+		for _, buf := range bufs {
+			if cap(buf) != 0 {
+				fh.poolHandle.Free(buf)
+			}
+		}
+	}()
 
-	params := &s3.PutObjectInput{
-		Bucket:       &fs.bucket,
-		Key:          fh.inode.FullName,
-		Body:         bytes.NewReader(buf),
-		StorageClass: &fs.flags.StorageClass,
+	params := &PutBlobInput{
+		Key:  *fh.inode.FullName,
+		Body: io.NewSectionReader(bufs, 0, bufs.size()),
+		BlobProperties: BlobProperties{
+			Metadata:           fs.inodeMetadata(fh.inode),
+			ContentType:        fs.contentType(fh.inode, bufs[0]),
+			CacheControl:       fs.cacheControl(),
+			ContentDisposition: fs.contentDisposition(),
+		},
+		StorageClass: fs.storageClass(*fh.inode.FullName),
 	}
 
-	_, err = fs.s3.PutObject(params)
+	var resp *PutBlobOutput
+	err = fs.retryUpload(func() error {
+		return fh.sendConditional(fs, func(ifMatch *string, ifNoneMatch *string) (err error) {
+			params.IfMatch = ifMatch
+			params.IfNoneMatch = ifNoneMatch
+			resp, err = fs.backend.PutBlob(context.Background(), params)
+			return
+		})
+	})
 	if err != nil {
-		err = mapAwsError(err)
+		return mapAwsError(err)
 	}
+
+	fh.etag = resp.ETag
+	fh.inode.uploaded(resp.ETag)
 	return
 }
 
 func (fh *FileHandle) FlushFile(fs *Goofys) (err error) {
 	fh.inode.logFuse("FlushFile")
 
+	fh.inode.writeMu.Lock()
+	defer fh.inode.writeMu.Unlock()
+
+	return fh.flush(fs)
+}
+
+// Writes can't come in while this runs, but the parts uploading in
+// the background still need fh.mu so we only hold it when we have to.
+//
+// LOCKS_REQUIRED(fh.inode.writeMu)
+func (fh *FileHandle) flush(fs *Goofys) (err error) {
 	if !fh.dirty {
 		return
 	}
 
 	// abort mpu on error
 	defer func() {
+		fh.mu.Lock()
+		defer fh.mu.Unlock()
+
 		if err != nil {
 			fh.inode.logFuse("<-- FlushFile", err)
-			if fh.mpuId != nil {
-				go func() {
-					params := &s3.AbortMultipartUploadInput{
-						Bucket:   &fs.bucket,
-						Key:      fh.inode.FullName,
-						UploadId: fh.mpuId,
-					}
-
-					fh.mpuId = nil
-					resp, _ := fs.s3.AbortMultipartUpload(params)
-					fs.logS3(resp)
-				}()
+			if fh.mpuId != nil {
+				go fs.abortMultipart(*fh.inode.FullName, *fh.mpuId)
+				fh.mpuId = nil
 			}
 		}
 
+		if fh.overlay != nil {
+			fh.overlay.Close()
+			fh.overlay = nil
+		}
+		fh.freePartBufs()
+
 		fh.writeInit = sync.Once{}
 		fh.nextWriteOffset = 0
 		fh.lastPartId = 0
 		fh.dirty = false
+
+		fh.inode.mu.Lock()
+		fh.inode.dirtyHandles--
+		if fh.inode.dirtyHandles == 0 && fh.inode.attrsDirty {
+			// attributes changed after we started uploading
+			fh.inode.scheduleAttrFlush(fs)
+		}
+		fh.inode.mu.Unlock()
 	}()
 
+	if fh.overlay != nil {
+		err = fh.replayOverlay(fs)
+		if err != nil {
+			return
+		}
+	}
+
 	if fh.lastPartId == 0 {
 		return fh.flushSmallFile(fs)
 	}
@@ -669,41 +1946,83 @@ func (fh *FileHandle) FlushFile(fs *Goofys) (err error) {
 	}
 
 	nParts := fh.lastPartId
+	bufs := partBuffers(fh.partBufs)
+	fh.partBufs = nil
 	if fh.buf != nil {
+		bufs = append(bufs, fh.buf)
+		fh.buf = nil
+	}
+	if len(bufs) != 0 {
 		// upload last part
 		nParts++
-		err = fh.mpuPartNoSpawn(fs, fh.buf, nParts)
+		var etag *string
+		etag, err = fh.mpuPartNoSpawn(fs, bufs, nParts)
 		if err != nil {
 			return
 		}
+		fh.setEtag(nParts, etag)
 	}
 
-	parts := make([]*s3.CompletedPart, nParts)
-	for i := 0; i < nParts; i++ {
-		parts[i] = &s3.CompletedPart{
-			ETag:       fh.etags[i],
-			PartNumber: aws.Int64(int64(i + 1)),
-		}
+	params := &MultipartBlobCommitInput{
+		Key:      *fh.inode.FullName,
+		UploadId: *fh.mpuId,
+		ETags:    fh.etags[:nParts],
 	}
 
-	params := &s3.CompleteMultipartUploadInput{
-		Bucket:   &fs.bucket,
-		Key:      fh.inode.FullName,
-		UploadId: fh.mpuId,
-		MultipartUpload: &s3.CompletedMultipartUpload{
-			Parts: parts,
-		},
+	var resp *MultipartBlobCommitOutput
+	err = fh.sendConditional(fs, func(ifMatch *string, ifNoneMatch *string) (err error) {
+		params.IfMatch = ifMatch
+		params.IfNoneMatch = ifNoneMatch
+		resp, err = fs.backend.MultipartBlobCommit(context.Background(), params)
+		return
+	})
+	if isNoSuchUpload(err) {
+		if etag, ok := fh.completedAnyway(fs, params.ETags); ok {
+			resp = &MultipartBlobCommitOutput{ETag: etag}
+			err = nil
+		}
+	}
+	if err != nil {
+		return mapUploadError(err)
 	}
 
-	fs.logS3(params)
+	fh.mpuId = nil
+	fh.etag = resp.ETag
+	fh.inode.uploaded(resp.ETag)
+
+	return
+}
+
+// Copy target to name, the closest we can get to a hard link.
+func (parent *Inode) Link(fs *Goofys, name string, target *Inode) (inode *Inode, err error) {
+	fullName := parent.getChildName(name)
+	parent.logFuse("Link", *target.FullName, fullName)
+
+	if target.Attributes.Mode&os.ModeDir != 0 {
+		return nil, syscall.EPERM
+	}
 
-	resp, err := fs.s3.CompleteMultipartUpload(params)
+	// XXX writes that are not flushed yet are not copied
+	err = fs.copyObjectMaybeMultipart(*target.FullName, fullName)
 	if err != nil {
-		return mapAwsError(err)
+		return
 	}
 
-	fs.logS3(resp)
-	fh.mpuId = nil
+	parent.mu.Lock()
+	parent.invalidateDir(fs)
+	parent.mu.Unlock()
+
+	target.mu.Lock()
+	attr := *target.Attributes
+	symlinkTarget := target.SymlinkTarget
+	target.mu.Unlock()
+
+	// it's a separate object
+	attr.Nlink = 1
+
+	inode = NewInode(&name, &fullName, parent.flags)
+	inode.Attributes = &attr
+	inode.SymlinkTarget = symlinkTarget
 
 	return
 }
@@ -712,57 +2031,308 @@ func (parent *Inode) Rename(fs *Goofys, from string, newParent *Inode, to string
 	parent.logFuse("Rename", from, newParent.getChildName(to))
 
 	fromFullName := parent.getChildName(from)
+	toFullName := newParent.getChildName(to)
+	if fromFullName == toFullName {
+		// copying it over itself then deleting it would lose it
+		return
+	}
 
-	// XXX don't hold the lock the entire time
-	parent.mu.Lock()
-	defer parent.mu.Unlock()
+	// what's on either side is decided with both directories
+	// locked, but the copy isn't, renaming a directory can take a
+	// long time
+	unlock := lockRenameDirs(parent, newParent)
+	fromIsDir, fromNotEmpty, fromIsLocal, err := fs.renameTypes(fromFullName, toFullName)
+	unlock()
+
+	defer func() {
+		// even if we fail, we might have changed something
+		unlock := lockRenameDirs(parent, newParent)
+		parent.invalidateDir(fs)
+		newParent.invalidateDir(fs)
+		unlock()
+	}()
 
-	fromIsDir, err := isEmptyDir(fs, fromFullName)
 	if err != nil {
-		// we don't support renaming a directory that's not empty
 		return
 	}
 
-	toFullName := newParent.getChildName(to)
+	if fs.localDirs != nil {
+		fs.localDirs.rename(fromFullName, toFullName)
+		if fromIsLocal {
+			// nothing in S3 to move
+			return
+		}
+	}
+
+	if fromIsDir {
+		fromFullName += "/"
+		toFullName += "/"
+	}
+
+	if fromNotEmpty {
+		return fs.renameDir(fromFullName, toFullName)
+	}
+
+	head, err := fs.copyHead(fromFullName)
+	if err != nil {
+		return
+	}
+	err = fs.copyObjectWithHead(fromFullName, toFullName, head)
+	if err != nil {
+		return
+	}
+	// the original is all we have until we know the copy is good
+	err = fs.verifyCopy(head, toFullName)
+	if err != nil {
+		return
+	}
 
-	if parent != newParent {
-		newParent.mu.Lock()
-		defer newParent.mu.Unlock()
+	err = fs.retry(func() (err error) {
+		return fs.backend.DeleteBlob(context.Background(), &DeleteBlobInput{Key: fromFullName})
+	})
+	if err != nil {
+		// the rename failed, but not before making the copy
+		err = mapAwsError(err)
+		log.Printf("Copied %v to %v but unable to delete %v, it's in both places: %v",
+			fromFullName, toFullName, fromFullName, err)
+		return
+	}
+
+	return
+}
+
+// Lock the directories on both sides of a rename, always in the same
+// order so that two renames going opposite ways between them can't
+// each hold one and wait for the other.
+func lockRenameDirs(parent *Inode, newParent *Inode) (unlock func()) {
+	first, second := parent, newParent
+	if second.Id < first.Id {
+		first, second = second, first
+	}
+
+	first.mu.Lock()
+	if second != first {
+		second.mu.Lock()
+	}
+
+	return func() {
+		if second != first {
+			second.mu.Unlock()
+		}
+		first.mu.Unlock()
+	}
+}
+
+// Whether a rename from fromFullName to toFullName moves a directory,
+// and if so whether it has anything in it or only exists locally.
+// Fails if what's at toFullName can't be replaced with it.
+//
+// LOCKS_REQUIRED(parent.mu)
+// LOCKS_REQUIRED(newParent.mu)
+func (fs *Goofys) renameTypes(fromFullName string, toFullName string) (
+	fromIsDir bool, fromNotEmpty bool, fromIsLocal bool, err error) {
+
+	fromIsDir, err = isEmptyDir(fs, fromFullName)
+	if err == fuse.ENOTEMPTY {
+		fromNotEmpty = true
+		err = nil
+	} else if err != nil {
+		return
+	}
+	fromIsLocal = !fromIsDir && fs.localDirs != nil && fs.localDirs.has(fromFullName)
+	if fromIsLocal {
+		fromIsDir = true
 	}
 
 	toIsDir, err := isEmptyDir(fs, toFullName)
 	if err != nil {
 		return
 	}
+	if !toIsDir && fs.localDirs != nil && fs.localDirs.has(toFullName) {
+		toIsDir = true
+	}
 
 	if fromIsDir && !toIsDir {
-		return fuse.ENOTDIR
+		// fine if there's nothing there
+		err = fs.retry(func() (err error) {
+			_, err = fs.backend.HeadBlob(context.Background(), &HeadBlobInput{Key: toFullName})
+			return
+		})
+		if err == nil {
+			err = fuse.ENOTDIR
+		} else if err = mapAwsError(err); err == fuse.ENOENT {
+			err = nil
+		}
 	} else if !fromIsDir && toIsDir {
-		return syscall.EISDIR
+		err = syscall.EISDIR
 	}
+	return
+}
 
-	size := int64(-1)
-	if fromIsDir {
-		fromFullName += "/"
-		toFullName += "/"
-		size = 0
+// renameDir logs how far it's got every this many keys
+const RENAME_PROGRESS_KEYS = 1000
+
+// Move every key under from to be under to instead. S3 can't do
+// this atomically so it's done in two passes: copy everything, then
+// delete the originals. If a copy fails we try to delete the copies
+// we made; if a delete fails some keys are left in both places.
+// Either way a concurrent reader can see a partial result.
+//
+// The copies run flags.MaxParallelCopy at a time and the deletes go
+// in batches. They don't HEAD their source, see copyListedObject, so
+// a file that never had its mtime saved in MTIME_META gets the time
+// of the rename as its mtime.
+func (fs *Goofys) renameDir(from string, to string) (err error) {
+	start := time.Now()
+
+	objs, err := fs.listAll(from)
+	if err != nil {
+		return
+	}
+
+	keys := make([]string, len(objs))
+	sizes := make(map[string]int64, len(objs))
+	for i, obj := range objs {
+		keys[i] = obj.Key
+		sizes[obj.Key] = obj.Size
 	}
 
-	err = fs.copyObjectMaybeMultipart(size, fromFullName, toFullName)
+	newKey := func(key string) string {
+		return to + key[len(from):]
+	}
+
+	var mu sync.Mutex
+	nCopied := 0
+
+	copied, err := fs.forEachKey(keys, func(key string) (err error) {
+		err = fs.copyListedObject(key, sizes[key], newKey(key))
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		nCopied++
+		if nCopied%RENAME_PROGRESS_KEYS == 0 {
+			log.Printf("Renaming %v to %v: copied %v of %v keys", from, to, nCopied, len(keys))
+		}
+		mu.Unlock()
+		return
+	})
 	if err != nil {
-		return err
+		var copies []string
+		for _, key := range copied {
+			// the directory blob might have been there before
+			if key != from {
+				copies = append(copies, newKey(key))
+			}
+		}
+
+		fs.deleteKeys(copies)
+		return
+	}
+
+	err = deleteErrno(fs.deleteKeys(keys))
+	if err == nil && len(keys) >= RENAME_PROGRESS_KEYS {
+		log.Printf("Renamed %v keys from %v to %v in %v", len(keys), from, to, time.Since(start))
+	}
+	return
+}
+
+// Copy from, which a listing said is size bytes, to to. Up to 5GB
+// S3 copies the metadata and the headers itself, so unlike
+// copyObjectMaybeMultipart there's no HEAD, and the mtime is only
+// kept if it's in MTIME_META already. A multipart copy still HEADs
+// for the metadata, but not for the size.
+func (fs *Goofys) copyListedObject(from string, size int64, to string) (err error) {
+	if size > MAX_COPY_SIZE {
+		return fs.copyObjectMultipart(size, from, to, "", nil)
 	}
 
-	delParams := &s3.DeleteObjectInput{
-		Bucket: &fs.bucket,
-		Key:    &fromFullName,
+	params := &CopyBlobInput{
+		Source:       from,
+		Destination:  to,
+		StorageClass: fs.storageClass(to),
 	}
 
-	_, err = fs.s3.DeleteObject(delParams)
+	err = fs.retry(func() (err error) {
+		_, err = fs.backend.CopyBlob(context.Background(), params)
+		return
+	})
 	if err != nil {
-		return mapAwsError(err)
+		err = mapAwsError(err)
+	}
+	return
+}
+
+// Every object under prefix, including the directory blob.
+func (fs *Goofys) listAll(prefix string) (objs []BlobItemOutput, err error) {
+	params := &ListBlobsInput{Prefix: prefix}
+
+	for {
+		var resp *ListBlobsOutput
+		err = fs.retry(func() (err error) {
+			resp, err = fs.backend.ListBlobs(context.Background(), params)
+			return
+		})
+		if err != nil {
+			return nil, mapAwsError(err)
+		}
+
+		objs = append(objs, resp.Items...)
+
+		if !resp.IsTruncated || resp.NextContinuationToken == nil {
+			return
+		}
+
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+// Call fn on each of keys with at most flags.MaxParallelCopy calls
+// in flight, stopping at the first error. Returns the keys fn
+// succeeded on.
+func (fs *Goofys) forEachKey(keys []string, fn func(key string) error) (done []string, err error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	work := make(chan string)
+
+	for i := 0; i < fs.flags.MaxParallelCopy; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for key := range work {
+				keyErr := fn(key)
+
+				mu.Lock()
+				if keyErr != nil {
+					if err == nil {
+						err = keyErr
+					}
+				} else {
+					done = append(done, key)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		mu.Lock()
+		failed := err != nil
+		mu.Unlock()
+
+		if failed {
+			break
+		}
+
+		work <- key
 	}
 
+	close(work)
+	wg.Wait()
+
 	return
 }
 
@@ -786,15 +2356,50 @@ func (p sortedDirents) Len() int           { return len(p) }
 func (p sortedDirents) Less(i, j int) bool { return p[i].Name < p[j].Name }
 func (p sortedDirents) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// Put the directories and the files of a listing page together,
+// sorted by name. S3 lists both in the order of their keys, and
+// that's the order of the names too unless a name has characters
+// that sort before "/", like "a-b/" before "a/". With presorted, a
+// page whose directories and files each turn out to be in order is
+// merged instead of sorted.
+func sortDirents(dirs, files []fuseutil.Dirent, presorted bool) (entries []fuseutil.Dirent) {
+	if !presorted || !sort.IsSorted(sortedDirents(dirs)) ||
+		!sort.IsSorted(sortedDirents(files)) {
+		entries = append(files, dirs...)
+		sort.Sort(sortedDirents(entries))
+		return
+	}
+
+	entries = make([]fuseutil.Dirent, 0, len(dirs)+len(files))
+	for len(dirs) != 0 && len(files) != 0 {
+		if dirs[0].Name <= files[0].Name {
+			entries = append(entries, dirs[0])
+			dirs = dirs[1:]
+		} else {
+			entries = append(entries, files[0])
+			files = files[1:]
+		}
+	}
+	entries = append(entries, dirs...)
+	entries = append(entries, files...)
+	return
+}
+
 func makeDirEntry(name string, t fuseutil.DirentType) fuseutil.Dirent {
 	return fuseutil.Dirent{Name: name, Type: t, Inode: fuseops.RootInodeID + 1}
 }
 
-func (dh *DirHandle) ReadDir(fs *Goofys, offset fuseops.DirOffset) (*fuseutil.Dirent, error) {
+// LOCKS_REQUIRED(dh.mu)
+func (dh *DirHandle) ReadDir(ctx context.Context, fs *Goofys, offset fuseops.DirOffset) (*fuseutil.Dirent, error) {
 	// If the request is for offset zero, we assume that either this is the first
 	// call or rewinddir has been called. Reset state.
 	if offset == 0 {
 		dh.Entries = nil
+		dh.Marker = nil
+		dh.BaseOffset = 0
+		dh.pages = nil
+		dh.page = 0
+		dh.cached, dh.gen = dh.inode.cachedListing(fs)
 	}
 
 	if offset == 0 {
@@ -814,72 +2419,233 @@ func (dh *DirHandle) ReadDir(fs *Goofys, offset fuseops.DirOffset) (*fuseutil.Di
 		panic(fmt.Sprintf("invalid offset %v, base=%v", offset, dh.BaseOffset))
 	}
 
-	if i >= len(dh.Entries) {
-		if dh.Marker != nil {
-			dh.Entries = nil
-			dh.BaseOffset += i
-			i = 0
+	if fs.flags.MaxDirEntries > 0 && i+dh.BaseOffset >= fs.flags.MaxDirEntries {
+		fs.logFuse("ReadDir: too many entries", *dh.inode.FullName, fs.flags.MaxDirEntries)
+		return nil, nil
+	}
+
+	// only keep one page around, the kernel asks for the entries
+	// in order so we never need to go back
+	for {
+		if dh.Entries == nil {
+			err := dh.readPage(ctx, fs)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if i < len(dh.Entries) || dh.Marker == nil {
+			break
 		}
+
+		dh.BaseOffset += len(dh.Entries)
+		i -= len(dh.Entries)
+		dh.Entries = nil
+		// lookups will have to go to S3 for what's not on
+		// the current page
+		dh.NameToEntry = make(map[string]fuseops.InodeAttributes)
+		dh.NameToETag = make(map[string]*string)
 	}
 
-	if i > 5000 {
-		// XXX prevent infinite loop, raise the limit later
-		panic("too many results")
+	if i == len(dh.Entries) {
+		// we've reached the end
+		return nil, nil
+	} else if i > len(dh.Entries) {
+		return nil, fuse.EINVAL
+	}
+
+	return &dh.Entries[i], nil
+}
+
+// S3 returns at most this many keys per page
+const LIST_MAX_KEYS = 1000
+
+// How many keys to ask for after listing listed entries of a
+// directory. With flags.ListPageSize the first page is that big and
+// then each page is as big as the ones before it put together, so a
+// short directory comes back quickly and a long one still gets to
+// full pages soon. nil for S3's default.
+func (fs *Goofys) listPageSize(listed int) *int64 {
+	if fs.flags.ListPageSize <= 0 {
+		return nil
+	}
+
+	size := fs.flags.ListPageSize
+	if listed > size {
+		size = listed
+	}
+	if size > LIST_MAX_KEYS {
+		size = LIST_MAX_KEYS
 	}
+	return aws.Int64(int64(size))
+}
 
-	if dh.Entries == nil {
+// Fill in dh.Entries with the next page of the listing, either from
+// S3 or from the cached listing we started with.
+//
+// LOCKS_REQUIRED(dh.mu)
+func (dh *DirHandle) readPage(ctx context.Context, fs *Goofys) (err error) {
+	if dh.cached != nil {
+		p := dh.cached[dh.page]
+		dh.page++
+
+		dh.Entries = p.entries
+		for name, attr := range p.attrs {
+			dh.NameToEntry[name] = attr
+		}
+		for name, etag := range p.etags {
+			dh.NameToETag[name] = etag
+		}
+		dh.Marker = p.marker
+	} else {
 		prefix := *dh.inode.FullName
 		if len(prefix) != 0 {
 			prefix += "/"
 		}
 
-		params := &s3.ListObjectsInput{
-			Bucket:    &fs.bucket,
-			Delimiter: aws.String("/"),
-			Marker:    dh.Marker,
-			Prefix:    &prefix,
-			//MaxKeys:      aws.Int64(3),
+		params := &ListBlobsInput{
+			Delimiter:         "/",
+			ContinuationToken: dh.Marker,
+			Prefix:            prefix,
+			MaxKeys:           fs.listPageSize(dh.BaseOffset),
 		}
 
-		resp, err := fs.s3.ListObjects(params)
+		var resp *ListBlobsOutput
+		err := fs.retry(func() (err error) {
+			resp, err = fs.backend.ListBlobs(ctx, params)
+			return
+		})
 		if err != nil {
-			return nil, mapAwsError(err)
+			return mapAwsError(err)
 		}
 
-		fs.logS3(resp)
+		if dh.BaseOffset == 0 {
+			dh.sizeTotal = 0
+			dh.sizeUnknown = false
+		}
 
-		dh.Entries = make([]fuseutil.Dirent, 0, len(resp.CommonPrefixes)+len(resp.Contents))
+		var dirs []fuseutil.Dirent
+		files := make([]fuseutil.Dirent, 0, len(resp.Prefixes)+len(resp.Items))
+		attrs := make(map[string]fuseops.InodeAttributes)
+		etags := make(map[string]*string)
+		var needHead []string
 
-		for _, dir := range resp.CommonPrefixes {
+		for _, dir := range resp.Prefixes {
 			// strip trailing /
-			dirName := (*dir.Prefix)[0 : len(*dir.Prefix)-1]
+			dirName := dir[0 : len(dir)-1]
 			// strip previous prefix
-			dirName = dirName[len(*params.Prefix):]
-			dh.Entries = append(dh.Entries, makeDirEntry(dirName, fuseutil.DT_Directory))
-			dh.NameToEntry[dirName] = fs.rootAttrs
+			dirName = dirName[len(params.Prefix):]
+			if len(dirName) == 0 {
+				// there are keys under dir//, which has no
+				// name we can show
+				continue
+			}
+			dirs = append(dirs, makeDirEntry(dirName, fuseutil.DT_Directory))
+			attrs[dirName] = fs.rootAttrs
+
+			if fs.localDirs != nil {
+				// S3 knows about it now
+				fs.localDirs.remove(prefix + dirName)
+			}
+
+			if fs.dirSizes != nil {
+				if size, ok := fs.dirSizes.get(prefix + dirName); ok && size.known {
+					dh.sizeTotal += size.size
+				} else {
+					dh.sizeUnknown = true
+				}
+			}
 		}
 
-		for _, obj := range resp.Contents {
-			baseName := (*obj.Key)[len(prefix):]
+		for _, obj := range resp.Items {
+			if fs.usage != nil {
+				fs.usage.update(obj.Key, uint64(obj.Size))
+			}
+			if fs.dirSizes != nil {
+				dh.sizeTotal += uint64(obj.Size)
+			}
+
+			baseName := obj.Key[len(prefix):]
 			if len(baseName) == 0 {
 				// this is a directory blob
 				continue
 			}
-			dh.Entries = append(dh.Entries, makeDirEntry(baseName, fuseutil.DT_File))
-			dh.NameToEntry[baseName] = fuseops.InodeAttributes{
-				Size:   uint64(*obj.Size),
+			if _, ok := fs.metadataOf(baseName); ok {
+				// the metadata of the one without the
+				// suffix is looked up instead
+				continue
+			}
+			files = append(files, makeDirEntry(baseName, fuseutil.DT_File))
+			if _, isDir := attrs[baseName]; isDir {
+				// both baseName and baseName/ exist, lookup
+				// will say it's a directory
+				continue
+			}
+			attrs[baseName] = fuseops.InodeAttributes{
+				Size:   uint64(obj.Size),
 				Nlink:  1,
-				Mode:   fs.flags.FileMode,
-				Atime:  *obj.LastModified,
-				Mtime:  *obj.LastModified,
-				Ctime:  *obj.LastModified,
-				Crtime: *obj.LastModified,
+				Mode:   fs.fileMode(baseName),
+				Atime:  obj.LastModified,
+				Mtime:  obj.LastModified,
+				Ctime:  obj.LastModified,
+				Crtime: obj.LastModified,
 				Uid:    fs.flags.Uid,
 				Gid:    fs.flags.Gid,
 			}
+			etags[baseName] = obj.ETag
+
+			// only empty objects can be symlinks. Attributes
+			// are HEADed for when the object is looked up, see
+			// lookupFromDirHandles. XXX without --posix-attrs
+			// we don't see the mtime that a rename saved until
+			// then
+			if obj.Size == 0 && fs.flags.ListSymlinks {
+				needHead = append(needHead, baseName)
+			}
+		}
+
+		if len(needHead) != 0 {
+			metadata := fs.headObjects(prefix, needHead)
+			for i := range files {
+				en := &files[i]
+				meta, ok := metadata[en.Name]
+				if !ok {
+					// or both a file and a directory,
+					// which we didn't HEAD
+					continue
+				}
+
+				attr := attrs[en.Name]
+				if target := symlinkTarget(meta); target != nil {
+					en.Type = fuseutil.DT_Link
+					attr.Mode = SYMLINK_MODE
+					attr.Size = uint64(len(*target))
+				}
+				fs.applyMetadata(&attr, meta)
+				attrs[en.Name] = attr
+			}
+		}
+
+		if fs.localDirs != nil {
+			// the directories that only exist in our memory
+			// go on the page S3 would have listed them on
+			for _, name := range fs.localDirs.children(prefix) {
+				key := prefix + name + "/"
+				if params.ContinuationToken != nil && key <= *params.ContinuationToken {
+					continue
+				}
+				if resp.IsTruncated && (resp.NextContinuationToken == nil ||
+					key > *resp.NextContinuationToken) {
+					continue
+				}
+				if _, ok := attrs[name]; !ok {
+					dirs = append(dirs, makeDirEntry(name, fuseutil.DT_Directory))
+					attrs[name] = fs.rootAttrs
+				}
+			}
 		}
 
-		sort.Sort(sortedDirents(dh.Entries))
+		dh.Entries = sortDirents(dirs, files, fs.flags.PresortedListings)
 
 		// Fix up offset fields.
 		for i := 0; i < len(dh.Entries); i++ {
@@ -888,21 +2654,87 @@ func (dh *DirHandle) ReadDir(fs *Goofys, offset fuseops.DirOffset) (*fuseutil.Di
 			en.Offset = fuseops.DirOffset(i+dh.BaseOffset) + 1 + 2
 		}
 
-		if *resp.IsTruncated {
-			dh.Marker = resp.NextMarker
+		if resp.IsTruncated {
+			dh.Marker = resp.NextContinuationToken
 		} else {
 			dh.Marker = nil
 		}
+
+		if fs.dirSizes != nil && dh.Marker == nil && !dh.sizeUnknown {
+			// we've seen everything in here, and know how
+			// big the subdirectories are
+			fs.dirSizes.set(*dh.inode.FullName, dh.sizeTotal, true)
+		}
+
+		for name, attr := range attrs {
+			dh.NameToEntry[name] = attr
+		}
+		for name, etag := range etags {
+			dh.NameToETag[name] = etag
+		}
+
+		if dh.pages != nil || dh.BaseOffset == 0 {
+			if len(dh.pages) < DIR_CACHE_MAX_PAGES {
+				dh.pages = append(dh.pages, dirPage{dh.Entries, attrs, etags, dh.Marker})
+				if dh.Marker == nil {
+					dh.inode.cacheListing(fs, dh.gen, dh.pages)
+				}
+			} else {
+				// too big to cache
+				dh.pages = nil
+			}
+		}
 	}
 
-	if i == len(dh.Entries) {
-		// we've reached the end
-		return nil, nil
-	} else if i > len(dh.Entries) {
-		return nil, fuse.EINVAL
+	return
+}
+
+// A listing of this directory that's younger than flags.TypeCacheTTL,
+// and the generation to pass to cacheListing if there isn't one.
+func (inode *Inode) cachedListing(fs *Goofys) (pages []dirPage, gen uint64) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.dirPages != nil && time.Since(inode.dirTime) < fs.flags.TypeCacheTTL {
+		return inode.dirPages, inode.dirGen
+	}
+	if fs.prewarmed != nil {
+		return fs.prewarmed.get(*inode.FullName, fs.flags.TypeCacheTTL), inode.dirGen
 	}
+	return nil, inode.dirGen
+}
 
-	return &dh.Entries[i], nil
+func (inode *Inode) cacheListing(fs *Goofys, gen uint64, pages []dirPage) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if fs.flags.TypeCacheTTL == 0 || gen != inode.dirGen {
+		return
+	}
+
+	inode.dirPages = pages
+	inode.dirTime = time.Now()
+}
+
+// Drop the cached listing if it's too old to be used.
+func (inode *Inode) expireListing(fs *Goofys) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.dirPages != nil && time.Since(inode.dirTime) >= fs.flags.TypeCacheTTL {
+		inode.dirPages = nil
+	}
+}
+
+// Something in this directory changed.
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) invalidateDir(fs *Goofys) {
+	inode.dirPages = nil
+	inode.dirGen++
+	if fs.prewarmed != nil {
+		fs.prewarmed.invalidate(*inode.FullName)
+	}
 }
 
 func (dh *DirHandle) CloseDir() error {
@@ -0,0 +1,56 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// Some policies and S3 lookalikes let you GET objects but not HEAD or
+// list them. With --head-fallback a lookup whose HEAD is forbidden
+// GETs the first byte instead and takes the size from Content-Range,
+// and a forbidden listing means there's no directory by that name.
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"golang.org/x/net/context"
+)
+
+// A HEAD of key made out of a GET of its first byte.
+func (fs *Goofys) headByGet(ctx context.Context, key string) (head *HeadBlobOutput, err error) {
+	params := &GetBlobInput{
+		Key:   key,
+		Count: 1,
+	}
+
+	var resp *GetBlobOutput
+	get := func() (err error) {
+		resp, err = fs.backend.GetBlob(ctx, params)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return
+	}
+
+	err = fs.retry(get)
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 416 {
+		// there's no first byte, it's empty
+		params.Count = 0
+		err = fs.retry(get)
+	}
+	// XXX archived objects are forbidden to GET too, and we can't
+	// tell how big they are
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	return &resp.HeadBlobOutput, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --no-dir-markers, MkDir doesn't PUT a dir/ marker. The new
+// directory only exists in our memory until something is created in
+// it, after that it exists in S3 because of what's in it like any
+// other prefix. An empty directory is gone after a remount, and other
+// mounts never see it.
+
+import (
+	"strings"
+	"sync"
+)
+
+type localDirs struct {
+	mu sync.Mutex
+	// full names of the directories we made that S3 doesn't know
+	// about yet
+	names map[string]bool
+}
+
+func newLocalDirs() *localDirs {
+	return &localDirs{names: make(map[string]bool)}
+}
+
+func (d *localDirs) add(fullName string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.names[fullName] = true
+}
+
+func (d *localDirs) has(fullName string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.names[fullName]
+}
+
+// fullName is gone, or has something in it so S3 knows about it now.
+func (d *localDirs) remove(fullName string) (removed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	removed = d.names[fullName]
+	delete(d.names, fullName)
+	return
+}
+
+// Move from and the directories below it to be under to.
+func (d *localDirs) rename(from string, to string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var moved []string
+	for name := range d.names {
+		if name == from || strings.HasPrefix(name, from+"/") {
+			moved = append(moved, name)
+		}
+	}
+
+	for _, name := range moved {
+		delete(d.names, name)
+		d.names[to+name[len(from):]] = true
+	}
+}
+
+// The names of the directories right under prefix, which ends with /
+// unless it's the root of the bucket.
+func (d *localDirs) children(prefix string) (names []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for name := range d.names {
+		if strings.HasPrefix(name, prefix) && !strings.Contains(name[len(prefix):], "/") {
+			names = append(names, name[len(prefix):])
+		}
+	}
+	return
+}
@@ -0,0 +1,900 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// An S3 that keeps one bucket in memory, so the file system can be
+// tested through s3Backend without s3proxy. It's an *s3.S3 whose
+// requests are answered by serve instead of going out, so everything
+// that builds a request, sets headers on it or cancels it works the
+// same as with S3. Listings follow S3: keys in byte order, common prefixes
+// with a delimiter, MaxKeys counting both, and NextMarker only with a
+// delimiter.
+//
+// XXX versions, storage classes other than the one asked for, and
+// archived objects aren't there
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	. "gopkg.in/check.v1"
+)
+
+type memObject struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+	metadata     map[string]*string
+	storageClass *string
+
+	contentType        *string
+	cacheControl       *string
+	contentDisposition *string
+	contentEncoding    *string
+}
+
+type memUpload struct {
+	key       string
+	initiated time.Time
+	// what the object gets when it's completed
+	object memObject
+	parts  map[int64]*memObject
+}
+
+type memBackend struct {
+	*s3.S3
+
+	mu sync.Mutex
+	// GUARDED_BY(mu)
+	objects map[string]*memObject
+	// GUARDED_BY(mu)
+	uploads map[string]*memUpload
+	// GUARDED_BY(mu)
+	nextUploadId int
+
+	// only count what's uploaded in parts, for files bigger than
+	// we can keep
+	discardParts bool
+	// GUARDED_BY(mu)
+	discardedBytes int64
+	// GUARDED_BY(mu)
+	discardedParts int
+}
+
+func newMemBackend() *memBackend {
+	b := &memBackend{
+		S3: s3.New(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Credentials: credentials.NewStaticCredentials("foo", "bar", ""),
+			MaxRetries:  aws.Int(0),
+		}),
+		objects: make(map[string]*memObject),
+		uploads: make(map[string]*memUpload),
+	}
+
+	// nothing goes out and nothing comes back to unmarshal
+	h := &b.S3.Handlers
+	h.Sign.Clear()
+	h.Send.Clear()
+	h.UnmarshalMeta.Clear()
+	h.ValidateResponse.Clear()
+	h.Unmarshal.Clear()
+	h.UnmarshalError.Clear()
+	h.Send.PushBack(b.serve)
+	return b
+}
+
+func memError(code string, status int) error {
+	return awserr.NewRequestFailure(awserr.New(code, code, nil), status, "")
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func readBody(body io.ReadSeeker) (data []byte, err error) {
+	if body == nil {
+		return
+	}
+	if _, err = body.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	return ioutil.ReadAll(body)
+}
+
+// key from what copySource made
+func copySourceKey(source string) (key string, err error) {
+	segments := strings.Split(source, "/")[1:]
+	for i, s := range segments {
+		if segments[i], err = url.QueryUnescape(s); err != nil {
+			return
+		}
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// start and end, inclusive, of bytes=start-[end] in something size
+// bytes long
+func parseRange(r string, size int64) (start int64, end int64, err error) {
+	r = strings.TrimPrefix(r, "bytes=")
+	i := strings.Index(r, "-")
+	if i == -1 {
+		return 0, 0, memError("InvalidArgument", 400)
+	}
+	if start, err = strconv.ParseInt(r[:i], 10, 64); err != nil {
+		return 0, 0, memError("InvalidArgument", 400)
+	}
+	end = size - 1
+	if len(r[i+1:]) != 0 {
+		if end, err = strconv.ParseInt(r[i+1:], 10, 64); err != nil {
+			return 0, 0, memError("InvalidArgument", 400)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size || start > end {
+		return 0, 0, memError("InvalidRange", 416)
+	}
+	return
+}
+
+// Answer r from memory, by filling in r.Data or setting r.Error.
+func (b *memBackend) serve(r *request.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r.HTTPResponse = &http.Response{StatusCode: 200, Header: http.Header{}}
+
+	var err error
+	switch in := r.Params.(type) {
+	case *s3.HeadObjectInput:
+		err = b.headObject(in, r.Data.(*s3.HeadObjectOutput))
+	case *s3.GetObjectInput:
+		err = b.getObject(in, r.HTTPRequest.Header.Get("If-Range"), r.Data.(*s3.GetObjectOutput))
+	case *s3.ListObjectsInput:
+		err = b.listObjects(in, r.Data.(*s3.ListObjectsOutput))
+	case *s3.ListObjectsV2Input:
+		err = b.listObjectsV2(in, r.Data.(*s3.ListObjectsV2Output))
+	case *s3.PutObjectInput:
+		err = b.putObject(in, r.HTTPRequest.Header, r.Data.(*s3.PutObjectOutput))
+	case *s3.CopyObjectInput:
+		err = b.copyObject(in, r.Data.(*s3.CopyObjectOutput))
+	case *s3.DeleteObjectInput:
+		delete(b.objects, *in.Key)
+	case *s3.DeleteObjectsInput:
+		for _, obj := range in.Delete.Objects {
+			delete(b.objects, *obj.Key)
+		}
+	case *s3.CreateMultipartUploadInput:
+		b.createMultipartUpload(in, r.Data.(*s3.CreateMultipartUploadOutput))
+	case *s3.UploadPartInput:
+		err = b.uploadPart(in, r.Data.(*s3.UploadPartOutput))
+	case *s3.UploadPartCopyInput:
+		err = b.uploadPartCopy(in, r.Data.(*s3.UploadPartCopyOutput))
+	case *s3.CompleteMultipartUploadInput:
+		err = b.completeMultipartUpload(in, r.HTTPRequest.Header, r.Data.(*s3.CompleteMultipartUploadOutput))
+	case *s3.AbortMultipartUploadInput:
+		if _, ok := b.uploads[*in.UploadId]; !ok {
+			err = memError("NoSuchUpload", 404)
+		}
+		delete(b.uploads, *in.UploadId)
+	case *s3.ListPartsInput:
+		err = b.listParts(in, r.Data.(*s3.ListPartsOutput))
+	case *s3.ListMultipartUploadsInput:
+		b.listMultipartUploads(in, r.Data.(*s3.ListMultipartUploadsOutput))
+	default:
+		err = memError("NotImplemented", 501)
+	}
+
+	if err != nil {
+		r.Error = err
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			r.HTTPResponse.StatusCode = reqErr.StatusCode()
+		}
+	}
+}
+
+func (b *memBackend) headObject(in *s3.HeadObjectInput, out *s3.HeadObjectOutput) error {
+	obj, ok := b.objects[*in.Key]
+	if !ok {
+		return memError("NotFound", 404)
+	}
+
+	*out = s3.HeadObjectOutput{
+		ContentLength:      aws.Int64(int64(len(obj.data))),
+		ETag:               aws.String("\"" + obj.etag + "\""),
+		LastModified:       aws.Time(obj.lastModified),
+		Metadata:           obj.metadata,
+		StorageClass:       obj.storageClass,
+		ContentType:        obj.contentType,
+		CacheControl:       obj.cacheControl,
+		ContentDisposition: obj.contentDisposition,
+		ContentEncoding:    obj.contentEncoding,
+	}
+	return nil
+}
+
+func (b *memBackend) getObject(in *s3.GetObjectInput, ifRange string, out *s3.GetObjectOutput) error {
+	obj, ok := b.objects[*in.Key]
+	if !ok {
+		return memError("NoSuchKey", 404)
+	}
+
+	etag := "\"" + obj.etag + "\""
+	data := obj.data
+	var contentRange *string
+	if in.Range != nil && (len(ifRange) == 0 || ifRange == etag) {
+		start, end, err := parseRange(*in.Range, int64(len(data)))
+		if err != nil {
+			return err
+		}
+		data = data[start : end+1]
+		contentRange = aws.String(fmt.Sprintf("bytes %v-%v/%v", start, end, len(obj.data)))
+	}
+
+	*out = s3.GetObjectOutput{
+		Body:               ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength:      aws.Int64(int64(len(data))),
+		ContentRange:       contentRange,
+		ETag:               aws.String(etag),
+		LastModified:       aws.Time(obj.lastModified),
+		Metadata:           obj.metadata,
+		StorageClass:       obj.storageClass,
+		ContentType:        obj.contentType,
+		CacheControl:       obj.cacheControl,
+		ContentDisposition: obj.contentDisposition,
+		ContentEncoding:    obj.contentEncoding,
+	}
+	return nil
+}
+
+// One page of keys after marker that start with prefix. Keys with
+// delimiter after the prefix are rolled into a common prefix, which
+// counts as one key towards maxKeys.
+func (b *memBackend) list(prefix string, delimiter string, marker string, maxKeys int64) (
+	contents []*s3.Object, prefixes []*s3.CommonPrefix, truncated bool, last string) {
+
+	var keys []string
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	n := int64(0)
+	for _, key := range keys {
+		if len(delimiter) != 0 {
+			if i := strings.Index(key[len(prefix):], delimiter); i != -1 {
+				p := key[:len(prefix)+i+len(delimiter)]
+				if p <= marker || p == last {
+					// continuing after this prefix, or
+					// already have it
+					continue
+				}
+				if n == maxKeys {
+					truncated = true
+					return
+				}
+				prefixes = append(prefixes, &s3.CommonPrefix{Prefix: aws.String(p)})
+				n++
+				last = p
+				continue
+			}
+		}
+
+		if n == maxKeys {
+			truncated = true
+			return
+		}
+		obj := b.objects[key]
+		contents = append(contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(obj.data))),
+			ETag:         aws.String("\"" + obj.etag + "\""),
+			LastModified: aws.Time(obj.lastModified),
+			StorageClass: obj.storageClass,
+		})
+		n++
+		last = key
+	}
+	return
+}
+
+func (b *memBackend) listObjects(in *s3.ListObjectsInput, out *s3.ListObjectsOutput) error {
+	maxKeys := int64(1000)
+	if in.MaxKeys != nil {
+		maxKeys = *in.MaxKeys
+	}
+
+	contents, prefixes, truncated, last := b.list(aws.StringValue(in.Prefix),
+		aws.StringValue(in.Delimiter), aws.StringValue(in.Marker), maxKeys)
+
+	*out = s3.ListObjectsOutput{
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+		IsTruncated:    aws.Bool(truncated),
+		Prefix:         in.Prefix,
+		Delimiter:      in.Delimiter,
+		Marker:         in.Marker,
+	}
+	if truncated && in.Delimiter != nil {
+		out.NextMarker = aws.String(last)
+	}
+	return nil
+}
+
+func (b *memBackend) listObjectsV2(in *s3.ListObjectsV2Input, out *s3.ListObjectsV2Output) error {
+	maxKeys := int64(1000)
+	if in.MaxKeys != nil {
+		maxKeys = *in.MaxKeys
+	}
+	marker := aws.StringValue(in.StartAfter)
+	if in.ContinuationToken != nil {
+		marker = *in.ContinuationToken
+	}
+
+	contents, prefixes, truncated, last := b.list(aws.StringValue(in.Prefix),
+		aws.StringValue(in.Delimiter), marker, maxKeys)
+
+	*out = s3.ListObjectsV2Output{
+		Contents:          contents,
+		CommonPrefixes:    prefixes,
+		IsTruncated:       aws.Bool(truncated),
+		KeyCount:          aws.Int64(int64(len(contents) + len(prefixes))),
+		Prefix:            in.Prefix,
+		Delimiter:         in.Delimiter,
+		ContinuationToken: in.ContinuationToken,
+	}
+	if truncated {
+		out.NextContinuationToken = aws.String(last)
+	}
+	return nil
+}
+
+// If-Match and If-None-Match: * for writing key
+func (b *memBackend) checkPreconditions(key string, header http.Header) error {
+	obj, exists := b.objects[key]
+	if ifMatch := header.Get("If-Match"); len(ifMatch) != 0 {
+		if !exists || strings.Trim(ifMatch, "\"") != obj.etag {
+			return memError("PreconditionFailed", 412)
+		}
+	}
+	if header.Get("If-None-Match") == "*" && exists {
+		return memError("PreconditionFailed", 412)
+	}
+	return nil
+}
+
+func (b *memBackend) putObject(in *s3.PutObjectInput, header http.Header, out *s3.PutObjectOutput) error {
+	if err := b.checkPreconditions(*in.Key, header); err != nil {
+		return err
+	}
+
+	data, err := readBody(in.Body)
+	if err != nil {
+		return err
+	}
+
+	obj := &memObject{
+		data:               data,
+		etag:               md5Hex(data),
+		lastModified:       time.Now(),
+		metadata:           canonicalMetadata(in.Metadata),
+		storageClass:       standardIsNil(in.StorageClass),
+		contentType:        in.ContentType,
+		cacheControl:       in.CacheControl,
+		contentDisposition: in.ContentDisposition,
+		contentEncoding:    in.ContentEncoding,
+	}
+	b.objects[*in.Key] = obj
+
+	*out = s3.PutObjectOutput{ETag: aws.String("\"" + obj.etag + "\"")}
+	return nil
+}
+
+// S3 gives us the keys of user metadata the way headers are spelled
+func canonicalMetadata(metadata map[string]*string) map[string]*string {
+	m := make(map[string]*string)
+	for k, v := range metadata {
+		m[http.CanonicalHeaderKey(k)] = v
+	}
+	return m
+}
+
+// S3 doesn't say when it's STANDARD
+func standardIsNil(storageClass *string) *string {
+	if storageClass == nil || *storageClass == "STANDARD" {
+		return nil
+	}
+	return storageClass
+}
+
+func (b *memBackend) copyObject(in *s3.CopyObjectInput, out *s3.CopyObjectOutput) error {
+	from, err := copySourceKey(*in.CopySource)
+	if err != nil {
+		return memError("InvalidArgument", 400)
+	}
+	src, ok := b.objects[from]
+	if !ok {
+		return memError("NoSuchKey", 404)
+	}
+
+	obj := *src
+	obj.lastModified = time.Now()
+	obj.storageClass = standardIsNil(in.StorageClass)
+	if aws.StringValue(in.MetadataDirective) == "REPLACE" {
+		obj.metadata = canonicalMetadata(in.Metadata)
+		obj.contentType = in.ContentType
+		obj.cacheControl = in.CacheControl
+		obj.contentDisposition = in.ContentDisposition
+		obj.contentEncoding = in.ContentEncoding
+	}
+	b.objects[*in.Key] = &obj
+
+	*out = s3.CopyObjectOutput{
+		CopyObjectResult: &s3.CopyObjectResult{
+			ETag:         aws.String("\"" + obj.etag + "\""),
+			LastModified: aws.Time(obj.lastModified),
+		},
+	}
+	return nil
+}
+
+func (b *memBackend) createMultipartUpload(in *s3.CreateMultipartUploadInput, out *s3.CreateMultipartUploadOutput) {
+	b.nextUploadId++
+	id := strconv.Itoa(b.nextUploadId)
+
+	b.uploads[id] = &memUpload{
+		key:       *in.Key,
+		initiated: time.Now(),
+		object: memObject{
+			metadata:           canonicalMetadata(in.Metadata),
+			storageClass:       standardIsNil(in.StorageClass),
+			contentType:        in.ContentType,
+			cacheControl:       in.CacheControl,
+			contentDisposition: in.ContentDisposition,
+			contentEncoding:    in.ContentEncoding,
+		},
+		parts: make(map[int64]*memObject),
+	}
+
+	*out = s3.CreateMultipartUploadOutput{
+		Bucket:   in.Bucket,
+		Key:      in.Key,
+		UploadId: aws.String(id),
+	}
+}
+
+func (b *memBackend) addPart(uploadId string, part int64, data []byte) (etag *string, err error) {
+	upload, ok := b.uploads[uploadId]
+	if !ok {
+		return nil, memError("NoSuchUpload", 404)
+	}
+
+	p := &memObject{data: data, etag: md5Hex(data), lastModified: time.Now()}
+	upload.parts[part] = p
+	return aws.String("\"" + p.etag + "\""), nil
+}
+
+func (b *memBackend) uploadPart(in *s3.UploadPartInput, out *s3.UploadPartOutput) error {
+	if b.discardParts {
+		size, err := in.Body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		b.discardedBytes += size
+		b.discardedParts++
+		// the object ends up empty
+		etag, err := b.addPart(*in.UploadId, *in.PartNumber, nil)
+		*out = s3.UploadPartOutput{ETag: etag}
+		return err
+	}
+
+	data, err := readBody(in.Body)
+	if err != nil {
+		return err
+	}
+
+	etag, err := b.addPart(*in.UploadId, *in.PartNumber, data)
+	if err != nil {
+		return err
+	}
+	*out = s3.UploadPartOutput{ETag: etag}
+	return nil
+}
+
+func (b *memBackend) uploadPartCopy(in *s3.UploadPartCopyInput, out *s3.UploadPartCopyOutput) error {
+	from, err := copySourceKey(*in.CopySource)
+	if err != nil {
+		return memError("InvalidArgument", 400)
+	}
+	src, ok := b.objects[from]
+	if !ok {
+		return memError("NoSuchKey", 404)
+	}
+
+	data := src.data
+	if in.CopySourceRange != nil {
+		start, end, err := parseRange(*in.CopySourceRange, int64(len(data)))
+		if err != nil {
+			return err
+		}
+		data = data[start : end+1]
+	}
+
+	etag, err := b.addPart(*in.UploadId, *in.PartNumber, append([]byte(nil), data...))
+	if err != nil {
+		return err
+	}
+	*out = s3.UploadPartCopyOutput{
+		CopyPartResult: &s3.CopyPartResult{ETag: etag, LastModified: aws.Time(time.Now())},
+	}
+	return nil
+}
+
+func (b *memBackend) completeMultipartUpload(in *s3.CompleteMultipartUploadInput, header http.Header,
+	out *s3.CompleteMultipartUploadOutput) error {
+
+	upload, ok := b.uploads[*in.UploadId]
+	if !ok {
+		return memError("NoSuchUpload", 404)
+	}
+	if err := b.checkPreconditions(upload.key, header); err != nil {
+		return err
+	}
+
+	var data []byte
+	h := md5.New()
+	for _, completed := range in.MultipartUpload.Parts {
+		p, ok := upload.parts[*completed.PartNumber]
+		if !ok || completed.ETag == nil || strings.Trim(*completed.ETag, "\"") != p.etag {
+			return memError("InvalidPart", 400)
+		}
+		data = append(data, p.data...)
+		sum, _ := hex.DecodeString(p.etag)
+		h.Write(sum)
+	}
+
+	obj := upload.object
+	obj.data = data
+	obj.etag = fmt.Sprintf("%x-%v", h.Sum(nil), len(in.MultipartUpload.Parts))
+	obj.lastModified = time.Now()
+	b.objects[upload.key] = &obj
+	delete(b.uploads, *in.UploadId)
+
+	*out = s3.CompleteMultipartUploadOutput{
+		Bucket: in.Bucket,
+		Key:    in.Key,
+		ETag:   aws.String("\"" + obj.etag + "\""),
+	}
+	return nil
+}
+
+func (b *memBackend) listParts(in *s3.ListPartsInput, out *s3.ListPartsOutput) error {
+	upload, ok := b.uploads[*in.UploadId]
+	if !ok {
+		return memError("NoSuchUpload", 404)
+	}
+
+	var numbers []int
+	for n := range upload.parts {
+		numbers = append(numbers, int(n))
+	}
+	sort.Ints(numbers)
+
+	var parts []*s3.Part
+	for _, n := range numbers {
+		p := upload.parts[int64(n)]
+		parts = append(parts, &s3.Part{
+			PartNumber:   aws.Int64(int64(n)),
+			ETag:         aws.String("\"" + p.etag + "\""),
+			Size:         aws.Int64(int64(len(p.data))),
+			LastModified: aws.Time(p.lastModified),
+		})
+	}
+
+	*out = s3.ListPartsOutput{
+		Bucket:      in.Bucket,
+		Key:         in.Key,
+		UploadId:    in.UploadId,
+		Parts:       parts,
+		IsTruncated: aws.Bool(false),
+	}
+	return nil
+}
+
+func (b *memBackend) listMultipartUploads(in *s3.ListMultipartUploadsInput, out *s3.ListMultipartUploadsOutput) {
+	// by key, then by id
+	var ids []string
+	for id, upload := range b.uploads {
+		if strings.HasPrefix(upload.key, aws.StringValue(in.Prefix)) {
+			ids = append(ids, upload.key+"\x00"+id)
+		}
+	}
+	sort.Strings(ids)
+
+	var uploads []*s3.MultipartUpload
+	for _, id := range ids {
+		id = id[strings.LastIndex(id, "\x00")+1:]
+		upload := b.uploads[id]
+		uploads = append(uploads, &s3.MultipartUpload{
+			Key:       aws.String(upload.key),
+			UploadId:  aws.String(id),
+			Initiated: aws.Time(upload.initiated),
+		})
+	}
+
+	*out = s3.ListMultipartUploadsOutput{
+		Bucket:      in.Bucket,
+		Prefix:      in.Prefix,
+		Uploads:     uploads,
+		IsTruncated: aws.Bool(false),
+	}
+}
+
+type MemBackendTest struct {
+	fs      *Goofys
+	backend *memBackend
+	ctx     context.Context
+}
+
+var _ = Suite(&MemBackendTest{})
+
+func (s *MemBackendTest) SetUpTest(t *C) {
+	s.ctx = context.Background()
+
+	// with a region we don't go looking for the bucket
+	flags := &FlagStorage{StorageClass: "STANDARD", Region: "us-east-1"}
+	awsConfig := &aws.Config{Credentials: credentials.NewStaticCredentials("foo", "bar", "")}
+
+	var err error
+	s.fs, err = NewGoofysWithError("mem", awsConfig, flags)
+	t.Assert(err, IsNil)
+
+	s.backend = newMemBackend()
+	s.fs.backend = &s3Backend{fs: s.fs, svc: s.backend.S3}
+
+	for _, key := range []string{"file1", "dir1/file2", "dir1/dir2/file3", "dir3/"} {
+		_, err := s.backend.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("mem"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte(key)),
+		})
+		t.Assert(err, IsNil)
+	}
+}
+
+func (s *MemBackendTest) lookUp(t *C, name string) (in *Inode, err error) {
+	in = s.fs.inodes[fuseops.RootInodeID]
+	for _, name := range strings.Split(name, "/") {
+		in, err = in.LookUp(s.ctx, s.fs, name)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *MemBackendTest) TestListing(t *C) {
+	for _, key := range []string{"a/x", "a/y", "b", "c/z"} {
+		_, err := s.backend.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("mem"),
+			Key:    aws.String("list/" + key),
+		})
+		t.Assert(err, IsNil)
+	}
+
+	params := &s3.ListObjectsInput{
+		Bucket:    aws.String("mem"),
+		Prefix:    aws.String("list/"),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int64(2),
+	}
+	resp, err := s.backend.ListObjects(params)
+	t.Assert(err, IsNil)
+	t.Assert(*resp.IsTruncated, Equals, true)
+	t.Assert(len(resp.CommonPrefixes), Equals, 1)
+	t.Assert(*resp.CommonPrefixes[0].Prefix, Equals, "list/a/")
+	t.Assert(len(resp.Contents), Equals, 1)
+	t.Assert(*resp.Contents[0].Key, Equals, "list/b")
+	t.Assert(*resp.NextMarker, Equals, "list/b")
+
+	params.Marker = resp.NextMarker
+	resp, err = s.backend.ListObjects(params)
+	t.Assert(err, IsNil)
+	t.Assert(*resp.IsTruncated, Equals, false)
+	t.Assert(len(resp.CommonPrefixes), Equals, 1)
+	t.Assert(*resp.CommonPrefixes[0].Prefix, Equals, "list/c/")
+	t.Assert(len(resp.Contents), Equals, 0)
+
+	dh := s.fs.inodes[fuseops.RootInodeID].OpenDir()
+	defer dh.CloseDir()
+	var names []string
+	for i := fuseops.DirOffset(0); ; i++ {
+		en, err := dh.ReadDir(s.ctx, s.fs, i)
+		t.Assert(err, IsNil)
+		if en == nil {
+			break
+		}
+		names = append(names, en.Name)
+	}
+	t.Assert(names, DeepEquals, []string{".", "..", "dir1", "dir3", "file1", "list"})
+}
+
+func (s *MemBackendTest) TestWriteAndRead(t *C) {
+	data := make([]byte, 11*1024*1024)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+
+	root := s.fs.inodes[fuseops.RootInodeID]
+	_, fh := root.Create(s.fs, "big")
+	for offset := 0; offset < len(data); offset += 128 * 1024 {
+		err := fh.WriteFile(s.fs, int64(offset), data[offset:offset+128*1024])
+		t.Assert(err, IsNil)
+	}
+	t.Assert(fh.FlushFile(s.fs), IsNil)
+	fh.Release()
+
+	// went up in parts
+	t.Assert(strings.HasSuffix(s.backend.objects["big"].etag, "-3"), Equals, true)
+
+	in, err := s.lookUp(t, "big")
+	t.Assert(err, IsNil)
+	t.Assert(in.Attributes.Size, Equals, uint64(len(data)))
+
+	fh = in.OpenFile(s.fs)
+	defer fh.Release()
+	buf := make([]byte, 1024*1024)
+	for offset := int64(0); offset < int64(len(data)); offset += int64(len(buf)) {
+		nread, err := fh.ReadFile(s.ctx, s.fs, offset, buf)
+		t.Assert(err, IsNil)
+		t.Assert(bytes.Equal(buf[:nread], data[offset:offset+int64(nread)]), Equals, true)
+	}
+}
+
+func (s *MemBackendTest) TestRmDirNotEmpty(t *C) {
+	root := s.fs.inodes[fuseops.RootInodeID]
+
+	err := root.RmDir(s.fs, "dir1")
+	t.Assert(err, Equals, fuse.ENOTEMPTY)
+
+	err = root.RmDir(s.fs, "dir3")
+	t.Assert(err, IsNil)
+	_, err = s.lookUp(t, "dir3")
+	t.Assert(err, Equals, fuse.ENOENT)
+}
+
+func (s *MemBackendTest) TestRenameDir(t *C) {
+	root := s.fs.inodes[fuseops.RootInodeID]
+
+	err := root.Rename(s.fs, "dir1", root, "moved")
+	t.Assert(err, IsNil)
+
+	_, err = s.lookUp(t, "dir1")
+	t.Assert(err, Equals, fuse.ENOENT)
+	in, err := s.lookUp(t, "moved/dir2/file3")
+	t.Assert(err, IsNil)
+
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+	buf := make([]byte, 100)
+	nread, err := fh.ReadFile(s.ctx, s.fs, 0, buf)
+	t.Assert(err, IsNil)
+	t.Assert(string(buf[:nread]), Equals, "dir1/dir2/file3")
+}
+
+func (s *MemBackendTest) TestPreconditions(t *C) {
+	s.fs.flags.ConditionalWrites = true
+
+	in, err := s.lookUp(t, "file1")
+	t.Assert(err, IsNil)
+	fh := in.OpenFile(s.fs)
+	defer fh.Release()
+
+	// someone else writes it first
+	_, err = s.backend.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("mem"),
+		Key:    aws.String("file1"),
+		Body:   bytes.NewReader([]byte("theirs")),
+	})
+	t.Assert(err, IsNil)
+
+	t.Assert(fh.WriteFile(s.fs, 0, []byte("ours")), IsNil)
+	t.Assert(fh.FlushFile(s.fs), Equals, syscall.ESTALE)
+}
+
+func (s *MemBackendTest) TestWritePastMaxParts(t *C) {
+	s.backend.discardParts = true
+	// the same as MAX_PARTS and WRITE_PART_GROWTH, 500 times
+	// smaller
+	s.fs.maxParts = 20
+	s.fs.partGrowth = 2
+
+	root := s.fs.inodes[fuseops.RootInodeID]
+	_, fh := root.Create(s.fs, "huge")
+	defer fh.Release()
+
+	// one buffer more than maxParts parts of BUF_SIZE, which is
+	// what a part used to be
+	size := int64(s.fs.maxParts+1) * BUF_SIZE
+	buf := make([]byte, 1024*1024)
+	for off := int64(0); off < size; off += int64(len(buf)) {
+		t.Assert(fh.WriteFile(s.fs, off, buf), IsNil)
+	}
+	t.Assert(fh.FlushFile(s.fs), IsNil)
+
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	// the last part is uploaded with the others
+	t.Assert(s.backend.discardedBytes, Equals, size)
+	t.Assert(s.backend.discardedParts <= s.fs.maxParts, Equals, true)
+	t.Assert(s.backend.objects["huge"], NotNil)
+}
+
+func (s *MemBackendTest) TestCleanupUploadsRace(t *C) {
+	for _, key := range []string{"a", "b"} {
+		_, err := s.backend.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket: aws.String("mem"),
+			Key:    aws.String(key),
+		})
+		t.Assert(err, IsNil)
+	}
+
+	// another mount's cleanup gets to the first one just before us
+	raced := false
+	s.backend.Handlers.Send.PushFront(func(r *request.Request) {
+		if in, ok := r.Params.(*s3.AbortMultipartUploadInput); ok && !raced {
+			raced = true
+			s.backend.mu.Lock()
+			delete(s.backend.uploads, *in.UploadId)
+			s.backend.mu.Unlock()
+		}
+	})
+
+	aborted, _, err := s.fs.CleanupUploads(0)
+	t.Assert(err, IsNil)
+	t.Assert(raced, Equals, true)
+	t.Assert(aborted, Equals, 1)
+
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	t.Assert(s.backend.uploads, HasLen, 0)
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --metadata-files, file.s3meta is a JSON document with what a
+// HEAD of file says about it, for scripts that can't get at xattrs.
+// Like versions it doesn't show up in listings and can only be read.
+// It's made when it's looked up, so it's as fresh as the lookup. Keys
+// that really end with the suffix are hidden, from listings too, and
+// can't be created, unlinked or renamed.
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const METADATA_SUFFIX = ".s3meta"
+
+type objectMetadata struct {
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`
+	StorageClass string            `json:"storage_class"`
+	LastModified time.Time         `json:"last_modified"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+// file.s3meta to file, ok is false if name is not the metadata of
+// something
+func (fs *Goofys) metadataOf(name string) (base string, ok bool) {
+	if !fs.flags.MetadataFiles || !strings.HasSuffix(name, METADATA_SUFFIX) {
+		return
+	}
+	base = name[:len(name)-len(METADATA_SUFFIX)]
+	return base, len(base) != 0
+}
+
+func (parent *Inode) lookUpMetadata(ctx context.Context, fs *Goofys, name string,
+	base string) (inode *Inode, err error) {
+
+	baseName := parent.getChildName(base)
+	params := &HeadBlobInput{Key: baseName}
+
+	var resp *HeadBlobOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.HeadBlob(ctx, params)
+		return
+	})
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	meta := objectMetadata{
+		Size:         resp.Size,
+		StorageClass: "STANDARD",
+		LastModified: resp.LastModified.UTC(),
+		Metadata:     make(map[string]string),
+	}
+	if resp.ETag != nil {
+		meta.ETag = strings.Trim(*resp.ETag, "\"")
+	}
+	if resp.StorageClass != nil {
+		// S3 only says when it's not STANDARD
+		meta.StorageClass = *resp.StorageClass
+	}
+	for k, v := range resp.Metadata {
+		meta.Metadata[strings.ToLower(k)] = *v
+	}
+
+	data, err := json.MarshalIndent(&meta, "", "  ")
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	fullName := parent.getChildName(name)
+	inode = NewInode(&name, &fullName, fs.flags)
+	inode.metadataFile = data
+	inode.Attributes = &fuseops.InodeAttributes{
+		Size:   uint64(len(data)),
+		Nlink:  1,
+		Mode:   fs.flags.FileMode &^ 0222,
+		Atime:  resp.LastModified,
+		Mtime:  resp.LastModified,
+		Ctime:  resp.LastModified,
+		Crtime: resp.LastModified,
+		Uid:    fs.flags.Uid,
+		Gid:    fs.flags.Gid,
+	}
+	return
+}
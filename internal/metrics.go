@@ -0,0 +1,106 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var s3Requests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "goofys",
+		Name:      "s3_requests_total",
+		Help:      "Number of S3 requests sent, by operation.",
+	},
+	[]string{"operation"},
+)
+
+var s3Errors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "goofys",
+		Name:      "s3_errors_total",
+		Help:      "Number of failed S3 requests, by operation and HTTP status (0 if we didn't get a response).",
+	},
+	[]string{"operation", "status"},
+)
+
+var s3Latency = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "goofys",
+		Name:      "s3_request_duration_seconds",
+		Help:      "How long S3 requests took, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+	},
+	[]string{"operation"},
+)
+
+var inodeCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "goofys",
+		Name:      "inode_cache_lookups_total",
+		Help:      "Inode cache lookups, by result (hit, miss, negative_hit, coalesced).",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(s3Requests)
+	prometheus.MustRegister(s3Errors)
+	prometheus.MustRegister(s3Latency)
+	prometheus.MustRegister(inodeCacheLookups)
+}
+
+// Record every request made through svc. This is done with handlers
+// so we don't need to touch every call site.
+func instrumentS3(svc *s3.S3) {
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		op := r.Operation.Name
+
+		s3Requests.WithLabelValues(op).Inc()
+		// r.Time is when the request was built, which is close
+		// enough to when it was sent
+		s3Latency.WithLabelValues(op).Observe(time.Since(r.Time).Seconds())
+
+		if r.HTTPResponse == nil {
+			if r.Error != nil {
+				s3Errors.WithLabelValues(op, "0").Inc()
+			}
+		} else if r.HTTPResponse.StatusCode >= 400 {
+			s3Errors.WithLabelValues(op, strconv.Itoa(r.HTTPResponse.StatusCode)).Inc()
+		}
+	})
+}
+
+// Serve /metrics, and /debug/inodes of fs, on addr in the background.
+func ServeMetrics(addr string, fs FileSystem) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
+	mux.Handle("/debug/inodes", serveInodeStats(fs))
+
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			log.Printf("Unable to serve metrics on %v: %v", addr, err)
+		}
+	}()
+}
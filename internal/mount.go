@@ -0,0 +1,124 @@
+// Copyright 2015 Ka-Hing Cheung
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// What Mount serves, a Goofys or with --multi-bucket a MultiBucket.
+type FileSystem interface {
+	fuseutil.FileSystem
+
+	FlushAll() (flushed int, err error)
+	CleanupUploads(olderThan time.Duration) (aborted int, size int64, err error)
+	InodeStats() InodeStats
+}
+
+// Mount the file system based on the supplied arguments, returning a
+// fuse.MountedFileSystem that can be joined to wait for unmounting.
+// bucketName can be bucket:prefix to mount only what's under prefix,
+// or with --multi-bucket a list of buckets. awsConfig can be nil to
+// use the default credentials.
+func Mount(
+	ctx context.Context,
+	bucketName string,
+	mountPoint string,
+	awsConfig *aws.Config,
+	flags *FlagStorage) (fs FileSystem, mfs *fuse.MountedFileSystem, err error) {
+
+	// NewMultiBucket complains about a prefix itself
+	if colon := strings.Index(bucketName, ":"); colon != -1 && !flags.MultiBucket {
+		flags.Prefix = bucketName[colon+1:]
+		bucketName = bucketName[:colon]
+	}
+
+	// Choose UID and GID.
+	uid, gid, err := MyUserAndGroup()
+	if err != nil {
+		err = fmt.Errorf("MyUserAndGroup: %v", err)
+		return
+	}
+
+	if int32(flags.Uid) == -1 {
+		flags.Uid = uid
+	}
+
+	if int32(flags.Gid) == -1 {
+		flags.Gid = gid
+	}
+
+	if awsConfig == nil {
+		awsConfig = &aws.Config{
+			Region: aws.String("us-west-2"),
+			//LogLevel: aws.LogLevel(aws.LogDebug),
+		}
+	}
+
+	// don't let a nil pointer into fs, it wouldn't be == nil
+	if flags.MultiBucket {
+		if m := NewMultiBucket(bucketName, awsConfig, flags); m != nil {
+			fs = m
+		}
+	} else {
+		var g *Goofys
+		// so the caller can tell a missing bucket from one
+		// we are not allowed to get to
+		g, err = NewGoofysWithError(bucketName, awsConfig, flags)
+		if err != nil {
+			return
+		}
+		fs = g
+	}
+	if fs == nil {
+		err = fmt.Errorf("Mount: initialization failed")
+		return
+	}
+	server := fuseutil.NewFileSystemServer(fs)
+
+	// Mount the file system.
+	mountCfg := &fuse.MountConfig{
+		FSName:                  bucketName,
+		Options:                 flags.MountOptions,
+		ErrorLogger:             log.New(os.Stderr, "fuse: ", log.Flags()),
+		DisableWritebackCaching: !flags.WritebackCache,
+		// the kernel refuses to open anything for writing
+		ReadOnly: flags.ReadOnly,
+	}
+
+	if flags.DebugFuse {
+		mountCfg.DebugLogger = log.New(os.Stderr, "fuse_debug: ", 0)
+	}
+
+	mfs, err = fuse.Mount(mountPoint, server, mountCfg)
+	if err != nil {
+		err = fmt.Errorf("Mount: %v", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,774 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --multi-bucket the top level of the mount has a directory for
+// each bucket, instead of being one bucket. The bucket argument is a
+// comma separated list of buckets, or * for all the buckets
+// ListBuckets returns. Each bucket is served by its own Goofys, using
+// the client of its region, which is set up the first time the
+// bucket is looked up. Inode and handle IDs of a bucket's Goofys get
+// the bucket's number in their high bits, the top level's have none.
+// The buckets share one buffer pool and one --cache-dir, so
+// --memory-limit and --cache-max-size are for all of them together.
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// a bucket's Goofys can hand out this many IDs, which is more than
+// it could in a century
+const MULTI_BUCKET_ID_SHIFT = 40
+const MULTI_BUCKET_ID_MASK = 1<<MULTI_BUCKET_ID_SHIFT - 1
+
+// the bucket argument that means all of them
+const ALL_BUCKETS = "*"
+
+type MultiBucket struct {
+	fuseutil.NotImplementedFileSystem
+
+	flags     *FlagStorage
+	awsConfig *aws.Config
+	rootAttrs fuseops.InodeAttributes
+
+	// the buckets we were given, nil if we list them with s3
+	names []string
+	s3    *s3.S3
+
+	// nil if the buckets can't be in different regions
+	regions *regionClients
+
+	// what every bucket's Goofys uses
+	shared *sharedResources
+
+	mu sync.Mutex
+
+	// what ListBuckets returned, and when
+	//
+	// GUARDED_BY(mu)
+	listed   []string
+	listTime time.Time
+
+	// GUARDED_BY(mu)
+	buckets map[string]*bucketMount
+	// bucket number n is mounted[n-1]
+	//
+	// GUARDED_BY(mu)
+	mounted []*Goofys
+
+	// handles of the top level directory, what it had when it
+	// was opened
+	//
+	// GUARDED_BY(mu)
+	nextHandleID fuseops.HandleID
+	dirHandles   map[fuseops.HandleID][]fuseutil.Dirent
+}
+
+type bucketMount struct {
+	mu sync.Mutex
+	// nil until it's looked up, or if setting it up failed
+	fs  *Goofys
+	num uint64
+}
+
+func NewMultiBucket(buckets string, awsConfig *aws.Config, flags *FlagStorage) *MultiBucket {
+	if flags.DebugS3 {
+		awsConfig.LogLevel = aws.LogLevel(aws.LogDebug | aws.LogDebugWithRequestErrors)
+	}
+
+	if strings.Contains(buckets, ":") {
+		log.Printf("--multi-bucket can't mount a prefix of a bucket: %v", buckets)
+		return nil
+	}
+
+	if flags.Anonymous && !flags.ReadOnly {
+		// see newGoofys, the kernel needs to know now
+		log.Printf("--anonymous: mounting %v read-only", buckets)
+		flags.ReadOnly = true
+	}
+
+	// set up the credentials once, not once per bucket
+	if err := configureAws(awsConfig, flags); err != nil {
+		log.Print(err)
+		return nil
+	}
+
+	if err := checkMemoryLimits(flags); err != nil {
+		log.Print(err)
+		return nil
+	}
+	shared, err := newSharedResources(flags)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+
+	now := time.Now()
+	m := &MultiBucket{
+		flags:     flags,
+		awsConfig: awsConfig,
+		rootAttrs: fuseops.InodeAttributes{
+			Size:   4096,
+			Nlink:  2,
+			Mode:   flags.DirMode | os.ModeDir,
+			Atime:  now,
+			Mtime:  now,
+			Ctime:  now,
+			Crtime: now,
+			Uid:    flags.Uid,
+			Gid:    flags.Gid,
+		},
+		shared:       shared,
+		buckets:      make(map[string]*bucketMount),
+		nextHandleID: 1,
+		dirHandles:   make(map[fuseops.HandleID][]fuseutil.Dirent),
+	}
+
+	if len(flags.Region) == 0 && len(flags.Endpoint) == 0 && !flags.SignatureV2 {
+		m.regions = newRegionClients(awsConfig, flags)
+	}
+
+	if buckets == ALL_BUCKETS {
+		m.s3 = s3.New(awsConfig)
+		if flags.SignatureV2 {
+			useSignatureV2(m.s3, "")
+		}
+		instrumentS3(m.s3)
+
+		// fail now if we can't list them
+		if _, err := m.bucketNames(); err != nil {
+			log.Printf("Unable to list buckets: %v", err)
+			return nil
+		}
+	} else {
+		for _, b := range strings.Split(buckets, ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				m.names = append(m.names, b)
+			}
+		}
+		if len(m.names) == 0 {
+			log.Printf("no buckets to mount")
+			return nil
+		}
+		sort.Strings(m.names)
+	}
+
+	return m
+}
+
+// The buckets at the top level, sorted.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *MultiBucket) bucketNames() (names []string, err error) {
+	if m.s3 == nil {
+		return m.names, nil
+	}
+
+	m.mu.Lock()
+	if m.listed != nil && time.Since(m.listTime) < m.flags.TypeCacheTTL {
+		names = m.listed
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+
+	resp, err := m.s3.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	names = make([]string, 0, len(resp.Buckets))
+	for _, b := range resp.Buckets {
+		names = append(names, *b.Name)
+	}
+	sort.Strings(names)
+
+	m.mu.Lock()
+	m.listed = names
+	m.listTime = time.Now()
+	m.mu.Unlock()
+	return
+}
+
+// The Goofys of bucket, set up if this is the first time we need it.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *MultiBucket) mount(bucket string) (fs *Goofys, num uint64, err error) {
+	names, err := m.bucketNames()
+	if err != nil {
+		return
+	}
+	if i := sort.SearchStrings(names, bucket); i == len(names) || names[i] != bucket {
+		return nil, 0, fuse.ENOENT
+	}
+
+	m.mu.Lock()
+	b := m.buckets[bucket]
+	if b == nil {
+		b = &bucketMount{}
+		m.buckets[bucket] = b
+	}
+	m.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fs == nil {
+		flags := *m.flags
+		// m.awsConfig already has the credentials these
+		// would get us
+		flags.CredentialProcess = ""
+		flags.RoleARN = ""
+		// and its HTTP client is already limited, by all
+		// the buckets together
+		flags.MaxReadBps = 0
+		flags.MaxWriteBps = 0
+		awsConfig := *m.awsConfig
+
+		var svc *s3.S3
+		if m.regions != nil {
+			var region string
+			region, err = m.regions.bucketRegion(bucket)
+			if err == fuse.ENOENT {
+				return nil, 0, err
+			} else if err == nil {
+				// so newGoofys doesn't ask again
+				flags.Region = region
+				svc = m.regions.bucketClient(region)
+			}
+		}
+
+		fs, err = newGoofys(bucket, &awsConfig, &flags, m.shared, svc)
+		if err != nil {
+			log.Print(err)
+			// we'll try again next time
+			if bucketErr, ok := err.(*BucketError); ok &&
+				(bucketErr.Err == fuse.ENOENT || bucketErr.Err == syscall.EACCES) {
+				return nil, 0, bucketErr.Err
+			}
+			return nil, 0, syscall.EIO
+		}
+		if m.regions != nil {
+			// it may have found out some other way
+			m.regions.setBucketRegion(bucket, *fs.awsConfig.Region)
+		}
+
+		m.mu.Lock()
+		m.mounted = append(m.mounted, fs)
+		b.num = uint64(len(m.mounted))
+		m.mu.Unlock()
+		b.fs = fs
+	}
+
+	return b.fs, b.num, nil
+}
+
+func multiBucketID(num uint64, id uint64) uint64 {
+	return num<<MULTI_BUCKET_ID_SHIFT | id
+}
+
+// The Goofys of the bucket id belongs to and what it calls it, nil
+// if it's the top level's.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *MultiBucket) route(id uint64) (fs *Goofys, num uint64, childID uint64) {
+	num = id >> MULTI_BUCKET_ID_SHIFT
+	if num == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mounted[num-1], num, id & MULTI_BUCKET_ID_MASK
+}
+
+func (m *MultiBucket) routeInode(id fuseops.InodeID) (*Goofys, uint64, fuseops.InodeID) {
+	fs, num, childID := m.route(uint64(id))
+	return fs, num, fuseops.InodeID(childID)
+}
+
+func (m *MultiBucket) routeHandle(id fuseops.HandleID) (*Goofys, uint64, fuseops.HandleID) {
+	fs, num, childID := m.route(uint64(id))
+	return fs, num, fuseops.HandleID(childID)
+}
+
+func (m *MultiBucket) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+
+	// the same made up numbers a bucket without
+	// --usage-refresh has
+	return (&Goofys{}).StatFS(ctx, op)
+}
+
+func (m *MultiBucket) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+
+	fs, num, parent := m.routeInode(op.Parent)
+	if fs == nil {
+		fs, num, err = m.mount(op.Name)
+		if err != nil {
+			return
+		}
+
+		op.Entry.Child = fuseops.InodeID(multiBucketID(num, uint64(fuseops.RootInodeID)))
+		op.Entry.Attributes = fs.rootAttrs
+		op.Entry.AttributesExpiration = time.Now().Add(m.flags.StatCacheTTL)
+		op.Entry.EntryExpiration = time.Now().Add(m.flags.TypeCacheTTL)
+		return
+	}
+
+	op.Parent = parent
+	err = fs.LookUpInode(ctx, op)
+	op.Entry.Child = fuseops.InodeID(multiBucketID(num, uint64(op.Entry.Child)))
+	return
+}
+
+func (m *MultiBucket) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+
+	fs, _, inode := m.routeInode(op.Inode)
+	if fs == nil {
+		op.Attributes = m.rootAttrs
+		op.AttributesExpiration = time.Now().Add(m.flags.StatCacheTTL)
+		return
+	}
+
+	op.Inode = inode
+	return fs.GetInodeAttributes(ctx, op)
+}
+
+func (m *MultiBucket) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+
+	fs, _, inode := m.routeInode(op.Inode)
+	if fs == nil {
+		return syscall.EPERM
+	}
+
+	op.Inode = inode
+	return fs.SetInodeAttributes(ctx, op)
+}
+
+func (m *MultiBucket) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+
+	fs, _, inode := m.routeInode(op.Inode)
+	if fs == nil || inode == fuseops.RootInodeID {
+		// buckets stay set up once they are
+		return
+	}
+
+	op.Inode = inode
+	return fs.ForgetInode(ctx, op)
+}
+
+func (m *MultiBucket) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+
+	fs, num, parent := m.routeInode(op.Parent)
+	if fs == nil {
+		// we don't create buckets
+		return syscall.EPERM
+	}
+
+	op.Parent = parent
+	err = fs.MkDir(ctx, op)
+	op.Entry.Child = fuseops.InodeID(multiBucketID(num, uint64(op.Entry.Child)))
+	return
+}
+
+func (m *MultiBucket) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+
+	fs, num, parent := m.routeInode(op.Parent)
+	if fs == nil {
+		return syscall.EPERM
+	}
+
+	op.Parent = parent
+	err = fs.CreateFile(ctx, op)
+	op.Entry.Child = fuseops.InodeID(multiBucketID(num, uint64(op.Entry.Child)))
+	op.Handle = fuseops.HandleID(multiBucketID(num, uint64(op.Handle)))
+	return
+}
+
+func (m *MultiBucket) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+
+	fs, num, parent := m.routeInode(op.Parent)
+	if fs == nil {
+		return syscall.EPERM
+	}
+
+	op.Parent = parent
+	err = fs.CreateSymlink(ctx, op)
+	op.Entry.Child = fuseops.InodeID(multiBucketID(num, uint64(op.Entry.Child)))
+	return
+}
+
+func (m *MultiBucket) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+
+	fs, num, parent := m.routeInode(op.Parent)
+	targetFs, _, target := m.routeInode(op.Target)
+	if fs == nil || targetFs == nil {
+		return syscall.EPERM
+	}
+	if fs != targetFs {
+		return syscall.EXDEV
+	}
+
+	op.Parent = parent
+	op.Target = target
+	err = fs.CreateLink(ctx, op)
+	op.Entry.Child = fuseops.InodeID(multiBucketID(num, uint64(op.Entry.Child)))
+	return
+}
+
+func (m *MultiBucket) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+
+	fs, _, oldParent := m.routeInode(op.OldParent)
+	newFs, _, newParent := m.routeInode(op.NewParent)
+	if fs == nil || newFs == nil {
+		return syscall.EPERM
+	}
+	if fs != newFs {
+		return syscall.EXDEV
+	}
+
+	op.OldParent = oldParent
+	op.NewParent = newParent
+	return fs.Rename(ctx, op)
+}
+
+func (m *MultiBucket) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+
+	fs, _, parent := m.routeInode(op.Parent)
+	if fs == nil {
+		return syscall.EPERM
+	}
+
+	op.Parent = parent
+	return fs.RmDir(ctx, op)
+}
+
+func (m *MultiBucket) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+
+	fs, _, parent := m.routeInode(op.Parent)
+	if fs == nil {
+		return syscall.EPERM
+	}
+
+	op.Parent = parent
+	return fs.Unlink(ctx, op)
+}
+
+func (m *MultiBucket) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+
+	fs, num, inode := m.routeInode(op.Inode)
+	if fs != nil {
+		op.Inode = inode
+		err = fs.OpenDir(ctx, op)
+		op.Handle = fuseops.HandleID(multiBucketID(num, uint64(op.Handle)))
+		return
+	}
+
+	names, err := m.bucketNames()
+	if err != nil {
+		return
+	}
+
+	entries := []fuseutil.Dirent{
+		makeDirEntry(".", fuseutil.DT_Directory),
+		makeDirEntry("..", fuseutil.DT_Directory),
+	}
+	for _, name := range names {
+		entries = append(entries, makeDirEntry(name, fuseutil.DT_Directory))
+	}
+	for i := range entries {
+		entries[i].Offset = fuseops.DirOffset(i + 1)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	op.Handle = m.nextHandleID
+	m.nextHandleID++
+	m.dirHandles[op.Handle] = entries
+	return
+}
+
+func (m *MultiBucket) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+
+	fs, _, handle := m.routeHandle(op.Handle)
+	if fs != nil {
+		_, _, op.Inode = m.routeInode(op.Inode)
+		op.Handle = handle
+		return fs.ReadDir(ctx, op)
+	}
+
+	m.mu.Lock()
+	entries, ok := m.dirHandles[op.Handle]
+	m.mu.Unlock()
+	if !ok {
+		return syscall.EBADF
+	}
+
+	for i := int(op.Offset); i < len(entries); i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], entries[i])
+		if n == 0 {
+			break
+		}
+		op.BytesRead += n
+	}
+	return
+}
+
+func (m *MultiBucket) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+
+	fs, _, handle := m.routeHandle(op.Handle)
+	if fs != nil {
+		op.Handle = handle
+		return fs.ReleaseDirHandle(ctx, op)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.dirHandles, op.Handle)
+	return
+}
+
+func (m *MultiBucket) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+
+	fs, num, inode := m.routeInode(op.Inode)
+	if fs == nil {
+		return syscall.EISDIR
+	}
+
+	op.Inode = inode
+	err = fs.OpenFile(ctx, op)
+	op.Handle = fuseops.HandleID(multiBucketID(num, uint64(op.Handle)))
+	return
+}
+
+func (m *MultiBucket) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+
+	fs, _, handle := m.routeHandle(op.Handle)
+	if fs == nil {
+		return syscall.EBADF
+	}
+
+	_, _, op.Inode = m.routeInode(op.Inode)
+	op.Handle = handle
+	return fs.ReadFile(ctx, op)
+}
+
+func (m *MultiBucket) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+
+	fs, _, handle := m.routeHandle(op.Handle)
+	if fs == nil {
+		return syscall.EBADF
+	}
+
+	_, _, op.Inode = m.routeInode(op.Inode)
+	op.Handle = handle
+	return fs.WriteFile(ctx, op)
+}
+
+func (m *MultiBucket) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) (err error) {
+
+	fs, _, handle := m.routeHandle(op.Handle)
+	if fs == nil {
+		return syscall.EBADF
+	}
+
+	_, _, op.Inode = m.routeInode(op.Inode)
+	op.Handle = handle
+	return fs.SyncFile(ctx, op)
+}
+
+func (m *MultiBucket) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+
+	fs, _, handle := m.routeHandle(op.Handle)
+	if fs == nil {
+		return syscall.EBADF
+	}
+
+	_, _, op.Inode = m.routeInode(op.Inode)
+	op.Handle = handle
+	return fs.FlushFile(ctx, op)
+}
+
+func (m *MultiBucket) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+
+	fs, _, handle := m.routeHandle(op.Handle)
+	if fs == nil {
+		return syscall.EBADF
+	}
+
+	op.Handle = handle
+	return fs.ReleaseFileHandle(ctx, op)
+}
+
+func (m *MultiBucket) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+
+	fs, _, inode := m.routeInode(op.Inode)
+	if fs == nil {
+		return syscall.EINVAL
+	}
+
+	op.Inode = inode
+	return fs.ReadSymlink(ctx, op)
+}
+
+func (m *MultiBucket) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+
+	fs, _, inode := m.routeInode(op.Inode)
+	if fs == nil {
+		return syscall.ENOTSUP
+	}
+
+	op.Inode = inode
+	return fs.GetXattr(ctx, op)
+}
+
+func (m *MultiBucket) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+
+	fs, _, inode := m.routeInode(op.Inode)
+	if fs == nil {
+		return syscall.ENOTSUP
+	}
+
+	op.Inode = inode
+	return fs.ListXattr(ctx, op)
+}
+
+func (m *MultiBucket) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+
+	fs, _, inode := m.routeInode(op.Inode)
+	if fs == nil {
+		return syscall.ENOTSUP
+	}
+
+	op.Inode = inode
+	return fs.SetXattr(ctx, op)
+}
+
+func (m *MultiBucket) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+
+	fs, _, inode := m.routeInode(op.Inode)
+	if fs == nil {
+		return syscall.ENOTSUP
+	}
+
+	op.Inode = inode
+	return fs.RemoveXattr(ctx, op)
+}
+
+// The buckets that have been set up so far.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *MultiBucket) mountedBuckets() []*Goofys {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]*Goofys(nil), m.mounted...)
+}
+
+// See Goofys.FlushAll.
+func (m *MultiBucket) FlushAll() (flushed int, err error) {
+	for _, fs := range m.mountedBuckets() {
+		n, flushErr := fs.FlushAll()
+		flushed += n
+		if flushErr != nil && err == nil {
+			err = flushErr
+		}
+	}
+	return
+}
+
+// See Goofys.CleanupUploads. Only buckets that have been looked up
+// are cleaned up.
+func (m *MultiBucket) CleanupUploads(olderThan time.Duration) (aborted int, size int64, err error) {
+	for _, fs := range m.mountedBuckets() {
+		n, s, cleanupErr := fs.CleanupUploads(olderThan)
+		aborted += n
+		size += s
+		if cleanupErr != nil && err == nil {
+			err = cleanupErr
+		}
+	}
+	return
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// S3 Object Lock: with --object-lock-mode and --object-lock-retention
+// everything we write can't be deleted or overwritten until the
+// retention is up, counting from when it's written. S3 wants a
+// Content-MD5 with uploads that have a retention, so we send one with
+// every upload.
+//
+// XXX a bucket with a default retention wants Content-MD5 too, but
+// without --object-lock-mode we don't send it
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/jacobsa/fuse"
+)
+
+var OBJECT_LOCK_MODES = map[string]bool{
+	"GOVERNANCE": true,
+	"COMPLIANCE": true,
+}
+
+// nil without --object-lock-mode
+func (fs *Goofys) objectLockMode() *string {
+	if fs.flags.ObjectLockMode == "" {
+		return nil
+	}
+	return &fs.flags.ObjectLockMode
+}
+
+// When what we write now can be deleted, nil without
+// --object-lock-mode.
+func (fs *Goofys) objectLockRetainUntil() *time.Time {
+	if fs.flags.ObjectLockMode == "" {
+		return nil
+	}
+	until := time.Now().Add(fs.flags.RetentionPeriod)
+	return &until
+}
+
+// Whether the bucket has Object Lock.
+func (fs *Goofys) hasObjectLock() (enabled bool, err error) {
+	var resp *s3.GetObjectLockConfigurationOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.s3.GetObjectLockConfiguration(
+			&s3.GetObjectLockConfigurationInput{Bucket: &fs.bucket})
+		return
+	})
+	if err != nil {
+		if mapAwsError(err) == fuse.ENOENT {
+			// ObjectLockConfigurationNotFoundError
+			return false, nil
+		}
+		return false, mapAwsError(err)
+	}
+
+	return resp.ObjectLockConfiguration != nil &&
+		resp.ObjectLockConfiguration.ObjectLockEnabled != nil &&
+		*resp.ObjectLockConfiguration.ObjectLockEnabled == "Enabled", nil
+}
+
+// Warn if the bucket can't lock what we write.
+func (fs *Goofys) useObjectLock() {
+	enabled, err := fs.hasObjectLock()
+	if err != nil {
+		log.Printf("Unable to tell if bucket %v has Object Lock: %v", fs.bucket, err)
+	} else if !enabled {
+		log.Printf("Bucket %v doesn't have Object Lock enabled, writes with"+
+			" --object-lock-mode will fail", fs.bucket)
+	}
+}
+
+// Set Content-MD5 on uploads.
+func contentMD5(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "UploadPart":
+	default:
+		return
+	}
+	if r.Error != nil || r.Body == nil {
+		return
+	}
+
+	start, err := r.Body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		r.Error = err
+		return
+	}
+	h := md5.New()
+	if _, err = io.Copy(h, r.Body); err != nil {
+		r.Error = err
+		return
+	}
+	if _, err = r.Body.Seek(start, io.SeekStart); err != nil {
+		r.Error = err
+		return
+	}
+
+	r.HTTPRequest.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
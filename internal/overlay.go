@@ -0,0 +1,293 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// a writeOverlay stages non-sequential writes on top of the object
+// that was in S3 when the overlay was created. When the file is
+// flushed the final object is reconstructed by reading the ranges we
+// don't have from S3 and splicing in the dirty ranges.
+
+// dirty data is kept in buffers of the handle's pool, one for each
+// BUF_SIZE page of the file that was written to, so it counts
+// against --memory-limit like any other write. Once the pool can't
+// give us another one, everything is spilled to an unlinked temp file
+// and the buffers go back.
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+type dirtyExtent struct {
+	offset int64
+	length int64
+}
+
+func (e *dirtyExtent) end() int64 {
+	return e.offset + e.length
+}
+
+type writeOverlay struct {
+	baseSize int64 // how much of the original object is still valid
+	size     int64 // size of the file with all the writes applied
+
+	// sorted by offset, never overlapping
+	extents []dirtyExtent
+
+	// what's in the extents, by page number, until it's spilled.
+	// Bytes outside of the extents are garbage.
+	pages map[int64][]byte
+	pool  *BufferPoolHandle
+	spill *os.File
+}
+
+func newWriteOverlay(baseSize int64, pool *BufferPoolHandle) *writeOverlay {
+	return &writeOverlay{
+		baseSize: baseSize,
+		size:     baseSize,
+		pages:    make(map[int64][]byte),
+		pool:     pool,
+	}
+}
+
+func (o *writeOverlay) spillToDisk() (err error) {
+	f, err := ioutil.TempFile("", "goofys")
+	if err != nil {
+		return
+	}
+	// we never need to open it again
+	os.Remove(f.Name())
+
+	for _, e := range o.extents {
+		for offset := e.offset; offset < e.end(); {
+			page := o.pages[offset/BUF_SIZE]
+			pageOffset := offset % BUF_SIZE
+			n := minInt64(BUF_SIZE-pageOffset, e.end()-offset)
+			_, err = f.WriteAt(page[pageOffset:pageOffset+n], offset)
+			if err != nil {
+				f.Close()
+				return
+			}
+			offset += n
+		}
+	}
+
+	o.freePages()
+	o.spill = f
+	return
+}
+
+func (o *writeOverlay) freePages() {
+	for n, page := range o.pages {
+		o.pool.Free(page)
+		delete(o.pages, n)
+	}
+}
+
+// Copy data into the pages at offset, getting the ones we don't have
+// yet. false if the pool is out of buffers.
+func (o *writeOverlay) writePages(offset int64, data []byte) bool {
+	for len(data) != 0 {
+		n := offset / BUF_SIZE
+		page, ok := o.pages[n]
+		if !ok {
+			page = o.pool.TryRequest()
+			if page == nil {
+				return false
+			}
+			page = page[:BUF_SIZE]
+			o.pages[n] = page
+		}
+
+		copied := copy(page[offset%BUF_SIZE:], data)
+		data = data[copied:]
+		offset += int64(copied)
+	}
+	return true
+}
+
+// Write data at offset, newer writes always win over older ones
+func (o *writeOverlay) Write(offset int64, data []byte) (err error) {
+	if len(data) == 0 {
+		return
+	}
+
+	n := dirtyExtent{offset: offset, length: int64(len(data))}
+
+	if o.spill == nil && !o.writePages(offset, data) {
+		// the pages we did write are dropped, they are
+		// written to the file below
+		err = o.spillToDisk()
+		if err != nil {
+			return
+		}
+	}
+	if o.spill != nil {
+		_, err = o.spill.WriteAt(data, offset)
+		if err != nil {
+			return
+		}
+	}
+
+	extents := make([]dirtyExtent, 0, len(o.extents)+2)
+	inserted := false
+
+	for _, e := range o.extents {
+		if e.end() <= n.offset || e.offset >= n.end() {
+			// no overlap
+			if !inserted && e.offset >= n.end() {
+				extents = append(extents, n)
+				inserted = true
+			}
+			extents = append(extents, e)
+			continue
+		}
+
+		// keep whatever part of the old extent we didn't overwrite
+		if e.offset < n.offset {
+			extents = append(extents, dirtyExtent{offset: e.offset, length: n.offset - e.offset})
+		}
+
+		if !inserted {
+			extents = append(extents, n)
+			inserted = true
+		}
+
+		if e.end() > n.end() {
+			extents = append(extents, dirtyExtent{offset: n.end(), length: e.end() - n.end()})
+		}
+	}
+
+	if !inserted {
+		extents = append(extents, n)
+	}
+
+	o.extents = extents
+
+	if n.end() > o.size {
+		o.size = n.end()
+	}
+	return
+}
+
+// Change the size of the file. Shrinking throws away both dirty data
+// and the part of the original object past size, growing leaves a
+// hole that reads as zeros.
+func (o *writeOverlay) Truncate(size int64) {
+	if size < o.size {
+		extents := o.extents[:0]
+		for _, e := range o.extents {
+			if e.offset >= size {
+				continue
+			}
+
+			if e.end() > size {
+				e.length = size - e.offset
+			}
+			extents = append(extents, e)
+		}
+		o.extents = extents
+
+		for n, page := range o.pages {
+			if n*BUF_SIZE >= size {
+				o.pool.Free(page)
+				delete(o.pages, n)
+			}
+		}
+
+		if o.baseSize > size {
+			o.baseSize = size
+		}
+	}
+
+	o.size = size
+}
+
+// returns true if [offset, end) is entirely made of dirty data
+func (o *writeOverlay) covers(offset int64, end int64) bool {
+	for _, e := range o.extents {
+		if e.end() <= offset {
+			continue
+		}
+		if e.offset > offset {
+			return false
+		}
+		offset = e.end()
+		if offset >= end {
+			return true
+		}
+	}
+
+	return offset >= end
+}
+
+// copy the dirty data that falls in [offset, offset + len(buf)) into
+// buf, leaving everything else untouched
+func (o *writeOverlay) apply(offset int64, buf []byte) (err error) {
+	end := offset + int64(len(buf))
+
+	for _, e := range o.extents {
+		if e.end() <= offset {
+			continue
+		}
+		if e.offset >= end {
+			break
+		}
+
+		from := maxInt64(e.offset, offset)
+		to := minInt64(e.end(), end)
+		dst := buf[from-offset : to-offset]
+
+		if o.spill != nil {
+			_, err = o.spill.ReadAt(dst, from)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		for len(dst) != 0 {
+			page := o.pages[from/BUF_SIZE]
+			copied := copy(dst, page[from%BUF_SIZE:])
+			dst = dst[copied:]
+			from += int64(copied)
+		}
+	}
+
+	return
+}
+
+func (o *writeOverlay) Close() {
+	if o.spill != nil {
+		o.spill.Close()
+		o.spill = nil
+	}
+	o.freePages()
+	o.extents = nil
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -18,8 +18,10 @@ package internal
 
 import (
 	"fmt"
+	"os"
 	"os/user"
 	"strconv"
+	"strings"
 )
 
 // Return the UID and GID of this process.
@@ -49,3 +51,24 @@ func MyUserAndGroup() (uid uint32, gid uint32, err error) {
 
 	return
 }
+
+// The permission bits of something created with mode: what was asked
+// for less flags.Umask.
+func (fs *Goofys) createMode(mode os.FileMode) os.FileMode {
+	return mode.Perm() &^ fs.flags.Umask
+}
+
+// The mode of file name: flags.FileMode, plus the execute bits
+// matching its read bits if name ends with one of flags.ExecSuffixes.
+func (fs *Goofys) fileMode(name string) (mode os.FileMode) {
+	mode = fs.flags.FileMode
+
+	name, _ = splitVersion(name)
+	for _, suffix := range fs.flags.ExecSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			mode |= (mode & 0444) >> 2
+			break
+		}
+	}
+	return
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --prewarm-depth, the first levels of directories are listed in
+// the background when we mount, so the first ls near the top of a big
+// bucket doesn't wait for S3. A directory that's opened before its
+// inode has a listing of its own replays the prewarmed one, until
+// --type-cache-ttl is up or something in the directory changes, the
+// same as the listings directories cache themselves.
+//
+// XXX this is only done once, the listings aren't kept warm after
+// --type-cache-ttl
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// how many directories we list at the same time
+const PREWARM_PARALLEL = 8
+
+// we stop once we've listed this many
+const PREWARM_MAX_DIRS = 10000
+
+type prewarmedDir struct {
+	pages []dirPage
+	time  time.Time
+}
+
+type prewarmedDirs struct {
+	mu sync.Mutex
+	// directory full name to its listing
+	dirs map[string]prewarmedDir
+	// bumped whenever a directory changes, so a listing that
+	// raced with the change is not kept
+	gen uint64
+}
+
+func newPrewarmedDirs() *prewarmedDirs {
+	return &prewarmedDirs{dirs: make(map[string]prewarmedDir)}
+}
+
+// The listing of dir if it's not older than ttl.
+func (p *prewarmedDirs) get(dir string, ttl time.Duration) []dirPage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	d, ok := p.dirs[dir]
+	if !ok {
+		return nil
+	}
+	if time.Since(d.time) >= ttl {
+		delete(p.dirs, dir)
+		return nil
+	}
+	return d.pages
+}
+
+func (p *prewarmedDirs) generation() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.gen
+}
+
+func (p *prewarmedDirs) set(dir string, gen uint64, pages []dirPage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if gen != p.gen {
+		return
+	}
+	p.dirs[dir] = prewarmedDir{pages, time.Now()}
+}
+
+func (p *prewarmedDirs) invalidate(dir string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.dirs, dir)
+	p.gen++
+}
+
+// List depth levels of directories from the root down.
+func (fs *Goofys) prewarm(depth int) {
+	fs.mu.Lock()
+	root := fs.getInodeOrDie(fuseops.RootInodeID)
+	fs.mu.Unlock()
+
+	start := time.Now()
+	level := []string{*root.FullName}
+	listed := 0
+
+	for d := 0; d < depth && len(level) != 0; d++ {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var next []string
+		sem := make(chan bool, PREWARM_PARALLEL)
+
+		for _, dir := range level {
+			if listed >= PREWARM_MAX_DIRS {
+				break
+			}
+			listed++
+
+			wg.Add(1)
+			sem <- true
+			go func(dir string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				subdirs, err := fs.prewarmDir(dir)
+				if err != nil {
+					log.Printf("Unable to prewarm %v: %v", dir, err)
+					return
+				}
+
+				mu.Lock()
+				next = append(next, subdirs...)
+				mu.Unlock()
+			}(dir)
+		}
+
+		wg.Wait()
+		level = next
+	}
+
+	if fs.flags.DebugFuse {
+		log.Printf("Prewarmed %v directories in %v", listed, time.Since(start))
+	}
+}
+
+// List dir and keep the listing, returns the directories in it.
+func (fs *Goofys) prewarmDir(dir string) (subdirs []string, err error) {
+	gen := fs.prewarmed.generation()
+
+	// an inode the kernel doesn't know about, just to list with
+	dh := NewDirHandle(NewInode(&dir, &dir, fs.flags))
+
+	for {
+		err = dh.readPage(context.Background(), fs)
+		if err != nil {
+			return nil, err
+		}
+		if dh.pages == nil {
+			// too big to cache, and to go into
+			return nil, nil
+		}
+
+		for _, e := range dh.Entries {
+			if e.Type == fuseutil.DT_Directory {
+				subdirs = append(subdirs, dh.inode.getChildName(e.Name))
+			}
+		}
+
+		if dh.Marker == nil {
+			break
+		}
+
+		dh.BaseOffset += len(dh.Entries)
+	}
+
+	fs.prewarmed.set(dir, gen, dh.pages)
+	return
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --probe we try what the mount is going to need before
+// serving anything, so missing permissions show up as one clear
+// message at mount time instead of as EACCES from some later
+// operation.
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// what we PUT and DELETE to see if we can write, hidden from
+// listings by the leading dot
+const PROBE_KEY_PREFIX = ".goofys-probe-"
+
+// List under the mount, and unless we are read only, write and
+// delete an empty object there.
+func (fs *Goofys) probe() (err error) {
+	root := fs.inodes[fuseops.RootInodeID]
+
+	prefix := *root.FullName
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+
+	_, err = fs.s3.ListObjects(&s3.ListObjectsInput{
+		Bucket:  &fs.bucket,
+		Prefix:  &prefix,
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list %v/%v: %v", fs.bucket, prefix, mapAwsError(err))
+	}
+
+	if fs.flags.ReadOnly {
+		return
+	}
+
+	key := root.getChildName(fmt.Sprintf("%v%v-%v", PROBE_KEY_PREFIX,
+		os.Getpid(), time.Now().UnixNano()))
+
+	_, err = fs.s3.PutObject(&s3.PutObjectInput{
+		Bucket:               &fs.bucket,
+		Key:                  &key,
+		StorageClass:         &fs.flags.StorageClass,
+		ServerSideEncryption: fs.sseType(),
+		SSEKMSKeyId:          fs.sseKMSKeyId(),
+		ACL:                  fs.acl(),
+		Tagging:              fs.tagging(),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write %v/%v: %v", fs.bucket, key, mapAwsError(err))
+	}
+
+	_, err = fs.s3.DeleteObject(&s3.DeleteObjectInput{Bucket: &fs.bucket, Key: &key})
+	if err != nil {
+		return fmt.Errorf("unable to delete %v/%v, it has to be removed by hand: %v",
+			fs.bucket, key, mapAwsError(err))
+	}
+
+	return
+}
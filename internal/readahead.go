@@ -0,0 +1,242 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// once a file handle is being read sequentially we stop relying on
+// a single stream and instead keep flags.ReadAheadStreams ranged
+// GETs in flight ahead of the reader. The window starts small,
+// doubles every time a buffer is consumed sequentially and halves on
+// every out of order read.
+
+import (
+	"sync"
+)
+
+const MIN_READ_AHEAD_CHUNK = 128 * 1024
+
+type readAheadBuffer struct {
+	offset int64
+	buf    []byte
+	nRead  int
+
+	// protects err and the content of buf until the fetch completes
+	wg  sync.WaitGroup
+	err error
+}
+
+func (fh *FileHandle) newReadAheadBuffer(fs *Goofys, offset int64, buf []byte) (b *readAheadBuffer) {
+	b = &readAheadBuffer{offset: offset, buf: buf}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.err = fh.readBase(fs, offset, b.buf)
+	}()
+
+	return
+}
+
+func (fh *FileHandle) readAheadChunkSize(fs *Goofys) int64 {
+	chunk := fh.readAheadWindow / int64(fs.flags.ReadAheadStreams)
+	if chunk > BUF_SIZE {
+		chunk = BUF_SIZE
+	} else if chunk < MIN_READ_AHEAD_CHUNK {
+		chunk = MIN_READ_AHEAD_CHUNK
+	}
+	return chunk
+}
+
+// Keep ReadAheadStreams buffers in flight, starting from offset if
+// we don't have any. We only wait for memory when there's nothing in
+// flight, and then without fh.mu.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) fillReadAhead(fs *Goofys, offset int64) {
+	size := int64(fh.inode.Attributes.Size)
+
+	for len(fh.readAheadBufs) < fs.flags.ReadAheadStreams {
+		if n := len(fh.readAheadBufs); n != 0 {
+			last := fh.readAheadBufs[n-1]
+			offset = last.offset + int64(len(last.buf))
+		}
+		if offset >= size {
+			break
+		}
+
+		buf := fh.poolHandle.TryRequest()
+		if buf == nil {
+			if len(fh.readAheadBufs) != 0 {
+				// more next time
+				break
+			}
+
+			fh.mu.Unlock()
+			buf = fh.poolHandle.Request()
+			fh.mu.Lock()
+
+			if len(fh.readAheadBufs) != 0 {
+				// another read filled it meanwhile
+				fh.poolHandle.Free(buf)
+				break
+			}
+		}
+
+		chunk := fh.readAheadChunkSize(fs)
+		if offset+chunk > size {
+			chunk = size - offset
+		}
+
+		b := fh.newReadAheadBuffer(fs, offset, buf[:chunk])
+		fh.readAheadBufs = append(fh.readAheadBufs, b)
+	}
+}
+
+// The buffers are recycled once their GETs finish, which we don't
+// wait for.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) dropReadAhead() {
+	for _, b := range fh.readAheadBufs {
+		// can't recycle the buffer while someone's writing to it
+		go func(b *readAheadBuffer) {
+			b.wg.Wait()
+			fh.poolHandle.Free(b.buf)
+		}(b)
+	}
+	fh.readAheadBufs = nil
+	// whatever comes next isn't in order
+	fh.readAheadSum = nil
+}
+
+// Decide if this read should be served by readahead, switching to
+// readahead when we see a sequential read and away from it when we
+// don't.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) useReadAhead(fs *Goofys, offset int64) bool {
+	if fs.flags.ReadAheadSize <= 0 {
+		return false
+	}
+
+	if offset != fh.readBufOffset || offset == 0 {
+		if len(fh.readAheadBufs) != 0 {
+			fh.inode.logFuse("out of order read, shrinking readahead",
+				offset, fh.readBufOffset, fh.readAheadWindow)
+			fh.dropReadAhead()
+			fh.readAheadWindow /= 2
+		}
+		return false
+	}
+
+	if len(fh.readAheadBufs) == 0 {
+		// the streams got us here, take over from them
+		if fs.flags.VerifyChecksums {
+			fh.takeStreamChecksum(offset)
+		}
+		fh.closeStreams()
+
+		if fh.poolHandle == nil {
+			fh.poolHandle = fs.bufferPool.NewPoolHandle()
+		}
+
+		minWindow := int64(fs.flags.ReadAheadStreams) * MIN_READ_AHEAD_CHUNK
+		if fh.readAheadWindow < minWindow {
+			fh.readAheadWindow = minWindow
+		}
+	}
+
+	return true
+}
+
+// fh.mu is released while we wait for a GET, so other reads and
+// writes of the handle can go on. A read that gets to the buffer we
+// are waiting for first takes it, and we carry on from where we are.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) readFromReadAhead(fs *Goofys, offset int64, buf []byte) (bytesRead int, err error) {
+	for bytesRead < len(buf) {
+		pos := offset + int64(bytesRead)
+		if len(fh.readAheadBufs) != 0 {
+			if b := fh.readAheadBufs[0]; b.offset+int64(b.nRead) != pos {
+				// another read moved it elsewhere
+				fh.dropReadAhead()
+			}
+		}
+
+		fh.fillReadAhead(fs, pos)
+		if len(fh.readAheadBufs) == 0 {
+			// EOF
+			break
+		}
+
+		b := fh.readAheadBufs[0]
+		if b.offset+int64(b.nRead) != pos {
+			// filled by another read while we waited for memory
+			continue
+		}
+
+		fh.mu.Unlock()
+		b.wg.Wait()
+		fh.mu.Lock()
+
+		if fh.released {
+			break
+		}
+		if len(fh.readAheadBufs) == 0 || fh.readAheadBufs[0] != b ||
+			b.offset+int64(b.nRead) != pos {
+			// another read used or dropped it meanwhile
+			continue
+		}
+
+		if b.err != nil {
+			err = b.err
+			fh.dropReadAhead()
+			break
+		}
+
+		n := copy(buf[bytesRead:], b.buf[b.nRead:])
+		if fh.readAheadSum != nil {
+			fh.readAheadSum.h.Write(buf[bytesRead : bytesRead+n])
+		}
+		b.nRead += n
+		bytesRead += n
+
+		if b.nRead == len(b.buf) {
+			fh.poolHandle.Free(b.buf)
+			fh.readAheadBufs = fh.readAheadBufs[1:]
+
+			if sum := fh.readAheadSum; sum != nil &&
+				b.offset+int64(len(b.buf)) == int64(fh.inode.Attributes.Size) {
+				// that was the end
+				fh.readAheadSum = nil
+				if err = sum.verify(); err != nil {
+					// none of it is any good
+					bytesRead = 0
+					fh.dropReadAhead()
+					break
+				}
+			}
+
+			// still sequential, read further ahead next time
+			fh.readAheadWindow *= 2
+			if fh.readAheadWindow > fs.flags.ReadAheadSize {
+				fh.readAheadWindow = fs.flags.ReadAheadSize
+			}
+		}
+	}
+
+	fh.readDone(offset, bytesRead)
+	return
+}
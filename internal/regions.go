@@ -0,0 +1,146 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --multi-bucket the buckets can be in different regions. This
+// remembers which region each bucket is in, so finding out is one
+// GetBucketLocation the first time a bucket is looked up and nothing
+// after. Each bucket's Goofys then uses the client kept here for that
+// region, so its requests go there without being redirected. It gets
+// a copy with handlers of its own though, because the audit log and
+// Content-MD5 are installed per bucket.
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/jacobsa/fuse"
+)
+
+type regionClients struct {
+	awsConfig *aws.Config
+	flags     *FlagStorage
+
+	mu sync.Mutex
+	// GUARDED_BY(mu)
+	clients map[string]*s3.S3
+	// bucket to the region it's in
+	//
+	// GUARDED_BY(mu)
+	regions map[string]string
+}
+
+func newRegionClients(awsConfig *aws.Config, flags *FlagStorage) *regionClients {
+	return &regionClients{
+		awsConfig: awsConfig,
+		flags:     flags,
+		clients:   make(map[string]*s3.S3),
+		regions:   make(map[string]string),
+	}
+}
+
+// The client for region, made the first time it's asked for.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *regionClients) client(region string) *s3.S3 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	svc, ok := r.clients[region]
+	if !ok {
+		awsConfig := *r.awsConfig
+		awsConfig.Region = aws.String(region)
+		svc = s3.New(&awsConfig)
+		instrumentS3(svc)
+		r.clients[region] = svc
+	}
+	return svc
+}
+
+// A client for a bucket in region. It's the region's, except that
+// handlers installed on it don't end up on the other buckets'.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *regionClients) bucketClient(region string) *s3.S3 {
+	svc := r.client(region)
+	c := *svc.Client
+	c.Handlers = svc.Handlers.Copy()
+	return &s3.S3{Client: &c}
+}
+
+// Which region bucket is in. If the default region can't tell us,
+// S3 may say where the bucket is in the error, and we ask again from
+// there, the same as detectBucketRegion.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *regionClients) bucketRegion(bucket string) (region string, err error) {
+	r.mu.Lock()
+	region, ok := r.regions[bucket]
+	r.mu.Unlock()
+	if ok {
+		return
+	}
+
+	params := &s3.GetBucketLocationInput{Bucket: &bucket}
+	var resp *s3.GetBucketLocationOutput
+	getLocation := func(svc *s3.S3) error {
+		return retryWithFlags(r.flags, func() (err error) {
+			resp, err = svc.GetBucketLocation(params)
+			return
+		})
+	}
+
+	err = getLocation(r.client(*r.awsConfig.Region))
+	if err != nil {
+		_, region = parseRegionError(err)
+		if len(region) != 0 {
+			err = getLocation(r.client(region))
+		}
+	}
+	if err != nil {
+		if err = mapAwsError(err); err == syscall.ENXIO {
+			// NoSuchBucket
+			err = fuse.ENOENT
+		}
+		return "", err
+	}
+
+	region = locationRegion(resp.LocationConstraint)
+	r.setBucketRegion(bucket, region)
+	return
+}
+
+// The region a GetBucketLocation answer means. us-east-1 has no
+// LocationConstraint, and buckets made in eu-west-1 a long time ago
+// say EU.
+func locationRegion(constraint *string) string {
+	if constraint == nil || len(*constraint) == 0 {
+		return "us-east-1"
+	} else if *constraint == "EU" {
+		return "eu-west-1"
+	}
+	return *constraint
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *regionClients) setBucketRegion(bucket string, region string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.regions[bucket] = region
+}
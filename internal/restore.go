@@ -0,0 +1,72 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// Objects in GLACIER or DEEP_ARCHIVE can't be read until they are
+// restored. Reading one fails with ENODATA, or with --restore-days
+// the first read asks S3 to restore it and reads fail with EAGAIN
+// until the restored copy is there, which takes hours.
+
+import (
+	"log"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func isArchived(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "InvalidObjectState"
+	}
+	return false
+}
+
+// Reading inode failed because it's archived.
+func (inode *Inode) archived(fs *Goofys) (err error) {
+	if fs.flags.RestoreDays <= 0 {
+		log.Printf("%v is archived, it has to be restored before it can be read",
+			*inode.FullName)
+		return syscall.ENODATA
+	}
+
+	inode.mu.Lock()
+	restoring := inode.restoring
+	inode.restoring = true
+	inode.mu.Unlock()
+
+	if restoring {
+		return syscall.EAGAIN
+	}
+
+	params := &RestoreBlobInput{
+		Key:  *inode.FullName,
+		Days: fs.flags.RestoreDays,
+	}
+
+	err = fs.retry(func() error {
+		return fs.backend.RestoreBlob(context.Background(), params)
+	})
+	if err != nil {
+		inode.mu.Lock()
+		inode.restoring = false
+		inode.mu.Unlock()
+		return mapAwsError(err)
+	}
+
+	log.Printf("Restoring %v, it can be read once that's done", *inode.FullName)
+	return syscall.EAGAIN
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const RETRY_BASE_DELAY = 100 * time.Millisecond
+const RETRY_MAX_DELAY = 10 * time.Second
+
+// Returns true if err is worth retrying: server errors, throttling,
+// timeouts and connections that got reset under us.
+func isRetryable(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case 500, 503:
+			return true
+		}
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "RequestTimeout", "SlowDown", "Throttling", "ThrottlingException",
+			"RequestLimitExceeded", "InternalError":
+			return true
+		}
+
+		if awsErr.OrigErr() != nil {
+			return isRetryable(awsErr.OrigErr())
+		}
+		return false
+	}
+
+	if err == syscall.ETIMEDOUT {
+		// flags.RequestTimeout
+		return true
+	}
+
+	if opErr, ok := err.(*net.OpError); ok {
+		if opErr.Err == syscall.ECONNRESET || opErr.Timeout() {
+			return true
+		}
+		return isRetryable(opErr.Err)
+	}
+
+	if err != nil && strings.Contains(err.Error(), "connection reset by peer") {
+		return true
+	}
+
+	return false
+}
+
+func retryDelay(attempt int) time.Duration {
+	delay := RETRY_BASE_DELAY << uint(attempt)
+	if delay > RETRY_MAX_DELAY || delay <= 0 {
+		delay = RETRY_MAX_DELAY
+	}
+
+	// full jitter
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// Call fn until it succeeds, returns an error that's not worth
+// retrying, or we've tried flags.MaxRetries more times. fn should
+// return the raw error from the SDK so we can tell what happened.
+func (fs *Goofys) retry(fn func() error) (err error) {
+	return retryWithFlags(fs.flags, fn)
+}
+
+// fs.retry for when there's no Goofys, only flags.
+func retryWithFlags(flags *FlagStorage, fn func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !isRetryable(err) || attempt >= flags.MaxRetries {
+			return
+		}
+
+		delay := retryDelay(attempt)
+		if flags.DebugS3 {
+			log.Printf("retrying in %v after %v", delay, err)
+		}
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,613 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// The StorageBackend of S3, or of anything that speaks its protocol.
+// Requests go out through svc, which is fs.s3 except in tests, with
+// the encryption, ACL, Object Lock and tagging from the flags on
+// everything we write. Every request gives up after
+// flags.RequestTimeout, see cancel.go, except copies which take as
+// long as S3 takes to copy.
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type s3Backend struct {
+	fs  *Goofys
+	svc *s3.S3
+}
+
+var _ StorageBackend = &s3Backend{}
+
+// The status DeleteObject would have failed with, for the codes
+// DeleteObjects reports per key. The others are server errors.
+var DELETE_ERROR_STATUS = map[string]int{
+	"AccessDenied":     403,
+	"NoSuchKey":        404,
+	"OperationAborted": 409,
+	"SlowDown":         503,
+}
+
+// The CopySource that points at key. Unlike Key, it's sent as is so
+// it has to be URL encoded, and S3 takes + to mean a space.
+func (b *s3Backend) copySource(key string) *string {
+	segments := strings.Split(b.fs.bucket+"/"+key, "/")
+	for i, s := range segments {
+		segments[i] = strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+	}
+	return aws.String(strings.Join(segments, "/"))
+}
+
+// Copies take as long as S3 takes to copy, so unlike send there's no
+// flags.RequestTimeout.
+func (b *s3Backend) sendCopy(ctx context.Context, req *request.Request) error {
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+	return contextError(ctx, ctx, req.Send())
+}
+
+func setPreconditions(req *request.Request, ifMatch *string, ifNoneMatch *string) {
+	if ifMatch != nil {
+		req.HTTPRequest.Header.Set("If-Match", *ifMatch)
+	}
+	if ifNoneMatch != nil {
+		req.HTTPRequest.Header.Set("If-None-Match", *ifNoneMatch)
+	}
+}
+
+// The MD5 of an object's content, if its ETag is one. It isn't for
+// objects encrypted with KMS or a customer key, or uploaded in parts.
+func s3ContentMD5(etag *string, sse *string, sseCustomerAlgorithm *string) *string {
+	if etag == nil || sseCustomerAlgorithm != nil || (sse != nil && *sse == "aws:kms") {
+		return nil
+	}
+
+	sum := strings.Trim(*etag, "\"")
+	if len(sum) != 2*md5.Size {
+		// multipart ones look like md5-parts
+		return nil
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return nil
+	}
+	return aws.String(strings.ToLower(sum))
+}
+
+// The total size in a Content-Range like bytes 0-0/1234
+func contentRangeSize(contentRange string) (size int64, err error) {
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return 0, syscall.EINVAL
+	}
+	return strconv.ParseInt(contentRange[i+1:], 10, 64)
+}
+
+func (b *s3Backend) HeadBlob(ctx context.Context, param *HeadBlobInput) (*HeadBlobOutput, error) {
+	req, resp := b.svc.HeadObjectRequest(&s3.HeadObjectInput{
+		Bucket:    &b.fs.bucket,
+		Key:       &param.Key,
+		VersionId: param.VersionId,
+	})
+	err := b.fs.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	b.fs.logS3(resp)
+
+	return &HeadBlobOutput{
+		BlobItemOutput: BlobItemOutput{
+			Key:          param.Key,
+			ETag:         resp.ETag,
+			LastModified: aws.TimeValue(resp.LastModified),
+			Size:         aws.Int64Value(resp.ContentLength),
+			StorageClass: resp.StorageClass,
+		},
+		BlobProperties: BlobProperties{
+			Metadata:                resp.Metadata,
+			ContentType:             resp.ContentType,
+			CacheControl:            resp.CacheControl,
+			ContentDisposition:      resp.ContentDisposition,
+			ContentEncoding:         resp.ContentEncoding,
+			ContentLanguage:         resp.ContentLanguage,
+			WebsiteRedirectLocation: resp.WebsiteRedirectLocation,
+		},
+		ContentMD5: s3ContentMD5(resp.ETag, resp.ServerSideEncryption, resp.SSECustomerAlgorithm),
+	}, nil
+}
+
+// ctx and flags.RequestTimeout only apply until the response starts,
+// see sendStream.
+func (b *s3Backend) GetBlob(ctx context.Context, param *GetBlobInput) (*GetBlobOutput, error) {
+	params := &s3.GetObjectInput{
+		Bucket:    &b.fs.bucket,
+		Key:       &param.Key,
+		VersionId: param.VersionId,
+	}
+	if param.Start != 0 || param.Count != 0 {
+		bytes := fmt.Sprintf("bytes=%v-", param.Start)
+		if param.Count != 0 {
+			bytes += strconv.FormatInt(param.Start+param.Count-1, 10)
+		}
+		params.Range = &bytes
+	}
+
+	req, resp := b.svc.GetObjectRequest(params)
+	// otherwise net/http asks for gzip and quietly decompresses
+	// gzip objects, but only when there's no Range, so their size
+	// would depend on the offset
+	req.HTTPRequest.Header.Set("Accept-Encoding", "identity")
+	if param.IfRange != nil && params.Range != nil {
+		req.HTTPRequest.Header.Set("If-Range", *param.IfRange)
+	}
+	err := b.fs.sendStream(ctx, req, &resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	size := aws.Int64Value(resp.ContentLength)
+	if resp.ContentRange != nil {
+		size, err = contentRangeSize(*resp.ContentRange)
+		if err != nil {
+			log.Printf("%v: bad Content-Range %v", param.Key, *resp.ContentRange)
+			resp.Body.Close()
+			return nil, syscall.EIO
+		}
+	}
+
+	return &GetBlobOutput{
+		HeadBlobOutput: HeadBlobOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key:          param.Key,
+				ETag:         resp.ETag,
+				LastModified: aws.TimeValue(resp.LastModified),
+				Size:         size,
+				StorageClass: resp.StorageClass,
+			},
+			BlobProperties: BlobProperties{
+				Metadata:                resp.Metadata,
+				ContentType:             resp.ContentType,
+				CacheControl:            resp.CacheControl,
+				ContentDisposition:      resp.ContentDisposition,
+				ContentEncoding:         resp.ContentEncoding,
+				ContentLanguage:         resp.ContentLanguage,
+				WebsiteRedirectLocation: resp.WebsiteRedirectLocation,
+			},
+			ContentMD5: s3ContentMD5(resp.ETag, resp.ServerSideEncryption, resp.SSECustomerAlgorithm),
+		},
+		Body: resp.Body,
+	}, nil
+}
+
+func listOutput(prefixes []*s3.CommonPrefix, contents []*s3.Object, truncated *bool,
+	next *string) *ListBlobsOutput {
+
+	out := &ListBlobsOutput{
+		IsTruncated:           aws.BoolValue(truncated),
+		NextContinuationToken: next,
+	}
+	for _, p := range prefixes {
+		out.Prefixes = append(out.Prefixes, *p.Prefix)
+	}
+	for _, obj := range contents {
+		out.Items = append(out.Items, BlobItemOutput{
+			Key:          *obj.Key,
+			ETag:         obj.ETag,
+			LastModified: aws.TimeValue(obj.LastModified),
+			Size:         aws.Int64Value(obj.Size),
+			StorageClass: obj.StorageClass,
+		})
+	}
+	return out
+}
+
+// ListObjects, or ListObjectsV2 with flags.UseV2List. The
+// continuation token is the marker of the former.
+func (b *s3Backend) ListBlobs(ctx context.Context, param *ListBlobsInput) (*ListBlobsOutput, error) {
+	var delimiter *string
+	if len(param.Delimiter) != 0 {
+		delimiter = &param.Delimiter
+	}
+
+	if !b.fs.flags.UseV2List {
+		req, resp := b.svc.ListObjectsRequest(&s3.ListObjectsInput{
+			Bucket:    &b.fs.bucket,
+			Delimiter: delimiter,
+			MaxKeys:   param.MaxKeys,
+			Prefix:    &param.Prefix,
+			Marker:    param.ContinuationToken,
+		})
+		err := b.fs.send(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		b.fs.logS3(resp)
+
+		out := listOutput(resp.CommonPrefixes, resp.Contents, resp.IsTruncated, resp.NextMarker)
+		// NextMarker is only returned with a delimiter
+		if out.IsTruncated && out.NextContinuationToken == nil && len(resp.Contents) != 0 {
+			out.NextContinuationToken = resp.Contents[len(resp.Contents)-1].Key
+		}
+		return out, nil
+	}
+
+	req, resp := b.svc.ListObjectsV2Request(&s3.ListObjectsV2Input{
+		Bucket:            &b.fs.bucket,
+		Delimiter:         delimiter,
+		MaxKeys:           param.MaxKeys,
+		Prefix:            &param.Prefix,
+		ContinuationToken: param.ContinuationToken,
+	})
+	err := b.fs.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	b.fs.logS3(resp)
+
+	return listOutput(resp.CommonPrefixes, resp.Contents, resp.IsTruncated,
+		resp.NextContinuationToken), nil
+}
+
+func (b *s3Backend) PutBlob(ctx context.Context, param *PutBlobInput) (*PutBlobOutput, error) {
+	params := &s3.PutObjectInput{
+		Bucket:                    &b.fs.bucket,
+		Key:                       &param.Key,
+		Metadata:                  param.Metadata,
+		ContentType:               param.ContentType,
+		CacheControl:              param.CacheControl,
+		ContentDisposition:        param.ContentDisposition,
+		ContentEncoding:           param.ContentEncoding,
+		ContentLanguage:           param.ContentLanguage,
+		WebsiteRedirectLocation:   param.WebsiteRedirectLocation,
+		StorageClass:              param.StorageClass,
+		ServerSideEncryption:      b.fs.sseType(),
+		ObjectLockMode:            b.fs.objectLockMode(),
+		ObjectLockRetainUntilDate: b.fs.objectLockRetainUntil(),
+		SSEKMSKeyId:               b.fs.sseKMSKeyId(),
+		ACL:                       b.fs.acl(),
+		Tagging:                   b.fs.tagging(),
+	}
+	if param.Body != nil {
+		// a previous attempt may have read it
+		if _, err := param.Body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		params.Body = param.Body
+	}
+
+	req, resp := b.svc.PutObjectRequest(params)
+	setPreconditions(req, param.IfMatch, param.IfNoneMatch)
+	err := b.fs.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	b.fs.logS3(resp)
+
+	return &PutBlobOutput{ETag: resp.ETag}, nil
+}
+
+// A plain copy keeps the tags, unlike a multipart one.
+func (b *s3Backend) CopyBlob(ctx context.Context, param *CopyBlobInput) (*CopyBlobOutput, error) {
+	params := &s3.CopyObjectInput{
+		Bucket:                    &b.fs.bucket,
+		CopySource:                b.copySource(param.Source),
+		Key:                       &param.Destination,
+		MetadataDirective:         aws.String("COPY"),
+		StorageClass:              param.StorageClass,
+		ServerSideEncryption:      b.fs.sseType(),
+		ObjectLockMode:            b.fs.objectLockMode(),
+		ObjectLockRetainUntilDate: b.fs.objectLockRetainUntil(),
+		SSEKMSKeyId:               b.fs.sseKMSKeyId(),
+		ACL:                       b.fs.acl(),
+	}
+	if p := param.Properties; p != nil {
+		params.MetadataDirective = aws.String("REPLACE")
+		params.Metadata = p.Metadata
+		params.ContentType = p.ContentType
+		params.CacheControl = p.CacheControl
+		params.ContentDisposition = p.ContentDisposition
+		params.ContentEncoding = p.ContentEncoding
+		params.ContentLanguage = p.ContentLanguage
+		params.WebsiteRedirectLocation = p.WebsiteRedirectLocation
+	}
+
+	req, resp := b.svc.CopyObjectRequest(params)
+	err := b.sendCopy(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	b.fs.logS3(resp)
+
+	out := &CopyBlobOutput{}
+	if resp.CopyObjectResult != nil {
+		out.ETag = resp.CopyObjectResult.ETag
+	}
+	return out, nil
+}
+
+func (b *s3Backend) DeleteBlob(ctx context.Context, param *DeleteBlobInput) error {
+	req, resp := b.svc.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: &b.fs.bucket,
+		Key:    &param.Key,
+	})
+	err := b.fs.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	b.fs.logS3(resp)
+	return nil
+}
+
+// The errors are what DeleteObject of the key would have returned.
+// A key that's already gone is in there too, with NoSuchKey.
+func (b *s3Backend) DeleteBlobs(ctx context.Context, param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	objs := make([]*s3.ObjectIdentifier, len(param.Keys))
+	for i := range param.Keys {
+		objs[i] = &s3.ObjectIdentifier{Key: &param.Keys[i]}
+	}
+
+	req, resp := b.svc.DeleteObjectsRequest(&s3.DeleteObjectsInput{
+		Bucket: &b.fs.bucket,
+		Delete: &s3.Delete{
+			Objects: objs,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	err := b.fs.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	b.fs.logS3(resp)
+
+	out := &DeleteBlobsOutput{Errors: make(map[string]error)}
+	for _, e := range resp.Errors {
+		code := aws.StringValue(e.Code)
+		status, ok := DELETE_ERROR_STATUS[code]
+		if !ok {
+			status = 500
+		}
+		out.Errors[aws.StringValue(e.Key)] = awserr.NewRequestFailure(
+			awserr.New(code, aws.StringValue(e.Message), nil), status, "")
+	}
+	return out, nil
+}
+
+func (b *s3Backend) RestoreBlob(ctx context.Context, param *RestoreBlobInput) error {
+	req, resp := b.svc.RestoreObjectRequest(&s3.RestoreObjectInput{
+		Bucket: &b.fs.bucket,
+		Key:    &param.Key,
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(int64(param.Days)),
+		},
+	})
+	err := b.fs.send(ctx, req)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b.fs.logS3(resp)
+	return nil
+}
+
+func (b *s3Backend) MultipartBlobBegin(ctx context.Context, param *MultipartBlobBeginInput) (
+	*MultipartBlobBeginOutput, error) {
+
+	req, resp := b.svc.CreateMultipartUploadRequest(&s3.CreateMultipartUploadInput{
+		Bucket:                    &b.fs.bucket,
+		Key:                       &param.Key,
+		Metadata:                  param.Metadata,
+		ContentType:               param.ContentType,
+		CacheControl:              param.CacheControl,
+		ContentDisposition:        param.ContentDisposition,
+		ContentEncoding:           param.ContentEncoding,
+		ContentLanguage:           param.ContentLanguage,
+		WebsiteRedirectLocation:   param.WebsiteRedirectLocation,
+		StorageClass:              param.StorageClass,
+		ServerSideEncryption:      b.fs.sseType(),
+		ObjectLockMode:            b.fs.objectLockMode(),
+		ObjectLockRetainUntilDate: b.fs.objectLockRetainUntil(),
+		SSEKMSKeyId:               b.fs.sseKMSKeyId(),
+		ACL:                       b.fs.acl(),
+		Tagging:                   b.fs.tagging(),
+	})
+	err := b.fs.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	b.fs.logS3(resp)
+
+	return &MultipartBlobBeginOutput{UploadId: *resp.UploadId}, nil
+}
+
+func (b *s3Backend) MultipartBlobAdd(ctx context.Context, param *MultipartBlobAddInput) (
+	*MultipartBlobAddOutput, error) {
+
+	// a previous attempt may have read it
+	if _, err := param.Body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	params := &s3.UploadPartInput{
+		Bucket:     &b.fs.bucket,
+		Key:        &param.Key,
+		PartNumber: &param.PartNumber,
+		UploadId:   &param.UploadId,
+		Body:       param.Body,
+	}
+	b.fs.logS3(params)
+
+	req, resp := b.svc.UploadPartRequest(params)
+	err := b.fs.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultipartBlobAddOutput{ETag: resp.ETag}, nil
+}
+
+func (b *s3Backend) MultipartBlobCopy(ctx context.Context, param *MultipartBlobCopyInput) (
+	*MultipartBlobAddOutput, error) {
+
+	// XXX use CopySourceIfUnmodifiedSince to ensure that
+	// we are copying from the same object
+	params := &s3.UploadPartCopyInput{
+		Bucket:     &b.fs.bucket,
+		Key:        &param.Key,
+		CopySource: b.copySource(param.Source),
+		UploadId:   &param.UploadId,
+		CopySourceRange: aws.String(fmt.Sprintf("bytes=%v-%v",
+			param.Offset, param.Offset+param.Size-1)),
+		PartNumber: &param.PartNumber,
+	}
+	b.fs.logS3(params)
+
+	req, resp := b.svc.UploadPartCopyRequest(params)
+	err := b.sendCopy(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultipartBlobAddOutput{ETag: resp.CopyPartResult.ETag}, nil
+}
+
+func (b *s3Backend) MultipartBlobCommit(ctx context.Context, param *MultipartBlobCommitInput) (
+	*MultipartBlobCommitOutput, error) {
+
+	parts := make([]*s3.CompletedPart, len(param.ETags))
+	for i := range param.ETags {
+		parts[i] = &s3.CompletedPart{
+			ETag:       param.ETags[i],
+			PartNumber: aws.Int64(int64(i + 1)),
+		}
+	}
+
+	params := &s3.CompleteMultipartUploadInput{
+		Bucket:   &b.fs.bucket,
+		Key:      &param.Key,
+		UploadId: &param.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: parts,
+		},
+	}
+	b.fs.logS3(params)
+
+	req, resp := b.svc.CompleteMultipartUploadRequest(params)
+	setPreconditions(req, param.IfMatch, param.IfNoneMatch)
+	err := b.fs.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	b.fs.logS3(resp)
+
+	return &MultipartBlobCommitOutput{ETag: resp.ETag}, nil
+}
+
+func (b *s3Backend) MultipartBlobAbort(ctx context.Context, param *MultipartBlobAbortInput) error {
+	req, resp := b.svc.AbortMultipartUploadRequest(&s3.AbortMultipartUploadInput{
+		Bucket:   &b.fs.bucket,
+		Key:      &param.Key,
+		UploadId: &param.UploadId,
+	})
+	err := b.fs.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	b.fs.logS3(resp)
+	return nil
+}
+
+func (b *s3Backend) ListMultipartBlobs(ctx context.Context, param *ListMultipartBlobsInput) (
+	*ListMultipartBlobsOutput, error) {
+
+	params := &s3.ListMultipartUploadsInput{
+		Bucket: &b.fs.bucket,
+		Prefix: &param.Prefix,
+	}
+
+	out := &ListMultipartBlobsOutput{}
+	for {
+		req, resp := b.svc.ListMultipartUploadsRequest(params)
+		err := b.fs.send(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		b.fs.logS3(resp)
+
+		for _, upload := range resp.Uploads {
+			out.Uploads = append(out.Uploads, MultipartBlob{
+				Key:       *upload.Key,
+				UploadId:  *upload.UploadId,
+				Initiated: aws.TimeValue(upload.Initiated),
+			})
+		}
+
+		if !aws.BoolValue(resp.IsTruncated) {
+			return out, nil
+		}
+
+		params.KeyMarker = resp.NextKeyMarker
+		params.UploadIdMarker = resp.NextUploadIdMarker
+	}
+}
+
+func (b *s3Backend) ListMultipartBlobParts(ctx context.Context, param *ListMultipartBlobPartsInput) (
+	*ListMultipartBlobPartsOutput, error) {
+
+	params := &s3.ListPartsInput{
+		Bucket:   &b.fs.bucket,
+		Key:      &param.Key,
+		UploadId: &param.UploadId,
+	}
+
+	out := &ListMultipartBlobPartsOutput{}
+	for {
+		req, resp := b.svc.ListPartsRequest(params)
+		err := b.fs.send(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		b.fs.logS3(resp)
+
+		for _, part := range resp.Parts {
+			out.Parts = append(out.Parts, MultipartBlobPart{
+				PartNumber: *part.PartNumber,
+				ETag:       part.ETag,
+				Size:       aws.Int64Value(part.Size),
+			})
+		}
+
+		if !aws.BoolValue(resp.IsTruncated) {
+			return out, nil
+		}
+
+		params.PartNumberMarker = resp.NextPartNumberMarker
+	}
+}
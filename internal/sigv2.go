@@ -0,0 +1,182 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --signature-v2 requests are signed the way S3 did before
+// Signature V4, for stores like Riak CS that never learned V4. The
+// SDK's V2 signer is the query string kind that S3 doesn't take, so
+// this is the header kind:
+//
+//   Authorization: AWS <access key>:base64(hmac-sha1(secret, StringToSign))
+//
+// see http://docs.aws.amazon.com/AmazonS3/latest/dev/RESTAuthentication.html
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// query parameters that are part of the resource being signed
+var SIGV2_SUBRESOURCES = map[string]bool{
+	"acl":            true,
+	"delete":         true,
+	"lifecycle":      true,
+	"location":       true,
+	"logging":        true,
+	"notification":   true,
+	"partNumber":     true,
+	"policy":         true,
+	"requestPayment": true,
+	"restore":        true,
+	"tagging":        true,
+	"torrent":        true,
+	"uploadId":       true,
+	"uploads":        true,
+	"versionId":      true,
+	"versioning":     true,
+	"versions":       true,
+	"website":        true,
+
+	"response-cache-control":       true,
+	"response-content-disposition": true,
+	"response-content-encoding":    true,
+	"response-content-language":    true,
+	"response-content-type":        true,
+	"response-expires":             true,
+}
+
+// Replace the V4 signer of svc.
+func useSignatureV2(svc *s3.S3, bucket string) {
+	svc.Handlers.Sign.Clear()
+	svc.Handlers.Sign.PushBack(func(r *request.Request) {
+		signV2(r, bucket)
+	})
+}
+
+func signV2(r *request.Request, bucket string) {
+	creds, err := r.Config.Credentials.Get()
+	if err != nil {
+		r.Error = err
+		return
+	}
+	if len(creds.AccessKeyID) == 0 {
+		// anonymous
+		return
+	}
+
+	h := r.HTTPRequest.Header
+	h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	h.Del("X-Amz-Date")
+	if len(creds.SessionToken) != 0 {
+		h.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	mac := hmac.New(sha1.New, []byte(creds.SecretAccessKey))
+	mac.Write([]byte(stringToSignV2(r.HTTPRequest, bucket)))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	h.Set("Authorization", "AWS "+creds.AccessKeyID+":"+sig)
+}
+
+func stringToSignV2(req *http.Request, bucket string) string {
+	h := req.Header
+
+	var amzKeys []string
+	amz := make(map[string]string)
+	for k, v := range h {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			amzKeys = append(amzKeys, k)
+			values := make([]string, len(v))
+			for i := range v {
+				values[i] = strings.TrimSpace(v[i])
+			}
+			amz[k] = strings.Join(values, ",")
+		}
+	}
+	sort.Strings(amzKeys)
+
+	s := req.Method + "\n" +
+		h.Get("Content-MD5") + "\n" +
+		h.Get("Content-Type") + "\n" +
+		h.Get("Date") + "\n"
+	for _, k := range amzKeys {
+		s += k + ":" + amz[k] + "\n"
+	}
+
+	return s + canonicalResourceV2(req, bucket)
+}
+
+// The path of req including the bucket, plus the sub-resources
+// being asked for.
+func canonicalResourceV2(req *http.Request, bucket string) string {
+	u := req.URL
+
+	path := u.Opaque
+	if len(path) != 0 {
+		// the SDK puts the escaped path here as //host/path
+		path = strings.TrimPrefix(path, "//")
+		if i := strings.Index(path, "/"); i != -1 {
+			path = path[i:]
+		} else {
+			path = "/"
+		}
+	} else {
+		path = u.EscapedPath()
+	}
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	host := u.Host
+	if i := strings.Index(host, ":"); i != -1 {
+		host = host[:i]
+	}
+	if strings.HasPrefix(host, bucket+".") {
+		// virtual hosted
+		path = "/" + bucket + path
+	}
+
+	query := u.Query()
+	var keys []string
+	for k := range query {
+		if SIGV2_SUBRESOURCES[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if i == 0 {
+			path += "?"
+		} else {
+			path += "&"
+		}
+		path += k
+		if v := query.Get(k); len(v) != 0 {
+			path += "=" + v
+		}
+	}
+
+	return path
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// How many inodes and handles we are keeping, to tell a mount that
+// grows because the kernel never forgets or releases from one that
+// leaks. Served as JSON on /debug/inodes of --metrics-addr.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// how many of the inodes with the most references we list
+const INODE_STATS_TOP = 20
+
+type InodeRefs struct {
+	Id   uint64 `json:"id"`
+	Name string `json:"name"`
+	Refs uint64 `json:"refs"`
+}
+
+type byRefs []InodeRefs
+
+func (p byRefs) Len() int           { return len(p) }
+func (p byRefs) Less(i, j int) bool { return p[i].Refs > p[j].Refs }
+func (p byRefs) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type InodeStats struct {
+	Inodes      int `json:"inodes"`
+	CachedNames int `json:"cached_names"`
+	DirHandles  int `json:"dir_handles"`
+	FileHandles int `json:"file_handles"`
+	// the kernel's references to all the inodes
+	Refs           uint64      `json:"refs"`
+	MostReferenced []InodeRefs `json:"most_referenced"`
+	// what checkInvariants found, if anything
+	InvariantError string `json:"invariant_error,omitempty"`
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Goofys) InodeStats() (stats InodeStats) {
+	if err := fs.checkInvariants(); err != nil {
+		stats.InvariantError = err.Error()
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	stats.Inodes = len(fs.inodes)
+	stats.CachedNames = len(fs.inodesCache)
+	stats.DirHandles = len(fs.dirHandles)
+	stats.FileHandles = len(fs.fileHandles)
+
+	refs := make([]InodeRefs, 0, len(fs.inodes))
+	for id, inode := range fs.inodes {
+		inode.mu.Lock()
+		refcnt := inode.refcnt
+		inode.mu.Unlock()
+
+		stats.Refs += refcnt
+		refs = append(refs, InodeRefs{uint64(id), *inode.FullName, refcnt})
+	}
+
+	sort.Sort(byRefs(refs))
+	if len(refs) > INODE_STATS_TOP {
+		refs = refs[:INODE_STATS_TOP]
+	}
+	stats.MostReferenced = refs
+	return
+}
+
+// See Goofys.InodeStats, the buckets' are added up. The IDs are the
+// ones the kernel sees.
+func (m *MultiBucket) InodeStats() (stats InodeStats) {
+	m.mu.Lock()
+	stats.DirHandles = len(m.dirHandles)
+	m.mu.Unlock()
+
+	for i, fs := range m.mountedBuckets() {
+		s := fs.InodeStats()
+		stats.Inodes += s.Inodes
+		stats.CachedNames += s.CachedNames
+		stats.DirHandles += s.DirHandles
+		stats.FileHandles += s.FileHandles
+		stats.Refs += s.Refs
+		for _, r := range s.MostReferenced {
+			r.Id = multiBucketID(uint64(i+1), r.Id)
+			r.Name = fs.bucket + "/" + r.Name
+			stats.MostReferenced = append(stats.MostReferenced, r)
+		}
+		if s.InvariantError != "" && stats.InvariantError == "" {
+			stats.InvariantError = fs.bucket + ": " + s.InvariantError
+		}
+	}
+
+	sort.Sort(byRefs(stats.MostReferenced))
+	if len(stats.MostReferenced) > INODE_STATS_TOP {
+		stats.MostReferenced = stats.MostReferenced[:INODE_STATS_TOP]
+	}
+	return
+}
+
+func serveInodeStats(fs FileSystem) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(fs.InodeStats())
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// --storage-class-rules picks the storage class of what we write by
+// its key, like logs/*=STANDARD_IA,*.tmp=REDUCED_REDUNDANCY. Patterns
+// are path.Match globs. One with a / is matched against the full key,
+// --prefix included, one without is matched against the name at any
+// depth, so *.tmp is every .tmp file and not only those at the top. A
+// pattern that matches a directory covers everything under it, so
+// logs/* and logs both mean all of logs/, and logs also any other
+// directory called logs. The first rule that matches wins, keys no
+// rule matches get --storage-class.
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+var STORAGE_CLASSES = []string{
+	"STANDARD",
+	"REDUCED_REDUNDANCY",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER",
+	"DEEP_ARCHIVE",
+}
+
+type storageClassRule struct {
+	pattern      string
+	storageClass string
+}
+
+func validateStorageClass(storageClass string) error {
+	for _, c := range STORAGE_CLASSES {
+		if storageClass == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown storage class %q", storageClass)
+}
+
+// rules is a comma separated list of pattern=class
+func parseStorageClassRules(rules string) (parsed []storageClassRule, err error) {
+	for _, r := range strings.Split(rules, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		i := strings.LastIndex(r, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q is not pattern=class", r)
+		}
+		pattern := strings.TrimSuffix(r[:i], "/")
+		storageClass := strings.ToUpper(strings.TrimSpace(r[i+1:]))
+
+		if _, err = path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%q: %v", pattern, err)
+		}
+		if err = validateStorageClass(storageClass); err != nil {
+			return
+		}
+
+		parsed = append(parsed, storageClassRule{pattern, storageClass})
+	}
+	return
+}
+
+// Whether the rule covers key or a directory key is in.
+func (r *storageClassRule) matches(key string) bool {
+	key = strings.TrimSuffix(key, "/")
+	anyDepth := !strings.Contains(r.pattern, "/")
+	for {
+		name := key
+		if anyDepth {
+			name = path.Base(key)
+		}
+		if ok, _ := path.Match(r.pattern, name); ok {
+			return true
+		}
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			return false
+		}
+		key = key[:i]
+	}
+}
+
+// The storage class to write key with.
+func (fs *Goofys) storageClass(key string) *string {
+	for i := range fs.storageClassRules {
+		if fs.storageClassRules[i].matches(key) {
+			return &fs.storageClassRules[i].storageClass
+		}
+	}
+	return &fs.flags.StorageClass
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// A handle keeps a few GETs open for reading, each at its own place
+// in the file. A read continues whichever stream is close enough to
+// where it starts and opens another one if none is, so readers at
+// different offsets, like the kernel's parallel reads or a program
+// with several threads, each get a stream rather than taking turns
+// closing and reopening one. A stream is used by one read at a time
+// and is read without holding fh.mu.
+
+import (
+	"io"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Reads that jump back or ahead by less than this are served without
+// reopening the stream
+const READ_REORDER_WINDOW = 128 * 1024
+
+// How many streams a handle keeps open, the least recently used one
+// is closed to make room
+const MAX_READ_STREAMS = 4
+
+type readStream struct {
+	// nil once it's hit the end or failed
+	body io.ReadCloser
+	// where the next byte from body is in the file
+	offset int64
+	// the last READ_REORDER_WINDOW bytes read from body, ending
+	// at offset
+	recent []byte
+
+	// GUARDED_BY(fh.mu)
+	busy     bool
+	lastUsed time.Time
+}
+
+func (s *readStream) close() {
+	if s.body != nil {
+		s.body.Close()
+		s.body = nil
+	}
+}
+
+func (s *readStream) remember(data []byte) {
+	if len(data) >= READ_REORDER_WINDOW {
+		s.recent = append(s.recent[:0], data[len(data)-READ_REORDER_WINDOW:]...)
+		return
+	}
+
+	if excess := len(s.recent) + len(data) - READ_REORDER_WINDOW; excess > 0 {
+		n := copy(s.recent, s.recent[excess:])
+		s.recent = s.recent[:n]
+	}
+	s.recent = append(s.recent, data...)
+}
+
+// Whether a read at offset can continue this stream.
+func (s *readStream) covers(offset int64) bool {
+	return s.body != nil && offset >= s.offset-int64(len(s.recent)) &&
+		offset <= s.offset+READ_REORDER_WINDOW
+}
+
+// Read at offset, which has to be covered. The stream is closed if
+// this hits the end or fails.
+func (s *readStream) read(ctx context.Context, offset int64, buf []byte) (bytesRead int, err error) {
+	defer func() {
+		if err != nil {
+			s.close()
+			if err == syscall.EIO {
+				// the checksum didn't match, none of
+				// it is any good
+				bytesRead = 0
+			} else if err != io.EOF && ctx.Err() != nil {
+				err = syscall.EINTR
+			}
+		}
+	}()
+
+	if body, ok := s.body.(interruptible); ok {
+		defer whenDone(ctx, body.interrupt)()
+	}
+
+	if offset < s.offset {
+		// we've just read past this
+		start := len(s.recent) - int(s.offset-offset)
+		bytesRead = copy(buf, s.recent[start:])
+		buf = buf[bytesRead:]
+		if len(buf) == 0 {
+			return
+		}
+	} else if offset > s.offset {
+		// cheaper to read through the gap than to reopen
+		skip := make([]byte, offset-s.offset)
+		var n int
+		n, err = tryReadAll(s.body, skip)
+		s.remember(skip[:n])
+		s.offset += int64(n)
+		if err != nil {
+			return
+		}
+	}
+
+	n, err := tryReadAll(s.body, buf)
+	s.remember(buf[:n])
+	s.offset += int64(n)
+	bytesRead += n
+	return
+}
+
+// Find an idle stream that can serve a read at offset, and mark it
+// busy. One that's right at offset is best.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) findStream(offset int64) (s *readStream) {
+	for _, c := range fh.streams {
+		if c.busy || !c.covers(offset) {
+			continue
+		}
+		if s == nil || c.offset == offset {
+			s = c
+		}
+	}
+
+	if s != nil {
+		s.busy = true
+	} else if len(fh.streams) != 0 {
+		fh.inode.logFuse("no stream near", offset)
+	}
+	return
+}
+
+// Start a stream at offset, which is busy until it's given to
+// doneWithStream. With fh.gunzip the stream may end before offset.
+//
+// LOCKS_EXCLUDED(fh.mu)
+func (fh *FileHandle) openStream(ctx context.Context, fs *Goofys, offset int64) (s *readStream, err error) {
+	if fh.gunzip {
+		var body *gunzipBody
+		body, err = fh.openGunzip(ctx, fs, offset)
+		if err != nil {
+			return
+		}
+		return &readStream{body: body, offset: body.n, busy: true}, nil
+	}
+
+	resp, err := fh.getObject(ctx, fs, offset, 0)
+	if err != nil {
+		return
+	}
+
+	if offset == 0 && fs.flags.VerifyChecksums {
+		fh.verifyBody(resp)
+	}
+	return &readStream{body: resp.Body, offset: offset, busy: true}, nil
+}
+
+// A read is done with s, which is added to the handle if it's new.
+// If there are too many streams now the least recently used idle
+// one is closed.
+//
+// LOCKS_EXCLUDED(fh.mu)
+func (fh *FileHandle) doneWithStream(s *readStream, isNew bool) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	s.busy = false
+	s.lastUsed = time.Now()
+
+	if isNew && s.body != nil {
+		fh.streams = append(fh.streams, s)
+	}
+
+	// forget the ones that are closed, and the least recently used
+	// if there are still too many
+	for {
+		var lru *readStream
+		streams := fh.streams[:0]
+		for _, c := range fh.streams {
+			if c.body == nil && !c.busy {
+				continue
+			}
+			streams = append(streams, c)
+			if !c.busy && (lru == nil || c.lastUsed.Before(lru.lastUsed)) {
+				lru = c
+			}
+		}
+		fh.streams = streams
+
+		if len(fh.streams) <= MAX_READ_STREAMS || lru == nil {
+			return
+		}
+		lru.close()
+	}
+}
+
+// Close the streams no read is using.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) closeStreams() {
+	streams := fh.streams[:0]
+	for _, s := range fh.streams {
+		if s.busy {
+			streams = append(streams, s)
+		} else {
+			s.close()
+		}
+	}
+	fh.streams = streams
+}
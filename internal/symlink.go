@@ -0,0 +1,150 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// A symlink is stored as an empty object with the target in the
+// x-amz-meta-symlink-target header and a content type of
+// application/x-goofys-symlink. Other mounts depend on this, so don't
+// change either of them. Looking them up always finds out, listing a
+// directory only does with --list-symlinks since it costs a HEAD per
+// empty object.
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const SYMLINK_META = "symlink-target"
+const SYMLINK_CONTENT_TYPE = "application/x-goofys-symlink"
+const SYMLINK_MODE = os.ModeSymlink | 0777
+
+// Returns the symlink target if metadata says this is a symlink.
+func symlinkTarget(metadata map[string]*string) *string {
+	return metadataValue(metadata, SYMLINK_META)
+}
+
+func (parent *Inode) CreateSymlink(
+	fs *Goofys,
+	name string,
+	target string) (inode *Inode, err error) {
+
+	parent.logFuse("CreateSymlink", name, target)
+
+	fullName := parent.getChildName(name)
+
+	params := &PutBlobInput{
+		Key: fullName,
+		BlobProperties: BlobProperties{
+			ContentType: aws.String(SYMLINK_CONTENT_TYPE),
+			Metadata:    map[string]*string{SYMLINK_META: &target},
+		},
+		StorageClass: fs.storageClass(fullName),
+	}
+
+	_, err = fs.backend.PutBlob(context.Background(), params)
+	if err != nil {
+		err = mapAwsError(err)
+		return
+	}
+
+	parent.mu.Lock()
+	parent.invalidateDir(fs)
+	parent.mu.Unlock()
+
+	now := time.Now()
+	inode = NewInode(&name, &fullName, parent.flags)
+	inode.Attributes = &fuseops.InodeAttributes{
+		Size:   uint64(len(target)),
+		Nlink:  1,
+		Mode:   SYMLINK_MODE,
+		Atime:  now,
+		Mtime:  now,
+		Ctime:  now,
+		Crtime: now,
+		Uid:    fs.flags.Uid,
+		Gid:    fs.flags.Gid,
+	}
+	inode.SymlinkTarget = &target
+	inode.attrTime = now
+
+	return
+}
+
+func (inode *Inode) ReadSymlink(fs *Goofys) (target string, err error) {
+	inode.logFuse("ReadSymlink")
+
+	if inode.SymlinkTarget != nil {
+		return *inode.SymlinkTarget, nil
+	}
+
+	params := &HeadBlobInput{Key: *inode.FullName, VersionId: inode.VersionId}
+
+	var resp *HeadBlobOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.HeadBlob(context.Background(), params)
+		return
+	})
+	if err != nil {
+		return "", mapAwsError(err)
+	}
+
+	t := symlinkTarget(resp.Metadata)
+	if t == nil {
+		return "", fuse.EINVAL
+	}
+
+	inode.SymlinkTarget = t
+	return *t, nil
+}
+
+// Symlinks look like empty files in a listing and a listing doesn't
+// include metadata, so HEAD the objects under prefix to find out,
+// with at most flags.MaxParallelCopy HEADs in flight. Returns name ->
+// metadata, objects we failed to HEAD are left out.
+func (fs *Goofys) headObjects(prefix string, names []string) (metadata map[string]map[string]*string) {
+	var mu sync.Mutex
+
+	metadata = make(map[string]map[string]*string)
+
+	fs.forEachKey(names, func(name string) error {
+		params := &HeadBlobInput{Key: prefix + name}
+
+		var resp *HeadBlobOutput
+		err := fs.retry(func() (err error) {
+			resp, err = fs.backend.HeadBlob(context.Background(), params)
+			return
+		})
+		if err != nil {
+			// we'll go with what the listing said, and
+			// keep going with the others
+			return nil
+		}
+
+		mu.Lock()
+		metadata[name] = resp.Metadata
+		mu.Unlock()
+		return nil
+	})
+
+	return
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// Uploads from every file being written share the request rate S3
+// gives us. When S3 tells us to slow down we halve how many uploads
+// are allowed in flight, and every limit uploads that go through
+// without being throttled we allow one more, up to what the buffer
+// pool could keep busy anyway.
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Losing a part loses the whole file, so throttling gets more
+// patience than flags.MaxRetries
+const UPLOAD_MAX_THROTTLED = 10
+
+func isThrottled(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 503 {
+		return true
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded":
+			return true
+		}
+	}
+
+	return false
+}
+
+type uploadLimiter struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	max      int
+	limit    int
+	inFlight int
+	// uploads that went through since the limit last changed
+	successes int
+
+	debug bool
+}
+
+func newUploadLimiter(max int, debug bool) *uploadLimiter {
+	l := &uploadLimiter{max: max, limit: max, debug: debug}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *uploadLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.inFlight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+}
+
+func (l *uploadLimiter) release(throttled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+
+	if throttled {
+		if l.limit > 1 {
+			l.limit /= 2
+			l.successes = 0
+			if l.debug {
+				log.Printf("throttled, allowing %v uploads in flight", l.limit)
+			}
+		}
+	} else {
+		l.successes++
+		if l.successes >= l.limit && l.limit < l.max {
+			l.limit++
+			l.successes = 0
+			if l.debug {
+				log.Printf("allowing %v uploads in flight", l.limit)
+			}
+		}
+	}
+
+	l.cond.Broadcast()
+}
+
+// Like retry, for uploads that go through fs.uploads.
+func (fs *Goofys) retryUpload(fn func() error) (err error) {
+	throttled := 0
+
+	for attempt := 0; ; attempt++ {
+		fs.uploads.acquire()
+		err = fn()
+		fs.uploads.release(isThrottled(err))
+
+		if err == nil || !isRetryable(err) {
+			return
+		}
+
+		if isThrottled(err) {
+			throttled++
+			if throttled > UPLOAD_MAX_THROTTLED {
+				return
+			}
+		} else if attempt-throttled >= fs.flags.MaxRetries {
+			return
+		}
+
+		delay := retryDelay(attempt)
+		if fs.flags.DebugS3 {
+			log.Printf("retrying upload in %v after %v", delay, err)
+		}
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// Writes that crashed or were interrupted leave multipart uploads
+// behind, and S3 charges for their parts until they are aborted.
+// FlushFile only aborts its own upload when it fails, anything else
+// has to be cleaned up here.
+//
+// The other way around, an upload can disappear while we write it:
+// it's aborted by a cleanup elsewhere, or it's completed by a
+// CompleteMultipartUpload whose response we never got, so the retry
+// finds it gone. The second isn't a failure, see completedAnyway. The
+// first is, the parts we uploaded went with it and we don't keep
+// their buffers to upload them again, so the write fails with
+// ECANCELED rather than looking like the file is missing.
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/jacobsa/fuse"
+)
+
+// Abort the multipart uploads under the mount that were started more
+// than olderThan ago, except the ones we are still writing. Returns
+// how many were aborted and how big their parts were.
+func (fs *Goofys) CleanupUploads(olderThan time.Duration) (aborted int, size int64, err error) {
+	prefix := fs.flags.Prefix
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+
+	var handles []*FileHandle
+	fs.mu.Lock()
+	for _, fh := range fs.fileHandles {
+		handles = append(handles, fh)
+	}
+	fs.mu.Unlock()
+
+	ours := make(map[string]bool)
+	for _, fh := range handles {
+		fh.mu.Lock()
+		if fh.mpuId != nil {
+			ours[*fh.mpuId] = true
+		}
+		fh.mu.Unlock()
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+
+	var resp *ListMultipartBlobsOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.ListMultipartBlobs(context.Background(),
+			&ListMultipartBlobsInput{Prefix: prefix})
+		return
+	})
+	if err != nil {
+		return aborted, size, mapAwsError(err)
+	}
+
+	for _, upload := range resp.Uploads {
+		if ours[upload.UploadId] || upload.Initiated.After(cutoff) {
+			continue
+		}
+
+		// abort it even if we can't tell how big it is
+		partsSize, _ := fs.uploadSize(upload)
+
+		params := &MultipartBlobAbortInput{Key: upload.Key, UploadId: upload.UploadId}
+		err = fs.retry(func() error {
+			return fs.backend.MultipartBlobAbort(context.Background(), params)
+		})
+		if err != nil {
+			err = mapAwsError(err)
+			if err == fuse.ENOENT {
+				// someone else finished or aborted it
+				err = nil
+				continue
+			}
+			return
+		}
+
+		aborted++
+		size += partsSize
+	}
+	return
+}
+
+// The size of the parts that have been uploaded so far.
+func (fs *Goofys) uploadSize(upload MultipartBlob) (size int64, err error) {
+	params := &ListMultipartBlobPartsInput{
+		Key:      upload.Key,
+		UploadId: upload.UploadId,
+	}
+
+	var resp *ListMultipartBlobPartsOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.ListMultipartBlobParts(context.Background(), params)
+		return
+	})
+	if err != nil {
+		return 0, mapAwsError(err)
+	}
+
+	for _, part := range resp.Parts {
+		size += part.Size
+	}
+	return
+}
+
+// How many handles FlushAll completes at once
+const FLUSH_ALL_PARALLEL = 16
+
+// Complete the uploads of every handle that has writes, so a
+// shutdown doesn't wait for the kernel to close them one at a time or
+// lose them if it never does. A failed flush doesn't stop the others,
+// the first error is returned after all of them are done.
+func (fs *Goofys) FlushAll() (flushed int, err error) {
+	var handles []*FileHandle
+	fs.mu.Lock()
+	for _, fh := range fs.fileHandles {
+		handles = append(handles, fh)
+	}
+	fs.mu.Unlock()
+
+	var dirty []*FileHandle
+	for _, fh := range handles {
+		fh.mu.Lock()
+		if fh.dirty {
+			dirty = append(dirty, fh)
+		}
+		fh.mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	work := make(chan *FileHandle)
+
+	for i := 0; i < FLUSH_ALL_PARALLEL && i < len(dirty); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for fh := range work {
+				flushErr := fh.FlushFile(fs)
+				if flushErr != nil {
+					log.Printf("Unable to flush %v: %v", *fh.inode.FullName, flushErr)
+				}
+
+				mu.Lock()
+				if flushErr != nil {
+					if err == nil {
+						err = flushErr
+					}
+				} else {
+					flushed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, fh := range dirty {
+		work <- fh
+	}
+	close(work)
+	wg.Wait()
+
+	return
+}
+
+// mapAwsError for writing to an upload of ours, which if it's gone
+// took the parts we uploaded with it. Anywhere else a missing upload
+// is just missing.
+func mapUploadError(err error) error {
+	if isNoSuchUpload(err) {
+		return syscall.ECANCELED
+	}
+	return mapAwsError(err)
+}
+
+func isNoSuchUpload(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "NoSuchUpload"
+	}
+	return false
+}
+
+// The ETag S3 gives an object made from parts with these ETags, the
+// MD5 of their MD5s and how many there are. ok is false if one of
+// them isn't an MD5, like with SSE-KMS.
+func multipartETag(etags []*string) (etag string, ok bool) {
+	h := md5.New()
+	for _, e := range etags {
+		if e == nil {
+			return
+		}
+		sum, err := hex.DecodeString(strings.Trim(*e, "\""))
+		if err != nil || len(sum) != md5.Size {
+			return
+		}
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%x-%v", h.Sum(nil), len(etags)), true
+}
+
+// CompleteMultipartUpload said there's no such upload. If the key is
+// what the upload would have made, an earlier attempt completed it
+// and we just didn't hear back.
+func (fh *FileHandle) completedAnyway(fs *Goofys, etags []*string) (etag *string, ok bool) {
+
+	expected, ok := multipartETag(etags)
+	if !ok {
+		return nil, false
+	}
+
+	params := &HeadBlobInput{Key: *fh.inode.FullName}
+	var resp *HeadBlobOutput
+	err := fs.retry(func() (err error) {
+		resp, err = fs.backend.HeadBlob(context.Background(), params)
+		return
+	})
+	if err != nil || resp.ETag == nil || strings.Trim(*resp.ETag, "\"") != expected {
+		log.Printf("%v: multipart upload %v is gone, the write is lost",
+			*fh.inode.FullName, *fh.mpuId)
+		return nil, false
+	}
+
+	fh.inode.logFuse("completed anyway", expected)
+	return resp.ETag, true
+}
@@ -0,0 +1,159 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --usage-refresh, StatFS reports how much is stored under the
+// mount instead of pretending it's all free. The numbers come from
+// listing everything every flags.UsageRefresh. For small mounts we
+// also remember the size of every key, so that what ReadDir and
+// Unlink see between scans is reflected right away; for big mounts
+// that would take too much memory and we only have the totals from
+// the last scan.
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const USAGE_MAX_KEYS = 100000
+
+type usageStats struct {
+	mu sync.Mutex
+
+	bytes   uint64
+	objects uint64
+
+	// nil if there are too many keys to keep track of
+	sizes map[string]uint64
+}
+
+func newUsageStats() *usageStats {
+	return &usageStats{sizes: make(map[string]uint64)}
+}
+
+func (u *usageStats) get() (bytes uint64, objects uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.bytes, u.objects
+}
+
+// We've just seen key with size.
+func (u *usageStats) update(key string, size uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.sizes == nil {
+		return
+	}
+
+	old, ok := u.sizes[key]
+	if ok {
+		u.bytes -= old
+	} else {
+		if len(u.sizes) >= USAGE_MAX_KEYS {
+			// wait for the next scan
+			return
+		}
+		u.objects++
+	}
+
+	u.sizes[key] = size
+	u.bytes += size
+}
+
+func (u *usageStats) forget(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.sizes == nil {
+		return
+	}
+
+	if old, ok := u.sizes[key]; ok {
+		delete(u.sizes, key)
+		u.bytes -= old
+		u.objects--
+	}
+}
+
+func (u *usageStats) replace(bytes uint64, objects uint64, sizes map[string]uint64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.bytes = bytes
+	u.objects = objects
+	u.sizes = sizes
+}
+
+// List everything under the mount and add it up.
+func (fs *Goofys) scanUsage() (err error) {
+	var bytes, objects uint64
+	sizes := make(map[string]uint64)
+
+	prefix := fs.flags.Prefix
+	if len(prefix) != 0 {
+		prefix += "/"
+	}
+
+	params := &ListBlobsInput{Prefix: prefix}
+
+	for {
+		var resp *ListBlobsOutput
+		err = fs.retry(func() (err error) {
+			resp, err = fs.backend.ListBlobs(context.Background(), params)
+			return
+		})
+		if err != nil {
+			return mapAwsError(err)
+		}
+
+		for _, obj := range resp.Items {
+			bytes += uint64(obj.Size)
+			objects++
+
+			if sizes != nil {
+				if len(sizes) >= USAGE_MAX_KEYS {
+					sizes = nil
+				} else {
+					sizes[obj.Key] = uint64(obj.Size)
+				}
+			}
+		}
+
+		if !resp.IsTruncated || resp.NextContinuationToken == nil {
+			break
+		}
+
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+
+	fs.usage.replace(bytes, objects, sizes)
+	return
+}
+
+func (fs *Goofys) refreshUsage() {
+	for {
+		err := fs.scanUsage()
+		if err != nil {
+			log.Printf("Unable to compute usage: %v", err)
+		}
+
+		time.Sleep(fs.flags.UsageRefresh)
+	}
+}
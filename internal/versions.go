@@ -0,0 +1,62 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --versions, file@version=<id> is version <id> of file in a
+// versioned bucket. It doesn't show up in listings, it has to be
+// looked up by name, and it can only be read.
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const VERSION_SEPARATOR = "@version="
+
+// file@version=id to file and id, id is empty if name is not a
+// version
+func splitVersion(name string) (base string, version string) {
+	i := strings.LastIndex(name, VERSION_SEPARATOR)
+	if i <= 0 {
+		return name, ""
+	}
+	return name[:i], name[i+len(VERSION_SEPARATOR):]
+}
+
+func (parent *Inode) lookUpVersion(ctx context.Context, fs *Goofys, name string,
+	base string, version string) (inode *Inode, err error) {
+
+	fullName := parent.getChildName(base)
+	params := &HeadBlobInput{
+		Key:       fullName,
+		VersionId: &version,
+	}
+
+	var resp *HeadBlobOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.HeadBlob(ctx, params)
+		return
+	})
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	inode = NewInode(&name, &fullName, fs.flags)
+	inode.VersionId = &version
+	inode.fillAttributes(fs, resp)
+	inode.Attributes.Mode &^= 0222
+	return
+}
@@ -0,0 +1,301 @@
+// Copyright 2015 Ka-Hing Cheung
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// With --xattr, user.foo is stored in x-amz-meta-foo. Header values
+// have to be printable, so anything else is base64 encoded and
+// marked with XATTR_BASE64_PREFIX. Like attributes, changing one
+// means copying the object onto itself, unless the file is being
+// written in which case it goes with the upload.
+
+import (
+	"encoding/base64"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/jacobsa/fuse"
+)
+
+const XATTR_NAMESPACE = "user."
+const XATTR_BASE64_PREFIX = "base64:"
+
+// S3 limits the size of all the user metadata, keys included
+const METADATA_MAX_SIZE = 2 * 1024
+
+// flags to setxattr(2)
+const XATTR_CREATE = 1
+const XATTR_REPLACE = 2
+
+// metadata that goofys uses itself
+var RESERVED_METADATA = map[string]bool{
+	SYMLINK_META: true,
+	MODE_META:    true,
+	UID_META:     true,
+	GID_META:     true,
+	MTIME_META:   true,
+}
+
+func xattrToMetadataKey(name string) (key string, err error) {
+	if !strings.HasPrefix(name, XATTR_NAMESPACE) {
+		// security.*, system.*, trusted.* can't be stored
+		return "", syscall.ENOTSUP
+	}
+
+	key = strings.ToLower(name[len(XATTR_NAMESPACE):])
+	if len(key) == 0 {
+		return "", syscall.EINVAL
+	}
+	return
+}
+
+func encodeXattr(value []byte) string {
+	printable := !strings.HasPrefix(string(value), XATTR_BASE64_PREFIX)
+	for _, c := range value {
+		if c < ' ' || c > '~' {
+			printable = false
+			break
+		}
+	}
+
+	if printable {
+		return string(value)
+	}
+	return XATTR_BASE64_PREFIX + base64.StdEncoding.EncodeToString(value)
+}
+
+func decodeXattr(value string) []byte {
+	if strings.HasPrefix(value, XATTR_BASE64_PREFIX) {
+		buf, err := base64.StdEncoding.DecodeString(value[len(XATTR_BASE64_PREFIX):])
+		if err == nil {
+			return buf
+		}
+	}
+	return []byte(value)
+}
+
+func metadataSize(metadata map[string]*string) (size int) {
+	for k, v := range metadata {
+		size += len(k) + len(*v)
+	}
+	return
+}
+
+// The object's metadata, HEADing it if we haven't already.
+func (inode *Inode) getUserMetadata(fs *Goofys) (metadata map[string]*string, err error) {
+	inode.mu.Lock()
+	metadata = inode.userMetadata
+	inode.mu.Unlock()
+
+	if metadata != nil {
+		return
+	}
+
+	params := &HeadBlobInput{Key: *inode.FullName, VersionId: inode.VersionId}
+
+	var resp *HeadBlobOutput
+	err = fs.retry(func() (err error) {
+		resp, err = fs.backend.HeadBlob(context.Background(), params)
+		return
+	})
+
+	metadata = make(map[string]*string)
+	if err != nil {
+		err = mapAwsError(err)
+		if err != fuse.ENOENT {
+			return nil, err
+		}
+		// not uploaded yet
+		err = nil
+	} else {
+		for k, v := range resp.Metadata {
+			metadata[strings.ToLower(k)] = v
+		}
+	}
+
+	inode.mu.Lock()
+	if inode.userMetadata == nil {
+		inode.userMetadata = metadata
+		if resp != nil {
+			inode.fillHeaders(&resp.BlobProperties)
+		}
+	}
+	metadata = inode.userMetadata
+	inode.mu.Unlock()
+
+	return
+}
+
+func (inode *Inode) GetXattr(fs *Goofys, name string) (value []byte, err error) {
+	inode.logFuse("GetXattr", name)
+
+	if inode.Attributes.Mode&os.ModeDir != 0 {
+		return nil, fuse.ENOATTR
+	}
+
+	key, err := xattrToMetadataKey(name)
+	if err != nil {
+		// nothing is stored in the other namespaces
+		return nil, fuse.ENOATTR
+	}
+
+	metadata, err := inode.getUserMetadata(fs)
+	if err != nil {
+		return
+	}
+
+	v, ok := metadata[key]
+	if !ok || RESERVED_METADATA[key] {
+		return nil, fuse.ENOATTR
+	}
+
+	return decodeXattr(*v), nil
+}
+
+func (inode *Inode) ListXattr(fs *Goofys) (names []string, err error) {
+	inode.logFuse("ListXattr")
+
+	if inode.Attributes.Mode&os.ModeDir != 0 {
+		return
+	}
+
+	metadata, err := inode.getUserMetadata(fs)
+	if err != nil {
+		return
+	}
+
+	for k := range metadata {
+		if !RESERVED_METADATA[k] {
+			names = append(names, XATTR_NAMESPACE+k)
+		}
+	}
+	sort.Strings(names)
+
+	return
+}
+
+func (inode *Inode) SetXattr(fs *Goofys, name string, value []byte, flags uint32) (err error) {
+	inode.logFuse("SetXattr", name, len(value), flags)
+
+	if inode.Attributes.Mode&os.ModeDir != 0 {
+		// XXX directories usually don't have an object
+		return syscall.ENOTSUP
+	}
+
+	key, err := xattrToMetadataKey(name)
+	if err != nil {
+		return
+	}
+	if RESERVED_METADATA[key] {
+		return syscall.EPERM
+	}
+
+	encoded := encodeXattr(value)
+	if len(key)+len(encoded) > METADATA_MAX_SIZE {
+		return syscall.E2BIG
+	}
+
+	return inode.updateUserMetadata(fs, func(metadata map[string]*string) error {
+		_, exists := metadata[key]
+		if exists && flags&XATTR_CREATE != 0 {
+			return syscall.EEXIST
+		} else if !exists && flags&XATTR_REPLACE != 0 {
+			return fuse.ENOATTR
+		}
+
+		metadata[key] = aws.String(encoded)
+		return nil
+	})
+}
+
+func (inode *Inode) RemoveXattr(fs *Goofys, name string) (err error) {
+	inode.logFuse("RemoveXattr", name)
+
+	if inode.Attributes.Mode&os.ModeDir != 0 {
+		return fuse.ENOATTR
+	}
+
+	key, err := xattrToMetadataKey(name)
+	if err != nil {
+		return fuse.ENOATTR
+	}
+	if RESERVED_METADATA[key] {
+		return syscall.EPERM
+	}
+
+	return inode.updateUserMetadata(fs, func(metadata map[string]*string) error {
+		if _, ok := metadata[key]; !ok {
+			return fuse.ENOATTR
+		}
+
+		delete(metadata, key)
+		return nil
+	})
+}
+
+// Apply change to a copy of the metadata and save it, either right
+// away or with the upload that's in progress.
+func (inode *Inode) updateUserMetadata(fs *Goofys,
+	change func(metadata map[string]*string) error) (err error) {
+
+	old, err := inode.getUserMetadata(fs)
+	if err != nil {
+		return
+	}
+
+	inode.mu.Lock()
+
+	// getUserMetadata doesn't hold the lock, so make sure we are
+	// changing the latest
+	if inode.userMetadata != nil {
+		old = inode.userMetadata
+	}
+
+	metadata := make(map[string]*string)
+	for k, v := range old {
+		metadata[k] = v
+	}
+
+	err = change(metadata)
+	if err == nil {
+		inode.userMetadata = metadata
+		if metadataSize(inode.metadata(fs)) > METADATA_MAX_SIZE {
+			inode.userMetadata = old
+			err = syscall.ENOSPC
+		}
+	}
+
+	if err != nil || inode.dirtyHandles != 0 {
+		inode.mu.Unlock()
+		return
+	}
+
+	toSave := inode.metadata(fs)
+	inode.mu.Unlock()
+
+	err = inode.replaceMetadata(fs, toSave)
+	if err != nil {
+		inode.mu.Lock()
+		inode.userMetadata = old
+		inode.mu.Unlock()
+	}
+
+	return
+}
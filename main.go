@@ -22,99 +22,63 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 
-	"github.com/aws/aws-sdk-go/aws"
-
 	"github.com/codegangsta/cli"
 
 	"github.com/jacobsa/fuse"
-	"github.com/jacobsa/fuse/fuseutil"
 )
 
-func registerSIGINTHandler(mountPoint string) {
-	// Register for SIGINT.
+func registerSIGINTHandler(fs FileSystem, mountPoint string) {
+	// Register for SIGINT and SIGTERM.
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 
 	// Start a goroutine that will unmount when the signal is received.
 	go func() {
 		for {
-			<-signalChan
-			log.Println("Received SIGINT, attempting to unmount...")
+			s := <-signalChan
+			log.Printf("Received %v, attempting to unmount...", s)
+
+			// files that are still open keep the unmount from
+			// going through, save what's written to them first
+			flushed, err := fs.FlushAll()
+			if flushed != 0 || err != nil {
+				log.Printf("Flushed %v files: %v", flushed, err)
+			}
 
-			err := fuse.Unmount(mountPoint)
+			err = fuse.Unmount(mountPoint)
 			if err != nil {
-				log.Printf("Failed to unmount in response to SIGINT: %v", err)
+				log.Printf("Failed to unmount in response to %v: %v", s, err)
 			} else {
-				log.Printf("Successfully unmounted in response to SIGINT.")
+				log.Printf("Successfully unmounted in response to %v.", s)
 				return
 			}
 		}
 	}()
 }
 
-// Mount the file system based on the supplied arguments, returning a
-// fuse.MountedFileSystem that can be joined to wait for unmounting.
-func mount(
-	ctx context.Context,
-	bucketName string,
-	mountPoint string,
-	flags *FlagStorage) (mfs *fuse.MountedFileSystem, err error) {
-
-	// Choose UID and GID.
-	uid, gid, err := MyUserAndGroup()
-	if err != nil {
-		err = fmt.Errorf("MyUserAndGroup: %v", err)
-		return
-	}
-
-	if int32(flags.Uid) == -1 {
-		flags.Uid = uid
-	}
-
-	if int32(flags.Gid) == -1 {
-		flags.Gid = gid
-	}
-
-	awsConfig := &aws.Config{
-		Region: aws.String("us-west-2"),
-		//LogLevel: aws.LogLevel(aws.LogDebug),
-	}
-	if len(flags.Endpoint) > 0 {
-		awsConfig.Endpoint = &flags.Endpoint
-	}
-	if flags.UsePathRequest {
-		awsConfig.S3ForcePathStyle = aws.Bool(true)
-	}
-
-	goofys := NewGoofys(bucketName, awsConfig, flags)
-	if goofys == nil {
-		err = fmt.Errorf("Mount: initialization failed")
-		return
-	}
-	server := fuseutil.NewFileSystemServer(goofys)
-
-	// Mount the file system.
-	mountCfg := &fuse.MountConfig{
-		FSName:                  bucketName,
-		Options:                 flags.MountOptions,
-		ErrorLogger:             log.New(os.Stderr, "fuse: ", log.Flags()),
-		DisableWritebackCaching: true,
-	}
-
-	if flags.DebugFuse {
-		mountCfg.DebugLogger = log.New(os.Stderr, "fuse_debug: ", 0)
-	}
+// Abort old multipart uploads now, and again every time we get
+// SIGUSR1.
+func registerCleanupHandler(fs FileSystem, olderThan time.Duration) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGUSR1)
 
-	mfs, err = fuse.Mount(mountPoint, server, mountCfg)
-	if err != nil {
-		err = fmt.Errorf("Mount: %v", err)
-		return
-	}
+	go func() {
+		for {
+			aborted, size, err := fs.CleanupUploads(olderThan)
+			if err != nil {
+				log.Printf("Failed to clean up multipart uploads: %v", err)
+			}
+			log.Printf("Aborted %v multipart uploads older than %v, %v bytes",
+				aborted, olderThan, size)
 
-	return
+			<-signalChan
+		}
+	}()
 }
 
 func main() {
@@ -138,23 +102,37 @@ func main() {
 		// Populate and parse flags.
 		bucketName := c.Args()[0]
 		mountPoint := c.Args()[1]
-		flags := PopulateFlags(c)
+		flags, err := PopulateFlags(c)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n\n", err)
+			cli.ShowAppHelp(c)
+			os.Exit(1)
+		}
 
 		// Mount the file system.
-		mfs, err := mount(
+		fs, mfs, err := Mount(
 			context.Background(),
 			bucketName,
 			mountPoint,
+			nil,
 			flags)
 
 		if err != nil {
 			log.Fatalf("Mounting file system: %v", err)
 		}
 
+		if flags.CleanupUploads > 0 {
+			registerCleanupHandler(fs, flags.CleanupUploads)
+		}
+
+		if flags.MetricsAddr != "" {
+			ServeMetrics(flags.MetricsAddr, fs)
+		}
+
 		log.Println("File system has been successfully mounted.")
 
 		// Let the user unmount with Ctrl-C (SIGINT).
-		registerSIGINTHandler(mfs.Dir())
+		registerSIGINTHandler(fs, mfs.Dir())
 
 		// Wait for the file system to be unmounted.
 		err = mfs.Join(context.Background())
@@ -163,6 +141,12 @@ func main() {
 			return
 		}
 
+		// a lazy unmount doesn't wait for open files to be closed
+		flushed, err := fs.FlushAll()
+		if flushed != 0 || err != nil {
+			log.Printf("Flushed %v files after unmount: %v", flushed, err)
+		}
+
 		log.Println("Successfully exiting.")
 	}
 